@@ -214,6 +214,8 @@ func main() {
 	customDir := flag.String("d", "", "Custom home directory for CyberChat data")
 	customPort := flag.Int("p", 7331, "Port to listen on")
 	customName := flag.String("n", "", "Name to use for this peer")
+	downloadDir := flag.String("downloads", "", "Directory for files downloaded from peers")
+	shareRoots := flag.String("share", "", "Comma-separated directories files may be shared from")
 	resetFlag := flag.Bool("r", false, "Reset all data and start fresh")
 	versionFlag := flag.Bool("v", false, "Show version information")
 	debugFlag := flag.Bool("debug", false, "Enable debug logging")
@@ -299,6 +301,12 @@ func main() {
 	if *customName != "" {
 		defaultConfig.Name = *customName
 	}
+	if *downloadDir != "" {
+		defaultConfig.DownloadDir = *downloadDir
+	}
+	if *shareRoots != "" {
+		defaultConfig.ShareRoots = strings.Split(*shareRoots, ",")
+	}
 
 	// Ensure data directory exists
 	if err := os.MkdirAll(defaultConfig.DataDir, 0755); err != nil {
@@ -336,6 +344,12 @@ func main() {
 		if *customName != "" {
 			cfg.Name = *customName
 		}
+		if *downloadDir != "" {
+			cfg.DownloadDir = *downloadDir
+		}
+		if *shareRoots != "" {
+			cfg.ShareRoots = strings.Split(*shareRoots, ",")
+		}
 		// Always ensure TrustSelfSigned is true
 		cfg.TrustSelfSigned = true
 		// Save updated config
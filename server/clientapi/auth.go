@@ -0,0 +1,26 @@
+package clientapi
+
+import (
+	"net"
+	"net/http"
+)
+
+// IsLocalRequest reports whether r comes from a loopback address. Only the
+// connection's address counts; X-Forwarded-For is chosen by the sender.
+func IsLocalRequest(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr // If no port, use the address as is
+	}
+	return host == "127.0.0.1" || host == "::1" || host == "localhost"
+}
+
+// VerifyClient reports whether r comes from a web client of this node: it
+// must carry apiKey in X-Client-API-Key and come from a loopback address.
+// Every client API handler checks its requests with it.
+func VerifyClient(r *http.Request, apiKey string) bool {
+	if key := r.Header.Get("X-Client-API-Key"); key == "" || key != apiKey {
+		return false
+	}
+	return IsLocalRequest(r)
+}
@@ -2,18 +2,24 @@ package clientapi
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"net/http"
+	"strconv"
 	"time"
 
+	"cyberchat/server/commands"
 	"cyberchat/server/db"
 	"cyberchat/server/discovery"
 	"cyberchat/server/messages"
 )
 
+// maxMessageBodySize caps a message request from the web client: the largest
+// content plus room for the other fields
+const maxMessageBodySize = messages.MaxMessageSize + 64*1024
+
 // Handlers contains HTTP handlers for client API operations
 type Handlers struct {
 	db           *db.DB
@@ -21,51 +27,62 @@ type Handlers struct {
 	clientAPIKey string
 	onMessage    func(*messages.Message, string) *messages.MessageDeliveryReport
 	discovery    *discovery.Service
+	pollResults  func(pollID string) (interface{}, error) // Current results of a poll message
+	commands     *commands.Dispatcher
 }
 
 // NewHandlers creates a new Handlers instance
-func NewHandlers(db *db.DB, guid string, clientAPIKey string, onMessage func(*messages.Message, string) *messages.MessageDeliveryReport, discovery *discovery.Service) *Handlers {
+func NewHandlers(db *db.DB, guid string, clientAPIKey string, onMessage func(*messages.Message, string) *messages.MessageDeliveryReport, discovery *discovery.Service, pollResults func(pollID string) (interface{}, error)) *Handlers {
 	return &Handlers{
 		db:           db,
 		guid:         guid,
 		clientAPIKey: clientAPIKey,
 		onMessage:    onMessage,
 		discovery:    discovery,
+		pollResults:  pollResults,
 	}
 }
 
-// verifyAPIKey checks if the provided API key is valid
-func (h *Handlers) verifyAPIKey(r *http.Request) bool {
-	apiKey := r.Header.Get("X-Client-API-Key")
-	return apiKey == h.clientAPIKey
-}
+// webMessage converts a stored message to the map returned to web clients.
+// Poll messages carry their current results and rich text its rendered HTML.
+func (h *Handlers) webMessage(msg *messages.Message) map[string]interface{} {
+	webMsg := map[string]interface{}{
+		"id":            msg.ID,
+		"sender_guid":   msg.SenderGUID,
+		"receiver_guid": msg.ReceiverGUID,
+		"type":          string(msg.Type),
+		"scope":         string(msg.Scope),
+		"content":       string(msg.Content),
+		"timestamp":     msg.Timestamp,
+		"clock":         msg.Clock,
+		"clock_skew":    msg.ClockSkew,
+		"priority":      string(msg.EffectivePriority()),
+	}
 
-// verifyClientIP checks if the request is coming from localhost
-func (h *Handlers) verifyClientIP(r *http.Request) bool {
-	// Get the real client IP, considering X-Forwarded-For
-	ip := r.RemoteAddr
-	if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
-		ip = forwardedFor
+	if msg.Type == messages.TypeRichText {
+		webMsg["html"] = msg.HTML
 	}
 
-	// Extract host from IP:port format
-	host, _, err := net.SplitHostPort(ip)
-	if err != nil {
-		host = ip // If no port, use the IP as is
+	if msg.Type == messages.TypePoll && h.pollResults != nil {
+		if results, err := h.pollResults(msg.ID); err == nil {
+			webMsg["poll"] = results
+		} else {
+			log.Printf("Warning: Failed to get results for poll %s: %v", msg.ID, err)
+		}
 	}
 
-	// Check if it's a localhost address
-	return host == "127.0.0.1" || host == "::1" || host == "localhost"
+	return webMsg
 }
 
-// verifyClient checks both API key and client IP
-func (h *Handlers) verifyClient(r *http.Request) bool {
-	return h.verifyAPIKey(r) && h.verifyClientIP(r)
+// SetCommands makes slash commands in sent messages run on dispatcher instead
+// of being sent. Must be called before the server starts.
+func (h *Handlers) SetCommands(dispatcher *commands.Dispatcher) {
+	h.commands = dispatcher
 }
 
 // HandleAuth returns the client API key only to localhost clients
 func (h *Handlers) HandleAuth(w http.ResponseWriter, r *http.Request) {
-	if !h.verifyClientIP(r) {
+	if !IsLocalRequest(r) {
 		http.Error(w, "Unauthorized - client API only available from localhost", http.StatusUnauthorized)
 		return
 	}
@@ -78,26 +95,25 @@ func (h *Handlers) HandleAuth(w http.ResponseWriter, r *http.Request) {
 
 // HandleMessage processes a message from the web client
 func (h *Handlers) HandleMessage(w http.ResponseWriter, r *http.Request) {
-	if !h.verifyClient(r) {
+	if !VerifyClient(r, h.clientAPIKey) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	// Read request body
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Failed to read request body", http.StatusBadRequest)
-		return
-	}
-
-	// Parse message
+	// Parse message straight from the capped body
 	var msg struct {
 		Type         string `json:"type"`
 		Content      string `json:"content"`
 		ReceiverGUID string `json:"receiver_guid"`
 		Scope        string `json:"scope"`
+		Priority     string `json:"priority"`
 	}
-	if err := json.Unmarshal(body, &msg); err != nil {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMessageBodySize)).Decode(&msg); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			messages.WriteValidationError(w, &messages.ValidationError{Code: messages.CodeContentTooLarge, Message: "message too large"})
+			return
+		}
 		http.Error(w, "Failed to parse message", http.StatusBadRequest)
 		return
 	}
@@ -105,11 +121,26 @@ func (h *Handlers) HandleMessage(w http.ResponseWriter, r *http.Request) {
 	// Create message using web-specific constructor
 	message := messages.NewWebMessage(h.guid, msg.ReceiverGUID, messages.MessageType(msg.Type), msg.Content)
 	message.Scope = messages.MessageScope(msg.Scope)
+	message.Priority = messages.Priority(msg.Priority)
+
+	// Only the connection's address counts; X-Forwarded-For is chosen by the sender
+	sourceIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		sourceIP = r.RemoteAddr
+	}
 
-	// Get source IP
-	sourceIP := r.RemoteAddr
-	if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
-		sourceIP = forwardedFor
+	// Slash commands run here and are never sent
+	if h.commands != nil {
+		if result, handled := h.commands.Handle(message, sourceIP); handled {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(result)
+			return
+		}
+	}
+
+	if err := message.ValidateChat(); err != nil {
+		messages.WriteValidationError(w, err)
+		return
 	}
 
 	// Process message and get delivery report
@@ -117,6 +148,10 @@ func (h *Handlers) HandleMessage(w http.ResponseWriter, r *http.Request) {
 	if h.onMessage != nil {
 		report = h.onMessage(message, sourceIP)
 	}
+	if report != nil && report.Rejected != nil {
+		messages.WriteValidationError(w, report.Rejected)
+		return
+	}
 
 	// Return delivery report
 	w.Header().Set("Content-Type", "application/json")
@@ -129,7 +164,7 @@ func (h *Handlers) HandleMessage(w http.ResponseWriter, r *http.Request) {
 
 // HandleGetMessages returns messages from the database
 func (h *Handlers) HandleGetMessages(w http.ResponseWriter, r *http.Request) {
-	if !h.verifyClient(r) {
+	if !VerifyClient(r, h.clientAPIKey) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
@@ -158,15 +193,7 @@ func (h *Handlers) HandleGetMessages(w http.ResponseWriter, r *http.Request) {
 	// Convert messages to web format
 	webMsgs := make([]map[string]interface{}, len(msgs))
 	for i, msg := range msgs {
-		webMsgs[i] = map[string]interface{}{
-			"id":            msg.ID,
-			"sender_guid":   msg.SenderGUID,
-			"receiver_guid": msg.ReceiverGUID,
-			"type":          string(msg.Type),
-			"scope":         string(msg.Scope),
-			"content":       string(msg.Content),
-			"timestamp":     msg.Timestamp,
-		}
+		webMsgs[i] = h.webMessage(msg)
 	}
 
 	// Return messages as JSON
@@ -177,9 +204,91 @@ func (h *Handlers) HandleGetMessages(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// HandleGetHistory returns a page of message history using before/after cursors
+func (h *Handlers) HandleGetHistory(w http.ResponseWriter, r *http.Request) {
+	if !VerifyClient(r, h.clientAPIKey) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	params := r.URL.Query()
+	query := db.HistoryQuery{
+		GUID:         h.guid,
+		Conversation: params.Get("conversation"),
+		Limit:        50, // Default page size
+	}
+
+	if limitStr := params.Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > 1000 {
+			http.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+		query.Limit = limit
+	}
+
+	switch params.Get("order") {
+	case "", "desc":
+		query.Ascending = false
+	case "asc":
+		query.Ascending = true
+	default:
+		http.Error(w, "Invalid order parameter", http.StatusBadRequest)
+		return
+	}
+
+	// Cursors are either an RFC3339 timestamp or a message ID
+	if before := params.Get("before"); before != "" {
+		if t, err := time.Parse(time.RFC3339, before); err == nil {
+			query.BeforeTime = t
+		} else {
+			query.BeforeID = before
+		}
+	}
+	if after := params.Get("after"); after != "" {
+		if t, err := time.Parse(time.RFC3339, after); err == nil {
+			query.AfterTime = t
+		} else {
+			query.AfterID = after
+		}
+	}
+
+	msgs, hasMore, err := h.db.GetMessageHistory(query)
+	if errors.Is(err, db.ErrCursorNotFound) {
+		http.Error(w, "Unknown cursor", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Convert messages to web format
+	webMsgs := make([]map[string]interface{}, len(msgs))
+	for i, msg := range msgs {
+		webMsgs[i] = h.webMessage(msg)
+	}
+
+	// The last message on the page is the cursor for the next request in the same order
+	var nextCursor string
+	if hasMore && len(msgs) > 0 {
+		nextCursor = msgs[len(msgs)-1].ID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"messages":    webMsgs,
+		"has_more":    hasMore,
+		"next_cursor": nextCursor,
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
 // HandleTruncateMessages truncates all messages from the database
 func (h *Handlers) HandleTruncateMessages(w http.ResponseWriter, r *http.Request) {
-	if !h.verifyClient(r) {
+	if !VerifyClient(r, h.clientAPIKey) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
@@ -199,7 +308,7 @@ func (h *Handlers) HandleTruncateMessages(w http.ResponseWriter, r *http.Request
 
 // HandleName processes a name update request from the web client
 func (h *Handlers) HandleName(w http.ResponseWriter, r *http.Request) {
-	if !h.verifyClient(r) {
+	if !VerifyClient(r, h.clientAPIKey) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
@@ -218,19 +327,11 @@ func (h *Handlers) HandleName(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Save name to database
-	if err := h.db.SaveName(req.Name); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to save name: %v", err), http.StatusInternalServerError)
+	if err := h.SetName(req.Name); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Trigger a peer update to broadcast the name change
-	if h.discovery != nil {
-		if err := h.discovery.UpdateName(req.Name); err != nil {
-			log.Printf("Warning: Failed to broadcast name update: %v", err)
-		}
-	}
-
 	// Return success
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{
@@ -238,3 +339,19 @@ func (h *Handlers) HandleName(w http.ResponseWriter, r *http.Request) {
 		"name":   req.Name,
 	})
 }
+
+// SetName saves our node name and announces it to peers
+func (h *Handlers) SetName(name string) error {
+	// Save name to database
+	if err := h.db.SaveName(name); err != nil {
+		return fmt.Errorf("failed to save name: %w", err)
+	}
+
+	// Trigger a peer update to broadcast the name change
+	if h.discovery != nil {
+		if err := h.discovery.UpdateName(name); err != nil {
+			log.Printf("Warning: Failed to broadcast name update: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package commands
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"cyberchat/server/messages"
+)
+
+const maxNameLength = 64
+
+// helpCommand lists the registered commands
+type helpCommand struct{ d *Dispatcher }
+
+func (c *helpCommand) Name() string  { return "help" }
+func (c *helpCommand) Usage() string { return "/help" }
+
+func (c *helpCommand) Run(call *Call) (string, error) {
+	var lines []string
+	for _, cmd := range c.d.list() {
+		lines = append(lines, cmd.Usage())
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// nickCommand changes our node name, like POST /api/v1/client/name
+type nickCommand struct{ d *Dispatcher }
+
+func (c *nickCommand) Name() string  { return "nick" }
+func (c *nickCommand) Usage() string { return "/nick <name>" }
+
+func (c *nickCommand) Run(call *Call) (string, error) {
+	if call.Args == "" {
+		return "", fmt.Errorf("usage: %s", c.Usage())
+	}
+	if len(call.Args) > maxNameLength {
+		return "", fmt.Errorf("name must be at most %d bytes", maxNameLength)
+	}
+	if err := c.d.setName(call.Args); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("You are now known as %s", call.Args), nil
+}
+
+// msgCommand sends a private message to a peer from any conversation
+type msgCommand struct{ d *Dispatcher }
+
+func (c *msgCommand) Name() string  { return "msg" }
+func (c *msgCommand) Usage() string { return "/msg <peer> <text>" }
+
+func (c *msgCommand) Run(call *Call) (string, error) {
+	target, text, _ := strings.Cut(call.Args, " ")
+	text = strings.TrimSpace(text)
+	if target == "" || text == "" {
+		return "", fmt.Errorf("usage: %s", c.Usage())
+	}
+
+	guid, name, err := c.d.resolvePeer(target)
+	if err != nil {
+		return "", err
+	}
+	if guid == c.d.guid {
+		return "", fmt.Errorf("cannot message yourself")
+	}
+
+	msg := messages.NewMessage(c.d.guid, guid, messages.TypeText, []byte(text))
+	msg.Priority = call.Message.Priority
+	if err := msg.ValidateContent(); err != nil {
+		return "", err
+	}
+
+	report := c.d.process(msg, call.SourceIP)
+	if report != nil && report.Failed > 0 {
+		return "", fmt.Errorf("failed to deliver message to %s", name)
+	}
+	return fmt.Sprintf("Sent to %s", name), nil
+}
+
+// meCommand sends an action ("* name waves") to the current conversation
+type meCommand struct{ d *Dispatcher }
+
+func (c *meCommand) Name() string  { return "me" }
+func (c *meCommand) Usage() string { return "/me <action>" }
+
+func (c *meCommand) Run(call *Call) (string, error) {
+	if call.Args == "" {
+		return "", fmt.Errorf("usage: %s", c.Usage())
+	}
+
+	name, err := c.d.db.GetName()
+	if err != nil {
+		return "", err
+	}
+
+	// Same conversation and priority as the typed message, new content
+	msg := messages.NewMessage(c.d.guid, call.Message.ReceiverGUID, messages.TypeText, []byte(fmt.Sprintf("* %s %s", name, call.Args)))
+	msg.Scope = call.Message.Scope
+	msg.Priority = call.Message.Priority
+	if err := msg.ValidateContent(); err != nil {
+		return "", err
+	}
+
+	c.d.process(msg, call.SourceIP)
+	return "", nil
+}
+
+// peersCommand lists the peers that are currently online
+type peersCommand struct{ d *Dispatcher }
+
+func (c *peersCommand) Name() string  { return "peers" }
+func (c *peersCommand) Usage() string { return "/peers" }
+
+func (c *peersCommand) Run(call *Call) (string, error) {
+	online := c.d.peerMgr.GetPeers()
+	sort.Slice(online, func(i, j int) bool {
+		return strings.ToLower(online[i].Name) < strings.ToLower(online[j].Name)
+	})
+
+	var lines []string
+	for _, peer := range online {
+		if peer.GUID == c.d.guid {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s (%s) at %s:%d", peer.Name, peer.GUID, peer.IPAddress, peer.Port))
+	}
+	if len(lines) == 0 {
+		return "No peers online", nil
+	}
+	return fmt.Sprintf("%d peers online:\n%s", len(lines), strings.Join(lines, "\n")), nil
+}
+
+// blockCommand refuses all messages from a peer, or lists blocked peers without arguments
+type blockCommand struct{ d *Dispatcher }
+
+func (c *blockCommand) Name() string  { return "block" }
+func (c *blockCommand) Usage() string { return "/block [peer]" }
+
+func (c *blockCommand) Run(call *Call) (string, error) {
+	if call.Args == "" {
+		guids, err := c.d.db.GetBlockedPeers()
+		if err != nil {
+			return "", err
+		}
+		if len(guids) == 0 {
+			return "No peers are blocked", nil
+		}
+		return fmt.Sprintf("Blocked peers:\n%s", strings.Join(guids, "\n")), nil
+	}
+
+	guid, name, err := c.d.resolvePeer(call.Args)
+	if err != nil {
+		return "", err
+	}
+	if guid == c.d.guid {
+		return "", fmt.Errorf("cannot block yourself")
+	}
+	if err := c.d.db.BlockPeer(guid); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Blocked %s (%s)", name, guid), nil
+}
+
+// unblockCommand accepts messages from a blocked peer again
+type unblockCommand struct{ d *Dispatcher }
+
+func (c *unblockCommand) Name() string  { return "unblock" }
+func (c *unblockCommand) Usage() string { return "/unblock <peer>" }
+
+func (c *unblockCommand) Run(call *Call) (string, error) {
+	if call.Args == "" {
+		return "", fmt.Errorf("usage: %s", c.Usage())
+	}
+
+	// Blocked peers may have been forgotten since, so a raw GUID is accepted too
+	guid, name, err := c.d.resolvePeer(call.Args)
+	if err != nil {
+		guid, name = call.Args, call.Args
+	}
+
+	err = c.d.db.UnblockPeer(guid)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("%s is not blocked", name)
+	}
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Unblocked %s", name), nil
+}
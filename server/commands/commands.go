@@ -0,0 +1,222 @@
+package commands
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"cyberchat/server/db"
+	"cyberchat/server/logging"
+	"cyberchat/server/messages"
+	"cyberchat/server/peers"
+)
+
+// Command is a slash command typed into the chat box by a local client.
+// Extensions implement it and add themselves with Dispatcher.Register.
+type Command interface {
+	// Name is the command word without the slash, e.g. "nick"
+	Name() string
+	// Usage is a one-line synopsis shown by /help, e.g. "/nick <name>"
+	Usage() string
+	// Run executes the command and returns the text shown to the local user
+	Run(call *Call) (string, error)
+}
+
+// Call is one invocation of a command
+type Call struct {
+	Name     string            // Command word, lower case
+	Args     string            // Everything after the command word, trimmed
+	Message  *messages.Message // The typed message; its receiver and scope tell where it was typed
+	SourceIP string
+}
+
+// Conversation returns the conversation the command was typed in
+func (c *Call) Conversation() string {
+	if c.Message.Scope == messages.ScopePrivate && c.Message.ReceiverGUID != "" {
+		return c.Message.ReceiverGUID
+	}
+	return db.ConversationBroadcast
+}
+
+// Result is the outcome of a command, returned to the client that typed it
+type Result struct {
+	Command string `json:"command"`
+	Output  string `json:"output,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// WebSocketManager interface for reporting command results to local clients
+type WebSocketManager interface {
+	Broadcast(message interface{})
+}
+
+// Dispatcher intercepts slash commands in messages from local clients
+type Dispatcher struct {
+	db        *db.DB
+	guid      string
+	peerMgr   *peers.Manager
+	process   func(*messages.Message, string) *messages.MessageDeliveryReport
+	send      func(*messages.Message)
+	setName   func(string) error
+	wsManager WebSocketManager
+
+	mu       sync.RWMutex
+	commands map[string]Command
+}
+
+// New creates a dispatcher with the built-in commands registered. process is the
+// message handler's ProcessMessage, send its SendControl, and setName applies a
+// new node name the way the client API does.
+func New(database *db.DB, guid string, peerMgr *peers.Manager, process func(*messages.Message, string) *messages.MessageDeliveryReport, send func(*messages.Message), setName func(string) error, wsManager WebSocketManager) *Dispatcher {
+	d := &Dispatcher{
+		db:        database,
+		guid:      guid,
+		peerMgr:   peerMgr,
+		process:   process,
+		send:      send,
+		setName:   setName,
+		wsManager: wsManager,
+		commands:  make(map[string]Command),
+	}
+
+	for _, cmd := range []Command{
+		&helpCommand{d},
+		&nickCommand{d},
+		&msgCommand{d},
+		&meCommand{d},
+		&peersCommand{d},
+		&blockCommand{d},
+		&unblockCommand{d},
+		&topicCommand{d},
+	} {
+		if err := d.Register(cmd); err != nil {
+			logging.Error("Commands", "Failed to register /%s: %v", cmd.Name(), err)
+		}
+	}
+
+	return d
+}
+
+// Register adds a command. Names are case-insensitive and must be unique.
+func (d *Dispatcher) Register(cmd Command) error {
+	name := strings.ToLower(cmd.Name())
+	if name == "" || strings.ContainsAny(name, " \t\n/") {
+		return fmt.Errorf("invalid command name %q", cmd.Name())
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, exists := d.commands[name]; exists {
+		return fmt.Errorf("command /%s is already registered", name)
+	}
+	d.commands[name] = cmd
+	return nil
+}
+
+// Handle runs msg as a command if it is one. It returns false for ordinary
+// messages, which should be processed as usual. A leading "//" escapes the
+// slash: the message is sent with one slash removed.
+func (d *Dispatcher) Handle(msg *messages.Message, sourceIP string) (*Result, bool) {
+	if msg.Type != messages.TypeText || len(msg.Content) == 0 || msg.Content[0] != '/' {
+		return nil, false
+	}
+	if len(msg.Content) > 1 && msg.Content[1] == '/' {
+		msg.Content = msg.Content[1:]
+		return nil, false
+	}
+
+	text := strings.TrimSpace(string(msg.Content[1:]))
+	name, args, _ := strings.Cut(text, " ")
+	call := &Call{
+		Name:     strings.ToLower(name),
+		Args:     strings.TrimSpace(args),
+		Message:  msg,
+		SourceIP: sourceIP,
+	}
+
+	result := &Result{Command: call.Name}
+
+	d.mu.RLock()
+	cmd, ok := d.commands[call.Name]
+	d.mu.RUnlock()
+
+	if !ok {
+		result.Error = fmt.Sprintf("Unknown command /%s. Type /help for a list of commands.", call.Name)
+	} else if output, err := cmd.Run(call); err != nil {
+		result.Error = err.Error()
+	} else {
+		result.Output = output
+	}
+
+	if result.Error != "" {
+		logging.Debug("Commands", "/%s failed: %s", call.Name, result.Error)
+	} else {
+		logging.Debug("Commands", "Ran /%s", call.Name)
+	}
+
+	d.broadcast(result)
+	return result, true
+}
+
+// list returns the registered commands sorted by name
+func (d *Dispatcher) list() []Command {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	cmds := make([]Command, 0, len(d.commands))
+	for _, cmd := range d.commands {
+		cmds = append(cmds, cmd)
+	}
+	sort.Slice(cmds, func(i, j int) bool {
+		return cmds[i].Name() < cmds[j].Name()
+	})
+	return cmds
+}
+
+// resolvePeer finds a known peer by GUID, or by name case-insensitively
+func (d *Dispatcher) resolvePeer(token string) (guid, name string, err error) {
+	if token == "" {
+		return "", "", fmt.Errorf("a peer name or GUID is required")
+	}
+
+	knownPeers, err := d.db.GetAllPeers()
+	if err != nil {
+		return "", "", err
+	}
+
+	var matches []*db.Peer
+	for _, peer := range knownPeers {
+		if strings.EqualFold(peer.GUID, token) {
+			return peer.GUID, peer.Username, nil
+		}
+		if strings.EqualFold(peer.Username, token) {
+			matches = append(matches, peer)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", "", fmt.Errorf("no peer named %s", token)
+	case 1:
+		return matches[0].GUID, matches[0].Username, nil
+	default:
+		return "", "", fmt.Errorf("%d peers are named %s; use the GUID instead", len(matches), token)
+	}
+}
+
+// broadcast reports a command result to local web clients
+func (d *Dispatcher) broadcast(result *Result) {
+	if d.wsManager == nil {
+		return
+	}
+
+	d.wsManager.Broadcast(struct {
+		Type    string  `json:"type"`
+		Content *Result `json:"content"`
+	}{
+		Type:    "command_result",
+		Content: result,
+	})
+}
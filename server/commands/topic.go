@@ -0,0 +1,133 @@
+package commands
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"cyberchat/server/db"
+	"cyberchat/server/logging"
+	"cyberchat/server/messages"
+)
+
+const maxTopicLength = 300
+
+// topicSignal is the payload of topic control messages
+type topicSignal struct {
+	Topic string `json:"topic"`
+}
+
+// topicCommand shows or sets the topic of the current conversation.
+// New topics are shared with the conversation's participants.
+type topicCommand struct{ d *Dispatcher }
+
+func (c *topicCommand) Name() string  { return "topic" }
+func (c *topicCommand) Usage() string { return "/topic [text]" }
+
+func (c *topicCommand) Run(call *Call) (string, error) {
+	conversation := call.Conversation()
+
+	if call.Args == "" {
+		topic, err := c.d.db.GetTopic(conversation)
+		if errors.Is(err, sql.ErrNoRows) {
+			return "No topic is set", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Topic: %s (set by %s at %s)", topic.Topic, topic.SetBy, topic.SetAt.Format(time.RFC3339)), nil
+	}
+
+	if len(call.Args) > maxTopicLength {
+		return "", fmt.Errorf("topic must be at most %d bytes", maxTopicLength)
+	}
+
+	topic := &db.Topic{
+		Conversation: conversation,
+		Topic:        call.Args,
+		SetBy:        c.d.guid,
+		SetAt:        time.Now(),
+	}
+	if err := c.d.db.SaveTopic(topic); err != nil {
+		return "", err
+	}
+
+	c.d.shareTopic(conversation, call.Args)
+	c.d.broadcastTopic(topic)
+	return fmt.Sprintf("Topic set to: %s", call.Args), nil
+}
+
+// HandleTopic processes an inbound topic control message from a peer
+func (d *Dispatcher) HandleTopic(msg *messages.Message, sourceIP string) {
+	if !d.peerMgr.VerifySource(msg.SenderGUID, sourceIP) {
+		logging.Error("Commands", "Rejecting topic claiming to be from %s sent from %s", msg.SenderGUID, sourceIP)
+		return
+	}
+
+	var signal topicSignal
+	if err := json.Unmarshal(msg.Content, &signal); err != nil {
+		logging.Error("Commands", "Invalid topic from %s: %v", msg.SenderGUID, err)
+		return
+	}
+	if signal.Topic == "" || len(signal.Topic) > maxTopicLength {
+		logging.Error("Commands", "Ignoring topic from %s with invalid length", msg.SenderGUID)
+		return
+	}
+
+	// From our side, a private conversation is the one with the sender
+	conversation := db.ConversationBroadcast
+	if msg.Scope == messages.ScopePrivate {
+		conversation = msg.SenderGUID
+	}
+
+	topic := &db.Topic{
+		Conversation: conversation,
+		Topic:        signal.Topic,
+		SetBy:        msg.SenderGUID,
+		SetAt:        time.Now(),
+	}
+	if err := d.db.SaveTopic(topic); err != nil {
+		logging.Error("Commands", "Failed to save topic from %s: %v", msg.SenderGUID, err)
+		return
+	}
+	d.broadcastTopic(topic)
+}
+
+// shareTopic sends a new topic to the other participants of a conversation
+func (d *Dispatcher) shareTopic(conversation, topic string) {
+	if d.send == nil {
+		return
+	}
+
+	content, err := json.Marshal(topicSignal{Topic: topic})
+	if err != nil {
+		logging.Error("Commands", "Failed to marshal topic: %v", err)
+		return
+	}
+
+	var msg *messages.Message
+	if conversation == db.ConversationBroadcast {
+		msg = messages.NewMessage(d.guid, "", messages.TypeTopic, content)
+		msg.Scope = messages.ScopeBroadcast
+	} else {
+		msg = messages.NewMessage(d.guid, conversation, messages.TypeTopic, content)
+	}
+	d.send(msg)
+}
+
+// broadcastTopic notifies local web clients about a topic change
+func (d *Dispatcher) broadcastTopic(topic *db.Topic) {
+	if d.wsManager == nil {
+		return
+	}
+
+	d.wsManager.Broadcast(struct {
+		Type    string    `json:"type"`
+		Content *db.Topic `json:"content"`
+	}{
+		Type:    "topic",
+		Content: topic,
+	})
+}
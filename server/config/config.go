@@ -7,4 +7,31 @@ type Config struct {
 	Name            string `json:"name"`              // Name to advertise to other peers
 	DataDir         string `json:"data_dir"`          // Directory for storing data
 	Debug           bool   `json:"debug"`             // Whether to enable debug logging
+
+	// Token-bucket limits on POST /api/v1/message. Rates are messages per second.
+	// Zero uses the default; a negative rate disables that limit.
+	MessageRatePerIP      float64 `json:"message_rate_per_ip"`
+	MessageBurstPerIP     int     `json:"message_burst_per_ip"`
+	MessageRatePerSender  float64 `json:"message_rate_per_sender"`
+	MessageBurstPerSender int     `json:"message_burst_per_sender"`
+	MessageRateGlobal     float64 `json:"message_rate_global"`
+	MessageBurstGlobal    int     `json:"message_burst_global"`
+
+	// Downloads of offered files to this node. An empty DownloadDir means
+	// DataDir/downloads, and zero MaxConcurrentDownloads uses the default.
+	// Offers from AutoAcceptPeers are downloaded without being requested if they
+	// are at most AutoAcceptMaxSize bytes; zero uses the default size and a
+	// negative size accepts any.
+	DownloadDir            string   `json:"download_dir"`
+	MaxConcurrentDownloads int      `json:"max_concurrent_downloads"`
+	AutoAcceptPeers        []string `json:"auto_accept_peers"`
+	AutoAcceptMaxSize      int64    `json:"auto_accept_max_size"`
+
+	// Directories web clients may browse and offer files from. Nothing outside
+	// them can be registered or served. Empty means DataDir/shared.
+	ShareRoots []string `json:"share_roots"`
+
+	// Largest file a web client may upload into the file store, in bytes.
+	// Zero uses the default and a negative size accepts any.
+	MaxUploadSize int64 `json:"max_upload_size"`
 }
@@ -5,10 +5,12 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"cyberchat/server/config"
@@ -122,6 +124,11 @@ func (db *DB) InitSchema() error {
 			scope TEXT NOT NULL DEFAULT 'private',
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			source_ip TEXT,
+			lamport_clock INTEGER NOT NULL DEFAULT 0,
+			clock_skew INTEGER NOT NULL DEFAULT 0,
+			received_at TIMESTAMP,
+			priority TEXT NOT NULL DEFAULT 'normal',
+			html TEXT NOT NULL DEFAULT '',
 			FOREIGN KEY(sender_guid) REFERENCES peers(guid),
 			FOREIGN KEY(receiver_guid) REFERENCES peers(guid)
 		)`,
@@ -135,9 +142,130 @@ func (db *DB) InitSchema() error {
 			size INTEGER NOT NULL,
 			mime_type TEXT,
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			sha256 TEXT NOT NULL DEFAULT '',
+			enc_key TEXT NOT NULL DEFAULT '',
+			kind TEXT NOT NULL DEFAULT 'file',
+			expires_at TIMESTAMP,
+			max_downloads INTEGER NOT NULL DEFAULT 0,
+			revoked_at TIMESTAMP,
+			blob TEXT NOT NULL DEFAULT '',
+			chunks TEXT NOT NULL DEFAULT '',
 			FOREIGN KEY(sender_guid) REFERENCES peers(guid),
 			FOREIGN KEY(receiver_guid) REFERENCES peers(guid)
 		)`,
+		`CREATE TABLE IF NOT EXISTS file_downloads (
+			file_id TEXT NOT NULL,
+			audience TEXT NOT NULL,
+			first_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (file_id, audience)
+		)`,
+		`CREATE TABLE IF NOT EXISTS file_sources (
+			file_id TEXT NOT NULL,
+			guid TEXT NOT NULL,
+			added_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (file_id, guid)
+		)`,
+		`CREATE TABLE IF NOT EXISTS blobs (
+			hash TEXT PRIMARY KEY,
+			size INTEGER NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS scheduled_messages (
+			id INTEGER PRIMARY KEY,
+			schedule_id TEXT NOT NULL UNIQUE,
+			receiver_guid TEXT NOT NULL DEFAULT '',
+			type TEXT NOT NULL,
+			scope TEXT NOT NULL DEFAULT 'broadcast',
+			content BLOB NOT NULL,
+			send_at TIMESTAMP NOT NULL,
+			status TEXT NOT NULL DEFAULT 'pending',
+			message_id TEXT,
+			error TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			sent_at TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS transfers (
+			id INTEGER PRIMARY KEY,
+			transfer_id TEXT NOT NULL UNIQUE,
+			file_id TEXT NOT NULL,
+			message_id TEXT NOT NULL,
+			sender_guid TEXT NOT NULL,
+			name TEXT NOT NULL,
+			size INTEGER NOT NULL DEFAULT 0,
+			status TEXT NOT NULL DEFAULT 'queued',
+			bytes INTEGER NOT NULL DEFAULT 0,
+			path TEXT NOT NULL DEFAULT '',
+			error TEXT NOT NULL DEFAULT '',
+			auto_accepted INTEGER NOT NULL DEFAULT 0,
+			paths TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS mentions (
+			id INTEGER PRIMARY KEY,
+			message_id TEXT NOT NULL,
+			mentioned_guid TEXT NOT NULL,
+			sender_guid TEXT NOT NULL,
+			scope TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			read_at TIMESTAMP,
+			UNIQUE(message_id, mentioned_guid)
+		)`,
+		`CREATE TABLE IF NOT EXISTS polls (
+			id INTEGER PRIMARY KEY,
+			poll_id TEXT NOT NULL UNIQUE,
+			creator_guid TEXT NOT NULL,
+			receiver_guid TEXT,
+			scope TEXT NOT NULL,
+			question TEXT NOT NULL,
+			options TEXT NOT NULL,
+			closes_at TIMESTAMP,
+			hide_results INTEGER NOT NULL DEFAULT 0,
+			revealed INTEGER NOT NULL DEFAULT 0,
+			closed_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS poll_votes (
+			id INTEGER PRIMARY KEY,
+			poll_id TEXT NOT NULL,
+			voter_guid TEXT NOT NULL,
+			option_index INTEGER NOT NULL,
+			voted_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(poll_id, voter_guid)
+		)`,
+		`CREATE TABLE IF NOT EXISTS pins (
+			id INTEGER PRIMARY KEY,
+			conversation TEXT NOT NULL,
+			message_id TEXT NOT NULL,
+			pinned_by TEXT NOT NULL,
+			note TEXT,
+			sender_guid TEXT NOT NULL,
+			type TEXT NOT NULL,
+			content BLOB NOT NULL,
+			message_timestamp TIMESTAMP,
+			pinned_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(conversation, message_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS blocked_peers (
+			guid TEXT PRIMARY KEY,
+			blocked_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS topics (
+			conversation TEXT PRIMARY KEY,
+			topic TEXT NOT NULL,
+			set_by TEXT NOT NULL,
+			set_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS thumbnails (
+			id INTEGER PRIMARY KEY,
+			message_id TEXT NOT NULL,
+			size INTEGER NOT NULL,
+			width INTEGER NOT NULL,
+			height INTEGER NOT NULL,
+			data BLOB NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(message_id, size)
+		)`,
 		`CREATE TABLE IF NOT EXISTS relays (
 			id INTEGER PRIMARY KEY,
 			peer_guid TEXT NOT NULL,
@@ -154,9 +282,99 @@ func (db *DB) InitSchema() error {
 		}
 	}
 
+	// Columns added after a table was first released. backfill runs once, right after the column is added.
+	migrations := []struct {
+		table, column, definition, backfill string
+	}{
+		// Existing history keeps its arrival order under the logical clock
+		{"messages", "lamport_clock", "INTEGER NOT NULL DEFAULT 0", `UPDATE messages SET lamport_clock = id`},
+		{"messages", "clock_skew", "INTEGER NOT NULL DEFAULT 0", ""},
+		{"messages", "received_at", "TIMESTAMP", `UPDATE messages SET received_at = created_at`},
+		{"messages", "priority", "TEXT NOT NULL DEFAULT 'normal'", ""},
+		{"messages", "html", "TEXT NOT NULL DEFAULT ''", ""},
+		{"files", "sha256", "TEXT NOT NULL DEFAULT ''", ""},
+		// Files registered before bodies were encrypted get a key of their own
+		{"files", "enc_key", "TEXT NOT NULL DEFAULT ''", `UPDATE files SET enc_key = lower(hex(randomblob(32)))`},
+		{"files", "kind", "TEXT NOT NULL DEFAULT 'file'", ""},
+		{"files", "expires_at", "TIMESTAMP", ""},
+		{"files", "max_downloads", "INTEGER NOT NULL DEFAULT 0", ""},
+		{"files", "revoked_at", "TIMESTAMP", ""},
+		{"files", "blob", "TEXT NOT NULL DEFAULT ''", ""},
+		{"files", "chunks", "TEXT NOT NULL DEFAULT ''", ""},
+	}
+
+	for _, m := range migrations {
+		added, err := db.addColumnIfMissing(m.table, m.column, m.definition)
+		if err != nil {
+			return err
+		}
+		if added && m.backfill != "" {
+			if _, err := db.conn.Exec(m.backfill); err != nil {
+				return fmt.Errorf("failed to backfill %s.%s: %w", m.table, m.column, err)
+			}
+		}
+	}
+
+	// Indexes backing history pagination and per-conversation lookups
+	indexes := []string{
+		`CREATE INDEX IF NOT EXISTS idx_messages_created_at ON messages(created_at, id)`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_clock ON messages(lamport_clock, created_at, id)`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_scope_clock ON messages(scope, lamport_clock, created_at, id)`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_sender_clock ON messages(sender_guid, lamport_clock, created_at, id)`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_receiver_clock ON messages(receiver_guid, lamport_clock, created_at, id)`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_scope_received_at ON messages(scope, received_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_scheduled_messages_status_send_at ON scheduled_messages(status, send_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_mentions_mentioned_read ON mentions(mentioned_guid, read_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_transfers_file_id ON transfers(file_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_transfers_status ON transfers(status, created_at)`,
+	}
+
+	for _, index := range indexes {
+		if _, err := db.conn.Exec(index); err != nil {
+			return fmt.Errorf("failed to create index: %w", err)
+		}
+	}
+
 	return nil
 }
 
+// addColumnIfMissing adds a column to a table created by an older version and
+// reports whether it had to be added
+func (db *DB) addColumnIfMissing(table, column, definition string) (bool, error) {
+	rows, err := db.conn.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, fmt.Errorf("failed to inspect table %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			columnType string
+			notNull    int
+			defaultVal sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultVal, &primaryKey); err != nil {
+			return false, fmt.Errorf("failed to scan column info: %w", err)
+		}
+		if name == column {
+			return false, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return false, fmt.Errorf("error iterating column info: %w", err)
+	}
+	rows.Close()
+
+	query := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)
+	if _, err := db.conn.Exec(query); err != nil {
+		return false, fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
+	return true, nil
+}
+
 // SaveGUID stores the server's GUID in settings
 func (db *DB) SaveGUID(guid string) error {
 	query := `INSERT INTO settings (key, value) VALUES ('guid', ?)`
@@ -228,7 +446,8 @@ func (db *DB) GetKeys() (publicKey, privateKey []byte, err error) {
 // CleanupOldMessages removes messages older than the specified duration
 func (db *DB) CleanupOldMessages(ctx context.Context, age time.Duration) error {
 	cutoff := time.Now().Add(-age)
-	query := `DELETE FROM messages WHERE created_at < ?`
+	// Pinned messages are kept for as long as they stay pinned
+	query := `DELETE FROM messages WHERE created_at < ? AND message_id NOT IN (SELECT message_id FROM pins)`
 
 	result, err := db.conn.ExecContext(ctx, query, cutoff)
 	if err != nil {
@@ -242,6 +461,21 @@ func (db *DB) CleanupOldMessages(ctx context.Context, age time.Duration) error {
 	}
 
 	log.Printf("Cleaned up %d old messages", rows)
+
+	// Mentions only make sense while their message exists
+	if _, err := db.conn.ExecContext(ctx, `DELETE FROM mentions WHERE message_id NOT IN (SELECT message_id FROM messages)`); err != nil {
+		return fmt.Errorf("failed to cleanup old mentions: %w", err)
+	}
+	if _, err := db.conn.ExecContext(ctx, `DELETE FROM thumbnails WHERE message_id NOT IN (SELECT message_id FROM messages)`); err != nil {
+		return fmt.Errorf("failed to cleanup old thumbnails: %w", err)
+	}
+	// A poll is its message; votes go with the poll
+	if _, err := db.conn.ExecContext(ctx, `DELETE FROM polls WHERE poll_id NOT IN (SELECT message_id FROM messages)`); err != nil {
+		return fmt.Errorf("failed to cleanup old polls: %w", err)
+	}
+	if _, err := db.conn.ExecContext(ctx, `DELETE FROM poll_votes WHERE poll_id NOT IN (SELECT poll_id FROM polls)`); err != nil {
+		return fmt.Errorf("failed to cleanup old poll votes: %w", err)
+	}
 	return nil
 }
 
@@ -250,8 +484,9 @@ func (db *DB) SaveMessage(msg *messages.Message, sourceIP string) error {
 	query := `
 		INSERT INTO messages (
 			message_id, sender_guid, receiver_guid,
-			content, type, scope, created_at, source_ip
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+			content, type, scope, created_at, source_ip,
+			lamport_clock, clock_skew, received_at, priority, html
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 	_, err := db.conn.Exec(query,
 		msg.ID,
@@ -260,8 +495,13 @@ func (db *DB) SaveMessage(msg *messages.Message, sourceIP string) error {
 		msg.Content,
 		string(msg.Type),
 		string(msg.Scope),
-		msg.Timestamp,
+		msg.Timestamp.UTC(),
 		sourceIP,
+		msg.Clock,
+		msg.ClockSkew,
+		time.Now().UTC(),
+		string(msg.EffectivePriority()),
+		msg.HTML,
 	)
 	if err != nil {
 		return fmt.Errorf("failed to save message: %w", err)
@@ -272,11 +512,12 @@ func (db *DB) SaveMessage(msg *messages.Message, sourceIP string) error {
 // GetMessages retrieves messages from the database
 func (db *DB) GetMessages(guid string, since time.Time, limit int) ([]*messages.Message, error) {
 	query := `
-		SELECT message_id, sender_guid, receiver_guid, content, type, scope, created_at
+		SELECT message_id, sender_guid, receiver_guid, content, type, scope, created_at,
+			lamport_clock, clock_skew, priority, html
 		FROM messages
 		WHERE (receiver_guid = ? OR sender_guid = ? OR scope = 'broadcast')
 		AND created_at > ?
-		ORDER BY created_at DESC
+		ORDER BY lamport_clock DESC, created_at DESC, id DESC
 		LIMIT ?
 	`
 	rows, err := db.conn.Query(query, guid, guid, since, limit)
@@ -296,6 +537,10 @@ func (db *DB) GetMessages(guid string, since time.Time, limit int) ([]*messages.
 			&msg.Type,
 			&msg.Scope,
 			&msg.Timestamp,
+			&msg.Clock,
+			&msg.ClockSkew,
+			&msg.Priority,
+			&msg.HTML,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan message: %w", err)
@@ -310,6 +555,131 @@ func (db *DB) GetMessages(guid string, since time.Time, limit int) ([]*messages.
 	return msgs, nil
 }
 
+// ErrCursorNotFound is returned when a history cursor references an unknown message
+var ErrCursorNotFound = errors.New("cursor message not found")
+
+// ConversationBroadcast selects the shared broadcast conversation in a HistoryQuery
+const ConversationBroadcast = "broadcast"
+
+// HistoryQuery describes a single page of message history
+type HistoryQuery struct {
+	GUID         string    // Local node GUID, used to resolve private conversations
+	Conversation string    // Peer GUID, ConversationBroadcast, or empty for all conversations
+	BeforeID     string    // Only return messages older than this message
+	AfterID      string    // Only return messages newer than this message
+	BeforeTime   time.Time // Only return messages created before this time
+	AfterTime    time.Time // Only return messages created after this time
+	Ascending    bool      // Oldest first instead of newest first
+	Limit        int       // Maximum number of messages to return
+}
+
+// GetMessageHistory retrieves a page of messages using cursor-based pagination.
+// The returned bool reports whether more messages exist beyond the page.
+func (db *DB) GetMessageHistory(q HistoryQuery) ([]*messages.Message, bool, error) {
+	var conditions []string
+	var args []interface{}
+
+	switch q.Conversation {
+	case "":
+		conditions = append(conditions, "(receiver_guid = ? OR sender_guid = ? OR scope = 'broadcast')")
+		args = append(args, q.GUID, q.GUID)
+	case ConversationBroadcast:
+		conditions = append(conditions, "scope = 'broadcast'")
+	default:
+		conditions = append(conditions, `scope = 'private' AND (
+			(sender_guid = ? AND receiver_guid = ?) OR (sender_guid = ? AND receiver_guid = ?)
+		)`)
+		args = append(args, q.GUID, q.Conversation, q.Conversation, q.GUID)
+	}
+
+	// Message ID cursors compare on the full sort key so equal clocks and timestamps stay stable
+	for _, cursor := range []string{q.BeforeID, q.AfterID} {
+		if cursor == "" {
+			continue
+		}
+		var count int
+		if err := db.conn.QueryRow("SELECT COUNT(*) FROM messages WHERE message_id = ?", cursor).Scan(&count); err != nil {
+			return nil, false, fmt.Errorf("failed to resolve cursor: %w", err)
+		}
+		if count == 0 {
+			return nil, false, ErrCursorNotFound
+		}
+	}
+	if q.BeforeID != "" {
+		conditions = append(conditions, "(lamport_clock, created_at, id) < (SELECT lamport_clock, created_at, id FROM messages WHERE message_id = ?)")
+		args = append(args, q.BeforeID)
+	}
+	if q.AfterID != "" {
+		conditions = append(conditions, "(lamport_clock, created_at, id) > (SELECT lamport_clock, created_at, id FROM messages WHERE message_id = ?)")
+		args = append(args, q.AfterID)
+	}
+	// Older rows keep the sender's timezone offset, so times compare as instants
+	if !q.BeforeTime.IsZero() {
+		conditions = append(conditions, "julianday(created_at) < julianday(?)")
+		args = append(args, q.BeforeTime.UTC())
+	}
+	if !q.AfterTime.IsZero() {
+		conditions = append(conditions, "julianday(created_at) > julianday(?)")
+		args = append(args, q.AfterTime.UTC())
+	}
+
+	order := "DESC"
+	if q.Ascending {
+		order = "ASC"
+	}
+
+	// Causal order first, wall clock only breaks ties between concurrent messages.
+	// Fetch one extra row to find out whether another page exists.
+	query := fmt.Sprintf(`
+		SELECT message_id, sender_guid, receiver_guid, content, type, scope, created_at,
+			lamport_clock, clock_skew, priority, html
+		FROM messages
+		WHERE %s
+		ORDER BY lamport_clock %s, created_at %s, id %s
+		LIMIT ?
+	`, strings.Join(conditions, " AND "), order, order, order)
+	args = append(args, q.Limit+1)
+
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to query message history: %w", err)
+	}
+	defer rows.Close()
+
+	var msgs []*messages.Message
+	for rows.Next() {
+		var msg messages.Message
+		err := rows.Scan(
+			&msg.ID,
+			&msg.SenderGUID,
+			&msg.ReceiverGUID,
+			&msg.Content,
+			&msg.Type,
+			&msg.Scope,
+			&msg.Timestamp,
+			&msg.Clock,
+			&msg.ClockSkew,
+			&msg.Priority,
+			&msg.HTML,
+		)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to scan message: %w", err)
+		}
+		msgs = append(msgs, &msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, false, fmt.Errorf("error iterating messages: %w", err)
+	}
+
+	hasMore := len(msgs) > q.Limit
+	if hasMore {
+		msgs = msgs[:q.Limit]
+	}
+
+	return msgs, hasMore, nil
+}
+
 // SaveConfig stores the server configuration
 func (db *DB) SaveConfig(config *config.Config) error {
 	data, err := json.Marshal(config)
@@ -399,6 +769,44 @@ func (db *DB) GetName() (string, error) {
 	return name, nil
 }
 
+// GetMessage returns a stored message by its message ID. Returns sql.ErrNoRows if it does not exist.
+func (db *DB) GetMessage(messageID string) (*messages.Message, error) {
+	var msg messages.Message
+	err := db.conn.QueryRow(`
+		SELECT message_id, sender_guid, receiver_guid, content, type, scope, created_at,
+			lamport_clock, clock_skew, priority, html
+		FROM messages
+		WHERE message_id = ?
+	`, messageID).Scan(
+		&msg.ID,
+		&msg.SenderGUID,
+		&msg.ReceiverGUID,
+		&msg.Content,
+		&msg.Type,
+		&msg.Scope,
+		&msg.Timestamp,
+		&msg.Clock,
+		&msg.ClockSkew,
+		&msg.Priority,
+		&msg.HTML,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get message: %w", err)
+	}
+	return &msg, nil
+}
+
+// GetMaxLamportClock returns the highest logical clock stored, so the clock
+// never runs backwards across restarts
+func (db *DB) GetMaxLamportClock() (uint64, error) {
+	var clock uint64
+	err := db.conn.QueryRow("SELECT COALESCE(MAX(lamport_clock), 0) FROM messages").Scan(&clock)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get max lamport clock: %w", err)
+	}
+	return clock, nil
+}
+
 // GetMessageCount returns the total number of messages in the database
 func (db *DB) GetMessageCount() (int, error) {
 	var count int
@@ -652,6 +1060,33 @@ func (db *DB) SaveClientAPIKey(key string) error {
 	return nil
 }
 
+// GetSetting retrieves a value from settings. ok is false if the key is not set.
+func (db *DB) GetSetting(key string) (value string, ok bool, err error) {
+	err = db.conn.QueryRow("SELECT value FROM settings WHERE key = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to get setting %s: %w", key, err)
+	}
+	return value, true, nil
+}
+
+// SaveSetting stores a value in settings, replacing any previous value
+func (db *DB) SaveSetting(key, value string) error {
+	_, err := db.conn.Exec(`
+		INSERT INTO settings (key, value, updated_at)
+		VALUES (?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(key) DO UPDATE SET
+			value = excluded.value,
+			updated_at = CURRENT_TIMESTAMP
+	`, key, value)
+	if err != nil {
+		return fmt.Errorf("failed to save setting %s: %w", key, err)
+	}
+	return nil
+}
+
 // TruncateMessages removes all messages from the database and reclaims space
 func (db *DB) TruncateMessages() error {
 	// Start a transaction
@@ -665,6 +1100,21 @@ func (db *DB) TruncateMessages() error {
 	if _, err := tx.Exec("DELETE FROM messages"); err != nil {
 		return fmt.Errorf("failed to truncate messages: %w", err)
 	}
+	if _, err := tx.Exec("DELETE FROM mentions"); err != nil {
+		return fmt.Errorf("failed to truncate mentions: %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM thumbnails"); err != nil {
+		return fmt.Errorf("failed to truncate thumbnails: %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM poll_votes"); err != nil {
+		return fmt.Errorf("failed to truncate poll votes: %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM polls"); err != nil {
+		return fmt.Errorf("failed to truncate polls: %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM pins"); err != nil {
+		return fmt.Errorf("failed to truncate pins: %w", err)
+	}
 
 	// Commit the transaction
 	if err := tx.Commit(); err != nil {
@@ -679,29 +1129,30 @@ func (db *DB) TruncateMessages() error {
 	return nil
 }
 
-// SaveFile stores a file record in the database
-func (db *DB) SaveFile(fileID, senderGUID, receiverGUID, filename, filepath string, size int64, mimeType string) error {
+// SaveFile stores a file record in the database. blob is the hash of the
+// stored copy of an uploaded file, or "" for a file served from its path.
+func (db *DB) SaveFile(fileID, senderGUID, receiverGUID, filename, filepath string, size int64, mimeType, sha256, encKey, kind, blob string) error {
 	query := `
 		INSERT INTO files (
-			file_id, sender_guid, receiver_guid, filename, filepath, size, mime_type
-		) VALUES (?, ?, ?, ?, ?, ?, ?)
+			file_id, sender_guid, receiver_guid, filename, filepath, size, mime_type, sha256, enc_key, kind, blob
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
-	_, err := db.conn.Exec(query, fileID, senderGUID, receiverGUID, filename, filepath, size, mimeType)
+	_, err := db.conn.Exec(query, fileID, senderGUID, receiverGUID, filename, filepath, size, mimeType, sha256, encKey, kind, blob)
 	if err != nil {
 		return fmt.Errorf("failed to save file: %w", err)
 	}
 	return nil
 }
 
-// GetFile retrieves a file record by its ID
-func (db *DB) GetFile(fileID string) (*FileRecord, error) {
-	query := `
-		SELECT file_id, sender_guid, receiver_guid, filename, filepath, size, mime_type, created_at
-		FROM files
-		WHERE file_id = ?
-	`
+// fileColumns are the columns scanned by scanFile
+const fileColumns = `file_id, sender_guid, receiver_guid, filename, filepath, size, mime_type, created_at, sha256, enc_key, kind,
+	expires_at, max_downloads, revoked_at, (SELECT COUNT(*) FROM file_downloads d WHERE d.file_id = files.file_id), blob, chunks`
+
+// scanFile scans a row of fileColumns
+func scanFile(row interface{ Scan(...any) error }) (*FileRecord, error) {
 	var file FileRecord
-	err := db.conn.QueryRow(query, fileID).Scan(
+	var expiresAt, revokedAt sql.NullTime
+	err := row.Scan(
 		&file.FileID,
 		&file.SenderGUID,
 		&file.ReceiverGUID,
@@ -710,14 +1161,102 @@ func (db *DB) GetFile(fileID string) (*FileRecord, error) {
 		&file.Size,
 		&file.MimeType,
 		&file.CreatedAt,
+		&file.SHA256,
+		&file.EncKey,
+		&file.Kind,
+		&expiresAt,
+		&file.MaxDownloads,
+		&revokedAt,
+		&file.Downloads,
+		&file.Blob,
+		&file.Chunks,
 	)
+	if err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		file.ExpiresAt = &expiresAt.Time
+	}
+	if revokedAt.Valid {
+		file.RevokedAt = &revokedAt.Time
+	}
+	return &file, nil
+}
+
+// GetFile retrieves a file record by its ID
+func (db *DB) GetFile(fileID string) (*FileRecord, error) {
+	file, err := scanFile(db.conn.QueryRow(`SELECT `+fileColumns+` FROM files WHERE file_id = ?`, fileID))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to get file: %w", err)
 	}
-	return &file, nil
+	return file, nil
+}
+
+// SetFileLimits sets when a file's share expires, nil for never, and how
+// many nodes may download it, zero for any number
+func (db *DB) SetFileLimits(fileID string, expiresAt *time.Time, maxDownloads int) error {
+	var expires sql.NullTime
+	if expiresAt != nil {
+		expires = sql.NullTime{Time: expiresAt.UTC(), Valid: true}
+	}
+	result, err := db.conn.Exec(`UPDATE files SET expires_at = ?, max_downloads = ? WHERE file_id = ?`, expires, maxDownloads, fileID)
+	if err != nil {
+		return fmt.Errorf("failed to set file limits: %w", err)
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// SetFileChunks stores the JSON chunk manifest of a file's encrypted body
+func (db *DB) SetFileChunks(fileID, chunks string) error {
+	if _, err := db.conn.Exec(`UPDATE files SET chunks = ? WHERE file_id = ?`, chunks, fileID); err != nil {
+		return fmt.Errorf("failed to set file chunks: %w", err)
+	}
+	return nil
+}
+
+// RevokeFile ends the share of a file. Revoking a file again keeps the time it
+// was first revoked. Returns sql.ErrNoRows if there is no such file.
+func (db *DB) RevokeFile(fileID string) error {
+	result, err := db.conn.Exec(`UPDATE files SET revoked_at = COALESCE(revoked_at, ?) WHERE file_id = ?`, time.Now().UTC(), fileID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke file: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ClaimFileDownload records that the node audience downloads a file and
+// reports whether it may. A node that downloaded the file before may always
+// continue, so resumed transfers are not counted twice; a new node may only
+// while fewer than maxDownloads have, unless maxDownloads is zero.
+func (db *DB) ClaimFileDownload(fileID, audience string, maxDownloads int) (bool, error) {
+	// One statement, so concurrent claims cannot both take the last download
+	_, err := db.conn.Exec(`
+		INSERT OR IGNORE INTO file_downloads (file_id, audience)
+		SELECT ?, ? WHERE ? <= 0 OR (SELECT COUNT(*) FROM file_downloads WHERE file_id = ?) < ?
+	`, fileID, audience, maxDownloads, fileID, maxDownloads)
+	if err != nil {
+		return false, fmt.Errorf("failed to record file download: %w", err)
+	}
+
+	var count int
+	err = db.conn.QueryRow(`SELECT COUNT(*) FROM file_downloads WHERE file_id = ? AND audience = ?`, fileID, audience).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up file download: %w", err)
+	}
+	return count > 0, nil
 }
 
 // FileRecord represents a file in the database
@@ -730,6 +1269,15 @@ type FileRecord struct {
 	Size         int64
 	MimeType     string
 	CreatedAt    time.Time
+	SHA256       string     // Hex content hash taken when the file was registered
+	EncKey       string     // Hex AES-256 key the file body is encrypted with for peers
+	Kind         string     // messages.FileKindFile, or messages.FileKindDirectory for a shared directory
+	ExpiresAt    *time.Time // When the share ends, if it does
+	MaxDownloads int        // Nodes that may download the file; zero for any number
+	Downloads    int        // Nodes that have downloaded it
+	RevokedAt    *time.Time // When the share was revoked, if it was
+	Blob         string     // Hash of the stored copy of an uploaded file; "" if served from Filepath
+	Chunks       string     // JSON chunk manifest of the encrypted body, for swarm downloads
 }
 
 // TruncateFiles removes all files from the database
@@ -739,6 +1287,9 @@ func (db *DB) TruncateFiles() error {
 	if err != nil {
 		return fmt.Errorf("failed to truncate files: %w", err)
 	}
+	if _, err := db.conn.Exec(`DELETE FROM file_downloads`); err != nil {
+		return fmt.Errorf("failed to truncate file downloads: %w", err)
+	}
 	return nil
 }
 
@@ -785,20 +1336,130 @@ func (db *DB) GetPeersLastSeenAfter(cutoff time.Time) ([]*Peer, error) {
 // MessageExists checks if a message with the given ID already exists
 func (db *DB) MessageExists(messageID string) (bool, error) {
 	var count int
-	err := db.conn.QueryRow("SELECT COUNT(*) FROM messages WHERE id = ?", messageID).Scan(&count)
+	err := db.conn.QueryRow("SELECT COUNT(*) FROM messages WHERE message_id = ?", messageID).Scan(&count)
 	if err != nil {
 		return false, fmt.Errorf("failed to check message existence: %w", err)
 	}
 	return count > 0, nil
 }
 
+// AddFileSource records that the node guid has a verified copy of a file
+// offered by a peer and serves it to others
+func (db *DB) AddFileSource(fileID, guid string) error {
+	_, err := db.conn.Exec(`INSERT OR IGNORE INTO file_sources (file_id, guid) VALUES (?, ?)`, fileID, guid)
+	if err != nil {
+		return fmt.Errorf("failed to save file source: %w", err)
+	}
+	return nil
+}
+
+// GetFileSources returns the GUIDs of the nodes that serve copies of a file,
+// in the order they were added
+func (db *DB) GetFileSources(fileID string) ([]string, error) {
+	rows, err := db.conn.Query(`SELECT guid FROM file_sources WHERE file_id = ? ORDER BY added_at, guid`, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query file sources: %w", err)
+	}
+	defer rows.Close()
+
+	var guids []string
+	for rows.Next() {
+		var guid string
+		if err := rows.Scan(&guid); err != nil {
+			return nil, fmt.Errorf("failed to scan file source: %w", err)
+		}
+		guids = append(guids, guid)
+	}
+	return guids, rows.Err()
+}
+
+// RemoveFileSource forgets one node's copy of a file
+func (db *DB) RemoveFileSource(fileID, guid string) error {
+	if _, err := db.conn.Exec(`DELETE FROM file_sources WHERE file_id = ? AND guid = ?`, fileID, guid); err != nil {
+		return fmt.Errorf("failed to delete file source: %w", err)
+	}
+	return nil
+}
+
+// GetFileOfferCandidates returns the ID, type and content of stored file and
+// text messages from senderGUID that mention fileID. Callers parse the offers
+// to match the file ID exactly.
+func (db *DB) GetFileOfferCandidates(senderGUID, fileID string) ([]*messages.Message, error) {
+	rows, err := db.conn.Query(`
+		SELECT message_id, type, content
+		FROM messages
+		WHERE sender_guid = ? AND type IN (?, ?) AND instr(CAST(content AS TEXT), ?) > 0
+	`, senderGUID, messages.TypeFile, messages.TypeText, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query file offers: %w", err)
+	}
+	defer rows.Close()
+
+	var offers []*messages.Message
+	for rows.Next() {
+		msg := &messages.Message{SenderGUID: senderGUID}
+		if err := rows.Scan(&msg.ID, &msg.Type, &msg.Content); err != nil {
+			return nil, fmt.Errorf("failed to scan file offer: %w", err)
+		}
+		offers = append(offers, msg)
+	}
+	return offers, rows.Err()
+}
+
+// DeleteFileSources forgets every copy of a file
+func (db *DB) DeleteFileSources(fileID string) error {
+	if _, err := db.conn.Exec(`DELETE FROM file_sources WHERE file_id = ?`, fileID); err != nil {
+		return fmt.Errorf("failed to delete file sources: %w", err)
+	}
+	return nil
+}
+
+// Blob is a stored file body, named by the SHA-256 of its content
+type Blob struct {
+	Hash      string
+	Size      int64
+	CreatedAt time.Time
+}
+
+// SaveBlob records a stored file body. Recording a blob again does nothing.
+func (db *DB) SaveBlob(hash string, size int64) error {
+	_, err := db.conn.Exec(`INSERT OR IGNORE INTO blobs (hash, size) VALUES (?, ?)`, hash, size)
+	if err != nil {
+		return fmt.Errorf("failed to save blob: %w", err)
+	}
+	return nil
+}
+
+// GetBlobs returns all stored file bodies
+func (db *DB) GetBlobs() ([]Blob, error) {
+	rows, err := db.conn.Query(`SELECT hash, size, created_at FROM blobs ORDER BY created_at`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query blobs: %w", err)
+	}
+	defer rows.Close()
+
+	var blobs []Blob
+	for rows.Next() {
+		var b Blob
+		if err := rows.Scan(&b.Hash, &b.Size, &b.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan blob row: %w", err)
+		}
+		blobs = append(blobs, b)
+	}
+	return blobs, rows.Err()
+}
+
+// DeleteBlob removes the record of a stored file body
+func (db *DB) DeleteBlob(hash string) error {
+	if _, err := db.conn.Exec(`DELETE FROM blobs WHERE hash = ?`, hash); err != nil {
+		return fmt.Errorf("failed to delete blob: %w", err)
+	}
+	return nil
+}
+
 // GetFiles returns all files from the database
 func (db *DB) GetFiles() ([]FileRecord, error) {
-	rows, err := db.conn.Query(`
-		SELECT file_id, sender_guid, receiver_guid, filename, filepath, size, mime_type, created_at
-		FROM files
-		ORDER BY created_at DESC
-	`)
+	rows, err := db.conn.Query(`SELECT ` + fileColumns + ` FROM files ORDER BY created_at DESC`)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query files: %w", err)
 	}
@@ -806,24 +1467,957 @@ func (db *DB) GetFiles() ([]FileRecord, error) {
 
 	var files []FileRecord
 	for rows.Next() {
-		var file FileRecord
-		var createdAt time.Time
-		err := rows.Scan(
-			&file.FileID,
-			&file.SenderGUID,
-			&file.ReceiverGUID,
-			&file.Filename,
-			&file.Filepath,
-			&file.Size,
-			&file.MimeType,
-			&createdAt,
-		)
+		file, err := scanFile(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan file row: %w", err)
 		}
-		file.CreatedAt = createdAt
-		files = append(files, file)
+		files = append(files, *file)
 	}
 
 	return files, nil
 }
+
+// Scheduled message statuses
+const (
+	ScheduleStatusPending   = "pending"
+	ScheduleStatusSending   = "sending" // Claimed by the scheduler, which is sending it
+	ScheduleStatusSent      = "sent"
+	ScheduleStatusFailed    = "failed"
+	ScheduleStatusCancelled = "cancelled"
+)
+
+// ErrScheduleNotPending is returned when cancelling a scheduled message that already fired
+var ErrScheduleNotPending = errors.New("scheduled message is not pending")
+
+// ScheduledMessage represents a message waiting to be sent at a later time
+type ScheduledMessage struct {
+	ScheduleID   string                `json:"schedule_id"`
+	ReceiverGUID string                `json:"receiver_guid"`
+	Type         messages.MessageType  `json:"type"`
+	Scope        messages.MessageScope `json:"scope"`
+	Content      []byte                `json:"-"`
+	SendAt       time.Time             `json:"send_at"`
+	Status       string                `json:"status"`
+	MessageID    string                `json:"message_id,omitempty"`
+	Error        string                `json:"error,omitempty"`
+	CreatedAt    time.Time             `json:"created_at"`
+}
+
+// SaveScheduledMessage stores a new pending scheduled message
+func (db *DB) SaveScheduledMessage(sm *ScheduledMessage) error {
+	query := `
+		INSERT INTO scheduled_messages (
+			schedule_id, receiver_guid, type, scope, content, send_at, status
+		) VALUES (?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := db.conn.Exec(query,
+		sm.ScheduleID,
+		sm.ReceiverGUID,
+		string(sm.Type),
+		string(sm.Scope),
+		sm.Content,
+		sm.SendAt.UTC(),
+		ScheduleStatusPending,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save scheduled message: %w", err)
+	}
+	return nil
+}
+
+// GetScheduledMessages returns scheduled messages ordered by send time, optionally filtered by status
+func (db *DB) GetScheduledMessages(status string) ([]*ScheduledMessage, error) {
+	query := `
+		SELECT schedule_id, receiver_guid, type, scope, content, send_at, status,
+			COALESCE(message_id, ''), COALESCE(error, ''), created_at
+		FROM scheduled_messages
+		WHERE (? = '' OR status = ?)
+		ORDER BY send_at ASC
+	`
+	return db.queryScheduledMessages(query, status, status)
+}
+
+// GetDueScheduledMessages returns pending scheduled messages whose send time has passed
+func (db *DB) GetDueScheduledMessages(now time.Time) ([]*ScheduledMessage, error) {
+	query := `
+		SELECT schedule_id, receiver_guid, type, scope, content, send_at, status,
+			COALESCE(message_id, ''), COALESCE(error, ''), created_at
+		FROM scheduled_messages
+		WHERE status = ? AND send_at <= ?
+		ORDER BY send_at ASC
+	`
+	return db.queryScheduledMessages(query, ScheduleStatusPending, now.UTC())
+}
+
+// GetNextScheduledTime returns the send time of the earliest pending scheduled message
+func (db *DB) GetNextScheduledTime() (time.Time, bool, error) {
+	var sendAt time.Time
+	query := `SELECT send_at FROM scheduled_messages WHERE status = ? ORDER BY send_at ASC LIMIT 1`
+	err := db.conn.QueryRow(query, ScheduleStatusPending).Scan(&sendAt)
+	if err == sql.ErrNoRows {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("failed to get next scheduled time: %w", err)
+	}
+	return sendAt, true, nil
+}
+
+// CancelScheduledMessage cancels a pending scheduled message
+func (db *DB) CancelScheduledMessage(scheduleID string) error {
+	result, err := db.conn.Exec(
+		`UPDATE scheduled_messages SET status = ? WHERE schedule_id = ? AND status = ?`,
+		ScheduleStatusCancelled, scheduleID, ScheduleStatusPending,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to cancel scheduled message: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rows == 0 {
+		var count int
+		if err := db.conn.QueryRow(`SELECT COUNT(*) FROM scheduled_messages WHERE schedule_id = ?`, scheduleID).Scan(&count); err != nil {
+			return fmt.Errorf("failed to look up scheduled message: %w", err)
+		}
+		if count == 0 {
+			return sql.ErrNoRows
+		}
+		return ErrScheduleNotPending
+	}
+	return nil
+}
+
+// ClaimScheduledMessage marks a pending scheduled message as being sent. It
+// returns false if the message is no longer pending, because it was
+// cancelled or already claimed, and must not be sent.
+func (db *DB) ClaimScheduledMessage(scheduleID string) (bool, error) {
+	result, err := db.conn.Exec(
+		`UPDATE scheduled_messages SET status = ? WHERE schedule_id = ? AND status = ?`,
+		ScheduleStatusSending, scheduleID, ScheduleStatusPending,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to claim scheduled message: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	return rows == 1, nil
+}
+
+// CompleteScheduledMessage records the outcome of a claimed scheduled message
+func (db *DB) CompleteScheduledMessage(scheduleID, status, messageID, errText string) error {
+	_, err := db.conn.Exec(`
+		UPDATE scheduled_messages
+		SET status = ?, message_id = ?, error = ?, sent_at = ?
+		WHERE schedule_id = ? AND status = ?
+	`, status, messageID, errText, time.Now().UTC(), scheduleID, ScheduleStatusSending)
+	if err != nil {
+		return fmt.Errorf("failed to update scheduled message: %w", err)
+	}
+	return nil
+}
+
+// FailInterruptedScheduledMessages marks the scheduled messages that were
+// being sent when the node stopped as failed. They may or may not have gone
+// out, and are not sent again.
+func (db *DB) FailInterruptedScheduledMessages() (int64, error) {
+	result, err := db.conn.Exec(
+		`UPDATE scheduled_messages SET status = ?, error = ? WHERE status = ?`,
+		ScheduleStatusFailed, "node stopped while sending", ScheduleStatusSending,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to update interrupted scheduled messages: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// queryScheduledMessages runs a scheduled_messages query and scans the rows
+func (db *DB) queryScheduledMessages(query string, args ...interface{}) ([]*ScheduledMessage, error) {
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query scheduled messages: %w", err)
+	}
+	defer rows.Close()
+
+	var scheduled []*ScheduledMessage
+	for rows.Next() {
+		var sm ScheduledMessage
+		err := rows.Scan(
+			&sm.ScheduleID,
+			&sm.ReceiverGUID,
+			&sm.Type,
+			&sm.Scope,
+			&sm.Content,
+			&sm.SendAt,
+			&sm.Status,
+			&sm.MessageID,
+			&sm.Error,
+			&sm.CreatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan scheduled message: %w", err)
+		}
+		scheduled = append(scheduled, &sm)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating scheduled messages: %w", err)
+	}
+
+	return scheduled, nil
+}
+
+// Transfer statuses
+const (
+	TransferStatusQueued    = "queued"
+	TransferStatusActive    = "active"
+	TransferStatusCompleted = "completed"
+	TransferStatusFailed    = "failed"
+)
+
+// Transfer is a download of a file offered by a peer to this node
+type Transfer struct {
+	TransferID   string    `json:"transfer_id"`
+	FileID       string    `json:"file_id"`
+	MessageID    string    `json:"message_id"`
+	SenderGUID   string    `json:"sender_guid"`
+	Name         string    `json:"name"`
+	Size         int64     `json:"size"`
+	Status       string    `json:"status"`
+	Bytes        int64     `json:"bytes"` // Bytes transferred so far
+	Path         string    `json:"path,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	AutoAccepted bool      `json:"auto_accepted"`
+	Paths        []string  `json:"paths,omitempty"` // Entries picked from a shared directory; empty for all
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// SaveTransfer stores a new queued transfer
+func (db *DB) SaveTransfer(t *Transfer) error {
+	paths := ""
+	if len(t.Paths) > 0 {
+		data, err := json.Marshal(t.Paths)
+		if err != nil {
+			return fmt.Errorf("failed to marshal transfer paths: %w", err)
+		}
+		paths = string(data)
+	}
+
+	query := `
+		INSERT INTO transfers (
+			transfer_id, file_id, message_id, sender_guid, name, size, status, auto_accepted, paths
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := db.conn.Exec(query,
+		t.TransferID,
+		t.FileID,
+		t.MessageID,
+		t.SenderGUID,
+		t.Name,
+		t.Size,
+		TransferStatusQueued,
+		t.AutoAccepted,
+		paths,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save transfer: %w", err)
+	}
+	return nil
+}
+
+// UpdateTransfer records the progress or outcome of a transfer
+func (db *DB) UpdateTransfer(transferID, status string, bytes int64, path, errText string) error {
+	_, err := db.conn.Exec(`
+		UPDATE transfers
+		SET status = ?, bytes = ?, path = ?, error = ?, updated_at = ?
+		WHERE transfer_id = ?
+	`, status, bytes, path, errText, time.Now().UTC(), transferID)
+	if err != nil {
+		return fmt.Errorf("failed to update transfer: %w", err)
+	}
+	return nil
+}
+
+// GetTransfer retrieves a transfer by its ID. Returns nil if there is none.
+func (db *DB) GetTransfer(transferID string) (*Transfer, error) {
+	transfers, err := db.queryTransfers(transferColumns+` WHERE transfer_id = ?`, transferID)
+	if err != nil || len(transfers) == 0 {
+		return nil, err
+	}
+	return transfers[0], nil
+}
+
+// GetLatestTransfer returns the most recent transfer of a file, or nil if it was never downloaded
+func (db *DB) GetLatestTransfer(fileID string) (*Transfer, error) {
+	transfers, err := db.queryTransfers(transferColumns+` WHERE file_id = ? ORDER BY created_at DESC, id DESC LIMIT 1`, fileID)
+	if err != nil || len(transfers) == 0 {
+		return nil, err
+	}
+	return transfers[0], nil
+}
+
+// GetTransfers returns transfers in the order they were requested, optionally filtered by status
+func (db *DB) GetTransfers(status string) ([]*Transfer, error) {
+	return db.queryTransfers(transferColumns+` WHERE (? = '' OR status = ?) ORDER BY created_at ASC, id ASC`, status, status)
+}
+
+const transferColumns = `
+	SELECT transfer_id, file_id, message_id, sender_guid, name, size, status,
+		bytes, path, error, auto_accepted, paths, created_at, updated_at
+	FROM transfers`
+
+// queryTransfers runs a transfers query and scans the rows
+func (db *DB) queryTransfers(query string, args ...interface{}) ([]*Transfer, error) {
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query transfers: %w", err)
+	}
+	defer rows.Close()
+
+	var transfers []*Transfer
+	for rows.Next() {
+		var t Transfer
+		var paths string
+		err := rows.Scan(
+			&t.TransferID,
+			&t.FileID,
+			&t.MessageID,
+			&t.SenderGUID,
+			&t.Name,
+			&t.Size,
+			&t.Status,
+			&t.Bytes,
+			&t.Path,
+			&t.Error,
+			&t.AutoAccepted,
+			&paths,
+			&t.CreatedAt,
+			&t.UpdatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan transfer: %w", err)
+		}
+		if paths != "" {
+			if err := json.Unmarshal([]byte(paths), &t.Paths); err != nil {
+				return nil, fmt.Errorf("failed to parse transfer paths: %w", err)
+			}
+		}
+		transfers = append(transfers, &t)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating transfers: %w", err)
+	}
+
+	return transfers, nil
+}
+
+// BroadcastRef identifies a stored broadcast for history sync
+type BroadcastRef struct {
+	MessageID  string    `json:"id"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// GetBroadcastRefsSince returns broadcasts we received at or after since, oldest
+// first. Receive times are our own clock, so peers can page through them without
+// trusting each other's wall clocks.
+func (db *DB) GetBroadcastRefsSince(since time.Time, limit int) ([]BroadcastRef, error) {
+	rows, err := db.conn.Query(`
+		SELECT message_id, COALESCE(received_at, created_at)
+		FROM messages
+		WHERE scope = 'broadcast' AND COALESCE(received_at, created_at) >= ?
+		ORDER BY COALESCE(received_at, created_at), id
+		LIMIT ?
+	`, since.UTC(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query broadcast refs: %w", err)
+	}
+	defer rows.Close()
+
+	var refs []BroadcastRef
+	for rows.Next() {
+		var ref BroadcastRef
+		if err := rows.Scan(&ref.MessageID, &ref.ReceivedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan broadcast ref: %w", err)
+		}
+		refs = append(refs, ref)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating broadcast refs: %w", err)
+	}
+
+	return refs, nil
+}
+
+// GetBroadcastMessages returns the stored broadcasts with the given message IDs.
+// IDs that are unknown or belong to private messages are skipped.
+func (db *DB) GetBroadcastMessages(messageIDs []string) ([]*messages.Message, error) {
+	if len(messageIDs) == 0 {
+		return nil, nil
+	}
+
+	placeholders := make([]string, len(messageIDs))
+	args := make([]interface{}, len(messageIDs))
+	for i, id := range messageIDs {
+		placeholders[i] = "?"
+		args[i] = id
+	}
+
+	query := fmt.Sprintf(`
+		SELECT message_id, sender_guid, receiver_guid, content, type, scope, created_at,
+			lamport_clock, clock_skew, priority, html
+		FROM messages
+		WHERE scope = 'broadcast' AND message_id IN (%s)
+		ORDER BY lamport_clock, created_at, id
+	`, strings.Join(placeholders, ", "))
+
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query broadcast messages: %w", err)
+	}
+	defer rows.Close()
+
+	var msgs []*messages.Message
+	for rows.Next() {
+		var msg messages.Message
+		err := rows.Scan(
+			&msg.ID,
+			&msg.SenderGUID,
+			&msg.ReceiverGUID,
+			&msg.Content,
+			&msg.Type,
+			&msg.Scope,
+			&msg.Timestamp,
+			&msg.Clock,
+			&msg.ClockSkew,
+			&msg.Priority,
+			&msg.HTML,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan message: %w", err)
+		}
+		msgs = append(msgs, &msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating messages: %w", err)
+	}
+
+	return msgs, nil
+}
+
+// Mention records that a message named a node
+type Mention struct {
+	MessageID     string                `json:"message_id"`
+	MentionedGUID string                `json:"mentioned_guid"`
+	SenderGUID    string                `json:"sender_guid"`
+	Scope         messages.MessageScope `json:"scope"`
+	Content       string                `json:"content"`
+	CreatedAt     time.Time             `json:"created_at"`
+	ReadAt        *time.Time            `json:"read_at,omitempty"`
+}
+
+// SaveMentions records the nodes named by a message. Repeated saves are ignored.
+func (db *DB) SaveMentions(msg *messages.Message, mentionedGUIDs []string) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, guid := range mentionedGUIDs {
+		_, err := tx.Exec(`
+			INSERT OR IGNORE INTO mentions (message_id, mentioned_guid, sender_guid, scope, created_at)
+			VALUES (?, ?, ?, ?, ?)
+		`, msg.ID, guid, msg.SenderGUID, string(msg.Scope), time.Now().UTC())
+		if err != nil {
+			return fmt.Errorf("failed to save mention: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// GetMentions returns mentions of guid, newest first, with the message content
+func (db *DB) GetMentions(guid string, unreadOnly bool, limit int) ([]*Mention, error) {
+	query := `
+		SELECT mn.message_id, mn.mentioned_guid, mn.sender_guid, mn.scope,
+			COALESCE(m.content, ''), mn.created_at, mn.read_at
+		FROM mentions mn
+		LEFT JOIN messages m ON m.message_id = mn.message_id
+		WHERE mn.mentioned_guid = ?`
+	if unreadOnly {
+		query += ` AND mn.read_at IS NULL`
+	}
+	query += ` ORDER BY mn.created_at DESC, mn.id DESC LIMIT ?`
+
+	rows, err := db.conn.Query(query, guid, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query mentions: %w", err)
+	}
+	defer rows.Close()
+
+	var mentions []*Mention
+	for rows.Next() {
+		var mention Mention
+		var content []byte
+		var readAt sql.NullTime
+		err := rows.Scan(
+			&mention.MessageID,
+			&mention.MentionedGUID,
+			&mention.SenderGUID,
+			&mention.Scope,
+			&content,
+			&mention.CreatedAt,
+			&readAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan mention: %w", err)
+		}
+		mention.Content = string(content)
+		if readAt.Valid {
+			mention.ReadAt = &readAt.Time
+		}
+		mentions = append(mentions, &mention)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating mentions: %w", err)
+	}
+
+	return mentions, nil
+}
+
+// MarkMentionsRead marks mentions of guid as read. With no message IDs every
+// unread mention is marked. It returns the number of mentions updated.
+func (db *DB) MarkMentionsRead(guid string, messageIDs []string) (int64, error) {
+	query := `UPDATE mentions SET read_at = ? WHERE mentioned_guid = ? AND read_at IS NULL`
+	args := []interface{}{time.Now().UTC(), guid}
+	if len(messageIDs) > 0 {
+		placeholders := make([]string, len(messageIDs))
+		for i, id := range messageIDs {
+			placeholders[i] = "?"
+			args = append(args, id)
+		}
+		query += fmt.Sprintf(" AND message_id IN (%s)", strings.Join(placeholders, ", "))
+	}
+
+	result, err := db.conn.Exec(query, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to mark mentions read: %w", err)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get affected rows: %w", err)
+	}
+	return updated, nil
+}
+
+// Poll is a poll message together with its local state
+type Poll struct {
+	PollID       string                `json:"poll_id"`
+	CreatorGUID  string                `json:"creator_guid"`
+	ReceiverGUID string                `json:"receiver_guid,omitempty"`
+	Scope        messages.MessageScope `json:"scope"`
+	Question     string                `json:"question"`
+	Options      []string              `json:"options"`
+	ClosesAt     time.Time             `json:"closes_at,omitempty"`
+	HideResults  bool                  `json:"hide_results"`
+	Revealed     bool                  `json:"revealed"`
+	ClosedAt     time.Time             `json:"closed_at,omitempty"`
+	CreatedAt    time.Time             `json:"created_at"`
+}
+
+// PollVote is one node's vote in a poll
+type PollVote struct {
+	VoterGUID string    `json:"voter_guid"`
+	Option    int       `json:"option"`
+	VotedAt   time.Time `json:"voted_at"`
+}
+
+// SavePoll stores a poll. Saving a poll that already exists is a no-op.
+func (db *DB) SavePoll(poll *Poll) error {
+	options, err := json.Marshal(poll.Options)
+	if err != nil {
+		return fmt.Errorf("failed to marshal poll options: %w", err)
+	}
+
+	var closesAt interface{}
+	if !poll.ClosesAt.IsZero() {
+		closesAt = poll.ClosesAt.UTC()
+	}
+
+	_, err = db.conn.Exec(`
+		INSERT OR IGNORE INTO polls (
+			poll_id, creator_guid, receiver_guid, scope, question,
+			options, closes_at, hide_results, created_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`,
+		poll.PollID,
+		poll.CreatorGUID,
+		poll.ReceiverGUID,
+		string(poll.Scope),
+		poll.Question,
+		string(options),
+		closesAt,
+		poll.HideResults,
+		poll.CreatedAt.UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save poll: %w", err)
+	}
+	return nil
+}
+
+// GetPoll returns a poll by ID. Returns sql.ErrNoRows if it does not exist.
+func (db *DB) GetPoll(pollID string) (*Poll, error) {
+	var poll Poll
+	var options string
+	var receiverGUID sql.NullString
+	var closesAt, closedAt sql.NullTime
+	err := db.conn.QueryRow(`
+		SELECT poll_id, creator_guid, receiver_guid, scope, question, options,
+			closes_at, hide_results, revealed, closed_at, created_at
+		FROM polls
+		WHERE poll_id = ?
+	`, pollID).Scan(
+		&poll.PollID,
+		&poll.CreatorGUID,
+		&receiverGUID,
+		&poll.Scope,
+		&poll.Question,
+		&options,
+		&closesAt,
+		&poll.HideResults,
+		&poll.Revealed,
+		&closedAt,
+		&poll.CreatedAt,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get poll: %w", err)
+	}
+
+	if err := json.Unmarshal([]byte(options), &poll.Options); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal poll options: %w", err)
+	}
+	poll.ReceiverGUID = receiverGUID.String
+	if closesAt.Valid {
+		poll.ClosesAt = closesAt.Time
+	}
+	if closedAt.Valid {
+		poll.ClosedAt = closedAt.Time
+	}
+	return &poll, nil
+}
+
+// SavePollVote records a vote, replacing the voter's previous vote in the same poll
+func (db *DB) SavePollVote(pollID, voterGUID string, option int) error {
+	_, err := db.conn.Exec(`
+		INSERT INTO poll_votes (poll_id, voter_guid, option_index, voted_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(poll_id, voter_guid) DO UPDATE SET
+			option_index = excluded.option_index,
+			voted_at = excluded.voted_at
+	`, pollID, voterGUID, option, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to save poll vote: %w", err)
+	}
+	return nil
+}
+
+// GetPollVotes returns all votes in a poll
+func (db *DB) GetPollVotes(pollID string) ([]PollVote, error) {
+	rows, err := db.conn.Query(`
+		SELECT voter_guid, option_index, voted_at
+		FROM poll_votes
+		WHERE poll_id = ?
+		ORDER BY voted_at
+	`, pollID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query poll votes: %w", err)
+	}
+	defer rows.Close()
+
+	var votes []PollVote
+	for rows.Next() {
+		var vote PollVote
+		if err := rows.Scan(&vote.VoterGUID, &vote.Option, &vote.VotedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan poll vote: %w", err)
+		}
+		votes = append(votes, vote)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating poll votes: %w", err)
+	}
+
+	return votes, nil
+}
+
+// ClosePoll marks a poll as closed. Closing an already closed poll keeps the original time.
+func (db *DB) ClosePoll(pollID string, closedAt time.Time) error {
+	_, err := db.conn.Exec(`UPDATE polls SET closed_at = ? WHERE poll_id = ? AND closed_at IS NULL`,
+		closedAt.UTC(), pollID)
+	if err != nil {
+		return fmt.Errorf("failed to close poll: %w", err)
+	}
+	return nil
+}
+
+// RevealPoll makes a poll's results visible before it closes
+func (db *DB) RevealPoll(pollID string) error {
+	if _, err := db.conn.Exec(`UPDATE polls SET revealed = 1 WHERE poll_id = ?`, pollID); err != nil {
+		return fmt.Errorf("failed to reveal poll: %w", err)
+	}
+	return nil
+}
+
+// Pin is a message pinned in a conversation. The message is snapshotted so the
+// pin survives even if the message itself is missing locally.
+type Pin struct {
+	Conversation     string               `json:"conversation"` // Peer GUID or ConversationBroadcast
+	MessageID        string               `json:"message_id"`
+	PinnedBy         string               `json:"pinned_by"`
+	Note             string               `json:"note,omitempty"`
+	SenderGUID       string               `json:"sender_guid"`
+	Type             messages.MessageType `json:"type"`
+	Content          string               `json:"content"`
+	MessageTimestamp time.Time            `json:"message_timestamp"`
+	PinnedAt         time.Time            `json:"pinned_at"`
+}
+
+// SavePin stores a pin, replacing an existing pin of the same message in the conversation
+func (db *DB) SavePin(pin *Pin) error {
+	_, err := db.conn.Exec(`
+		INSERT INTO pins (
+			conversation, message_id, pinned_by, note, sender_guid,
+			type, content, message_timestamp, pinned_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(conversation, message_id) DO UPDATE SET
+			pinned_by = excluded.pinned_by,
+			note = excluded.note,
+			pinned_at = excluded.pinned_at
+	`,
+		pin.Conversation,
+		pin.MessageID,
+		pin.PinnedBy,
+		pin.Note,
+		pin.SenderGUID,
+		string(pin.Type),
+		[]byte(pin.Content),
+		pin.MessageTimestamp.UTC(),
+		pin.PinnedAt.UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save pin: %w", err)
+	}
+	return nil
+}
+
+// DeletePin removes a pin. Returns sql.ErrNoRows if the message was not pinned in the conversation.
+func (db *DB) DeletePin(conversation, messageID string) error {
+	result, err := db.conn.Exec(`DELETE FROM pins WHERE conversation = ? AND message_id = ?`, conversation, messageID)
+	if err != nil {
+		return fmt.Errorf("failed to delete pin: %w", err)
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get affected rows: %w", err)
+	}
+	if deleted == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetPins returns pins newest first, limited to one conversation unless conversation is empty
+func (db *DB) GetPins(conversation string) ([]*Pin, error) {
+	query := `
+		SELECT conversation, message_id, pinned_by, COALESCE(note, ''), sender_guid,
+			type, content, message_timestamp, pinned_at
+		FROM pins`
+	var args []interface{}
+	if conversation != "" {
+		query += ` WHERE conversation = ?`
+		args = append(args, conversation)
+	}
+	query += ` ORDER BY pinned_at DESC, id DESC`
+
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query pins: %w", err)
+	}
+	defer rows.Close()
+
+	var pins []*Pin
+	for rows.Next() {
+		var pin Pin
+		var content []byte
+		var messageTimestamp sql.NullTime
+		err := rows.Scan(
+			&pin.Conversation,
+			&pin.MessageID,
+			&pin.PinnedBy,
+			&pin.Note,
+			&pin.SenderGUID,
+			&pin.Type,
+			&content,
+			&messageTimestamp,
+			&pin.PinnedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan pin: %w", err)
+		}
+		pin.Content = string(content)
+		if messageTimestamp.Valid {
+			pin.MessageTimestamp = messageTimestamp.Time
+		}
+		pins = append(pins, &pin)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating pins: %w", err)
+	}
+
+	return pins, nil
+}
+
+// ThumbnailRecord is a stored thumbnail of an image message
+type ThumbnailRecord struct {
+	MessageID string
+	Size      int
+	Width     int
+	Height    int
+	Data      []byte
+	CreatedAt time.Time
+}
+
+// SaveThumbnail stores a thumbnail, replacing any existing one of the same size
+func (db *DB) SaveThumbnail(t *ThumbnailRecord) error {
+	_, err := db.conn.Exec(`
+		INSERT INTO thumbnails (message_id, size, width, height, data, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(message_id, size) DO UPDATE SET
+			width = excluded.width,
+			height = excluded.height,
+			data = excluded.data,
+			created_at = excluded.created_at
+	`, t.MessageID, t.Size, t.Width, t.Height, t.Data, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to save thumbnail: %w", err)
+	}
+	return nil
+}
+
+// GetThumbnail returns the thumbnail of a message at the given size. Returns sql.ErrNoRows if there is none.
+func (db *DB) GetThumbnail(messageID string, size int) (*ThumbnailRecord, error) {
+	var t ThumbnailRecord
+	err := db.conn.QueryRow(`
+		SELECT message_id, size, width, height, data, created_at
+		FROM thumbnails
+		WHERE message_id = ? AND size = ?
+	`, messageID, size).Scan(&t.MessageID, &t.Size, &t.Width, &t.Height, &t.Data, &t.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get thumbnail: %w", err)
+	}
+	return &t, nil
+}
+
+// BlockPeer stops messages from a peer from being accepted
+func (db *DB) BlockPeer(guid string) error {
+	_, err := db.conn.Exec(`
+		INSERT INTO blocked_peers (guid, blocked_at) VALUES (?, ?)
+		ON CONFLICT(guid) DO NOTHING
+	`, guid, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to block peer: %w", err)
+	}
+	return nil
+}
+
+// UnblockPeer accepts messages from a peer again. Returns sql.ErrNoRows if it was not blocked.
+func (db *DB) UnblockPeer(guid string) error {
+	result, err := db.conn.Exec(`DELETE FROM blocked_peers WHERE guid = ?`, guid)
+	if err != nil {
+		return fmt.Errorf("failed to unblock peer: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to unblock peer: %w", err)
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// IsPeerBlocked reports whether messages from a peer are refused
+func (db *DB) IsPeerBlocked(guid string) (bool, error) {
+	var count int
+	if err := db.conn.QueryRow(`SELECT COUNT(*) FROM blocked_peers WHERE guid = ?`, guid).Scan(&count); err != nil {
+		return false, fmt.Errorf("failed to check blocked peer: %w", err)
+	}
+	return count > 0, nil
+}
+
+// GetBlockedPeers returns the GUIDs of all blocked peers, most recently blocked first
+func (db *DB) GetBlockedPeers() ([]string, error) {
+	rows, err := db.conn.Query(`SELECT guid FROM blocked_peers ORDER BY blocked_at DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query blocked peers: %w", err)
+	}
+	defer rows.Close()
+
+	var guids []string
+	for rows.Next() {
+		var guid string
+		if err := rows.Scan(&guid); err != nil {
+			return nil, fmt.Errorf("failed to scan blocked peer: %w", err)
+		}
+		guids = append(guids, guid)
+	}
+	return guids, rows.Err()
+}
+
+// Topic is the topic of a conversation
+type Topic struct {
+	Conversation string    `json:"conversation"` // Peer GUID or ConversationBroadcast
+	Topic        string    `json:"topic"`
+	SetBy        string    `json:"set_by"`
+	SetAt        time.Time `json:"set_at"`
+}
+
+// SaveTopic sets the topic of a conversation, replacing any previous one
+func (db *DB) SaveTopic(t *Topic) error {
+	_, err := db.conn.Exec(`
+		INSERT INTO topics (conversation, topic, set_by, set_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(conversation) DO UPDATE SET
+			topic = excluded.topic,
+			set_by = excluded.set_by,
+			set_at = excluded.set_at
+	`, t.Conversation, t.Topic, t.SetBy, t.SetAt.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to save topic: %w", err)
+	}
+	return nil
+}
+
+// GetTopic returns the topic of a conversation. Returns sql.ErrNoRows if none is set.
+func (db *DB) GetTopic(conversation string) (*Topic, error) {
+	var t Topic
+	err := db.conn.QueryRow(`
+		SELECT conversation, topic, set_by, set_at
+		FROM topics
+		WHERE conversation = ?
+	`, conversation).Scan(&t.Conversation, &t.Topic, &t.SetBy, &t.SetAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get topic: %w", err)
+	}
+	return &t, nil
+}
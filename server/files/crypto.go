@@ -0,0 +1,323 @@
+package files
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// File bodies travel between nodes in a chunked AEAD format. The stream is a
+// header of magic and salt followed by the file in 64 KiB chunks, each sealed
+// with AES-256-GCM. A chunk's nonce and additional data hold its index, and the
+// additional data marks the last chunk, so chunks cannot be reordered, dropped
+// or cut off. The salt is derived from the file key and the content hash, so a
+// file that changes on disk is sealed under a different chunk key instead of
+// reusing nonces, while the same content always gives the same ciphertext and
+// byte ranges of it stay stable across requests. File offers name the format
+// messages.FileEncryptionScheme.
+const (
+	cipherMagic      = "CCF1"
+	cipherSaltSize   = 32
+	cipherHeaderSize = len(cipherMagic) + cipherSaltSize
+	cipherChunkSize  = 64 * 1024
+	cipherTagSize    = 16
+)
+
+// NewFileKey returns a random hex encoded 256-bit file key
+func NewFileKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("failed to generate file key: %w", err)
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// parseFileKey decodes a hex file key
+func parseFileKey(hexKey string) ([]byte, error) {
+	key, err := hex.DecodeString(hexKey)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("invalid file key")
+	}
+	return key, nil
+}
+
+// ciphertextSize returns the length of the encrypted stream for a file of plainSize bytes
+func ciphertextSize(plainSize int64) int64 {
+	return int64(cipherHeaderSize) + plainSize + chunkCount(plainSize)*cipherTagSize
+}
+
+// chunkCount returns the number of chunks of a file; an empty file has one empty chunk
+func chunkCount(plainSize int64) int64 {
+	if plainSize == 0 {
+		return 1
+	}
+	return (plainSize + cipherChunkSize - 1) / cipherChunkSize
+}
+
+// chunkAEAD derives the chunk cipher for a file key and salt
+func chunkAEAD(key, salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("chunk key"))
+	mac.Write(salt)
+
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce and chunkAD bind a sealed chunk to its position
+func chunkNonce(index int64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], uint64(index))
+	return nonce
+}
+
+func chunkAD(index int64, last bool) []byte {
+	ad := make([]byte, 9)
+	binary.BigEndian.PutUint64(ad, uint64(index))
+	if last {
+		ad[8] = 1
+	}
+	return ad
+}
+
+// encryptedFile presents a plaintext file as its encrypted stream. It seeks,
+// so ranges of the ciphertext can be served without encrypting what precedes them.
+type encryptedFile struct {
+	f         *os.File
+	plainSize int64
+	header    []byte
+	aead      cipher.AEAD
+
+	pos      int64
+	chunkIdx int64  // Index of the chunk in sealed, or -1
+	sealed   []byte // Current chunk, sealed
+}
+
+// newEncryptedFile wraps f, whose content has the hex SHA-256 contentHash
+func newEncryptedFile(f *os.File, plainSize int64, hexKey, contentHash string) (*encryptedFile, error) {
+	key, err := parseFileKey(hexKey)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("salt"))
+	mac.Write([]byte(contentHash))
+	salt := mac.Sum(nil)
+
+	aead, err := chunkAEAD(key, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptedFile{
+		f:         f,
+		plainSize: plainSize,
+		header:    append([]byte(cipherMagic), salt...),
+		aead:      aead,
+		chunkIdx:  -1,
+	}, nil
+}
+
+// Salt identifies the ciphertext; it changes whenever the content does
+func (e *encryptedFile) Salt() string {
+	return hex.EncodeToString(e.header[len(cipherMagic):])
+}
+
+// Size returns the length of the encrypted stream
+func (e *encryptedFile) Size() int64 {
+	return ciphertextSize(e.plainSize)
+}
+
+func (e *encryptedFile) Read(p []byte) (int, error) {
+	if e.pos >= e.Size() {
+		return 0, io.EOF
+	}
+
+	if e.pos < int64(cipherHeaderSize) {
+		n := copy(p, e.header[e.pos:])
+		e.pos += int64(n)
+		return n, nil
+	}
+
+	sealedSize := int64(cipherChunkSize + cipherTagSize)
+	offset := e.pos - int64(cipherHeaderSize)
+	index := offset / sealedSize
+	if index != e.chunkIdx {
+		if err := e.seal(index); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, e.sealed[offset-index*sealedSize:])
+	e.pos += int64(n)
+	return n, nil
+}
+
+// seal encrypts chunk index into e.sealed
+func (e *encryptedFile) seal(index int64) error {
+	start := index * cipherChunkSize
+	length := min(int64(cipherChunkSize), e.plainSize-start)
+
+	plain := make([]byte, length)
+	if _, err := e.f.ReadAt(plain, start); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+	last := index == chunkCount(e.plainSize)-1
+
+	e.sealed = e.aead.Seal(e.sealed[:0], chunkNonce(index), plain, chunkAD(index, last))
+	e.chunkIdx = index
+	return nil
+}
+
+func (e *encryptedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += e.pos
+	case io.SeekEnd:
+		offset += e.Size()
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	e.pos = offset
+	return offset, nil
+}
+
+// encryptWriter seals a stream of unknown length as it is written. It holds
+// back a full chunk until more data follows, so Close can mark the last one.
+// Its salt is random, as the same stream is never served in ranges.
+type encryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	buf    []byte
+	index  int64
+	sealed []byte
+}
+
+// newEncryptWriter writes the stream header to w and returns a writer for the plaintext
+func newEncryptWriter(w io.Writer, hexKey string) (*encryptWriter, error) {
+	key, err := parseFileKey(hexKey)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, cipherSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	aead, err := chunkAEAD(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append([]byte(cipherMagic), salt...)); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	e.buf = append(e.buf, p...)
+	for len(e.buf) > cipherChunkSize {
+		if err := e.seal(e.buf[:cipherChunkSize], false); err != nil {
+			return 0, err
+		}
+		e.buf = append(e.buf[:0], e.buf[cipherChunkSize:]...)
+	}
+	return len(p), nil
+}
+
+// Close seals what is left as the last chunk. It does not close the underlying writer.
+func (e *encryptWriter) Close() error {
+	return e.seal(e.buf, true)
+}
+
+func (e *encryptWriter) seal(chunk []byte, last bool) error {
+	e.sealed = e.aead.Seal(e.sealed[:0], chunkNonce(e.index), chunk, chunkAD(e.index, last))
+	e.index++
+	_, err := e.w.Write(e.sealed)
+	return err
+}
+
+// decryptFile decrypts the encrypted stream in src into dst. It fails if any
+// chunk was modified, reordered or removed, leaving dst incomplete.
+func decryptFile(src, dst, hexKey string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open encrypted file: %w", err)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create decrypted file: %w", err)
+	}
+	defer out.Close()
+
+	if err := decryptStream(in, out, hexKey); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+// decryptStream decrypts an encrypted stream from src into dst, chunk by chunk
+func decryptStream(src io.Reader, dst io.Writer, hexKey string) error {
+	key, err := parseFileKey(hexKey)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReaderSize(src, cipherChunkSize+cipherTagSize)
+
+	header := make([]byte, cipherHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(cipherMagic)]) != cipherMagic {
+		return errors.New("not an encrypted file stream")
+	}
+	aead, err := chunkAEAD(key, header[len(cipherMagic):])
+	if err != nil {
+		return err
+	}
+
+	sealed := make([]byte, cipherChunkSize+cipherTagSize)
+	var plain []byte
+	for index := int64(0); ; index++ {
+		n, err := io.ReadFull(r, sealed)
+		if err == io.EOF {
+			return errors.New("encrypted file stream is truncated")
+		}
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("failed to read encrypted stream: %w", err)
+		}
+
+		last := n < len(sealed)
+		if !last {
+			if _, peekErr := r.Peek(1); peekErr == io.EOF {
+				last = true
+			}
+		}
+
+		plain, err = aead.Open(plain[:0], chunkNonce(index), sealed[:n], chunkAD(index, last))
+		if err != nil {
+			return fmt.Errorf("chunk %d failed authentication", index)
+		}
+		if _, err := dst.Write(plain); err != nil {
+			return fmt.Errorf("failed to write decrypted data: %w", err)
+		}
+		if last {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,439 @@
+package files
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cyberchat/server/logging"
+	"cyberchat/server/messages"
+)
+
+// maxManifestEntries bounds the entries of a shared directory
+const maxManifestEntries = 100000
+
+// Manifest entry types
+const (
+	EntryFile = "file"
+	EntryDir  = "dir"
+)
+
+// Manifest lists the contents of a shared directory. Its JSON encoding is
+// hashed and the hash signed into download tokens, and each file carries its
+// own hash, so a receiver can verify any subset of the entries.
+type Manifest struct {
+	Name    string          `json:"name"`
+	Size    int64           `json:"size"` // Total size of the files
+	Entries []ManifestEntry `json:"entries"`
+	Skipped []SkippedEntry  `json:"skipped,omitempty"`
+}
+
+// ManifestEntry is a file or directory in a shared directory
+type ManifestEntry struct {
+	Path   string `json:"path"` // Relative to the shared directory, separated by slashes
+	Type   string `json:"type"` // EntryFile or EntryDir
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// SkippedEntry is something in a shared directory that is not shared
+type SkippedEntry struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"` // symlink, special or unreadable
+}
+
+var errTooManyEntries = fmt.Errorf("directory has more than %d entries", maxManifestEntries)
+
+// buildManifest walks root without following symlinks and returns its
+// manifest along with the JSON encoding the share's hash is taken of. Symlinks
+// and special files such as devices, sockets and pipes are listed as skipped.
+// The walk is in lexical order and leaves out times, so an unchanged directory
+// always gives the same manifest.
+func (h *Handlers) buildManifest(root string) (*Manifest, []byte, error) {
+	manifest := &Manifest{Name: filepath.Base(root), Entries: []ManifestEntry{}}
+
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if p == root {
+			return err
+		}
+		rel, relErr := filepath.Rel(root, p)
+		if relErr != nil {
+			return relErr
+		}
+		rel = filepath.ToSlash(rel)
+
+		if err != nil {
+			manifest.Skipped = append(manifest.Skipped, SkippedEntry{Path: rel, Reason: "unreadable"})
+			if d != nil && d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			manifest.Skipped = append(manifest.Skipped, SkippedEntry{Path: rel, Reason: "symlink"})
+		case d.IsDir():
+			manifest.Entries = append(manifest.Entries, ManifestEntry{Path: rel, Type: EntryDir})
+		case d.Type().IsRegular():
+			info, err := d.Info()
+			if err != nil {
+				manifest.Skipped = append(manifest.Skipped, SkippedEntry{Path: rel, Reason: "unreadable"})
+				return nil
+			}
+			hash, err := h.contentHash(p, info)
+			if err != nil {
+				manifest.Skipped = append(manifest.Skipped, SkippedEntry{Path: rel, Reason: "unreadable"})
+				return nil
+			}
+			manifest.Entries = append(manifest.Entries, ManifestEntry{Path: rel, Type: EntryFile, Size: info.Size(), SHA256: hash})
+			manifest.Size += info.Size()
+		default:
+			manifest.Skipped = append(manifest.Skipped, SkippedEntry{Path: rel, Reason: "special"})
+		}
+
+		if len(manifest.Entries) > maxManifestEntries {
+			return errTooManyEntries
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	return manifest, data, nil
+}
+
+// parseManifest decodes a manifest received from a peer and checks that every
+// entry has a safe relative path, a known type and, for files, a hash
+func parseManifest(data []byte) (*Manifest, error) {
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if len(manifest.Entries) > maxManifestEntries {
+		return nil, errTooManyEntries
+	}
+
+	seen := make(map[string]bool, len(manifest.Entries))
+	for _, entry := range manifest.Entries {
+		if !validEntryPath(entry.Path) {
+			return nil, fmt.Errorf("manifest has unsafe path %q", entry.Path)
+		}
+		if seen[entry.Path] {
+			return nil, fmt.Errorf("manifest lists %q twice", entry.Path)
+		}
+		seen[entry.Path] = true
+
+		switch entry.Type {
+		case EntryDir:
+		case EntryFile:
+			if entry.Size < 0 || len(entry.SHA256) != 64 {
+				return nil, fmt.Errorf("manifest entry %q has no valid size and hash", entry.Path)
+			}
+		default:
+			return nil, fmt.Errorf("manifest entry %q has unknown type %q", entry.Path, entry.Type)
+		}
+	}
+	return &manifest, nil
+}
+
+// validEntryPath reports whether p is a clean relative slash-separated path
+// that stays inside the directory it is relative to
+func validEntryPath(p string) bool {
+	if p == "" || p == "." || path.Clean(p) != p || path.IsAbs(p) {
+		return false
+	}
+	if strings.ContainsAny(p, "\\:\x00") {
+		return false
+	}
+	for _, part := range strings.Split(p, "/") {
+		if part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// selectEntries returns the entries of the manifest named by paths along with
+// everything under the directories among them. No paths selects everything.
+func selectEntries(manifest *Manifest, paths []string) ([]ManifestEntry, error) {
+	if len(paths) == 0 {
+		return manifest.Entries, nil
+	}
+
+	for _, p := range paths {
+		if !validEntryPath(p) {
+			return nil, fmt.Errorf("invalid entry path %q", p)
+		}
+	}
+
+	var selected []ManifestEntry
+	matched := make(map[string]bool, len(paths))
+	for _, entry := range manifest.Entries {
+		for _, p := range paths {
+			if entry.Path == p || strings.HasPrefix(entry.Path, p+"/") {
+				selected = append(selected, entry)
+				matched[p] = true
+				break
+			}
+		}
+	}
+	for _, p := range paths {
+		if !matched[p] {
+			return nil, fmt.Errorf("%q is not in the shared directory", p)
+		}
+	}
+	return selected, nil
+}
+
+// HandleManifest serves the manifest of a shared directory. Like file bodies,
+// it is encrypted with the file key for everyone but this node's own web clients.
+func (h *Handlers) HandleManifest(w http.ResponseWriter, r *http.Request) {
+	setDownloadCORS(w, r)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	file, audience, ok := h.authorize(w, r, r.PathValue("file_id"))
+	if !ok {
+		return
+	}
+	if file.Kind != messages.FileKindDirectory {
+		http.Error(w, "File is not a shared directory", http.StatusBadRequest)
+		return
+	}
+
+	_, data, err := h.buildManifest(file.Filepath)
+	if err != nil {
+		logging.Error("Files", "Failed to read shared directory %s: %v", file.Filepath, err)
+		http.Error(w, "Failed to read directory", http.StatusInternalServerError)
+		return
+	}
+
+	if h.servesPlaintext(r, audience) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	ew, err := newEncryptWriter(w, file.EncKey)
+	if err == nil {
+		if _, err = ew.Write(data); err == nil {
+			err = ew.Close()
+		}
+	}
+	if err != nil {
+		logging.Error("Files", "Failed to send manifest of %s: %v", file.FileID, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// HandleArchive streams a shared directory, or the entries named by the path
+// query parameters, as a tar or zip archive built on the fly. Only what the
+// manifest lists is included. The archive is encrypted with the file key like
+// file bodies, except for this node's own web clients. As it is generated
+// while it is sent, it has no ETag and cannot be fetched in ranges.
+func (h *Handlers) HandleArchive(w http.ResponseWriter, r *http.Request) {
+	setDownloadCORS(w, r)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	fileID := r.PathValue("file_id")
+	file, audience, ok := h.authorize(w, r, fileID)
+	if !ok {
+		return
+	}
+	if file.Kind != messages.FileKindDirectory {
+		http.Error(w, "File is not a shared directory", http.StatusBadRequest)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "tar"
+	}
+	if format != "tar" && format != "zip" {
+		http.Error(w, "Format must be tar or zip", http.StatusBadRequest)
+		return
+	}
+
+	manifest, _, err := h.buildManifest(file.Filepath)
+	if err != nil {
+		logging.Error("Files", "Failed to read shared directory %s: %v", file.Filepath, err)
+		http.Error(w, "Failed to read directory", http.StatusInternalServerError)
+		return
+	}
+	entries, err := selectEntries(manifest, r.URL.Query()["path"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cw := &countingWriter{ResponseWriter: w}
+	var out io.Writer = cw
+	var ew *encryptWriter
+	if h.servesPlaintext(r, audience) {
+		if format == "zip" {
+			w.Header().Set("Content-Type", "application/zip")
+		} else {
+			w.Header().Set("Content-Type", "application/x-tar")
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, file.Filename, format))
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.enc"`, fileID))
+		if ew, err = newEncryptWriter(cw, file.EncKey); err != nil {
+			logging.Error("Files", "Failed to encrypt archive of %s: %v", fileID, err)
+			http.Error(w, "Failed to encrypt archive", http.StatusInternalServerError)
+			return
+		}
+		out = ew
+	}
+
+	start := time.Now()
+	logging.Info("Files", "Sending %d entries of %s to %s as %s", len(entries), fileID, r.RemoteAddr, format)
+
+	err = writeArchive(out, file.Filepath, entries, format)
+	if err == nil && ew != nil {
+		err = ew.Close()
+	}
+	if err != nil {
+		// Cut the response off so the receiver sees a failed transfer; an
+		// encrypted stream without its last chunk would not decrypt anyway
+		logging.Error("Files", "Archive of %s failed after %d bytes: %v", fileID, cw.written, err)
+		panic(http.ErrAbortHandler)
+	}
+	logging.Info("Files", "Sent archive of %s: %d bytes in %s", fileID, cw.written, time.Since(start).Round(time.Millisecond))
+}
+
+// writeArchive writes entries of the directory root to w in the given format.
+// Each entry is checked again as it is added: it must still be what the
+// manifest says, reached without passing through a symlink, and a file must
+// still have its listed size.
+func writeArchive(w io.Writer, root string, entries []ManifestEntry, format string) error {
+	var add func(entry ManifestEntry, info os.FileInfo, f *os.File) error
+	var finish func() error
+
+	switch format {
+	case "zip":
+		zw := zip.NewWriter(w)
+		add = func(entry ManifestEntry, info os.FileInfo, f *os.File) error {
+			header := &zip.FileHeader{Name: entry.Path, Modified: info.ModTime(), Method: zip.Deflate}
+			if entry.Type == EntryDir {
+				header.Name += "/"
+				header.Method = zip.Store
+			}
+			dst, err := zw.CreateHeader(header)
+			if err != nil || f == nil {
+				return err
+			}
+			_, err = io.CopyN(dst, f, entry.Size)
+			return err
+		}
+		finish = zw.Close
+	default:
+		tw := tar.NewWriter(w)
+		add = func(entry ManifestEntry, info os.FileInfo, f *os.File) error {
+			header := &tar.Header{Name: entry.Path, ModTime: info.ModTime(), Typeflag: tar.TypeReg, Mode: 0644, Size: entry.Size}
+			if entry.Type == EntryDir {
+				header = &tar.Header{Name: entry.Path + "/", ModTime: info.ModTime(), Typeflag: tar.TypeDir, Mode: 0755}
+			}
+			if err := tw.WriteHeader(header); err != nil || f == nil {
+				return err
+			}
+			_, err := io.CopyN(tw, f, entry.Size)
+			return err
+		}
+		finish = tw.Close
+	}
+
+	checked := make(map[string]bool)
+	for _, entry := range entries {
+		if err := checkNoSymlinks(root, entry.Path, checked); err != nil {
+			return err
+		}
+		p := filepath.Join(root, filepath.FromSlash(entry.Path))
+		info, err := os.Lstat(p)
+		if err != nil {
+			return fmt.Errorf("entry %s: %w", entry.Path, err)
+		}
+
+		if entry.Type == EntryDir {
+			if !info.IsDir() {
+				return fmt.Errorf("entry %s is no longer a directory", entry.Path)
+			}
+			if err := add(entry, info, nil); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !info.Mode().IsRegular() || info.Size() != entry.Size {
+			return fmt.Errorf("entry %s changed since it was listed", entry.Path)
+		}
+		if err := addFile(p, entry, info, add); err != nil {
+			return err
+		}
+	}
+	return finish()
+}
+
+// addFile opens a listed file, makes sure it is the file that was checked,
+// and adds it to the archive
+func addFile(p string, entry ManifestEntry, info os.FileInfo, add func(ManifestEntry, os.FileInfo, *os.File) error) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return fmt.Errorf("entry %s: %w", entry.Path, err)
+	}
+	defer f.Close()
+
+	opened, err := f.Stat()
+	if err != nil || !os.SameFile(info, opened) {
+		return fmt.Errorf("entry %s changed while it was opened", entry.Path)
+	}
+	if err := add(entry, info, f); err != nil {
+		if errors.Is(err, io.EOF) {
+			return fmt.Errorf("entry %s shrank while it was sent", entry.Path)
+		}
+		return err
+	}
+	return nil
+}
+
+// checkNoSymlinks makes sure none of the directories leading to rel under root
+// has been replaced by a symlink since the manifest was built. Directories
+// already checked are remembered in checked.
+func checkNoSymlinks(root, rel string, checked map[string]bool) error {
+	dir := path.Dir(rel)
+	for dir != "." && !checked[dir] {
+		info, err := os.Lstat(filepath.Join(root, filepath.FromSlash(dir)))
+		if err != nil {
+			return fmt.Errorf("entry %s: %w", rel, err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("entry %s is no longer inside a directory", rel)
+		}
+		checked[dir] = true
+		dir = path.Dir(dir)
+	}
+	return nil
+}
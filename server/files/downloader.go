@@ -0,0 +1,1030 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cyberchat/server/config"
+	"cyberchat/server/db"
+	"cyberchat/server/logging"
+	"cyberchat/server/messages"
+	"cyberchat/server/peers"
+
+	"github.com/google/uuid"
+)
+
+const (
+	downloadAttempts   = 5               // Attempts per download, each resuming where the last stopped
+	downloadRetryDelay = 2 * time.Second // Base delay between attempts, doubled after each failure
+	downloadIdleLimit  = 30 * time.Second
+	downloadProgress   = 500 * time.Millisecond // Minimum interval between progress events
+	maxManifestSize    = 64 << 20               // Largest encrypted manifest accepted from a peer
+
+	// DefaultMaxConcurrentDownloads is how many downloads run at once unless configured
+	DefaultMaxConcurrentDownloads = 3
+	// DefaultAutoAcceptMaxSize is the largest offer downloaded automatically unless configured
+	DefaultAutoAcceptMaxSize = 100 << 20
+)
+
+// Downloader fetches files offered by peers into a directory on this node.
+// Downloads are requested by web clients or accepted automatically from
+// configured peers, wait in a queue and run a few at a time. Their state is
+// kept in the transfers table, and data is written to a partial file next to
+// the destination, so a transfer that is interrupted, even by a restart,
+// continues from what is on disk.
+type Downloader struct {
+	dir       string
+	db        *db.DB
+	peerMgr   *peers.Manager
+	wsManager WebSocketManager
+	client    *http.Client
+	guid      string
+	send      func(*messages.Message) // Sends control messages to peers
+
+	limit         int
+	autoAccept    map[string]bool // Sender GUIDs whose offers are downloaded unasked
+	autoAcceptMax int64           // Largest offer accepted automatically; negative for any
+
+	mu      sync.Mutex
+	queue   []*download
+	running int
+	active  map[string]bool // File IDs queued or being downloaded
+}
+
+// download is a queued or running transfer
+type download struct {
+	transfer   *db.Transfer
+	offer      *messages.FileOffer
+	expected   string // Content hash signed by the sender, if any
+	senderAddr string // Address of the sender's node once known
+}
+
+// TransferEvent reports a node-side download to web clients. It is sent as a
+// file_transfer event with the fields of the events for files served to peers.
+type TransferEvent struct {
+	Direction  string  `json:"direction"` // Always "download"
+	TransferID string  `json:"transfer_id"`
+	FileID     string  `json:"file_id"`
+	Filename   string  `json:"filename"`
+	Size       int64   `json:"size"`
+	ClientIP   string  `json:"client_ip"` // Address of the sender's node
+	SenderGUID string  `json:"sender_guid"`
+	Status     string  `json:"status"` // queued, starting, transferring, completed or failed
+	Progress   int     `json:"progress"`
+	StartTime  int64   `json:"start_time"`
+	BytesRead  int64   `json:"bytes_read"` // Bytes on disk
+	Speed      float64 `json:"speed"`      // bytes per second
+	Duration   float64 `json:"duration,omitempty"`
+	AvgSpeed   float64 `json:"avg_speed,omitempty"`
+	Path       string  `json:"path,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// NewDownloader creates a downloader with the download settings in cfg
+func NewDownloader(cfg *config.Config, database *db.DB, peerMgr *peers.Manager, wsManager WebSocketManager) *Downloader {
+	dir := cfg.DownloadDir
+	if dir == "" {
+		dir = filepath.Join(cfg.DataDir, "downloads")
+	}
+	limit := cfg.MaxConcurrentDownloads
+	if limit <= 0 {
+		limit = DefaultMaxConcurrentDownloads
+	}
+	autoAcceptMax := cfg.AutoAcceptMaxSize
+	if autoAcceptMax == 0 {
+		autoAcceptMax = DefaultAutoAcceptMaxSize
+	}
+	autoAccept := make(map[string]bool)
+	for _, guid := range cfg.AutoAcceptPeers {
+		autoAccept[guid] = true
+	}
+
+	return &Downloader{
+		dir:       dir,
+		db:        database,
+		peerMgr:   peerMgr,
+		wsManager: wsManager,
+		client: &http.Client{
+			Transport: &http.Transport{
+				// Peers use self-signed certificates
+				TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
+				ResponseHeaderTimeout: downloadIdleLimit,
+			},
+		},
+		limit:         limit,
+		autoAccept:    autoAccept,
+		autoAcceptMax: autoAcceptMax,
+		active:        make(map[string]bool),
+	}
+}
+
+// SetSender sets this node's GUID and how it tells peers about the files it
+// serves to other downloaders. Without it, downloaded files are not served.
+// Must be called before the server starts.
+func (d *Downloader) SetSender(guid string, send func(*messages.Message)) {
+	d.guid = guid
+	d.send = send
+}
+
+// Start queues a download of the file offered in msg from its sender's node
+// and returns the new transfer. Progress is reported as file_transfer
+// WebSocket events. Encrypted offers are decrypted with the key they carry
+// once the transfer is complete, and the file is checked against the content
+// hash the sender signed into the offer's token. For a shared directory,
+// paths selects the entries to download; none downloads all of it.
+func (d *Downloader) Start(msg *messages.Message, paths []string) (*db.Transfer, error) {
+	return d.enqueue(msg, paths, false)
+}
+
+// Manifest fetches the manifest of the directory offered in msg from its
+// sender's node and verifies it against the hash signed into the offer
+func (d *Downloader) Manifest(msg *messages.Message) (*Manifest, error) {
+	dl, err := d.prepare(msg, &db.Transfer{SenderGUID: msg.SenderGUID})
+	if err != nil {
+		return nil, err
+	}
+	if dl.offer.Kind != messages.FileKindDirectory {
+		return nil, fmt.Errorf("message %s does not offer a directory", msg.ID)
+	}
+	return d.fetchManifest(dl)
+}
+
+// HandleMessage downloads files offered by auto-accepted peers. It is a
+// message listener; offers that were downloaded before are skipped, so
+// history sync does not fetch them again.
+func (d *Downloader) HandleMessage(msg *messages.Message) {
+	if !d.autoAccept[msg.SenderGUID] || !msg.IsFileOffer() {
+		return
+	}
+	offer, err := messages.ParseFileOffer(msg.Content)
+	if err != nil {
+		return
+	}
+	if d.autoAcceptMax >= 0 && offer.Size > d.autoAcceptMax {
+		logging.Info("Downloader", "Not accepting %s from %s automatically: %d bytes is over the limit", offer.FileID, msg.SenderGUID, offer.Size)
+		return
+	}
+	previous, err := d.db.GetLatestTransfer(offer.FileID)
+	if err != nil {
+		logging.Error("Downloader", "Failed to look up transfers of %s: %v", offer.FileID, err)
+		return
+	}
+	if previous != nil {
+		return
+	}
+
+	if _, err := d.enqueue(msg, nil, true); err != nil {
+		logging.Error("Downloader", "Failed to accept %s from %s: %v", offer.FileID, msg.SenderGUID, err)
+	}
+}
+
+// HandleRevocation handles a peer revoking the share of a file it offered.
+// Queued downloads of the file are dropped, and web clients are told with a
+// file_revoked event. A download already running fails on its next request,
+// which the sender answers with 410 Gone.
+func (d *Downloader) HandleRevocation(msg *messages.Message, sourceIP string) {
+	if !d.peerMgr.VerifySource(msg.SenderGUID, sourceIP) {
+		logging.Error("Downloader", "Rejecting revocation claiming to be from %s sent from %s", msg.SenderGUID, sourceIP)
+		return
+	}
+
+	var notice revocation
+	if err := json.Unmarshal(msg.Content, &notice); err != nil || notice.FileID == "" {
+		logging.Error("Downloader", "Invalid revocation from %s", msg.SenderGUID)
+		return
+	}
+	// Only the sender can revoke its shares
+	notice.SenderGUID = msg.SenderGUID
+	logging.Info("Downloader", "%s revoked the share of %s", msg.SenderGUID, notice.FileID)
+
+	// Copies held by other nodes are only forgotten when the file is one the
+	// revoking peer offered
+	offered, err := d.offeredBy(msg.SenderGUID, notice.FileID)
+	if err != nil {
+		logging.Error("Downloader", "Failed to look up offers of %s: %v", notice.FileID, err)
+	}
+	if offered {
+		if err := d.db.DeleteFileSources(notice.FileID); err != nil {
+			logging.Error("Downloader", "Failed to delete sources of %s: %v", notice.FileID, err)
+		}
+	}
+
+	d.mu.Lock()
+	var dropped []*download
+	queue := d.queue[:0]
+	for _, dl := range d.queue {
+		if dl.offer.FileID == notice.FileID && dl.transfer.SenderGUID == msg.SenderGUID {
+			dropped = append(dropped, dl)
+			delete(d.active, dl.offer.FileID)
+			continue
+		}
+		queue = append(queue, dl)
+	}
+	d.queue = queue
+	d.mu.Unlock()
+
+	for _, dl := range dropped {
+		d.fail(dl, TransferEvent{Size: dl.offer.Size, BytesRead: dl.transfer.Bytes}, errors.New("share was revoked by the sender"))
+	}
+
+	if d.wsManager == nil {
+		return
+	}
+	d.wsManager.Broadcast(struct {
+		Type    string     `json:"type"`
+		Content revocation `json:"content"`
+	}{
+		Type:    "file_revoked",
+		Content: notice,
+	})
+}
+
+// Resume queues the transfers that were queued or running when the node
+// stopped. Partial files are resumed where they ended.
+func (d *Downloader) Resume() {
+	var pending []*db.Transfer
+	for _, status := range []string{db.TransferStatusActive, db.TransferStatusQueued} {
+		transfers, err := d.db.GetTransfers(status)
+		if err != nil {
+			logging.Error("Downloader", "Failed to load %s transfers: %v", status, err)
+			return
+		}
+		pending = append(pending, transfers...)
+	}
+
+	for _, t := range pending {
+		msg, err := d.db.GetMessage(t.MessageID)
+		if err == nil {
+			var dl *download
+			if dl, err = d.prepare(msg, t); err == nil && d.claim(t.FileID) {
+				logging.Info("Downloader", "Resuming transfer %s of %s", t.TransferID, t.FileID)
+				d.push(dl)
+				continue
+			}
+		}
+		if err == nil {
+			err = fmt.Errorf("file %s is already being downloaded", t.FileID)
+		}
+		d.db.UpdateTransfer(t.TransferID, db.TransferStatusFailed, t.Bytes, "", err.Error())
+	}
+}
+
+// Transfers returns the downloads this node has made, optionally filtered by status
+func (d *Downloader) Transfers(status string) ([]*db.Transfer, error) {
+	return d.db.GetTransfers(status)
+}
+
+// enqueue records a transfer for the offer in msg and queues it
+func (d *Downloader) enqueue(msg *messages.Message, paths []string, auto bool) (*db.Transfer, error) {
+	t := &db.Transfer{
+		TransferID:   uuid.New().String(),
+		MessageID:    msg.ID,
+		SenderGUID:   msg.SenderGUID,
+		Status:       db.TransferStatusQueued,
+		Paths:        paths,
+		AutoAccepted: auto,
+	}
+	dl, err := d.prepare(msg, t)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) > 0 && dl.offer.Kind != messages.FileKindDirectory {
+		return nil, fmt.Errorf("entries can only be selected from a shared directory")
+	}
+	for _, p := range paths {
+		if !validEntryPath(p) {
+			return nil, fmt.Errorf("invalid entry path %q", p)
+		}
+	}
+	t.FileID, t.Name, t.Size = dl.offer.FileID, dl.offer.Name, dl.offer.Size
+
+	if !d.claim(t.FileID) {
+		return nil, fmt.Errorf("file %s is already being downloaded", t.FileID)
+	}
+	if err := d.db.SaveTransfer(t); err != nil {
+		d.release(t.FileID)
+		return nil, err
+	}
+	t.CreatedAt = time.Now()
+	t.UpdatedAt = t.CreatedAt
+
+	d.push(dl)
+	return t, nil
+}
+
+// prepare checks the offer in msg and its token
+func (d *Downloader) prepare(msg *messages.Message, t *db.Transfer) (*download, error) {
+	if !msg.IsFileOffer() {
+		return nil, fmt.Errorf("message %s is not a file offer", msg.ID)
+	}
+	offer, err := messages.ParseFileOffer(msg.Content)
+	if err != nil {
+		return nil, err
+	}
+	if offer.Token == "" {
+		return nil, fmt.Errorf("file offer has no download token")
+	}
+	expected, err := d.offeredHash(msg.SenderGUID, offer)
+	if err != nil {
+		return nil, err
+	}
+	if expected == "" && offer.Kind == messages.FileKindDirectory {
+		return nil, fmt.Errorf("directory offer has no manifest hash")
+	}
+	if expected == "" {
+		logging.Info("Downloader", "File %s from %s has no content hash and cannot be verified", offer.FileID, msg.SenderGUID)
+	}
+	return &download{transfer: t, offer: offer, expected: expected}, nil
+}
+
+// claim marks a file as queued, unless it already is
+func (d *Downloader) claim(fileID string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.active[fileID] {
+		return false
+	}
+	d.active[fileID] = true
+	return true
+}
+
+func (d *Downloader) release(fileID string) {
+	d.mu.Lock()
+	delete(d.active, fileID)
+	d.mu.Unlock()
+}
+
+// push adds a claimed download to the queue
+func (d *Downloader) push(dl *download) {
+	d.mu.Lock()
+	d.queue = append(d.queue, dl)
+	d.mu.Unlock()
+
+	d.report(dl, TransferEvent{Status: "queued", Size: dl.offer.Size, BytesRead: dl.transfer.Bytes})
+	d.next()
+}
+
+// next starts queued downloads while fewer than the limit are running
+func (d *Downloader) next() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for d.running < d.limit && len(d.queue) > 0 {
+		dl := d.queue[0]
+		d.queue = d.queue[1:]
+		d.running++
+
+		go func() {
+			d.run(dl)
+
+			d.mu.Lock()
+			d.running--
+			delete(d.active, dl.offer.FileID)
+			d.mu.Unlock()
+			d.next()
+		}()
+	}
+}
+
+// offeredBy reports whether a stored message from senderGUID offers fileID
+func (d *Downloader) offeredBy(senderGUID, fileID string) (bool, error) {
+	candidates, err := d.db.GetFileOfferCandidates(senderGUID, fileID)
+	if err != nil {
+		return false, err
+	}
+	for _, msg := range candidates {
+		if !msg.IsFileOffer() {
+			continue
+		}
+		if offer, err := messages.ParseFileOffer(msg.Content); err == nil && offer.FileID == fileID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// offeredHash returns the content hash in the offer's token after checking
+// that the token was signed by the sender's key
+func (d *Downloader) offeredHash(senderGUID string, offer *messages.FileOffer) (string, error) {
+	pub, err := d.senderKey(senderGUID)
+	if err != nil {
+		return "", err
+	}
+	hash, err := TokenHash(pub, offer.Token, offer.FileID)
+	if err != nil {
+		return "", fmt.Errorf("file offer was not issued by its sender: %w", err)
+	}
+	return hash, nil
+}
+
+// senderKey returns the public key tokens of the sender's offers are signed with
+func (d *Downloader) senderKey(senderGUID string) (*rsa.PublicKey, error) {
+	peer, err := d.db.GetPeer(senderGUID)
+	if err != nil {
+		return nil, err
+	}
+	if peer == nil || len(peer.PublicKey) == 0 {
+		return nil, fmt.Errorf("public key of sender %s is unknown", senderGUID)
+	}
+	block, _ := pem.Decode(peer.PublicKey)
+	if block == nil {
+		return nil, fmt.Errorf("public key of sender %s is invalid", senderGUID)
+	}
+	pub, err := x509.ParsePKCS1PublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("public key of sender %s is invalid: %w", senderGUID, err)
+	}
+	return pub, nil
+}
+
+// source returns the URL of the offered file on its sender's node. The
+// endpoint is appended to the file's path, as in "/manifest" or "/archive".
+func (d *Downloader) source(dl *download, endpoint string, query url.Values) (string, error) {
+	peer, ok := d.peerMgr.GetPeer(dl.transfer.SenderGUID)
+	if !ok {
+		return "", fmt.Errorf("sender %s is not online", dl.transfer.SenderGUID)
+	}
+	dl.senderAddr = peer.IPAddress
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("token", dl.offer.Token)
+	source := url.URL{
+		Scheme:   "https",
+		Host:     fmt.Sprintf("%s:%d", peer.IPAddress, peer.Port),
+		Path:     "/api/v1/file/" + dl.offer.FileID + endpoint,
+		RawQuery: query.Encode(),
+	}
+	return source.String(), nil
+}
+
+// run downloads a file or directory and moves it into place
+func (d *Downloader) run(dl *download) {
+	event := TransferEvent{Size: dl.offer.Size, StartTime: time.Now().Unix()}
+	started := time.Now()
+
+	if err := os.MkdirAll(d.dir, 0755); err != nil {
+		d.fail(dl, event, fmt.Errorf("failed to create download directory: %w", err))
+		return
+	}
+
+	var dest string
+	var err error
+	if dl.offer.Kind == messages.FileKindDirectory {
+		dest, err = d.runDirectory(dl, &event)
+	} else {
+		dest, err = d.runFile(dl, &event)
+	}
+	if err != nil {
+		d.fail(dl, event, err)
+		return
+	}
+
+	logging.Info("Downloader", "Downloaded %s to %s", dl.offer.FileID, dest)
+	d.advertise(dl)
+	event.Status = "completed"
+	event.Path = dest
+	event.Error = ""
+	event.Duration = time.Since(started).Seconds()
+	event.AvgSpeed = float64(event.BytesRead) / event.Duration
+	d.report(dl, event)
+}
+
+// runFile downloads an offered file with retries, verifies its content and
+// moves it into place
+func (d *Downloader) runFile(dl *download, event *TransferEvent) (string, error) {
+	offer, senderGUID, expected := dl.offer, dl.transfer.SenderGUID, dl.expected
+	part := filepath.Join(d.dir, "."+offer.FileID+".part")
+
+	err := d.withRetries(dl, "Download", func() error {
+		if sources := d.swarmSources(dl); sources != nil {
+			os.Remove(part + ".etag")
+			return d.fetchSwarm(dl, sources, part, event)
+		}
+		// A partial file from a swarm download has gaps
+		os.Remove(part + ".chunks")
+		source, err := d.source(dl, "", nil)
+		if err != nil {
+			return err
+		}
+		return d.fetch(dl, source, part, bodySize(offer, offer.Size), event)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	os.Remove(part + ".etag")
+	os.Remove(part + ".chunks")
+
+	// Offers with a key are served encrypted; older nodes send plaintext
+	content := part
+	if offer.Key != "" {
+		content = part + ".plain"
+		if err := decryptFile(part, content, offer.Key); err != nil {
+			os.Remove(content)
+			d.quarantine(offer, senderGUID, part, "decryption_failed", expected, "")
+			return "", fmt.Errorf("failed to decrypt file: %w", err)
+		}
+		os.Remove(part)
+	}
+
+	if expected != "" {
+		actual, err := hashFile(content)
+		if err != nil {
+			os.Remove(content)
+			return "", err
+		}
+		if actual != expected {
+			d.quarantine(offer, senderGUID, content, "hash_mismatch", expected, actual)
+			return "", fmt.Errorf("content hash mismatch")
+		}
+	}
+
+	dest, err := finalPath(d.dir, offer.Name)
+	if err != nil {
+		return "", err
+	}
+	if err := os.Rename(content, dest); err != nil {
+		return "", fmt.Errorf("failed to move download into place: %w", err)
+	}
+	return dest, nil
+}
+
+// runDirectory downloads a shared directory, or the selected entries of it.
+// The manifest is fetched and checked against the signed hash first, then the
+// entries are fetched as one tar archive and extracted next to the
+// destination, verifying each file against its manifest entry. The directory
+// is moved into place only once everything matched.
+func (d *Downloader) runDirectory(dl *download, event *TransferEvent) (string, error) {
+	offer, senderGUID := dl.offer, dl.transfer.SenderGUID
+
+	var manifest *Manifest
+	err := d.withRetries(dl, "Manifest download", func() error {
+		var err error
+		manifest, err = d.fetchManifest(dl)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	entries, err := selectEntries(manifest, dl.transfer.Paths)
+	if err != nil {
+		return "", err
+	}
+
+	// Archives are generated as they are sent, so an interrupted one starts over
+	part := filepath.Join(d.dir, "."+offer.FileID+".part")
+	query := url.Values{"format": {"tar"}, "path": dl.transfer.Paths}
+	limit := bodySize(offer, archiveSizeLimit(entries))
+	err = d.withRetries(dl, "Download", func() error {
+		source, err := d.source(dl, "/archive", query)
+		if err != nil {
+			return err
+		}
+		return d.fetch(dl, source, part, limit, event)
+	})
+	os.Remove(part + ".etag")
+	if err != nil {
+		return "", err
+	}
+
+	content := part
+	if offer.Key != "" {
+		content = part + ".plain"
+		if err := decryptFile(part, content, offer.Key); err != nil {
+			os.Remove(content)
+			d.quarantine(offer, senderGUID, part, "decryption_failed", dl.expected, "")
+			return "", fmt.Errorf("failed to decrypt archive: %w", err)
+		}
+		os.Remove(part)
+	}
+
+	archive, err := os.Open(content)
+	if err != nil {
+		return "", fmt.Errorf("failed to open archive: %w", err)
+	}
+	staging := filepath.Join(d.dir, "."+offer.FileID+".extract")
+	os.RemoveAll(staging)
+	err = extractArchive(archive, staging, entries)
+	archive.Close()
+
+	var mismatch *entryError
+	switch {
+	case errors.As(err, &mismatch):
+		os.Remove(content)
+		d.quarantine(offer, senderGUID, staging, "hash_mismatch", mismatch.Expected, mismatch.Actual)
+		return "", err
+	case err != nil:
+		os.RemoveAll(staging)
+		d.quarantine(offer, senderGUID, content, "invalid_archive", dl.expected, "")
+		return "", err
+	}
+	os.Remove(content)
+
+	dest, err := finalPath(d.dir, offer.Name)
+	if err != nil {
+		os.RemoveAll(staging)
+		return "", err
+	}
+	if err := os.Rename(staging, dest); err != nil {
+		os.RemoveAll(staging)
+		return "", fmt.Errorf("failed to move download into place: %w", err)
+	}
+	return dest, nil
+}
+
+// fetchManifest fetches the manifest of a shared directory, decrypts it and
+// checks it against the hash signed into the offer
+func (d *Downloader) fetchManifest(dl *download) (*Manifest, error) {
+	source, err := d.source(dl, "/manifest", nil)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), downloadIdleLimit)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errNotRetryable, err)
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusGone:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%w: peer returned HTTP %d: %s", errNotRetryable, resp.StatusCode, strings.TrimSpace(string(body)))
+	default:
+		return nil, fmt.Errorf("peer returned HTTP %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if len(data) > maxManifestSize {
+		return nil, fmt.Errorf("%w: manifest is too large", errNotRetryable)
+	}
+	if dl.offer.Key != "" {
+		var plain bytes.Buffer
+		if err := decryptStream(bytes.NewReader(data), &plain, dl.offer.Key); err != nil {
+			return nil, fmt.Errorf("%w: failed to decrypt manifest: %v", errNotRetryable, err)
+		}
+		data = plain.Bytes()
+	}
+
+	sum := sha256.Sum256(data)
+	if actual := hex.EncodeToString(sum[:]); actual != dl.expected {
+		d.quarantine(dl.offer, dl.transfer.SenderGUID, "", "hash_mismatch", dl.expected, actual)
+		return nil, fmt.Errorf("%w: manifest does not match the offer; the directory changed or was tampered with", errNotRetryable)
+	}
+	return parseManifest(data)
+}
+
+// withRetries runs attempt until it succeeds, fails in a way another attempt
+// cannot fix, or runs out of attempts, waiting longer after each failure
+func (d *Downloader) withRetries(dl *download, what string, attempt func() error) error {
+	var err error
+	delay := downloadRetryDelay
+	for i := 1; i <= downloadAttempts; i++ {
+		// The sender may come online between attempts, or change its address
+		if err = attempt(); err == nil {
+			return nil
+		}
+		logging.Error("Downloader", "%s of %s failed (attempt %d/%d): %v", what, dl.offer.FileID, i, downloadAttempts, err)
+		if errors.Is(err, errNotRetryable) || i == downloadAttempts {
+			break
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+	return err
+}
+
+// errNotRetryable marks failures that another attempt cannot fix
+var errNotRetryable = errors.New("not retryable")
+
+// bodySize returns how many bytes the sender of offer serves for size bytes
+// of content, which is more when it is encrypted
+func bodySize(offer *messages.FileOffer, size int64) int64 {
+	if offer.Key != "" {
+		return ciphertextSize(size)
+	}
+	return size
+}
+
+// archiveSizeLimit returns the most a tar archive of entries can take: each
+// entry's content padded to whole blocks, its header, and a PAX header for a
+// long name, followed by the two blocks that end the archive
+func archiveSizeLimit(entries []ManifestEntry) int64 {
+	const block = 512
+	blocks := func(n int64) int64 { return (n + block - 1) / block * block }
+
+	total := int64(2 * block)
+	for _, entry := range entries {
+		total += 2*block + blocks(int64(len(entry.Path))+64) + blocks(entry.Size)
+	}
+	return total
+}
+
+// fetch makes one attempt to complete the partial file at part. A partial file
+// is resumed with a Range request guarded by If-Range on the ETag it was
+// started with, so a file that changed on the sender is fetched from scratch.
+// The body may take at most limit bytes, which a file's must also fill;
+// archives are streamed without a length, so theirs may be shorter.
+func (d *Downloader) fetch(dl *download, source, part string, limit int64, event *TransferEvent) error {
+	exact := dl.offer.Kind != messages.FileKindDirectory
+	var offset int64
+	etag := ""
+	if info, err := os.Stat(part); err == nil {
+		if saved, err := os.ReadFile(part + ".etag"); err == nil && len(saved) > 0 {
+			offset = info.Size()
+			etag = string(saved)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errNotRetryable, err)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", etag)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		start, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok || start != offset {
+			return fmt.Errorf("peer answered with unexpected range %q", resp.Header.Get("Content-Range"))
+		}
+		if total > limit || (exact && total != limit) {
+			return fmt.Errorf("%w: peer serves %d bytes, the offer has %d", errNotRetryable, total, limit)
+		}
+		flags |= os.O_APPEND
+		event.Size = total
+	case http.StatusOK:
+		// A full response: the file changed, or this is the first attempt
+		offset = 0
+		flags |= os.O_TRUNC
+		if resp.ContentLength > limit || (exact && resp.ContentLength >= 0 && resp.ContentLength != limit) {
+			return fmt.Errorf("%w: peer serves %d bytes, the offer has %d", errNotRetryable, resp.ContentLength, limit)
+		}
+		// Archives are streamed without a length
+		event.Size = max(resp.ContentLength, 0)
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The partial file already has everything, or more than the file has now
+		if _, total, ok := parseContentRange(resp.Header.Get("Content-Range")); ok && total == offset && total <= limit {
+			event.BytesRead = offset
+			event.Size = total
+			return nil
+		}
+		os.Remove(part)
+		os.Remove(part + ".etag")
+		return fmt.Errorf("partial download does not match the file, starting over")
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusGone:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%w: peer returned HTTP %d: %s", errNotRetryable, resp.StatusCode, strings.TrimSpace(string(body)))
+	default:
+		return fmt.Errorf("peer returned HTTP %d", resp.StatusCode)
+	}
+
+	if err := os.WriteFile(part+".etag", []byte(resp.Header.Get("ETag")), 0644); err != nil {
+		return fmt.Errorf("failed to save download state: %w", err)
+	}
+	f, err := os.OpenFile(part, flags, 0644)
+	if err != nil {
+		return fmt.Errorf("%w: failed to open partial file: %v", errNotRetryable, err)
+	}
+	defer f.Close()
+
+	event.BytesRead = offset
+	event.Status = "starting"
+	d.report(dl, *event)
+
+	// Abort a transfer that stops making progress; the next attempt resumes it
+	idle := time.AfterFunc(downloadIdleLimit, cancel)
+	defer idle.Stop()
+
+	attemptStart := time.Now()
+	lastUpdate := attemptStart
+	buf := make([]byte, 32*1024)
+	for {
+		n, readErr := resp.Body.Read(buf)
+		if n > 0 {
+			idle.Reset(downloadIdleLimit)
+			// Whatever the peer declared, nothing beyond the offer is written
+			if event.BytesRead+int64(n) > limit {
+				f.Close()
+				os.Remove(part)
+				os.Remove(part + ".etag")
+				return fmt.Errorf("%w: peer sent more than the %d bytes offered", errNotRetryable, limit)
+			}
+			if _, err := f.Write(buf[:n]); err != nil {
+				return fmt.Errorf("%w: failed to write partial file: %v", errNotRetryable, err)
+			}
+			event.BytesRead += int64(n)
+			if time.Since(lastUpdate) >= downloadProgress {
+				event.Status = "transferring"
+				event.Speed = float64(event.BytesRead-offset) / time.Since(attemptStart).Seconds()
+				d.report(dl, *event)
+				lastUpdate = time.Now()
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return fmt.Errorf("transfer interrupted at %d bytes: %w", event.BytesRead, readErr)
+		}
+	}
+
+	if event.Size > 0 && event.BytesRead != event.Size {
+		return fmt.Errorf("transfer ended at %d of %d bytes", event.BytesRead, event.Size)
+	}
+	return nil
+}
+
+// parseContentRange parses "bytes start-end/total" or "bytes */total"
+func parseContentRange(header string) (start, total int64, ok bool) {
+	spec, found := strings.CutPrefix(header, "bytes ")
+	if !found {
+		return 0, 0, false
+	}
+	rangePart, totalPart, found := strings.Cut(spec, "/")
+	if !found {
+		return 0, 0, false
+	}
+	total, err := strconv.ParseInt(totalPart, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	if rangePart == "*" {
+		return 0, total, true
+	}
+	first, _, found := strings.Cut(rangePart, "-")
+	if !found {
+		return 0, 0, false
+	}
+	start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return start, total, true
+}
+
+// finalPath picks a name in dir for a finished download without replacing
+// an existing file: "name.ext", then "name (1).ext" and so on
+func finalPath(dir, name string) (string, error) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 0; i < 1000; i++ {
+		candidate := name
+		if i > 0 {
+			candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
+		}
+		path := filepath.Join(dir, candidate)
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("no free file name for %s in %s", name, dir)
+}
+
+// quarantine moves a download that failed verification out of the way, so it
+// is neither used nor resumed, and alerts web clients. The reason is
+// decryption_failed when the encrypted stream did not authenticate,
+// hash_mismatch when the content differs from the hash the sender signed, or
+// invalid_archive when a directory archive does not match its manifest. With
+// no path there is nothing to move, as for a manifest that failed its check.
+func (d *Downloader) quarantine(offer *messages.FileOffer, senderGUID, path, reason, expected, actual string) {
+	quarantined := ""
+	if path != "" {
+		dir := filepath.Join(d.dir, ".quarantine")
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			logging.Error("Downloader", "Failed to create quarantine directory: %v", err)
+			os.RemoveAll(path)
+		} else {
+			quarantined = filepath.Join(dir, offer.FileID+"-"+offer.Name)
+			os.RemoveAll(quarantined)
+			if err := os.Rename(path, quarantined); err != nil {
+				logging.Error("Downloader", "Failed to quarantine %s: %v", offer.FileID, err)
+				os.RemoveAll(path)
+				quarantined = ""
+			}
+		}
+	}
+
+	logging.Error("Downloader", "File %s from %s failed verification (%s): expected %s, got %s", offer.FileID, senderGUID, reason, expected, actual)
+
+	if d.wsManager == nil {
+		return
+	}
+	d.wsManager.Broadcast(struct {
+		Type    string `json:"type"`
+		Content struct {
+			FileID     string `json:"file_id"`
+			Name       string `json:"name"`
+			SenderGUID string `json:"sender_guid"`
+			Reason     string `json:"reason"`
+			Expected   string `json:"expected_sha256"`
+			Actual     string `json:"actual_sha256,omitempty"`
+			Path       string `json:"quarantine_path,omitempty"`
+		} `json:"content"`
+	}{
+		Type: "file_integrity_failed",
+		Content: struct {
+			FileID     string `json:"file_id"`
+			Name       string `json:"name"`
+			SenderGUID string `json:"sender_guid"`
+			Reason     string `json:"reason"`
+			Expected   string `json:"expected_sha256"`
+			Actual     string `json:"actual_sha256,omitempty"`
+			Path       string `json:"quarantine_path,omitempty"`
+		}{
+			FileID:     offer.FileID,
+			Name:       offer.Name,
+			SenderGUID: senderGUID,
+			Reason:     reason,
+			Expected:   expected,
+			Actual:     actual,
+			Path:       quarantined,
+		},
+	})
+}
+
+func (d *Downloader) fail(dl *download, event TransferEvent, err error) {
+	event.Status = "failed"
+	event.Error = err.Error()
+	d.report(dl, event)
+}
+
+// report records the state of a transfer and sends it to web clients as a
+// file_transfer event
+func (d *Downloader) report(dl *download, event TransferEvent) {
+	event.Direction = "download"
+	event.TransferID = dl.transfer.TransferID
+	event.FileID = dl.offer.FileID
+	event.Filename = dl.offer.Name
+	event.SenderGUID = dl.transfer.SenderGUID
+	event.ClientIP = dl.senderAddr
+	if event.Size > 0 {
+		event.Progress = int(event.BytesRead * 100 / event.Size)
+	}
+
+	status := db.TransferStatusActive
+	switch event.Status {
+	case "queued":
+		status = db.TransferStatusQueued
+	case "completed":
+		status = db.TransferStatusCompleted
+	case "failed":
+		status = db.TransferStatusFailed
+	}
+	if err := d.db.UpdateTransfer(event.TransferID, status, event.BytesRead, event.Path, event.Error); err != nil {
+		logging.Error("Downloader", "Failed to record transfer %s: %v", event.TransferID, err)
+	}
+
+	if d.wsManager == nil {
+		return
+	}
+	d.wsManager.Broadcast(struct {
+		Type    string        `json:"type"`
+		Content TransferEvent `json:"content"`
+	}{
+		Type:    "file_transfer",
+		Content: event,
+	})
+}
@@ -0,0 +1,104 @@
+package files
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// entryError reports an archive entry whose content differs from its manifest entry
+type entryError struct {
+	Path     string
+	Expected string
+	Actual   string
+}
+
+func (e *entryError) Error() string {
+	return fmt.Sprintf("entry %s does not match the manifest: expected %s, got %s", e.Path, e.Expected, e.Actual)
+}
+
+// extractArchive unpacks a tar stream of shared directory entries into dir,
+// which must be new. Only regular files and directories that are among
+// entries are accepted, each once, so nothing in the archive can name a path
+// outside dir or create links. Every file is checked against the size and hash
+// in its entry, and every entry must be in the archive.
+func extractArchive(r io.Reader, dir string, entries []ManifestEntry) error {
+	expected := make(map[string]ManifestEntry, len(entries))
+	for _, entry := range entries {
+		expected[entry.Path] = entry
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("invalid archive: %w", err)
+		}
+
+		name := strings.TrimSuffix(header.Name, "/")
+		entry, ok := expected[name]
+		if !ok {
+			return fmt.Errorf("archive has unexpected entry %q", header.Name)
+		}
+		delete(expected, name)
+		target := filepath.Join(dir, filepath.FromSlash(name))
+
+		switch {
+		case header.Typeflag == tar.TypeDir && entry.Type == EntryDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return fmt.Errorf("failed to create directory %s: %w", name, err)
+			}
+		case header.Typeflag == tar.TypeReg && entry.Type == EntryFile:
+			if header.Size != entry.Size {
+				return fmt.Errorf("archive entry %s has %d bytes, the manifest lists %d", name, header.Size, entry.Size)
+			}
+			if err := extractFile(tr, dir, target, entry); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("archive entry %s is not a %s", name, entry.Type)
+		}
+	}
+
+	for name := range expected {
+		return fmt.Errorf("archive is missing entry %s", name)
+	}
+	return nil
+}
+
+// extractFile writes one file entry to target and verifies its hash. Parent
+// directories missing from a partial selection are created.
+func extractFile(r io.Reader, dir, target string, entry ManifestEntry) error {
+	if parent := path.Dir(entry.Path); parent != "." {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.FromSlash(parent)), 0755); err != nil {
+			return fmt.Errorf("failed to create directory %s: %w", parent, err)
+		}
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", entry.Path, err)
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, hasher), r); err != nil {
+		return fmt.Errorf("failed to extract %s: %w", entry.Path, err)
+	}
+	if actual := hex.EncodeToString(hasher.Sum(nil)); actual != entry.SHA256 {
+		return &entryError{Path: entry.Path, Expected: entry.SHA256, Actual: actual}
+	}
+	return f.Sync()
+}
@@ -1,42 +1,92 @@
 package files
 
 import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
-	"runtime"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"cyberchat/server/clientapi"
+	"cyberchat/server/db"
+	"cyberchat/server/logging"
+	"cyberchat/server/messages"
+
 	"github.com/google/uuid"
 )
 
+// maxUploadFormOverhead is room in an upload request for the form fields and
+// multipart framing around the file
+const maxUploadFormOverhead = 1 << 20
+
 // Handlers contains HTTP handlers for file operations
 type Handlers struct {
 	db        DB
 	guid      string
 	apiKey    string
+	publicKey *rsa.PublicKey // Verifies the download tokens this node issued
 	wsManager WebSocketManager
+
+	hashMu sync.Mutex
+	hashes map[string]hashEntry // Content hashes of shared files by path
+
+	downloader *Downloader
+	roots      *ShareRoots // Where web clients may browse and register files
+	blobs      *BlobStore  // Copies of uploaded files
+	send       func(*messages.Message)
 }
 
 // NewHandlers creates a new Handlers instance
-func NewHandlers(db DB, guid string, apiKey string, wsManager WebSocketManager) *Handlers {
+func NewHandlers(db DB, guid string, apiKey string, publicKey *rsa.PublicKey, wsManager WebSocketManager) *Handlers {
 	return &Handlers{
 		db:        db,
 		guid:      guid,
 		apiKey:    apiKey,
+		publicKey: publicKey,
 		wsManager: wsManager,
+		hashes:    make(map[string]hashEntry),
 	}
 }
 
-// verifyAPIKey checks if the provided API key is valid
-func (h *Handlers) verifyAPIKey(r *http.Request) bool {
-	key := r.Header.Get("X-Client-API-Key")
-	return key != "" && key == h.apiKey
+// SetShareRoots confines browsing, registering and serving files to roots.
+// Without roots, all of them are refused. Must be called before the server starts.
+func (h *Handlers) SetShareRoots(roots *ShareRoots) {
+	h.roots = roots
+}
+
+// SetBlobStore enables uploading files into store. Must be called before the
+// server starts.
+func (h *Handlers) SetBlobStore(store *BlobStore) {
+	h.blobs = store
+}
+
+// SetSender sets how revocations reach the nodes a file was offered to.
+// Must be called before the server starts.
+func (h *Handlers) SetSender(send func(*messages.Message)) {
+	h.send = send
+}
+
+// SetDownloader enables downloads of offered files to this node. Must be
+// called before the server starts.
+func (h *Handlers) SetDownloader(d *Downloader) {
+	h.downloader = d
 }
 
 // readerState holds the state for progress tracking
@@ -50,12 +100,13 @@ type readerState struct {
 	transferID string
 }
 
-// HandleDownload handles file download requests
+// HandleDownload handles file download requests. The downloader must present
+// the download token it received in the encrypted file offer, issued to the
+// file's receiver or, for broadcast files, to any node the offer was sent to.
+// The body is the file encrypted with its key from the offer, except for this
+// node's own web clients on the loopback interface, which get the plaintext.
 func (h *Handlers) HandleDownload(w http.ResponseWriter, r *http.Request) {
-	// Add CORS headers
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "*")
+	setDownloadCORS(w, r)
 
 	// Handle preflight
 	if r.Method == "OPTIONS" {
@@ -63,7 +114,7 @@ func (h *Handlers) HandleDownload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if r.Method != http.MethodGet {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
@@ -76,14 +127,12 @@ func (h *Handlers) HandleDownload(w http.ResponseWriter, r *http.Request) {
 	}
 	fileID := parts[len(parts)-1]
 
-	// Get file record from database
-	file, err := h.db.GetFile(fileID)
-	if err != nil {
-		http.Error(w, "Failed to get file record", http.StatusInternalServerError)
+	file, audience, ok := h.authorize(w, r, fileID)
+	if !ok {
 		return
 	}
-	if file == nil {
-		http.Error(w, "File not found", http.StatusNotFound)
+	if file.Kind == messages.FileKindDirectory {
+		http.Error(w, "File is a shared directory; download its archive", http.StatusBadRequest)
 		return
 	}
 
@@ -104,10 +153,51 @@ func (h *Handlers) HandleDownload(w http.ResponseWriter, r *http.Request) {
 	}
 	defer f.Close()
 
-	// Set response headers
-	w.Header().Set("Content-Type", file.MimeType)
-	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, file.Filename))
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", file.Size))
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, "Failed to open file", http.StatusInternalServerError)
+		return
+	}
+	hash, err := h.contentHash(file.Filepath, info)
+	if err != nil {
+		http.Error(w, "Failed to read file", http.StatusInternalServerError)
+		return
+	}
+
+	// Set response headers. ServeContent adds Content-Length and answers Range,
+	// If-Range and conditional requests against the ETag.
+	var content io.ReadSeeker = f
+	size := info.Size()
+	if h.servesPlaintext(r, audience) {
+		w.Header().Set("Content-Type", file.MimeType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, file.Filename))
+		w.Header().Set("ETag", `"`+hash+`"`)
+	} else {
+		if file.EncKey == "" {
+			http.Error(w, "File has no encryption key", http.StatusInternalServerError)
+			return
+		}
+		encrypted, err := newEncryptedFile(f, info.Size(), file.EncKey, hash)
+		if err != nil {
+			logging.Error("Files", "Failed to encrypt %s: %v", fileID, err)
+			http.Error(w, "Failed to encrypt file", http.StatusInternalServerError)
+			return
+		}
+		content = encrypted
+		size = encrypted.Size()
+
+		// The ciphertext reveals neither the name nor the content hash
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.enc"`, fileID))
+		w.Header().Set("ETag", `"`+encrypted.Salt()+`"`)
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	// HEAD requests only check that the file is there; they are not transfers
+	if r.Method == http.MethodHead {
+		http.ServeContent(w, r, "", info.ModTime(), content)
+		return
+	}
 
 	// Generate transfer ID
 	transferID := uuid.New().String()
@@ -117,15 +207,15 @@ func (h *Handlers) HandleDownload(w http.ResponseWriter, r *http.Request) {
 		wsManager:  h.wsManager,
 		fileID:     fileID,
 		filename:   file.Filename,
-		size:       file.Size,
+		size:       size,
 		clientIP:   clientIP,
 		transferID: transferID,
 	}
 
 	// Create progress reader
 	state.ProgressReader = &ProgressReader{
-		Reader:     f,
-		Size:       file.Size,
+		Reader:     content,
+		Size:       size,
 		Progress:   0,
 		LastUpdate: time.Now(),
 		OnProgress: func(bytesRead, totalSize int64) {
@@ -219,9 +309,11 @@ func (h *Handlers) HandleDownload(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
-	// Stream file to response with progress tracking
-	bytesWritten, err := io.Copy(w, state.ProgressReader)
-	if err != nil {
+	// Stream the file, or the requested ranges of it, with progress tracking
+	cw := &countingWriter{ResponseWriter: w}
+	http.ServeContent(cw, r, "", info.ModTime(), state.ProgressReader)
+	bytesWritten := cw.written
+	if err := cw.err; err != nil {
 		// Notify about failure
 		if h.wsManager != nil {
 			h.wsManager.Broadcast(struct {
@@ -256,7 +348,6 @@ func (h *Handlers) HandleDownload(w http.ResponseWriter, r *http.Request) {
 				},
 			})
 		}
-		http.Error(w, "Failed to stream file", http.StatusInternalServerError)
 		return
 	}
 
@@ -299,6 +390,166 @@ func (h *Handlers) HandleDownload(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// authorize checks the download token of a request for fileID and returns the
+// file with the GUID of the node the token was issued to. It writes the error
+// response when the request is refused.
+func (h *Handlers) authorize(w http.ResponseWriter, r *http.Request, fileID string) (*FileRecord, string, bool) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "Download token required", http.StatusUnauthorized)
+		return nil, "", false
+	}
+	audience, err := VerifyToken(h.publicKey, token, fileID)
+	if err != nil {
+		logging.Info("Files", "Rejected download of %s from %s: %v", fileID, r.RemoteAddr, err)
+		status := http.StatusForbidden
+		if errors.Is(err, ErrTokenMalformed) {
+			status = http.StatusUnauthorized
+		}
+		http.Error(w, err.Error(), status)
+		return nil, "", false
+	}
+
+	// Tokens for this node are for its own web clients, which are on loopback.
+	// Anywhere else such a token has leaked, and would skip the download limit.
+	if audience == h.guid && !isLoopback(r) {
+		logging.Info("Files", "Rejected download of %s from %s with a token for this node", fileID, r.RemoteAddr)
+		http.Error(w, "Download token is not valid for this node", http.StatusForbidden)
+		return nil, "", false
+	}
+
+	// Get file record from database
+	file, err := h.db.GetFile(fileID)
+	if err != nil {
+		http.Error(w, "Failed to get file record", http.StatusInternalServerError)
+		return nil, "", false
+	}
+	if file == nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return nil, "", false
+	}
+	if !h.mayDownload(file, audience) {
+		logging.Info("Files", "Rejected download of %s by %s, which is not its receiver", fileID, audience)
+		http.Error(w, "Download token is not valid for this file", http.StatusForbidden)
+		return nil, "", false
+	}
+	if reason := shareEnded(file); reason != "" {
+		logging.Info("Files", "Refused download of %s by %s: %s", fileID, audience, reason)
+		http.Error(w, reason, http.StatusGone)
+		return nil, "", false
+	}
+
+	if file.Blob != "" {
+		// Stored copies are served from the blob store, wherever it is now
+		if h.blobs == nil {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return nil, "", false
+		}
+		file.Filepath = h.blobs.Path(file.Blob)
+	} else {
+		// The path is checked again in case it was registered before the share
+		// roots changed, or something along it was replaced by a symlink since
+		resolved, err := h.roots.Resolve(file.Filepath)
+		if errors.Is(err, ErrOutsideShareRoots) {
+			logging.Info("Files", "Refused to serve %s: %s is outside the share roots", fileID, file.Filepath)
+			http.Error(w, "File is outside the share roots", http.StatusForbidden)
+			return nil, "", false
+		}
+		if err != nil {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return nil, "", false
+		}
+		file.Filepath = resolved
+	}
+
+	// A share takes new nodes only until as many as allowed have downloaded
+	// it. Nodes that started count once, however often they resume, and this
+	// node's own clients are not counted.
+	if audience != h.guid {
+		allowed, err := h.db.ClaimFileDownload(fileID, audience, file.MaxDownloads)
+		if err != nil {
+			logging.Error("Files", "Failed to count download of %s: %v", fileID, err)
+			http.Error(w, "Failed to check download limit", http.StatusInternalServerError)
+			return nil, "", false
+		}
+		if !allowed {
+			logging.Info("Files", "Refused download of %s by %s: limit of %d reached", fileID, audience, file.MaxDownloads)
+			http.Error(w, "Share has reached its download limit", http.StatusGone)
+			return nil, "", false
+		}
+	}
+	return file, audience, true
+}
+
+// shareEnded returns why a file is no longer shared, or "" if it still is
+func shareEnded(file *FileRecord) string {
+	switch {
+	case file.RevokedAt != nil:
+		return "Share was revoked"
+	case file.ExpiresAt != nil && !time.Now().Before(*file.ExpiresAt):
+		return "Share has expired"
+	}
+	return ""
+}
+
+// servesPlaintext reports whether a request gets file content unencrypted,
+// which only this node's own web clients on the loopback interface do
+func (h *Handlers) servesPlaintext(r *http.Request, audience string) bool {
+	return audience == h.guid && isLoopback(r)
+}
+
+// mayDownload reports whether the node a token was issued to may fetch file.
+// Files without a receiver were offered to the whole broadcast audience.
+func (h *Handlers) mayDownload(file *FileRecord, audience string) bool {
+	return audience == h.guid || file.ReceiverGUID == "" || file.ReceiverGUID == audience
+}
+
+// isLoopback reports whether a request came from this machine
+func isLoopback(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// setDownloadCORS lets a web client read download responses when it is served
+// from the browser's own machine, which is where the receiving node runs.
+// Other origins get no CORS headers.
+func setDownloadCORS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "Origin")
+
+	origin, err := url.Parse(r.Header.Get("Origin"))
+	if err != nil || origin.Host == "" {
+		return
+	}
+	host := origin.Hostname()
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", origin.Scheme+"://"+origin.Host)
+	w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+}
+
+// countingWriter counts the body bytes written to a response and keeps the
+// first write error, which means the downloader went away
+type countingWriter struct {
+	http.ResponseWriter
+	written int64
+	err     error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(p)
+	cw.written += int64(n)
+	if err != nil && cw.err == nil {
+		cw.err = err
+	}
+	return n, err
+}
+
 // ProgressReader wraps an io.Reader to track read progress
 type ProgressReader struct {
 	Reader     io.Reader
@@ -309,6 +560,21 @@ type ProgressReader struct {
 	OnProgress func(int64, int64)
 }
 
+// Seek moves the underlying reader, which must be an io.Seeker. Progress
+// follows the position, so a resumed download reports how much of the whole
+// file the downloader has.
+func (pr *ProgressReader) Seek(offset int64, whence int) (int64, error) {
+	seeker, ok := pr.Reader.(io.Seeker)
+	if !ok {
+		return 0, errors.New("reader does not support seeking")
+	}
+	pos, err := seeker.Seek(offset, whence)
+	if err == nil {
+		pr.Progress = pos
+	}
+	return pos, err
+}
+
 func (pr *ProgressReader) Read(p []byte) (int, error) {
 	if pr.StartTime.IsZero() {
 		pr.StartTime = time.Now()
@@ -324,24 +590,149 @@ func (pr *ProgressReader) Read(p []byte) (int, error) {
 	return n, err
 }
 
-// HandleUpload handles file path registration from the web client
+// HandleFetch downloads the file offered in a stored message to this node.
+// The transfer runs in the background and resumes after interruptions. For a
+// shared directory, paths may select the entries to download.
+func (h *Handlers) HandleFetch(w http.ResponseWriter, r *http.Request) {
+	if !clientapi.VerifyClient(r, h.apiKey) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if h.downloader == nil {
+		http.Error(w, "Downloads are not enabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	var req struct {
+		MessageID string   `json:"message_id"`
+		Paths     []string `json:"paths"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MessageID == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	msg, ok := h.peerOffer(w, req.MessageID)
+	if !ok {
+		return
+	}
+
+	transfer, err := h.downloader.Start(msg, req.Paths)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(transfer)
+}
+
+// HandleClientManifest fetches the manifest of a directory offered in a stored
+// message from the sender's node, so a web client can pick entries to download
+func (h *Handlers) HandleClientManifest(w http.ResponseWriter, r *http.Request) {
+	if !clientapi.VerifyClient(r, h.apiKey) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if h.downloader == nil {
+		http.Error(w, "Downloads are not enabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	msg, ok := h.peerOffer(w, r.PathValue("message_id"))
+	if !ok {
+		return
+	}
+
+	manifest, err := h.downloader.Manifest(msg)
+	if err != nil {
+		logging.Error("Files", "Failed to get manifest for message %s: %v", msg.ID, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(manifest)
+}
+
+// peerOffer looks up a stored message offering a file from another node. It
+// writes the error response when there is none.
+func (h *Handlers) peerOffer(w http.ResponseWriter, messageID string) (*messages.Message, bool) {
+	msg, err := h.db.GetMessage(messageID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, "Failed to get message", http.StatusInternalServerError)
+		return nil, false
+	}
+	if msg.SenderGUID == h.guid {
+		http.Error(w, "File is already on this node", http.StatusBadRequest)
+		return nil, false
+	}
+	return msg, true
+}
+
+// HandleTransfers lists the downloads of this node, oldest first
+func (h *Handlers) HandleTransfers(w http.ResponseWriter, r *http.Request) {
+	if !clientapi.VerifyClient(r, h.apiKey) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if h.downloader == nil {
+		http.Error(w, "Downloads are not enabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	transfers, err := h.downloader.Transfers(r.URL.Query().Get("status"))
+	if err != nil {
+		logging.Error("Files", "Failed to list transfers: %v", err)
+		http.Error(w, "Failed to list transfers", http.StatusInternalServerError)
+		return
+	}
+	if transfers == nil {
+		transfers = []*db.Transfer{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(transfers)
+}
+
+// HandleUpload registers a file from the web client. A file sent in the
+// form's file part is copied into the blob store. Otherwise filepath names a
+// regular file or a directory to share with everything under it, which is
+// served from where it is unless store is "true", which copies a regular
+// file into the blob store.
 func (h *Handlers) HandleUpload(w http.ResponseWriter, r *http.Request) {
 	// Verify API key
-	if !h.verifyAPIKey(r) {
+	if !clientapi.VerifyClient(r, h.apiKey) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	// Parse multipart form
-	if err := r.ParseMultipartForm(100 << 20); err != nil { // 100MB max
-		http.Error(w, "Failed to parse form", http.StatusBadRequest)
-		return
+	// The body is capped at the largest upload plus room for the other fields;
+	// without a file store, nothing can be uploaded
+	limit := int64(maxUploadFormOverhead)
+	if h.blobs != nil {
+		limit += h.blobs.MaxUpload()
+		if h.blobs.MaxUpload() < 0 {
+			limit = -1
+		}
+	}
+	if limit >= 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
 	}
 
-	// Get file path from form
-	filePath := r.FormValue("filepath")
-	if filePath == "" {
-		http.Error(w, "Missing filepath", http.StatusBadRequest)
+	// Parse multipart form; larger uploads are buffered on disk
+	if err := r.ParseMultipartForm(100 << 20); err != nil { // 100MB in memory
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, "File is larger than the upload limit", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
 		return
 	}
 
@@ -352,24 +743,285 @@ func (h *Handlers) HandleUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get receiver GUID (optional for broadcast)
-	receiverGUID := r.FormValue("receiver_guid")
+	expiresAt, maxDownloads, err := parseShareLimits(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	// Verify file exists and get its info
-	fileInfo, err := os.Stat(filePath)
+	// Peers are sent the file encrypted under a key of its own, which travels in the encrypted offer
+	key, err := NewFileKey()
 	if err != nil {
-		http.Error(w, "File not found or inaccessible", http.StatusBadRequest)
+		http.Error(w, "Failed to generate file key", http.StatusInternalServerError)
+		return
+	}
+
+	// Receiver GUID is optional for broadcast
+	file := &FileRecord{
+		FileID:       fileID,
+		SenderGUID:   h.guid,
+		ReceiverGUID: r.FormValue("receiver_guid"),
+		EncKey:       key,
+		Kind:         messages.FileKindFile,
+	}
+
+	part, header, err := r.FormFile("file")
+	switch {
+	case err == nil:
+		defer part.Close()
+		if !h.registerUpload(w, file, part, header) {
+			return
+		}
+	case !errors.Is(err, http.ErrMissingFile):
+		http.Error(w, "Failed to read uploaded file", http.StatusBadRequest)
 		return
+	case r.FormValue("filepath") == "":
+		http.Error(w, "Missing filepath", http.StatusBadRequest)
+		return
+	default:
+		if !h.registerPath(w, file, r.FormValue("filepath"), r.FormValue("store") == "true") {
+			return
+		}
+	}
+
+	if expiresAt != nil || maxDownloads > 0 {
+		if err := h.db.SetFileLimits(fileID, expiresAt, maxDownloads); err != nil {
+			logging.Error("Files", "Failed to set limits of %s: %v", fileID, err)
+			http.Error(w, "Failed to save file record", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Only broadcast files anyone may fetch are swarmed
+	if file.Kind == messages.FileKindFile && file.ReceiverGUID == "" && maxDownloads == 0 {
+		h.addChunkManifest(file)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"file_id":       fileID,
+		"name":          file.Filename,
+		"kind":          file.Kind,
+		"size":          file.Size,
+		"mime":          file.MimeType,
+		"sha256":        file.SHA256,
+		"stored":        file.Blob != "",
+		"expires_at":    expiresAt,
+		"max_downloads": maxDownloads,
+	})
+}
+
+// registerUpload stores an uploaded file in the blob store and saves its
+// record. It writes the error response and returns false if that fails.
+func (h *Handlers) registerUpload(w http.ResponseWriter, file *FileRecord, part multipart.File, header *multipart.FileHeader) bool {
+	// Browsers may send a path, with either separator
+	file.Filename = path.Base(strings.ReplaceAll(header.Filename, "\\", "/"))
+	if file.Filename == "." || file.Filename == "/" {
+		file.Filename = "upload"
+	}
+	file.MimeType = header.Header.Get("Content-Type")
+	if _, _, err := mime.ParseMediaType(file.MimeType); err != nil {
+		file.MimeType = getMimeType(file.Filename)
+	}
+	return h.storeFile(w, file, part)
+}
+
+// registerPath saves the record of a file or directory on this node,
+// copying a regular file into the blob store if store is set. It writes the
+// error response and returns false if that fails.
+func (h *Handlers) registerPath(w http.ResponseWriter, file *FileRecord, filePath string, store bool) bool {
+	// Only files in the share roots may be offered. The path is stored with
+	// its symlinks resolved, so the record keeps naming what was checked.
+	resolved, err := h.roots.Resolve(filePath)
+	if errors.Is(err, ErrOutsideShareRoots) {
+		logging.Info("Files", "Refused to register %s: outside the share roots", filePath)
+		http.Error(w, "Path is outside the share roots", http.StatusForbidden)
+		return false
+	}
+	if err != nil {
+		http.Error(w, "File not found or inaccessible", http.StatusBadRequest)
+		return false
 	}
 
-	// Save file record to database
-	err = h.db.SaveFile(fileID, h.guid, receiverGUID, filepath.Base(filePath), filePath, fileInfo.Size(), "application/octet-stream")
+	// Verify file exists and get its info
+	fileInfo, err := os.Stat(resolved)
 	if err != nil {
+		http.Error(w, "File not found or inaccessible", http.StatusBadRequest)
+		return false
+	}
+	file.Filename, file.Filepath = filepath.Base(resolved), resolved
+	file.Size, file.MimeType = fileInfo.Size(), "application/octet-stream"
+
+	// Hash the content now; the hash goes into the signed download tokens so
+	// receivers can verify what they get. A directory is shared as a whole, and
+	// its hash is that of the manifest listing its entries and their hashes.
+	switch {
+	case fileInfo.IsDir() && store:
+		http.Error(w, "Directories cannot be stored; share them from their path", http.StatusBadRequest)
+		return false
+	case fileInfo.IsDir():
+		manifest, data, err := h.buildManifest(resolved)
+		if err != nil {
+			logging.Error("Files", "Failed to read directory %s: %v", resolved, err)
+			http.Error(w, "Failed to read directory", http.StatusBadRequest)
+			return false
+		}
+		sum := sha256.Sum256(data)
+		file.SHA256 = hex.EncodeToString(sum[:])
+		file.Kind, file.Size, file.MimeType = messages.FileKindDirectory, manifest.Size, "inode/directory"
+	case fileInfo.Mode().IsRegular() && store:
+		f, err := os.Open(resolved)
+		if err != nil {
+			http.Error(w, "Failed to read file", http.StatusBadRequest)
+			return false
+		}
+		defer f.Close()
+		return h.storeFile(w, file, f)
+	case fileInfo.Mode().IsRegular():
+		if file.SHA256, err = h.contentHash(resolved, fileInfo); err != nil {
+			http.Error(w, "Failed to read file", http.StatusBadRequest)
+			return false
+		}
+	default:
+		http.Error(w, "Not a regular file or directory", http.StatusBadRequest)
+		return false
+	}
+
+	if err := h.saveFile(file); err != nil {
 		http.Error(w, "Failed to save file record", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// storeFile copies the content of r into the blob store and saves the record
+// of file, which is served from the stored copy. The content is hashed as it
+// is copied. It writes the error response and returns false if that fails.
+func (h *Handlers) storeFile(w http.ResponseWriter, file *FileRecord, r io.Reader) bool {
+	if h.blobs == nil {
+		http.Error(w, "File store is not available", http.StatusServiceUnavailable)
+		return false
+	}
+	err := h.blobs.Add(r, func(hash string, size int64) error {
+		file.SHA256, file.Size = hash, size
+		file.Blob, file.Filepath = hash, h.blobs.Path(hash)
+		return h.saveFile(file)
+	})
+	if err != nil {
+		logging.Error("Files", "Failed to store %s: %v", file.FileID, err)
+		http.Error(w, "Failed to store file", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+func (h *Handlers) saveFile(file *FileRecord) error {
+	return h.db.SaveFile(file.FileID, file.SenderGUID, file.ReceiverGUID, file.Filename, file.Filepath, file.Size, file.MimeType, file.SHA256, file.EncKey, file.Kind, file.Blob)
+}
+
+// parseShareLimits reads the optional limits of a new share from the form:
+// expires_at as an RFC 3339 time or expires_in_seconds from now, and
+// max_downloads
+func parseShareLimits(r *http.Request) (*time.Time, int, error) {
+	var expiresAt *time.Time
+	if value := r.FormValue("expires_at"); value != "" {
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, 0, errors.New("expires_at must be an RFC 3339 time")
+		}
+		expiresAt = &t
+	} else if value := r.FormValue("expires_in_seconds"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			return nil, 0, errors.New("expires_in_seconds must be a positive number")
+		}
+		t := time.Now().Add(time.Duration(seconds) * time.Second)
+		expiresAt = &t
+	}
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return nil, 0, errors.New("expires_at is in the past")
+	}
+
+	maxDownloads := 0
+	if value := r.FormValue("max_downloads"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, 0, errors.New("max_downloads must be a number that is not negative")
+		}
+		maxDownloads = n
+	}
+	return expiresAt, maxDownloads, nil
+}
+
+// HandleRevoke ends the share of a file registered on this node. Peers that
+// download it afterwards get 410 Gone, and the nodes it was offered to are
+// told, so they can stop waiting for it.
+func (h *Handlers) HandleRevoke(w http.ResponseWriter, r *http.Request) {
+	if !clientapi.VerifyClient(r, h.apiKey) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	fileID := r.PathValue("file_id")
+	if err := h.db.RevokeFile(fileID); errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		logging.Error("Files", "Failed to revoke %s: %v", fileID, err)
+		http.Error(w, "Failed to revoke file", http.StatusInternalServerError)
+		return
+	}
+	file, err := h.db.GetFile(fileID)
+	if err != nil || file == nil {
+		http.Error(w, "Failed to get file record", http.StatusInternalServerError)
+		return
+	}
+	logging.Info("Files", "Revoked share of %s", fileID)
+	if file.Blob != "" {
+		h.collectBlobs()
+	}
+
+	h.notifyRevoked(file)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(file)
+}
+
+// revocation is the content of file_revoke control messages and of the
+// file_revoked events sent to web clients
+type revocation struct {
+	FileID     string    `json:"file_id"`
+	SenderGUID string    `json:"sender_guid"`
+	RevokedAt  time.Time `json:"revoked_at"`
+}
+
+// notifyRevoked tells the file's receiver, or every peer for a broadcast
+// share, and this node's web clients that a share was revoked
+func (h *Handlers) notifyRevoked(file *FileRecord) {
+	notice := revocation{FileID: file.FileID, SenderGUID: h.guid, RevokedAt: *file.RevokedAt}
+
+	if h.send != nil {
+		content, err := json.Marshal(notice)
+		if err != nil {
+			logging.Error("Files", "Failed to marshal revocation: %v", err)
+			return
+		}
+		msg := messages.NewMessage(h.guid, file.ReceiverGUID, messages.TypeFileRevoke, content)
+		if file.ReceiverGUID == "" {
+			msg.Scope = messages.ScopeBroadcast
+		}
+		h.send(msg)
+	}
+
+	if h.wsManager != nil {
+		h.wsManager.Broadcast(struct {
+			Type    string     `json:"type"`
+			Content revocation `json:"content"`
+		}{
+			Type:    "file_revoked",
+			Content: notice,
+		})
+	}
 }
 
 // HandleFilesystem handles filesystem browsing requests
@@ -387,22 +1039,21 @@ func (h *Handlers) HandleFilesystem(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Verify API key
-	if !h.verifyAPIKey(r) {
+	if !clientapi.VerifyClient(r, h.apiKey) {
 		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
 		return
 	}
 
 	// Get query parameters
+	roots := h.roots.List()
 	path := r.URL.Query().Get("path")
 	if path == "" || path == "~" {
-		// Use home directory if available, otherwise fallback to root
-		if home, err := os.UserHomeDir(); err == nil {
-			path = home
-		} else if runtime.GOOS == "windows" {
-			path = "C:"
-		} else {
-			path = "/"
+		// Start at the first share root
+		if len(roots) == 0 {
+			http.Error(w, `{"error": "No share roots are configured"}`, http.StatusForbidden)
+			return
 		}
+		path = roots[0]
 	} else if strings.HasPrefix(path, "~/") {
 		// Expand ~ to home directory
 		if home, err := os.UserHomeDir(); err == nil {
@@ -410,8 +1061,16 @@ func (h *Handlers) HandleFilesystem(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Clean and resolve the path
-	path = filepath.Clean(path)
+	// Resolve the path and keep browsing inside the share roots
+	path, err := h.roots.Resolve(path)
+	if errors.Is(err, ErrOutsideShareRoots) {
+		http.Error(w, `{"error": "Path is outside the share roots"}`, http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": "Failed to read directory: %v"}`, err), http.StatusBadRequest)
+		return
+	}
 
 	// Get other parameters
 	showHidden := r.URL.Query().Get("hidden") == "true"
@@ -430,22 +1089,18 @@ func (h *Handlers) HandleFilesystem(w http.ResponseWriter, r *http.Request) {
 	// Process entries
 	var result struct {
 		CurrentPath string      `json:"current_path"`
-		ParentPath  string      `json:"parent_path"`
+		ParentPath  string      `json:"parent_path,omitempty"` // Empty at a share root
 		IsRoot      bool        `json:"is_root"`
 		Entries     []FileEntry `json:"entries"`
-		Volumes     []string    `json:"volumes,omitempty"` // For Windows drives
+		Roots       []string    `json:"roots"`
 	}
 
 	result.CurrentPath = path
-	result.ParentPath = filepath.Dir(path)
-	result.IsRoot = path == "/" || (runtime.GOOS == "windows" && len(path) <= 3)
-
-	// On Windows, list available drives at root
-	if runtime.GOOS == "windows" && len(path) <= 3 {
-		if drives, err := listWindowsDrives(); err == nil {
-			result.Volumes = drives
-		}
+	result.IsRoot = h.roots.IsRoot(path)
+	if !result.IsRoot {
+		result.ParentPath = filepath.Dir(path)
 	}
+	result.Roots = roots
 
 	// Process entries
 	result.Entries = make([]FileEntry, 0)
@@ -460,6 +1115,13 @@ func (h *Handlers) HandleFilesystem(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
+		// Leave out links that lead outside the share roots
+		if entry.Type()&fs.ModeSymlink != 0 {
+			if _, err := h.roots.Resolve(filepath.Join(path, entry.Name())); err != nil {
+				continue
+			}
+		}
+
 		isDir := entry.IsDir()
 		if fileType != "all" && ((fileType == "file" && isDir) || (fileType == "dir" && !isDir)) {
 			continue
@@ -515,7 +1177,7 @@ func (h *Handlers) HandleTruncate(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Verify API key
-	if !h.verifyAPIKey(r) {
+	if !clientapi.VerifyClient(r, h.apiKey) {
 		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
 		return
 	}
@@ -525,13 +1187,46 @@ func (h *Handlers) HandleTruncate(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf(`{"error": "Failed to truncate files: %v"}`, err), http.StatusInternalServerError)
 		return
 	}
+	h.collectBlobs()
 
 	w.WriteHeader(http.StatusOK)
 }
 
+// collectBlobs frees the stored copies no file record needs anymore
+func (h *Handlers) collectBlobs() {
+	if h.blobs == nil {
+		return
+	}
+	if _, _, err := h.blobs.Collect(); err != nil {
+		logging.Error("Files", "Failed to collect blobs: %v", err)
+	}
+}
+
+// HandleStorage reports the space taken by stored copies of uploaded files
+func (h *Handlers) HandleStorage(w http.ResponseWriter, r *http.Request) {
+	if !clientapi.VerifyClient(r, h.apiKey) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if h.blobs == nil {
+		http.Error(w, "File store is not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	usage, err := h.blobs.Usage()
+	if err != nil {
+		logging.Error("Files", "Failed to get storage usage: %v", err)
+		http.Error(w, "Failed to get storage usage", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
+
 // HandleListFiles returns a list of all shared files
 func (h *Handlers) HandleListFiles(w http.ResponseWriter, r *http.Request) {
-	if !h.verifyAPIKey(r) {
+	if !clientapi.VerifyClient(r, h.apiKey) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
@@ -590,22 +1285,6 @@ func isWritable(path string) bool {
 	return true
 }
 
-// listWindowsDrives returns available Windows drive letters
-func listWindowsDrives() ([]string, error) {
-	if runtime.GOOS != "windows" {
-		return nil, nil
-	}
-
-	var drives []string
-	for _, drive := range "ABCDEFGHIJKLMNOPQRSTUVWXYZ" {
-		path := string(drive) + ":\\"
-		if _, err := os.Stat(path); err == nil {
-			drives = append(drives, path)
-		}
-	}
-	return drives, nil
-}
-
 // getMimeType returns the MIME type for a file based on its extension
 func getMimeType(filename string) string {
 	ext := strings.ToLower(filepath.Ext(filename))
@@ -631,10 +1310,18 @@ func getMimeType(filename string) string {
 
 // DB interface defines required database operations
 type DB interface {
-	SaveFile(fileID, senderGUID, receiverGUID, filename, filepath string, size int64, mimeType string) error
+	SaveFile(fileID, senderGUID, receiverGUID, filename, filepath string, size int64, mimeType, sha256, encKey, kind, blob string) error
 	GetFile(fileID string) (*FileRecord, error)
 	TruncateFiles() error
 	GetFiles() ([]FileRecord, error)
+	GetMessage(messageID string) (*messages.Message, error)
+	SetFileLimits(fileID string, expiresAt *time.Time, maxDownloads int) error
+	SetFileChunks(fileID, chunks string) error
+	RevokeFile(fileID string) error
+	ClaimFileDownload(fileID, audience string, maxDownloads int) (bool, error)
+	SaveBlob(hash string, size int64) error
+	GetBlobs() ([]BlobRecord, error)
+	DeleteBlob(hash string) error
 }
 
 // FileRecord represents a file record from the database
@@ -647,6 +1334,15 @@ type FileRecord struct {
 	Size         int64
 	MimeType     string
 	CreatedAt    string
+	SHA256       string
+	EncKey       string
+	Kind         string
+	ExpiresAt    *time.Time
+	MaxDownloads int
+	Downloads    int
+	RevokedAt    *time.Time
+	Blob         string // Hash of the stored copy; "" for a file served from Filepath
+	Chunks       string // Chunk manifest as JSON; "" if the file is not swarmed
 }
 
 // WebSocketManager interface for broadcasting messages
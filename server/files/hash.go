@@ -0,0 +1,53 @@
+package files
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// hashEntry is a cached content hash, valid while the file keeps its size and modification time
+type hashEntry struct {
+	size    int64
+	modTime time.Time
+	hash    string
+}
+
+// contentHash returns the hex SHA-256 of the file at path. Hashes are cached
+// per path and recomputed when the file changes on disk.
+func (h *Handlers) contentHash(path string, info os.FileInfo) (string, error) {
+	h.hashMu.Lock()
+	entry, ok := h.hashes[path]
+	h.hashMu.Unlock()
+	if ok && entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+		return entry.hash, nil
+	}
+
+	hash, err := hashFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	h.hashMu.Lock()
+	h.hashes[path] = hashEntry{size: info.Size(), modTime: info.ModTime(), hash: hash}
+	h.hashMu.Unlock()
+	return hash, nil
+}
+
+// hashFile returns the hex SHA-256 of a file's content
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %w", err)
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", fmt.Errorf("failed to hash file: %w", err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -0,0 +1,106 @@
+package files
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cyberchat/server/config"
+	"cyberchat/server/logging"
+)
+
+// ErrOutsideShareRoots is returned for paths that are not inside a share root
+var ErrOutsideShareRoots = errors.New("path is outside the share roots")
+
+// ShareRoots are the directories web clients may browse and share files from.
+// Paths are checked after resolving every symlink in them, so a link inside a
+// root cannot lead outside of it.
+type ShareRoots struct {
+	roots []string // Absolute, with symlinks resolved
+}
+
+// NewShareRoots resolves the share roots in cfg. Without configured roots, the
+// directory DataDir/shared is created and used. Roots that cannot be resolved
+// are left out and logged.
+func NewShareRoots(cfg *config.Config) (*ShareRoots, error) {
+	paths := cfg.ShareRoots
+	if len(paths) == 0 {
+		dir := filepath.Join(cfg.DataDir, "shared")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create share directory: %w", err)
+		}
+		paths = []string{dir}
+	}
+
+	s := &ShareRoots{}
+	for _, p := range paths {
+		resolved, err := resolvePath(p)
+		if err == nil {
+			var info os.FileInfo
+			if info, err = os.Stat(resolved); err == nil && !info.IsDir() {
+				err = errors.New("not a directory")
+			}
+		}
+		if err != nil {
+			logging.Error("Files", "Ignoring share root %s: %v", p, err)
+			continue
+		}
+		s.roots = append(s.roots, resolved)
+	}
+	if len(s.roots) == 0 {
+		return nil, errors.New("no usable share roots")
+	}
+	return s, nil
+}
+
+// List returns the share roots
+func (s *ShareRoots) List() []string {
+	if s == nil {
+		return nil
+	}
+	return s.roots
+}
+
+// Resolve returns p as an absolute path with its symlinks resolved. It fails
+// with ErrOutsideShareRoots if that is not inside a share root, and with the
+// error from the filesystem if p does not exist.
+func (s *ShareRoots) Resolve(p string) (string, error) {
+	resolved, err := resolvePath(p)
+	if err != nil {
+		return "", err
+	}
+	if !s.IsRoot(resolved) && !s.contains(resolved) {
+		return "", ErrOutsideShareRoots
+	}
+	return resolved, nil
+}
+
+// IsRoot reports whether the resolved path p is one of the share roots
+func (s *ShareRoots) IsRoot(p string) bool {
+	for _, root := range s.List() {
+		if p == root {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ShareRoots) contains(p string) bool {
+	for _, root := range s.List() {
+		rel, err := filepath.Rel(root, p)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel) {
+			return true
+		}
+	}
+	return false
+}
+
+func resolvePath(p string) (string, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(abs)
+}
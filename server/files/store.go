@@ -0,0 +1,248 @@
+package files
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"cyberchat/server/config"
+	"cyberchat/server/logging"
+)
+
+const (
+	// blobCollectInterval is how often blobs of expired shares are removed
+	blobCollectInterval = time.Hour
+
+	// DefaultMaxUploadSize is the largest upload accepted unless configured
+	DefaultMaxUploadSize = 4 << 30
+)
+
+// BlobStore keeps copies of uploaded files under DataDir/blobs, named by the
+// SHA-256 of their content, so the same content uploaded twice is stored once
+// and a share keeps working when the original is moved or edited. A blob is
+// kept while a file record that can still be downloaded refers to it.
+type BlobStore struct {
+	dir       string
+	db        DB
+	maxUpload int64 // Negative for no limit
+
+	// Held from storing a blob until its file record is saved, and while
+	// collecting, so a blob is never removed before its record exists
+	mu sync.Mutex
+}
+
+// BlobRecord is a stored file body as recorded in the database
+type BlobRecord struct {
+	Hash      string
+	Size      int64
+	CreatedAt time.Time
+}
+
+// StorageUsage reports how much space the blob store takes
+type StorageUsage struct {
+	Dir              string `json:"dir"`
+	Blobs            int    `json:"blobs"`
+	StoredBytes      int64  `json:"stored_bytes"`      // Size of all blobs
+	Files            int    `json:"files"`             // File records whose blob is stored
+	FileBytes        int64  `json:"file_bytes"`        // Their total size, counting duplicates
+	SavedBytes       int64  `json:"saved_bytes"`       // Not stored because the content was already there
+	ReclaimableBytes int64  `json:"reclaimable_bytes"` // Blobs no share needs, removed by the next collection
+}
+
+// NewBlobStore creates the blob directory under cfg.DataDir. Uploads left
+// unfinished when the node stopped are removed.
+func NewBlobStore(cfg *config.Config, db DB) (*BlobStore, error) {
+	s := &BlobStore{dir: filepath.Join(cfg.DataDir, "blobs"), db: db, maxUpload: cfg.MaxUploadSize}
+	if s.maxUpload == 0 {
+		s.maxUpload = DefaultMaxUploadSize
+	}
+	if err := os.RemoveAll(s.tmpDir()); err != nil {
+		return nil, fmt.Errorf("failed to clear unfinished uploads: %w", err)
+	}
+	if err := os.MkdirAll(s.tmpDir(), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create blob directory: %w", err)
+	}
+	return s, nil
+}
+
+func (s *BlobStore) tmpDir() string {
+	return filepath.Join(s.dir, "tmp")
+}
+
+// MaxUpload returns the largest upload accepted, or a negative size if any is
+func (s *BlobStore) MaxUpload() int64 {
+	return s.maxUpload
+}
+
+// Path returns where the blob with the given hash is stored
+func (s *BlobStore) Path(hash string) string {
+	return filepath.Join(s.dir, hash[:2], hash)
+}
+
+// Add stores the content read from r and calls register with its hash and
+// size to save the file record that uses it. Content that is already stored
+// is not written again. If register fails, the blob is left for Collect.
+func (s *BlobStore) Add(r io.Reader, register func(hash string, size int64) error) error {
+	tmp, err := os.CreateTemp(s.tmpDir(), "upload-*")
+	if err != nil {
+		return fmt.Errorf("failed to create upload file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hasher), r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to store upload: %w", err)
+	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The blob is recorded before it is moved into place, so a crash in
+	// between leaves a record that Collect removes rather than an unknown file
+	if err := s.db.SaveBlob(hash, size); err != nil {
+		return err
+	}
+	path := s.Path(hash)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return fmt.Errorf("failed to create blob directory: %w", err)
+		}
+		if err := os.Chmod(tmp.Name(), 0400); err != nil {
+			return fmt.Errorf("failed to store upload: %w", err)
+		}
+		if err := os.Rename(tmp.Name(), path); err != nil {
+			return fmt.Errorf("failed to store upload: %w", err)
+		}
+		logging.Info("Files", "Stored blob %s (%d bytes)", hash, size)
+	} else if err != nil {
+		return fmt.Errorf("failed to check blob: %w", err)
+	} else {
+		logging.Info("Files", "Upload matches stored blob %s", hash)
+	}
+
+	return register(hash, size)
+}
+
+// Collect removes the blobs that no file record needs anymore: those of
+// records that were deleted, revoked or have expired. It returns how many
+// blobs were removed and how many bytes that freed.
+func (s *BlobStore) Collect() (int, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	blobs, _, needed, err := s.load()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	removed, freed := 0, int64(0)
+	for _, blob := range blobs {
+		if needed[blob.Hash] {
+			continue
+		}
+		path := s.Path(blob.Hash)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			logging.Error("Files", "Failed to remove blob %s: %v", blob.Hash, err)
+			continue
+		}
+		// Fails while other blobs share the directory
+		os.Remove(filepath.Dir(path))
+		if err := s.db.DeleteBlob(blob.Hash); err != nil {
+			logging.Error("Files", "Failed to delete blob record %s: %v", blob.Hash, err)
+			continue
+		}
+		removed++
+		freed += blob.Size
+	}
+	if removed > 0 {
+		logging.Info("Files", "Removed %d unused blobs, freeing %d bytes", removed, freed)
+	}
+	return removed, freed, nil
+}
+
+// Usage reports the space taken by stored blobs
+func (s *BlobStore) Usage() (*StorageUsage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	blobs, records, needed, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &StorageUsage{Dir: s.dir, Blobs: len(blobs)}
+	sizes := make(map[string]int64, len(blobs))
+	for _, blob := range blobs {
+		sizes[blob.Hash] = blob.Size
+		usage.StoredBytes += blob.Size
+		if !needed[blob.Hash] {
+			usage.ReclaimableBytes += blob.Size
+		}
+	}
+	referenced := make(map[string]bool)
+	for _, record := range records {
+		if _, stored := sizes[record.Blob]; !stored {
+			continue
+		}
+		usage.Files++
+		usage.FileBytes += record.Size
+		if !referenced[record.Blob] {
+			referenced[record.Blob] = true
+			usage.SavedBytes -= sizes[record.Blob]
+		}
+	}
+	usage.SavedBytes += usage.FileBytes
+	return usage, nil
+}
+
+// Run removes unneeded blobs now and then periodically, so the blobs of
+// shares that expire are freed, until ctx is done
+func (s *BlobStore) Run(ctx context.Context) {
+	ticker := time.NewTicker(blobCollectInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, _, err := s.Collect(); err != nil {
+			logging.Error("Files", "Failed to collect blobs: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// load returns the stored blobs, the file records and the set of blobs
+// those records need
+func (s *BlobStore) load() ([]BlobRecord, []FileRecord, map[string]bool, error) {
+	blobs, err := s.db.GetBlobs()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	records, err := s.db.GetFiles()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	needed := make(map[string]bool)
+	for i := range records {
+		if records[i].Blob != "" && shareEnded(&records[i]) == "" {
+			needed[records[i].Blob] = true
+		}
+	}
+	return blobs, records, needed, nil
+}
@@ -0,0 +1,629 @@
+package files
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"cyberchat/server/db"
+	"cyberchat/server/logging"
+	"cyberchat/server/messages"
+)
+
+// Popular files are swarmed: nodes that downloaded and verified a file
+// broadcast offered with a chunk manifest serve it to the others, which fetch
+// its chunks in parallel from the sender and those nodes. Every node serves
+// the same ciphertext, since it depends only on the file key and the content,
+// so each chunk can be checked against the manifest whichever node sent it.
+const (
+	swarmChunkMinSize     = 1 << 20 // Chunks double from this until at most messages.MaxChunks are needed
+	swarmWorkersPerSource = 2       // Chunks fetched from one source at once
+	swarmMaxWorkers       = 8       // Chunks fetched at once in total
+	swarmSourceFailures   = 3       // Failed requests in a row before a source is dropped
+)
+
+var (
+	// errNotSeeding is returned for files this node does not serve to other downloaders
+	errNotSeeding = errors.New("file is not served from this node")
+	// errSeedEnded is returned for copies of shares that have expired
+	errSeedEnded = errors.New("share has expired")
+	// errBadChunk marks a chunk that does not match the chunk manifest
+	errBadChunk = errors.New("chunk does not match the chunk manifest")
+	// errSourceGone marks a source that refused the download
+	errSourceGone = errors.New("source refused the download")
+)
+
+// buildChunkManifest hashes the encrypted body of the file at path in chunks
+func buildChunkManifest(path, hexKey, contentHash string) (*messages.ChunkManifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	encrypted, err := newEncryptedFile(f, info.Size(), hexKey, contentHash)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &messages.ChunkManifest{Size: swarmChunkMinSize, Length: encrypted.Size()}
+	for (manifest.Length+manifest.Size-1)/manifest.Size > messages.MaxChunks {
+		manifest.Size *= 2
+	}
+	for {
+		hasher := sha256.New()
+		n, err := io.CopyN(hasher, encrypted, manifest.Size)
+		if n > 0 {
+			manifest.SHA256 = append(manifest.SHA256, hex.EncodeToString(hasher.Sum(nil)))
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash chunks: %w", err)
+		}
+	}
+	return manifest, nil
+}
+
+// addChunkManifest stores the chunk manifest of a newly registered file, so
+// broadcast offers of it can be swarmed. Without one, the file is only
+// downloaded from this node.
+func (h *Handlers) addChunkManifest(file *FileRecord) {
+	manifest, err := buildChunkManifest(file.Filepath, file.EncKey, file.SHA256)
+	if err == nil {
+		var data []byte
+		if data, err = json.Marshal(manifest); err == nil {
+			err = h.db.SetFileChunks(file.FileID, string(data))
+		}
+	}
+	if err != nil {
+		logging.Error("Files", "Failed to build chunk manifest of %s: %v", file.FileID, err)
+	}
+}
+
+// HandleSeed serves a file this node downloaded to other nodes downloading
+// it, encrypted exactly as its sender serves it. The token must be one the
+// file's sender issued. Only ranges are useful to downloaders, but whole
+// responses are served as well.
+func (h *Handlers) HandleSeed(w http.ResponseWriter, r *http.Request) {
+	if h.downloader == nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	fileID := r.PathValue("file_id")
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "Download token required", http.StatusUnauthorized)
+		return
+	}
+
+	seed, err := h.downloader.seed(fileID, token)
+	switch {
+	case err == nil:
+	case errors.Is(err, errNotSeeding):
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	case errors.Is(err, errSeedEnded):
+		http.Error(w, "Share has expired", http.StatusGone)
+		return
+	case errors.Is(err, ErrTokenMalformed):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	case errors.Is(err, ErrTokenSignature), errors.Is(err, ErrTokenExpired), errors.Is(err, ErrTokenFile), errors.Is(err, ErrTokenScope):
+		logging.Info("Files", "Rejected seed request for %s from %s: %v", fileID, r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	default:
+		logging.Error("Files", "Failed to look up seed of %s: %v", fileID, err)
+		http.Error(w, "Failed to look up file", http.StatusInternalServerError)
+		return
+	}
+
+	f, err := os.Open(seed.path)
+	if err != nil {
+		h.downloader.withdraw(fileID, "the downloaded copy is gone")
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	// The copy may have been edited since it was downloaded, and would no
+	// longer match the chunk manifest
+	hash, err := h.contentHash(seed.path, info)
+	if err != nil || hash != seed.hash {
+		h.downloader.withdraw(fileID, "the downloaded copy changed")
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	encrypted, err := newEncryptedFile(f, info.Size(), seed.key, seed.hash)
+	if err != nil {
+		logging.Error("Files", "Failed to encrypt seed of %s: %v", fileID, err)
+		http.Error(w, "Failed to encrypt file", http.StatusInternalServerError)
+		return
+	}
+	logging.Debug("Files", "Seeding %s to %s (%s)", fileID, r.RemoteAddr, r.Header.Get("Range"))
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", `"`+encrypted.Salt()+`"`)
+	w.Header().Set("Accept-Ranges", "bytes")
+	http.ServeContent(w, r, "", info.ModTime(), encrypted)
+}
+
+// seed is a downloaded file this node serves to other downloaders
+type seed struct {
+	path string
+	key  string
+	hash string
+}
+
+// seed returns the copy of fileID this node serves, after checking that
+// token was issued for it by the file's sender
+func (d *Downloader) seed(fileID, token string) (*seed, error) {
+	if d.guid == "" {
+		return nil, errNotSeeding
+	}
+	guids, err := d.db.GetFileSources(fileID)
+	if err != nil {
+		return nil, err
+	}
+	seeding := false
+	for _, guid := range guids {
+		seeding = seeding || guid == d.guid
+	}
+	if !seeding {
+		return nil, errNotSeeding
+	}
+
+	t, err := d.db.GetLatestTransfer(fileID)
+	if err != nil {
+		return nil, err
+	}
+	if t == nil || t.Status != db.TransferStatusCompleted || t.Path == "" {
+		return nil, errNotSeeding
+	}
+	msg, err := d.db.GetMessage(t.MessageID)
+	if err != nil {
+		return nil, errNotSeeding
+	}
+	offer, err := messages.ParseFileOffer(msg.Content)
+	if err != nil || offer.Chunks == nil {
+		return nil, errNotSeeding
+	}
+	if offer.ExpiresAt != nil && !time.Now().Before(*offer.ExpiresAt) {
+		return nil, errSeedEnded
+	}
+
+	pub, err := d.senderKey(t.SenderGUID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := VerifySeedToken(pub, token, fileID); err != nil {
+		return nil, err
+	}
+	hash, err := TokenHash(pub, offer.Token, fileID)
+	if err != nil || hash == "" {
+		return nil, errNotSeeding
+	}
+	return &seed{path: t.Path, key: offer.Key, hash: hash}, nil
+}
+
+// sourceSignal is the content of file_source control messages
+type sourceSignal struct {
+	FileID string `json:"file_id"`
+}
+
+// advertise tells the peers that this node has a verified copy of a file
+// offered with a chunk manifest and serves it to other downloaders
+func (d *Downloader) advertise(dl *download) {
+	if d.send == nil || dl.offer.Chunks == nil || dl.expected == "" {
+		return
+	}
+	if err := d.db.AddFileSource(dl.offer.FileID, d.guid); err != nil {
+		logging.Error("Downloader", "Failed to record seed of %s: %v", dl.offer.FileID, err)
+		return
+	}
+
+	content, err := json.Marshal(sourceSignal{FileID: dl.offer.FileID})
+	if err != nil {
+		logging.Error("Downloader", "Failed to marshal source signal: %v", err)
+		return
+	}
+	msg := messages.NewMessage(d.guid, "", messages.TypeFileSource, content)
+	msg.Scope = messages.ScopeBroadcast
+	d.send(msg)
+	logging.Info("Downloader", "Serving %s to other downloaders", dl.offer.FileID)
+}
+
+// withdraw stops serving this node's copy of a file
+func (d *Downloader) withdraw(fileID, reason string) {
+	logging.Info("Downloader", "No longer serving %s: %s", fileID, reason)
+	if err := d.db.RemoveFileSource(fileID, d.guid); err != nil {
+		logging.Error("Downloader", "Failed to remove seed of %s: %v", fileID, err)
+	}
+}
+
+// HandleSource records a peer that advertises a verified copy of a file.
+// Nothing it sends is trusted: its chunks are checked like any other.
+func (d *Downloader) HandleSource(msg *messages.Message, sourceIP string) {
+	if !d.peerMgr.VerifySource(msg.SenderGUID, sourceIP) {
+		logging.Error("Downloader", "Rejecting file source claiming to be from %s sent from %s", msg.SenderGUID, sourceIP)
+		return
+	}
+
+	var signal sourceSignal
+	if err := json.Unmarshal(msg.Content, &signal); err != nil || signal.FileID == "" {
+		logging.Error("Downloader", "Invalid file source from %s", msg.SenderGUID)
+		return
+	}
+	if err := d.db.AddFileSource(signal.FileID, msg.SenderGUID); err != nil {
+		logging.Error("Downloader", "Failed to record source of %s: %v", signal.FileID, err)
+		return
+	}
+	logging.Info("Downloader", "%s serves a copy of %s", msg.SenderGUID, signal.FileID)
+}
+
+// swarmSource is a node a swarm download fetches chunks from
+type swarmSource struct {
+	guid     string
+	url      string
+	sender   bool
+	failures int  // Failed requests in a row
+	dropped  bool // No more chunks are fetched from it in this attempt
+}
+
+// swarmSources returns the nodes to fetch an offered file from: its sender
+// and the nodes that advertised a copy, as far as they are online. It returns
+// nil when the offer has no chunk manifest or seed token, or no other node is
+// there to help, and the file is downloaded from its sender alone.
+func (d *Downloader) swarmSources(dl *download) []*swarmSource {
+	if dl.offer.Chunks == nil || dl.offer.SeedToken == "" {
+		return nil
+	}
+	guids, err := d.db.GetFileSources(dl.offer.FileID)
+	if err != nil {
+		logging.Error("Downloader", "Failed to look up sources of %s: %v", dl.offer.FileID, err)
+		return nil
+	}
+
+	var sources []*swarmSource
+	for _, guid := range guids {
+		if guid == d.guid || guid == dl.transfer.SenderGUID {
+			continue
+		}
+		peer, ok := d.peerMgr.GetPeer(guid)
+		if !ok {
+			continue
+		}
+		source := url.URL{
+			Scheme:   "https",
+			Host:     fmt.Sprintf("%s:%d", peer.IPAddress, peer.Port),
+			Path:     "/api/v1/seed/" + dl.offer.FileID,
+			RawQuery: url.Values{"token": {dl.offer.SeedToken}}.Encode(),
+		}
+		sources = append(sources, &swarmSource{guid: guid, url: source.String()})
+	}
+	if len(sources) == 0 {
+		return nil
+	}
+	if source, err := d.source(dl, "", nil); err == nil {
+		sources = append([]*swarmSource{{guid: dl.transfer.SenderGUID, url: source, sender: true}}, sources...)
+	}
+	return sources
+}
+
+// swarm is one attempt at fetching a file from several sources
+type swarm struct {
+	d     *Downloader
+	dl    *download
+	f     *os.File
+	state string // File listing the chunks that are in
+	event *TransferEvent
+
+	pending  chan int      // Chunks to fetch
+	finished chan struct{} // Closed when every chunk is in, or the attempt is aborted
+	finish   sync.Once
+
+	mu         sync.Mutex
+	done       []bool
+	remaining  int
+	err        error // Why the attempt was aborted
+	lastErr    error // Last failure of any source
+	started    time.Time
+	offset     int64 // Bytes that were in before this attempt
+	lastUpdate time.Time
+}
+
+// fetchSwarm makes one attempt to complete the partial file at part by
+// fetching its chunks in parallel from sources. Each chunk is checked against
+// the chunk manifest before it counts. A source that sends a bad chunk is
+// dropped and forgotten, and one that keeps failing is dropped for this
+// attempt. The chunks that are in are listed next to the partial file, so the
+// next attempt, even after a restart, only fetches the rest.
+func (d *Downloader) fetchSwarm(dl *download, sources []*swarmSource, part string, event *TransferEvent) error {
+	chunks := dl.offer.Chunks
+	f, err := os.OpenFile(part, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("%w: failed to open partial file: %v", errNotRetryable, err)
+	}
+	defer f.Close()
+	if err := f.Truncate(chunks.Length); err != nil {
+		return fmt.Errorf("%w: failed to size partial file: %v", errNotRetryable, err)
+	}
+
+	s := &swarm{
+		d:        d,
+		dl:       dl,
+		f:        f,
+		state:    part + ".chunks",
+		event:    event,
+		pending:  make(chan int, len(chunks.SHA256)),
+		finished: make(chan struct{}),
+		done:     loadChunkState(part+".chunks", len(chunks.SHA256)),
+		started:  time.Now(),
+	}
+	event.Size, event.BytesRead = chunks.Length, 0
+	for i, done := range s.done {
+		if done {
+			event.BytesRead += chunkLength(chunks, i)
+		} else {
+			s.remaining++
+			s.pending <- i
+		}
+	}
+	if s.remaining == 0 {
+		return nil
+	}
+	s.offset = event.BytesRead
+	event.Status = "starting"
+	d.report(dl, *event)
+	logging.Info("Downloader", "Fetching %d of %d chunks of %s from %d sources", s.remaining, len(s.done), dl.offer.FileID, len(sources))
+
+	var wg sync.WaitGroup
+	workers := 0
+	for n := 0; n < swarmWorkersPerSource; n++ {
+		for _, source := range sources {
+			if workers == swarmMaxWorkers {
+				break
+			}
+			workers++
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.work(source)
+			}()
+		}
+	}
+	wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.remaining == 0:
+		return nil
+	case s.err != nil:
+		return s.err
+	default:
+		return fmt.Errorf("%d of %d chunks could not be fetched from any source: %v", s.remaining, len(s.done), s.lastErr)
+	}
+}
+
+// work fetches chunks from one source until every chunk is in, the attempt
+// is aborted or the source is dropped
+func (s *swarm) work(source *swarmSource) {
+	for {
+		var i int
+		select {
+		case <-s.finished:
+			return
+		case i = <-s.pending:
+		}
+		if s.stopped(source) {
+			s.pending <- i
+			return
+		}
+
+		err := s.d.fetchChunk(s.dl, source.url, s.f, i)
+		if err == nil {
+			s.complete(source, i)
+			continue
+		}
+		s.pending <- i
+		if !s.fail(source, i, err) {
+			return
+		}
+	}
+}
+
+// stopped reports whether source should take no more chunks
+func (s *swarm) stopped(source *swarmSource) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return source.dropped || s.err != nil || s.remaining == 0
+}
+
+// end closes finished. The last chunk and an abort may race to end the attempt.
+func (s *swarm) end() {
+	s.finish.Do(func() { close(s.finished) })
+}
+
+// complete records that chunk i is in
+func (s *swarm) complete(source *swarmSource, i int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	source.failures = 0
+	s.done[i] = true
+	s.remaining--
+	saveChunkState(s.state, s.done)
+
+	s.event.BytesRead += chunkLength(s.dl.offer.Chunks, i)
+	if s.remaining == 0 {
+		s.end()
+		return
+	}
+	if time.Since(s.lastUpdate) >= downloadProgress {
+		s.event.Status = "transferring"
+		s.event.Speed = float64(s.event.BytesRead-s.offset) / time.Since(s.started).Seconds()
+		s.d.report(s.dl, *s.event)
+		s.lastUpdate = time.Now()
+	}
+}
+
+// fail records a failed request for chunk i and reports whether the source
+// is still used. A refusal from the sender ends the download.
+func (s *swarm) fail(source *swarmSource, i int, err error) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fileID := s.dl.offer.FileID
+	logging.Error("Downloader", "Chunk %d of %s from %s failed: %v", i, fileID, source.guid, err)
+	s.lastErr = err
+	if source.dropped {
+		return false
+	}
+	source.failures++
+
+	switch {
+	case errors.Is(err, errSourceGone) && source.sender:
+		// The share was revoked, has expired or is otherwise refused. It no
+		// longer matters once every chunk is in.
+		if s.err == nil && s.remaining > 0 {
+			s.err = fmt.Errorf("%w: %v", errNotRetryable, err)
+			s.end()
+		}
+	case errors.Is(err, errBadChunk), errors.Is(err, errSourceGone):
+		// A node that sends bad chunks, or no longer has the file, is forgotten
+		if !source.sender {
+			if err := s.d.db.RemoveFileSource(fileID, source.guid); err != nil {
+				logging.Error("Downloader", "Failed to remove source of %s: %v", fileID, err)
+			}
+		}
+	case source.failures < swarmSourceFailures:
+		return true
+	}
+	source.dropped = true
+	return false
+}
+
+// fetchChunk fetches chunk i of an encrypted file from source into f and
+// checks it against the chunk manifest
+func (d *Downloader) fetchChunk(dl *download, source string, f *os.File, i int) error {
+	chunks := dl.offer.Chunks
+	start, length := int64(i)*chunks.Size, chunkLength(chunks, i)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errSourceGone, err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+length-1))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		if rangeStart, total, ok := parseContentRange(resp.Header.Get("Content-Range")); !ok || rangeStart != start || total != chunks.Length {
+			return fmt.Errorf("%w: source answered with range %q", errBadChunk, resp.Header.Get("Content-Range"))
+		}
+	case http.StatusOK, http.StatusRequestedRangeNotSatisfiable:
+		// The source's copy is not the length of the manifest's
+		return fmt.Errorf("%w: source answered HTTP %d to a range request", errBadChunk, resp.StatusCode)
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusGone:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%w: HTTP %d: %s", errSourceGone, resp.StatusCode, strings.TrimSpace(string(body)))
+	default:
+		return fmt.Errorf("source returned HTTP %d", resp.StatusCode)
+	}
+
+	// Abort a chunk that stops making progress
+	idle := time.AfterFunc(downloadIdleLimit, cancel)
+	defer idle.Stop()
+
+	hasher := sha256.New()
+	w := io.NewOffsetWriter(f, start)
+	body := io.LimitReader(resp.Body, length)
+	buf := make([]byte, 32*1024)
+	var n int64
+	for {
+		read, readErr := body.Read(buf)
+		if read > 0 {
+			idle.Reset(downloadIdleLimit)
+			if _, err := w.Write(buf[:read]); err != nil {
+				return fmt.Errorf("failed to write partial file: %w", err)
+			}
+			hasher.Write(buf[:read])
+			n += int64(read)
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return fmt.Errorf("chunk interrupted at %d of %d bytes: %w", n, length, readErr)
+		}
+	}
+	if n != length {
+		return fmt.Errorf("chunk ended at %d of %d bytes", n, length)
+	}
+	if actual := hex.EncodeToString(hasher.Sum(nil)); actual != chunks.SHA256[i] {
+		return fmt.Errorf("%w: chunk %d has hash %s", errBadChunk, i, actual)
+	}
+	return nil
+}
+
+// chunkLength returns the length of chunk i; the last one may be shorter
+func chunkLength(chunks *messages.ChunkManifest, i int) int64 {
+	return min(chunks.Size, chunks.Length-int64(i)*chunks.Size)
+}
+
+// loadChunkState reads which of count chunks a partial file has. A missing
+// or unreadable list means none.
+func loadChunkState(path string, count int) []bool {
+	done := make([]bool, count)
+	data, err := os.ReadFile(path)
+	if err != nil || len(data) != count {
+		return done
+	}
+	for i, c := range data {
+		done[i] = c == '1'
+	}
+	return done
+}
+
+// saveChunkState writes which chunks a partial file has, one digit each
+func saveChunkState(path string, done []bool) {
+	data := make([]byte, len(done))
+	for i, d := range done {
+		data[i] = '0'
+		if d {
+			data[i] = '1'
+		}
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		logging.Error("Downloader", "Failed to save chunk list %s: %v", path, err)
+	}
+}
@@ -0,0 +1,139 @@
+package files
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DownloadTokenTTL is how long a download token stays valid after it is issued
+const DownloadTokenTTL = 24 * time.Hour
+
+// Errors returned by VerifyToken and VerifySeedToken
+var (
+	ErrTokenMalformed = errors.New("malformed download token")
+	ErrTokenSignature = errors.New("download token signature is invalid")
+	ErrTokenExpired   = errors.New("download token has expired")
+	ErrTokenFile      = errors.New("download token is for another file")
+	ErrTokenScope     = errors.New("download token is not valid here")
+)
+
+// scopeSeed marks tokens that nodes serving copies of a swarmed file accept.
+// The file's sender does not, so a copy's node cannot download as the
+// receiver it was shown the token by.
+const scopeSeed = "seed"
+
+// tokenClaims is the signed payload of a download token
+type tokenClaims struct {
+	FileID   string `json:"file_id"`
+	Audience string `json:"aud"`              // GUID of the node the token was issued to
+	Expires  int64  `json:"exp"`              // Unix seconds
+	SHA256   string `json:"sha256,omitempty"` // Hex content hash taken when the file was registered
+	Scope    string `json:"scope,omitempty"`  // Empty for downloads from the sender
+}
+
+// IssueToken creates a download token for fileID that is valid for ttl. The
+// token is signed with the serving node's key, names the node it is for and
+// carries the file's content hash, if known, for the receiver to verify.
+// It is a bearer credential, so it must only travel inside encrypted messages.
+func IssueToken(key *rsa.PrivateKey, fileID, audience, sha256Hex string, ttl time.Duration) (string, error) {
+	return issueToken(key, tokenClaims{FileID: fileID, Audience: audience, SHA256: sha256Hex}, ttl)
+}
+
+// IssueSeedToken creates a token for fileID that lets audience fetch chunks
+// from other nodes serving copies of the file. The sender's node refuses it.
+func IssueSeedToken(key *rsa.PrivateKey, fileID, audience string, ttl time.Duration) (string, error) {
+	return issueToken(key, tokenClaims{FileID: fileID, Audience: audience, Scope: scopeSeed}, ttl)
+}
+
+// issueToken signs claims, which expire after ttl
+func issueToken(key *rsa.PrivateKey, claims tokenClaims, ttl time.Duration) (string, error) {
+	claims.Expires = time.Now().Add(ttl).Unix()
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal token claims: %w", err)
+	}
+
+	digest := sha256.Sum256(payload)
+	signature, err := rsa.SignPSS(rand.Reader, key, crypto.SHA256, digest[:], nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign download token: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// VerifyToken checks a download token for fileID against the serving node's
+// public key and returns the GUID of the node it was issued to. Seed tokens
+// are refused.
+func VerifyToken(pub *rsa.PublicKey, token, fileID string) (string, error) {
+	return verifyToken(pub, token, fileID, "")
+}
+
+// VerifySeedToken checks a seed token for fileID against the public key of
+// the file's sender and returns the GUID of the node it was issued to
+func VerifySeedToken(pub *rsa.PublicKey, token, fileID string) (string, error) {
+	return verifyToken(pub, token, fileID, scopeSeed)
+}
+
+func verifyToken(pub *rsa.PublicKey, token, fileID, scope string) (string, error) {
+	claims, err := readToken(pub, token, fileID)
+	if err != nil {
+		return "", err
+	}
+	if claims.Scope != scope {
+		return "", ErrTokenScope
+	}
+	if time.Now().Unix() > claims.Expires {
+		return "", ErrTokenExpired
+	}
+	return claims.Audience, nil
+}
+
+// TokenHash checks the signature of a download token for fileID with the
+// sending node's public key and returns the content hash it vouches for.
+// It is empty for files offered by nodes that did not hash them.
+func TokenHash(pub *rsa.PublicKey, token, fileID string) (string, error) {
+	claims, err := readToken(pub, token, fileID)
+	if err != nil {
+		return "", err
+	}
+	return claims.SHA256, nil
+}
+
+// readToken verifies the signature of a token and decodes its claims
+func readToken(pub *rsa.PublicKey, token, fileID string) (*tokenClaims, error) {
+	encodedPayload, encodedSignature, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrTokenMalformed
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return nil, ErrTokenMalformed
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return nil, ErrTokenMalformed
+	}
+
+	digest := sha256.Sum256(payload)
+	if err := rsa.VerifyPSS(pub, crypto.SHA256, digest[:], signature, nil); err != nil {
+		return nil, ErrTokenSignature
+	}
+
+	var claims tokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrTokenMalformed
+	}
+	if claims.FileID != fileID {
+		return nil, ErrTokenFile
+	}
+	return &claims, nil
+}
@@ -0,0 +1,164 @@
+package historysync
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cyberchat/server/db"
+	"cyberchat/server/logging"
+	"cyberchat/server/messages"
+)
+
+const maxPullBodySize = 64 * 1024
+
+// Handlers contains the peer-to-peer HTTP handlers for history sync
+type Handlers struct {
+	syncer   *Syncer
+	db       *db.DB
+	guid     string
+	addToken func(*messages.Message, string)
+}
+
+// NewHandlers creates a new Handlers instance. addToken is the message
+// handler's AddDownloadToken, which gives each pulling peer a download token
+// of its own for our file offers.
+func NewHandlers(syncer *Syncer, database *db.DB, guid string, addToken func(*messages.Message, string)) *Handlers {
+	return &Handlers{
+		syncer:   syncer,
+		db:       database,
+		guid:     guid,
+		addToken: addToken,
+	}
+}
+
+// HandleListBroadcasts returns the IDs of broadcasts we received since ?since=, oldest first
+func (h *Handlers) HandleListBroadcasts(w http.ResponseWriter, r *http.Request) {
+	since, err := time.Parse(time.RFC3339Nano, r.URL.Query().Get("since"))
+	if err != nil {
+		http.Error(w, "Invalid since parameter", http.StatusBadRequest)
+		return
+	}
+
+	limit := maxListLimit
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > maxListLimit {
+			http.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Taken before the query so nothing stored meanwhile falls between sync points
+	serverTime := time.Now().UTC()
+
+	// Fetch one extra row to find out whether another page exists
+	refs, err := h.db.GetBroadcastRefsSince(since, limit+1)
+	if err != nil {
+		logging.Error("HistorySync", "Failed to list broadcasts: %v", err)
+		http.Error(w, "Failed to list broadcasts", http.StatusInternalServerError)
+		return
+	}
+
+	resp := ListResponse{
+		Broadcasts: refs,
+		ServerTime: serverTime,
+	}
+	if len(refs) > limit {
+		resp.Broadcasts = refs[:limit]
+		resp.HasMore = true
+	}
+	if resp.Broadcasts == nil {
+		resp.Broadcasts = []db.BroadcastRef{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// HandlePull returns the requested broadcasts encrypted to the requesting peer.
+// The key is fetched from the peer's registered address, so only that peer can
+// read the response.
+func (h *Handlers) HandlePull(w http.ResponseWriter, r *http.Request) {
+	var req PullRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPullBodySize)).Decode(&req); err != nil {
+		http.Error(w, "Failed to parse request", http.StatusBadRequest)
+		return
+	}
+
+	if req.GUID == "" {
+		http.Error(w, "guid is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.IDs) == 0 || len(req.IDs) > maxPullBatch {
+		http.Error(w, "Between 1 and 100 ids are required", http.StatusBadRequest)
+		return
+	}
+
+	pubKey, err := h.syncer.publicKeyFor(req.GUID)
+	if err != nil {
+		logging.Error("HistorySync", "Rejecting pull from %s: %v", req.GUID, err)
+		http.Error(w, "Unknown peer", http.StatusForbidden)
+		return
+	}
+
+	msgs, err := h.db.GetBroadcastMessages(req.IDs)
+	if err != nil {
+		logging.Error("HistorySync", "Failed to get broadcasts: %v", err)
+		http.Error(w, "Failed to get broadcasts", http.StatusInternalServerError)
+		return
+	}
+
+	encrypted := make([]*messages.EncryptedMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		msg.ReceiverGUID = req.GUID
+
+		// Stored offers carry download tokens issued to this node, which must
+		// not reach other peers. Our own offers get a token for the requester;
+		// offers from other nodes go without one.
+		if msg.IsFileOffer() {
+			if !stripToken(msg) {
+				logging.Error("HistorySync", "Not serving file offer %s to %s: unreadable offer", msg.ID, req.GUID)
+				continue
+			}
+			if msg.SenderGUID == h.guid {
+				h.addToken(msg, req.GUID)
+			}
+		}
+
+		encMsg, err := msg.Encrypt(pubKey)
+		if err != nil {
+			logging.Error("HistorySync", "Failed to encrypt message %s for %s: %v", msg.ID, req.GUID, err)
+			continue
+		}
+		encrypted = append(encrypted, encMsg)
+	}
+
+	logging.Info("HistorySync", "Serving %d of %d requested broadcasts to %s", len(encrypted), len(req.IDs), req.GUID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(encrypted)
+}
+
+// stripToken removes the download and seed tokens from the file offer in
+// msg. It reports false if the offer could not be read.
+func stripToken(msg *messages.Message) bool {
+	var offer map[string]json.RawMessage
+	if err := json.Unmarshal(msg.Content, &offer); err != nil {
+		return false
+	}
+	_, hasToken := offer["token"]
+	_, hasSeedToken := offer["seed_token"]
+	if !hasToken && !hasSeedToken {
+		return true
+	}
+	delete(offer, "token")
+	delete(offer, "seed_token")
+	content, err := json.Marshal(offer)
+	if err != nil {
+		return false
+	}
+	msg.Content = content
+	return true
+}
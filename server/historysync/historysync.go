@@ -0,0 +1,373 @@
+package historysync
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"cyberchat/server/db"
+	"cyberchat/server/discovery"
+	"cyberchat/server/logging"
+	"cyberchat/server/messages"
+	"cyberchat/server/peers"
+)
+
+const (
+	startupDelay    = 10 * time.Second // Give discovery time to find peers before the first sync
+	resyncAfter     = 10 * time.Minute // A peer seen again after this long is synced again
+	initialLookback = 24 * time.Hour   // How far back to sync with a peer we never synced with
+	maxListLimit    = 1000             // Upper bound on IDs returned per list request
+	maxPullBatch    = 100              // Upper bound on messages pulled per request
+	requestTimeout  = 10 * time.Second
+
+	settingPrefix = "history_sync:" // Settings key prefix for per-peer sync points
+)
+
+// ListResponse is returned by the broadcast ID listing endpoint
+type ListResponse struct {
+	Broadcasts []db.BroadcastRef `json:"broadcasts"`
+	HasMore    bool              `json:"has_more"`
+	ServerTime time.Time         `json:"server_time"` // Use as the next sync point once all pages are read
+}
+
+// PullRequest asks a peer for stored broadcasts, encrypted to the requester
+type PullRequest struct {
+	GUID string   `json:"guid"`
+	IDs  []string `json:"ids"`
+}
+
+// Syncer pulls broadcasts that were sent while this node was offline from its peers
+type Syncer struct {
+	db         *db.DB
+	guid       string
+	privateKey *rsa.PrivateKey
+	discovery  *discovery.Service
+	peerMgr    *peers.Manager
+	process    func(*messages.Message, string) *messages.MessageDeliveryReport
+	acquire    func(messages.Priority) func()
+	client     *http.Client
+	queue      chan string
+	mu         sync.Mutex
+	lastSync   map[string]time.Time // Last sync attempt per peer GUID
+}
+
+// New creates a new syncer. process is the message handler's ProcessSyncedMessage and
+// acquire its AcquireLane, so sync requests yield to chat deliveries.
+func New(database *db.DB, guid string, privateKey *rsa.PrivateKey, discoveryService *discovery.Service, peerMgr *peers.Manager, process func(*messages.Message, string) *messages.MessageDeliveryReport, acquire func(messages.Priority) func()) *Syncer {
+	return &Syncer{
+		db:         database,
+		guid:       guid,
+		privateKey: privateKey,
+		discovery:  discoveryService,
+		peerMgr:    peerMgr,
+		process:    process,
+		acquire:    acquire,
+		client: &http.Client{
+			Timeout: requestTimeout,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: true,
+				},
+			},
+		},
+		queue:    make(chan string, 100),
+		lastSync: make(map[string]time.Time),
+	}
+}
+
+// Run syncs with all known peers shortly after startup, then with every peer
+// that comes (back) online, until ctx is done
+func (s *Syncer) Run(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(startupDelay):
+	}
+
+	logging.Info("HistorySync", "Starting history sync")
+	for _, peer := range s.peerMgr.GetPeers() {
+		s.PeerSeen(peer.GUID)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case guid := <-s.queue:
+			if err := s.syncPeer(guid); err != nil {
+				logging.Error("HistorySync", "Failed to sync with %s: %v", guid, err)
+			}
+		}
+	}
+}
+
+// PeerSeen queues a sync with the peer unless we synced with it recently
+func (s *Syncer) PeerSeen(guid string) {
+	if guid == s.guid {
+		return
+	}
+
+	s.mu.Lock()
+	if last, ok := s.lastSync[guid]; ok && time.Since(last) < resyncAfter {
+		s.mu.Unlock()
+		return
+	}
+	s.lastSync[guid] = time.Now()
+	s.mu.Unlock()
+
+	select {
+	case s.queue <- guid:
+	default:
+		// Queue is full; allow the peer to be queued again on its next update
+		s.mu.Lock()
+		delete(s.lastSync, guid)
+		s.mu.Unlock()
+	}
+}
+
+// syncPeer lists the peer's broadcasts since our last sync point and pulls the ones we are missing
+func (s *Syncer) syncPeer(guid string) error {
+	peer, exists := s.peerMgr.GetPeer(guid)
+	if !exists {
+		return fmt.Errorf("peer not found")
+	}
+	baseURL := fmt.Sprintf("https://%s", net.JoinHostPort(peer.IPAddress, fmt.Sprint(peer.Port)))
+
+	since, err := s.syncPoint(guid)
+	if err != nil {
+		return err
+	}
+
+	var missing []db.BroadcastRef
+	var nextPoint time.Time
+	for {
+		list, err := s.list(baseURL, since)
+		if err != nil {
+			return err
+		}
+		if nextPoint.IsZero() {
+			nextPoint = list.ServerTime
+		}
+
+		for _, ref := range list.Broadcasts {
+			exists, err := s.db.MessageExists(ref.MessageID)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				missing = append(missing, ref)
+			}
+		}
+
+		if !list.HasMore || len(list.Broadcasts) == 0 {
+			break
+		}
+		// Pages overlap by one timestamp; duplicates are filtered by MessageExists
+		last := list.Broadcasts[len(list.Broadcasts)-1].ReceivedAt
+		if !last.After(since) {
+			break
+		}
+		since = last
+	}
+
+	merged := 0
+	done := make(map[string]bool)
+	for start := 0; start < len(missing); start += maxPullBatch {
+		end := start + maxPullBatch
+		if end > len(missing) {
+			end = len(missing)
+		}
+		ids := make([]string, 0, end-start)
+		for _, ref := range missing[start:end] {
+			ids = append(ids, ref.MessageID)
+		}
+		n, err := s.pull(baseURL, peer.IPAddress, ids, done)
+		if err != nil {
+			return err
+		}
+		merged += n
+	}
+
+	// Broadcasts that could not be merged are listed again next time, so the
+	// sync point stops at the earliest of them. They are ordered by time.
+	for _, ref := range missing {
+		if !done[ref.MessageID] {
+			nextPoint = ref.ReceivedAt
+			break
+		}
+	}
+
+	if !nextPoint.IsZero() {
+		if err := s.db.SaveSetting(settingPrefix+guid, nextPoint.UTC().Format(time.RFC3339Nano)); err != nil {
+			return err
+		}
+	}
+
+	if len(missing) > 0 {
+		logging.Info("HistorySync", "Merged %d of %d missing broadcasts from %s", merged, len(missing), guid)
+	} else {
+		logging.Debug("HistorySync", "Already up to date with %s", guid)
+	}
+	return nil
+}
+
+// syncPoint returns the peer's clock time at our last successful sync with it
+func (s *Syncer) syncPoint(guid string) (time.Time, error) {
+	value, ok, err := s.db.GetSetting(settingPrefix + guid)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !ok {
+		return time.Now().Add(-initialLookback), nil
+	}
+
+	since, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		logging.Error("HistorySync", "Ignoring invalid sync point for %s: %v", guid, err)
+		return time.Now().Add(-initialLookback), nil
+	}
+	return since, nil
+}
+
+// list fetches one page of broadcast IDs from a peer
+func (s *Syncer) list(baseURL string, since time.Time) (*ListResponse, error) {
+	query := url.Values{}
+	query.Set("since", since.UTC().Format(time.RFC3339Nano))
+	query.Set("limit", fmt.Sprint(maxListLimit))
+
+	release := s.acquire(messages.PriorityLow)
+	defer release()
+
+	resp, err := s.client.Get(baseURL + "/api/v1/sync/broadcasts?" + query.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list broadcasts: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("peer returned error (HTTP %d): %s", resp.StatusCode, string(body))
+	}
+
+	var list ListResponse
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("failed to decode broadcast list: %w", err)
+	}
+	return &list, nil
+}
+
+// pull fetches the given broadcasts from a peer, decrypts them and merges them
+// into the local history. It returns how many messages were merged and adds
+// the IDs that need not be pulled again to done.
+func (s *Syncer) pull(baseURL, sourceIP string, ids []string, done map[string]bool) (int, error) {
+	body, err := json.Marshal(PullRequest{GUID: s.guid, IDs: ids})
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal pull request: %w", err)
+	}
+
+	encrypted, err := s.fetch(baseURL, body)
+	if err != nil {
+		return 0, err
+	}
+
+	merged := 0
+	for _, encMsg := range encrypted {
+		if err := encMsg.Validate(); err != nil {
+			logging.Error("HistorySync", "Ignoring invalid pulled envelope %s: %v", encMsg.ID, err)
+			continue
+		}
+		msg, err := encMsg.Decrypt(s.privateKey)
+		if err != nil {
+			logging.Error("HistorySync", "Failed to decrypt pulled message %s: %v", encMsg.ID, err)
+			continue
+		}
+		if msg.Scope != messages.ScopeBroadcast {
+			logging.Error("HistorySync", "Ignoring pulled message %s with scope %s", msg.ID, msg.Scope)
+			continue
+		}
+		if err := msg.ValidateChat(); err != nil {
+			logging.Error("HistorySync", "Ignoring invalid pulled message %s: %v", msg.ID, err)
+			continue
+		}
+
+		// Anyone can encrypt a message to us claiming to be from us, and
+		// nothing proves that one of ours is, so they are never taken from
+		// peers. Pulling them again would not change that.
+		if msg.SenderGUID == s.guid {
+			logging.Error("HistorySync", "Ignoring pulled message %s claiming to be from this node", msg.ID)
+			done[msg.ID] = true
+			continue
+		}
+
+		// ProcessSyncedMessage deduplicates, merges the Lamport clock and notifies web clients
+		s.process(msg, sourceIP)
+		done[msg.ID] = true
+		merged++
+	}
+
+	return merged, nil
+}
+
+// fetch posts a pull request to a peer. The request holds a low priority lane
+// only while it is on the network, not while the results are merged.
+func (s *Syncer) fetch(baseURL string, body []byte) ([]messages.EncryptedMessage, error) {
+	release := s.acquire(messages.PriorityLow)
+	defer release()
+
+	resp, err := s.client.Post(baseURL+"/api/v1/sync/messages", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to pull broadcasts: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("peer returned error (HTTP %d): %s", resp.StatusCode, string(body))
+	}
+
+	var encrypted []messages.EncryptedMessage
+	if err := json.NewDecoder(resp.Body).Decode(&encrypted); err != nil {
+		return nil, fmt.Errorf("failed to decode pulled broadcasts: %w", err)
+	}
+	return encrypted, nil
+}
+
+// publicKeyFor fetches the public key of a known peer from its registered address
+func (s *Syncer) publicKeyFor(guid string) (*rsa.PublicKey, error) {
+	mgrPeer, exists := s.peerMgr.GetPeer(guid)
+	if !exists {
+		return nil, fmt.Errorf("unknown peer %s", guid)
+	}
+
+	pubKeyBytes, err := s.discovery.GetPeerPublicKey(discovery.Peer{
+		GUID: mgrPeer.GUID,
+		Name: mgrPeer.Name,
+		IP:   net.ParseIP(mgrPeer.IPAddress),
+		Port: mgrPeer.Port,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get public key: %w", err)
+	}
+
+	block, _ := pem.Decode(pubKeyBytes)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode public key")
+	}
+
+	pubKey, err := x509.ParsePKCS1PublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+	return pubKey, nil
+}
@@ -0,0 +1,73 @@
+package imageproc
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"cyberchat/server/clientapi"
+	"cyberchat/server/db"
+)
+
+const defaultThumbnailSize = 256
+
+// Handlers contains HTTP handlers for image operations
+type Handlers struct {
+	db     *db.DB
+	apiKey string
+}
+
+// NewHandlers creates a new Handlers instance
+func NewHandlers(database *db.DB, apiKey string) *Handlers {
+	return &Handlers{
+		db:     database,
+		apiKey: apiKey,
+	}
+}
+
+// HandleThumbnail serves the JPEG thumbnail of an image message at ?size=
+func (h *Handlers) HandleThumbnail(w http.ResponseWriter, r *http.Request) {
+	if !clientapi.VerifyClient(r, h.apiKey) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	size := defaultThumbnailSize
+	if sizeStr := r.URL.Query().Get("size"); sizeStr != "" {
+		var err error
+		size, err = strconv.Atoi(sizeStr)
+		if err != nil || !validSize(size) {
+			http.Error(w, fmt.Sprintf("Invalid size parameter, must be one of %v", ThumbnailSizes), http.StatusBadRequest)
+			return
+		}
+	}
+
+	thumb, err := h.db.GetThumbnail(r.PathValue("message_id"), size)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Thumbnail not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to get thumbnail", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Length", strconv.Itoa(len(thumb.Data)))
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Header().Set("X-Image-Width", strconv.Itoa(thumb.Width))
+	w.Header().Set("X-Image-Height", strconv.Itoa(thumb.Height))
+	w.Write(thumb.Data)
+}
+
+// validSize reports whether size is one of ThumbnailSizes
+func validSize(size int) bool {
+	for _, s := range ThumbnailSizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
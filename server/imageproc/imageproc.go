@@ -0,0 +1,107 @@
+package imageproc
+
+import (
+	"cyberchat/server/db"
+	"cyberchat/server/logging"
+	"cyberchat/server/messages"
+)
+
+// WebSocketManager interface for telling local clients that thumbnails are ready
+type WebSocketManager interface {
+	Broadcast(message interface{})
+}
+
+const (
+	thumbnailWorkers   = 2  // Images decoded at once
+	maxQueuedThumbnail = 32 // Images waiting for a worker; more are skipped
+)
+
+// Thumbnailer generates and stores thumbnails for image messages
+type Thumbnailer struct {
+	db        *db.DB
+	wsManager WebSocketManager
+	workers   chan struct{} // Held while an image is decoded
+	admitted  chan struct{} // Held from admission until an image is done
+}
+
+// New creates a new thumbnailer
+func New(database *db.DB, wsManager WebSocketManager) *Thumbnailer {
+	return &Thumbnailer{
+		db:        database,
+		wsManager: wsManager,
+		workers:   make(chan struct{}, thumbnailWorkers),
+		admitted:  make(chan struct{}, thumbnailWorkers+maxQueuedThumbnail),
+	}
+}
+
+// HandleMessage generates thumbnails for a newly stored image message in the
+// background. Registered as a message handler listener. Only a few images are
+// decoded at once, and images arriving while the queue is full get none.
+func (t *Thumbnailer) HandleMessage(msg *messages.Message) {
+	if msg.Type != messages.TypeImage {
+		return
+	}
+	if messages.DetectImageFormat(msg.Content) == messages.ImageFormatWebP {
+		logging.Debug("Images", "No thumbnails for WebP message %s", msg.ID)
+		return
+	}
+
+	select {
+	case t.admitted <- struct{}{}:
+	default:
+		logging.Info("Images", "Skipping thumbnails for %s: too many images queued", msg.ID)
+		return
+	}
+	go func() {
+		defer func() { <-t.admitted }()
+		t.workers <- struct{}{}
+		defer func() { <-t.workers }()
+		t.generate(msg.ID, msg.Content)
+	}()
+}
+
+// generate renders and stores every thumbnail size for one message
+func (t *Thumbnailer) generate(messageID string, data []byte) {
+	thumbnails, err := MakeThumbnails(data)
+	if err != nil {
+		logging.Error("Images", "Failed to create thumbnails for %s: %v", messageID, err)
+		return
+	}
+
+	sizes := make([]int, 0, len(thumbnails))
+	for _, thumb := range thumbnails {
+		err := t.db.SaveThumbnail(&db.ThumbnailRecord{
+			MessageID: messageID,
+			Size:      thumb.Size,
+			Width:     thumb.Width,
+			Height:    thumb.Height,
+			Data:      thumb.Data,
+		})
+		if err != nil {
+			logging.Error("Images", "Failed to save %dpx thumbnail for %s: %v", thumb.Size, messageID, err)
+			continue
+		}
+		sizes = append(sizes, thumb.Size)
+	}
+
+	logging.Debug("Images", "Created %d thumbnails for %s", len(sizes), messageID)
+
+	if t.wsManager != nil && len(sizes) > 0 {
+		t.wsManager.Broadcast(struct {
+			Type    string `json:"type"`
+			Content struct {
+				MessageID string `json:"message_id"`
+				Sizes     []int  `json:"sizes"`
+			} `json:"content"`
+		}{
+			Type: "thumbnail",
+			Content: struct {
+				MessageID string `json:"message_id"`
+				Sizes     []int  `json:"sizes"`
+			}{
+				MessageID: messageID,
+				Sizes:     sizes,
+			},
+		})
+	}
+}
@@ -0,0 +1,345 @@
+package imageproc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"cyberchat/server/messages"
+)
+
+// StripMetadata removes EXIF, XMP and text metadata (including GPS positions)
+// from an image without re-encoding it. GIF carries no EXIF; its comments and
+// application extensions other than animation looping are removed.
+func StripMetadata(data []byte) ([]byte, error) {
+	switch messages.DetectImageFormat(data) {
+	case messages.ImageFormatJPEG:
+		return stripJPEG(data)
+	case messages.ImageFormatPNG:
+		return stripPNG(data)
+	case messages.ImageFormatWebP:
+		return stripWebP(data)
+	case messages.ImageFormatGIF:
+		return stripGIF(data)
+	default:
+		return nil, errors.New("unsupported image format")
+	}
+}
+
+// stripJPEG drops APP1 (EXIF, XMP), APP13 (IPTC) and comment segments. The
+// EXIF orientation is kept in an APP1 segment holding nothing else, so photos
+// taken upright are still shown upright.
+func stripJPEG(data []byte) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2]) // SOI
+
+	keptOrientation := false
+	pos := 2
+	for pos < len(data) {
+		if data[pos] != 0xFF {
+			return nil, fmt.Errorf("expected JPEG marker at offset %d", pos)
+		}
+		if pos+1 >= len(data) {
+			return nil, errors.New("truncated JPEG marker")
+		}
+		marker := data[pos+1]
+
+		// Fill bytes before a marker
+		if marker == 0xFF {
+			pos++
+			continue
+		}
+
+		// Markers without a length field
+		if marker == 0xD8 || marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			out.Write(data[pos : pos+2])
+			pos += 2
+			continue
+		}
+		if marker == 0xD9 { // EOI
+			out.Write(data[pos : pos+2])
+			return out.Bytes(), nil
+		}
+
+		if pos+4 > len(data) {
+			return nil, errors.New("truncated JPEG segment")
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, errors.New("invalid JPEG segment length")
+		}
+
+		// Start of scan: the entropy-coded data and everything after it is kept as is
+		if marker == 0xDA {
+			out.Write(data[pos:])
+			return out.Bytes(), nil
+		}
+
+		if marker == 0xE1 && !keptOrientation {
+			if orientation, ok := exifOrientation(data[pos+4 : end]); ok && orientation != 1 {
+				out.Write(orientationSegment(orientation))
+				keptOrientation = true
+			}
+		}
+		if marker != 0xE1 && marker != 0xED && marker != 0xFE {
+			out.Write(data[pos:end])
+		}
+		pos = end
+	}
+
+	return out.Bytes(), nil
+}
+
+// exifTagOrientation is the EXIF tag of the image orientation
+const exifTagOrientation = 0x0112
+
+// exifOrientation returns the orientation in IFD0 of an APP1 EXIF payload
+func exifOrientation(payload []byte) (uint16, bool) {
+	tiff, ok := bytes.CutPrefix(payload, []byte("Exif\x00\x00"))
+	if !ok || len(tiff) < 8 {
+		return 0, false
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0, false
+	}
+	if order.Uint16(tiff[2:4]) != 42 {
+		return 0, false
+	}
+
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0, false
+	}
+	entries := int(order.Uint16(tiff[ifd : ifd+2]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + 12*i
+		if entry+12 > len(tiff) {
+			break
+		}
+		// A single SHORT value is stored in the entry itself
+		if order.Uint16(tiff[entry:entry+2]) == exifTagOrientation && order.Uint16(tiff[entry+2:entry+4]) == 3 {
+			orientation := order.Uint16(tiff[entry+8 : entry+10])
+			return orientation, orientation >= 1 && orientation <= 8
+		}
+	}
+	return 0, false
+}
+
+// orientationSegment returns an APP1 EXIF segment with only an orientation
+func orientationSegment(orientation uint16) []byte {
+	tiff := []byte{'M', 'M', 0, 42, 0, 0, 0, 8} // Big endian, IFD0 right after the header
+	tiff = binary.BigEndian.AppendUint16(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, exifTagOrientation)
+	tiff = binary.BigEndian.AppendUint16(tiff, 3) // SHORT
+	tiff = binary.BigEndian.AppendUint32(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0, 0)                     // Padding of the value field
+	tiff = binary.BigEndian.AppendUint32(tiff, 0) // No further IFD
+
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	segment := []byte{0xFF, 0xE1}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// pngMetadataChunks are the PNG chunks removed by stripPNG
+var pngMetadataChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+// stripPNG drops EXIF, text and timestamp chunks
+func stripPNG(data []byte) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:8]) // Signature
+
+	pos := 8
+	for pos < len(data) {
+		if pos+8 > len(data) {
+			return nil, errors.New("truncated PNG chunk")
+		}
+		length := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+		chunkType := string(data[pos+4 : pos+8])
+		end := pos + 12 + length // Length, type, data, CRC
+		if length < 0 || end > len(data) {
+			return nil, errors.New("invalid PNG chunk length")
+		}
+
+		if !pngMetadataChunks[chunkType] {
+			out.Write(data[pos:end])
+		}
+		pos = end
+
+		if chunkType == "IEND" {
+			break
+		}
+	}
+
+	return out.Bytes(), nil
+}
+
+// VP8X feature flags for metadata chunks
+const (
+	webPFlagEXIF = 0x08
+	webPFlagXMP  = 0x04
+)
+
+// stripWebP drops EXIF and XMP chunks and clears their VP8X flags
+func stripWebP(data []byte) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:12]) // RIFF header; size is fixed up below
+
+	pos := 12
+	for pos < len(data) {
+		if pos+8 > len(data) {
+			return nil, errors.New("truncated WebP chunk")
+		}
+		fourCC := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		end := pos + 8 + size + size%2 // Chunks are padded to an even size
+		if size < 0 || end > len(data) {
+			// Some encoders omit the final padding byte
+			if pos+8+size == len(data) {
+				end = len(data)
+			} else {
+				return nil, errors.New("invalid WebP chunk size")
+			}
+		}
+
+		switch fourCC {
+		case "EXIF", "XMP ":
+			// Dropped
+		case "VP8X":
+			chunk := append([]byte(nil), data[pos:end]...)
+			if len(chunk) > 8 {
+				chunk[8] &^= webPFlagEXIF | webPFlagXMP
+			}
+			out.Write(chunk)
+		default:
+			out.Write(data[pos:end])
+		}
+		pos = end
+	}
+
+	stripped := out.Bytes()
+	binary.LittleEndian.PutUint32(stripped[4:8], uint32(len(stripped)-8))
+	return stripped, nil
+}
+
+// GIF block introducers and extension labels
+const (
+	gifExtension    = 0x21
+	gifImage        = 0x2C
+	gifTrailer      = 0x3B
+	gifComment      = 0xFE
+	gifApplication  = 0xFF
+	gifColorTable   = 0x80 // Flag for a color table following a descriptor
+	gifScreenHeader = 13   // Signature, version and logical screen descriptor
+	gifImageHeader  = 10   // Image separator and descriptor
+)
+
+// gifLoopApplications are the application extensions kept by stripGIF; they
+// only say how often an animation repeats
+var gifLoopApplications = map[string]bool{
+	"NETSCAPE2.0": true,
+	"ANIMEXTS1.0": true,
+}
+
+// stripGIF drops comment extensions and application extensions such as XMP,
+// keeping the ones that control animation looping
+func stripGIF(data []byte) ([]byte, error) {
+	if len(data) < gifScreenHeader {
+		return nil, errors.New("truncated GIF header")
+	}
+	pos := gifScreenHeader + colorTableSize(data[10])
+	if pos > len(data) {
+		return nil, errors.New("truncated GIF color table")
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:pos])
+
+	for pos < len(data) {
+		start := pos
+		switch data[pos] {
+		case gifTrailer:
+			out.WriteByte(gifTrailer)
+			return out.Bytes(), nil
+
+		case gifExtension:
+			if pos+2 > len(data) {
+				return nil, errors.New("truncated GIF extension")
+			}
+			label := data[pos+1]
+			end, err := skipSubBlocks(data, pos+2)
+			if err != nil {
+				return nil, err
+			}
+			keep := label != gifComment
+			if label == gifApplication {
+				keep = pos+3+11 <= end && data[pos+2] == 11 && gifLoopApplications[string(data[pos+3:pos+3+11])]
+			}
+			if keep {
+				out.Write(data[start:end])
+			}
+			pos = end
+
+		case gifImage:
+			if pos+gifImageHeader > len(data) {
+				return nil, errors.New("truncated GIF image descriptor")
+			}
+			// Descriptor, local color table, LZW code size, then the image data
+			pos += gifImageHeader + colorTableSize(data[pos+9]) + 1
+			if pos > len(data) {
+				return nil, errors.New("truncated GIF image")
+			}
+			end, err := skipSubBlocks(data, pos)
+			if err != nil {
+				return nil, err
+			}
+			out.Write(data[start:end])
+			pos = end
+
+		default:
+			return nil, fmt.Errorf("unexpected GIF block 0x%02x at offset %d", data[pos], pos)
+		}
+	}
+
+	// Some encoders omit the trailer
+	return out.Bytes(), nil
+}
+
+// colorTableSize returns the length of the color table announced by the
+// packed fields of a screen or image descriptor
+func colorTableSize(flags byte) int {
+	if flags&gifColorTable == 0 {
+		return 0
+	}
+	return 3 << (flags&0x07 + 1)
+}
+
+// skipSubBlocks returns the offset just past the data sub-blocks starting at
+// pos, including the empty block that ends them
+func skipSubBlocks(data []byte, pos int) (int, error) {
+	for {
+		if pos >= len(data) {
+			return 0, errors.New("truncated GIF data block")
+		}
+		size := int(data[pos])
+		pos += 1 + size
+		if size == 0 {
+			return pos, nil
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package imageproc
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif" // Register GIF for image.Decode
+	"image/jpeg"
+	_ "image/png" // Register PNG for image.Decode
+)
+
+// ThumbnailSizes are the bounding boxes, in pixels, thumbnails are generated for
+var ThumbnailSizes = []int{64, 256, 512}
+
+const thumbnailQuality = 80
+
+// Thumbnail is a JPEG rendition of an image that fits in a size x size box
+type Thumbnail struct {
+	Size   int
+	Width  int
+	Height int
+	Data   []byte
+}
+
+// MakeThumbnails decodes an image once and renders a JPEG thumbnail for every
+// size in ThumbnailSizes. Images are never scaled up. WebP cannot be decoded
+// with the standard library, so it gets no thumbnails.
+func MakeThumbnails(data []byte) ([]Thumbnail, error) {
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	// The largest thumbnail is drawn from the decoded image and the others
+	// from it, so no full-size copy of the image is made
+	srcW, srcH := src.Bounds().Dx(), src.Bounds().Dy()
+	largest := 0
+	for _, size := range ThumbnailSizes {
+		largest = max(largest, size)
+	}
+	baseW, baseH := fit(srcW, srcH, largest)
+	base := downscale(src, baseW, baseH)
+
+	thumbnails := make([]Thumbnail, 0, len(ThumbnailSizes))
+	for _, size := range ThumbnailSizes {
+		width, height := fit(srcW, srcH, size)
+
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, scale(base, width, height), &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+			return nil, fmt.Errorf("failed to encode thumbnail: %w", err)
+		}
+
+		thumbnails = append(thumbnails, Thumbnail{
+			Size:   size,
+			Width:  width,
+			Height: height,
+			Data:   buf.Bytes(),
+		})
+	}
+
+	return thumbnails, nil
+}
+
+// downscale flattens src onto white, since JPEG has no alpha channel, and
+// scales it down to width x height by averaging the source pixels under each
+// target pixel. The source is read one row at a time.
+func downscale(src image.Image, width, height int) *image.RGBA {
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+
+	row := image.NewRGBA(image.Rect(0, 0, srcW, 1))
+	sums := make([]uint64, width*4)
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	y, n := 0, uint64(0)
+	for sy := 0; sy < srcH; sy++ {
+		draw.Draw(row, row.Bounds(), &image.Uniform{C: color.White}, image.Point{}, draw.Src)
+		draw.Draw(row, row.Bounds(), src, image.Point{X: bounds.Min.X, Y: bounds.Min.Y + sy}, draw.Over)
+
+		for x := 0; x < width; x++ {
+			x0 := x * srcW / width
+			x1 := max((x+1)*srcW/width, x0+1)
+			for sx := x0; sx < x1; sx++ {
+				for c := 0; c < 4; c++ {
+					sums[x*4+c] += uint64(row.Pix[sx*4+c])
+				}
+			}
+		}
+		n++
+
+		// The last source row of a target row completes it
+		if sy+1 == max((y+1)*srcH/height, y*srcH/height+1) {
+			for x := 0; x < width; x++ {
+				x0 := x * srcW / width
+				count := n * uint64(max((x+1)*srcW/width, x0+1)-x0)
+				i := dst.PixOffset(x, y)
+				for c := 0; c < 4; c++ {
+					dst.Pix[i+c] = uint8(sums[x*4+c] / count)
+					sums[x*4+c] = 0
+				}
+			}
+			y, n = y+1, 0
+		}
+	}
+	return dst
+}
+
+// fit returns the dimensions of a width x height image scaled down to fit in a size x size box
+func fit(width, height, size int) (int, int) {
+	if width <= size && height <= size {
+		return width, height
+	}
+	if width >= height {
+		h := height * size / width
+		if h < 1 {
+			h = 1
+		}
+		return size, h
+	}
+	w := width * size / height
+	if w < 1 {
+		w = 1
+	}
+	return w, size
+}
+
+// scale downsamples src to width x height by averaging the source pixels under each target pixel
+func scale(src *image.RGBA, width, height int) *image.RGBA {
+	srcW, srcH := src.Bounds().Dx(), src.Bounds().Dy()
+	if srcW == width && srcH == height {
+		return src
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := y * srcH / height
+		y1 := (y + 1) * srcH / height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0 := x * srcW / width
+			x1 := (x + 1) * srcW / width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r += uint32(p[0])
+					g += uint32(p[1])
+					b += uint32(p[2])
+					a += uint32(p[3])
+					n++
+				}
+			}
+
+			i := dst.PixOffset(x, y)
+			dst.Pix[i] = uint8(r / n)
+			dst.Pix[i+1] = uint8(g / n)
+			dst.Pix[i+2] = uint8(b / n)
+			dst.Pix[i+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
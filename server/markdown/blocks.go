@@ -0,0 +1,326 @@
+package markdown
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	atxHeadingRe    = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	thematicBreakRe = regexp.MustCompile(`^ {0,3}(?:(?:\*[ \t]*){3,}|(?:-[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	fenceRe         = regexp.MustCompile("^( {0,3})(`{3,}|~{3,})[ \t]*([^`]*?)[ \t]*$")
+	blockquoteRe    = regexp.MustCompile(`^ {0,3}> ?`)
+	listItemRe      = regexp.MustCompile(`^( {0,3})([-+*]|\d{1,9}[.)])([ \t]+|$)`)
+	setextRe        = regexp.MustCompile(`^ {0,3}(=+|-+)[ \t]*$`)
+	infoStringRe    = regexp.MustCompile(`^[A-Za-z0-9_+#.-]+$`)
+)
+
+// maxDepth bounds nesting of block quotes and lists so hostile input cannot recurse without limit
+const maxDepth = 16
+
+// listMarker describes the marker of a list item line
+type listMarker struct {
+	ordered bool
+	start   string // Number of an ordered item
+	bullet  byte   // Bullet character or ordered delimiter
+	indent  int    // Column where the item's content starts
+}
+
+// parseListMarker returns the list marker at the start of line, if any
+func parseListMarker(line string) (listMarker, bool) {
+	m := listItemRe.FindStringSubmatch(line)
+	if m == nil {
+		return listMarker{}, false
+	}
+
+	marker := listMarker{indent: len(m[0])}
+	if strings.TrimSpace(m[3]) == "" && len(m[3]) > 4 {
+		// More than four spaces after the marker belong to an indented code block
+		marker.indent = len(m[1]) + len(m[2]) + 1
+	}
+	last := m[2][len(m[2])-1]
+	if last == '.' || last == ')' {
+		marker.ordered = true
+		marker.start = strings.TrimLeft(m[2][:len(m[2])-1], "0")
+		if marker.start == "" {
+			marker.start = "0"
+		}
+	}
+	marker.bullet = last
+	return marker, true
+}
+
+// renderBlocks renders a sequence of lines as block content. In a tight list
+// paragraphs are rendered without their <p> wrapper.
+func (r *renderer) renderBlocks(lines []string, tight bool, depth int) {
+	for i := 0; i < len(lines); {
+		line := lines[i]
+
+		if strings.TrimSpace(line) == "" {
+			i++
+			continue
+		}
+
+		// Fenced code block
+		if m := fenceRe.FindStringSubmatch(line); m != nil && (m[2][0] == '~' || !strings.Contains(m[3], "`")) {
+			indent, fence := len(m[1]), m[2]
+			var code []string
+			i++
+			for i < len(lines) {
+				trimmed := strings.TrimLeft(lines[i], " ")
+				if strings.HasPrefix(trimmed, fence[:1]) && len(lines[i])-len(trimmed) < 4 &&
+					strings.TrimRight(trimmed, " \t") == strings.Repeat(fence[:1], len(strings.TrimRight(trimmed, " \t"))) &&
+					len(strings.TrimRight(trimmed, " \t")) >= len(fence) {
+					i++
+					break
+				}
+				code = append(code, removeIndent(lines[i], indent))
+				i++
+			}
+			r.codeBlock(code, firstWord(m[3]))
+			continue
+		}
+
+		// Indented code block
+		if strings.HasPrefix(line, "    ") || strings.HasPrefix(line, "\t") {
+			var code []string
+			for i < len(lines) && (strings.TrimSpace(lines[i]) == "" || strings.HasPrefix(lines[i], "    ") || strings.HasPrefix(lines[i], "\t")) {
+				code = append(code, removeIndent(lines[i], 4))
+				i++
+			}
+			for len(code) > 0 && strings.TrimSpace(code[len(code)-1]) == "" {
+				code = code[:len(code)-1]
+			}
+			r.codeBlock(code, "")
+			continue
+		}
+
+		// ATX heading
+		if m := atxHeadingRe.FindStringSubmatch(line); m != nil {
+			r.heading(len(m[1]), m[2])
+			i++
+			continue
+		}
+
+		if thematicBreakRe.MatchString(line) {
+			r.thematicBreak()
+			i++
+			continue
+		}
+
+		// Block quote, including lazy continuation lines
+		if blockquoteRe.MatchString(line) {
+			var quoted []string
+			for i < len(lines) {
+				if loc := blockquoteRe.FindStringIndex(lines[i]); loc != nil {
+					quoted = append(quoted, lines[i][loc[1]:])
+				} else if strings.TrimSpace(lines[i]) != "" && len(quoted) > 0 &&
+					strings.TrimSpace(quoted[len(quoted)-1]) != "" && !startsBlock(lines[i]) {
+					quoted = append(quoted, lines[i])
+				} else {
+					break
+				}
+				i++
+			}
+			r.open("blockquote", "\n")
+			r.nested(quoted, false, depth)
+			r.close("blockquote", "\n")
+			continue
+		}
+
+		// List
+		if marker, ok := parseListMarker(line); ok {
+			i = r.list(lines, i, marker, depth)
+			continue
+		}
+
+		// Paragraph, possibly turned into a setext heading by its underline
+		var para []string
+		level := 0
+		for i < len(lines) && strings.TrimSpace(lines[i]) != "" {
+			if len(para) > 0 {
+				if m := setextRe.FindStringSubmatch(lines[i]); m != nil {
+					level = 1
+					if m[1][0] == '-' {
+						level = 2
+					}
+					i++
+					break
+				}
+				if startsBlock(lines[i]) {
+					break
+				}
+			}
+			para = append(para, strings.TrimLeft(lines[i], " \t"))
+			i++
+		}
+
+		text := strings.TrimRight(strings.Join(para, "\n"), " \t")
+		if level > 0 {
+			r.heading(level, text)
+		} else {
+			r.paragraph(text, tight)
+		}
+	}
+}
+
+// list renders the list starting at lines[start] and returns the index of the first line after it
+func (r *renderer) list(lines []string, start int, first listMarker, depth int) int {
+	type item struct {
+		lines []string
+	}
+	var items []item
+	tight := true
+	blankBetween := false
+
+	i := start
+	marker := first
+	for i < len(lines) {
+		body := []string{lines[i][min(marker.indent, len(lines[i])):]}
+		i++
+
+		// Continuation lines are indented to the content column, or lazy paragraph text
+		for i < len(lines) {
+			line := lines[i]
+			if strings.TrimSpace(line) == "" {
+				body = append(body, "")
+				i++
+				continue
+			}
+			if leadingSpaces(line) >= marker.indent {
+				body = append(body, removeIndent(line, marker.indent))
+				i++
+				continue
+			}
+			if _, isItem := parseListMarker(line); !isItem && strings.TrimSpace(body[len(body)-1]) != "" && !startsBlock(line) {
+				body = append(body, line)
+				i++
+				continue
+			}
+			break
+		}
+
+		// Trailing blank lines separate items; they make the list loose if another item follows
+		trailing := 0
+		for len(body) > 0 && strings.TrimSpace(body[len(body)-1]) == "" {
+			body = body[:len(body)-1]
+			trailing++
+		}
+		if blankBetween {
+			tight = false
+		}
+		blankBetween = trailing > 0
+		for j := 1; j < len(body); j++ {
+			if strings.TrimSpace(body[j]) == "" && j+1 < len(body) {
+				tight = false
+			}
+		}
+		items = append(items, item{lines: body})
+
+		next, ok := parseListMarker(safeLine(lines, i))
+		if !ok || next.ordered != first.ordered || next.bullet != first.bullet || thematicBreakRe.MatchString(lines[i]) {
+			break
+		}
+		marker = next
+	}
+
+	if first.ordered {
+		if first.start != "1" {
+			r.open(`ol start="`+first.start+`"`, "\n")
+		} else {
+			r.open("ol", "\n")
+		}
+	} else {
+		r.open("ul", "\n")
+	}
+
+	for n, it := range items {
+		r.listItem(first.ordered, first.start, n)
+		r.nested(it.lines, tight, depth)
+		r.close("li", "\n")
+	}
+
+	if first.ordered {
+		r.close("ol", "\n")
+	} else {
+		r.close("ul", "\n")
+	}
+	return i
+}
+
+// nested renders child blocks, flattening them to text past maxDepth
+func (r *renderer) nested(lines []string, tight bool, depth int) {
+	if depth >= maxDepth {
+		r.paragraph(strings.Join(lines, "\n"), tight)
+		return
+	}
+	r.renderBlocks(lines, tight, depth+1)
+}
+
+// startsBlock reports whether line would interrupt a paragraph
+func startsBlock(line string) bool {
+	if atxHeadingRe.MatchString(line) || thematicBreakRe.MatchString(line) || blockquoteRe.MatchString(line) {
+		return true
+	}
+	if fenceRe.MatchString(line) {
+		return true
+	}
+	// Only bullets and lists starting at 1 interrupt a paragraph, and never empty items
+	if marker, ok := parseListMarker(line); ok {
+		rest := strings.TrimSpace(line[min(marker.indent, len(line)):])
+		return rest != "" && (!marker.ordered || marker.start == "1")
+	}
+	return false
+}
+
+// removeIndent strips up to n columns of leading whitespace, counting a tab as four
+func removeIndent(line string, n int) string {
+	col := 0
+	for i := 0; i < len(line); i++ {
+		if col >= n {
+			return line[i:]
+		}
+		switch line[i] {
+		case ' ':
+			col++
+		case '\t':
+			col += 4
+		default:
+			return line[i:]
+		}
+	}
+	return ""
+}
+
+// leadingSpaces returns the indentation of line in columns
+func leadingSpaces(line string) int {
+	col := 0
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case ' ':
+			col++
+		case '\t':
+			col += 4
+		default:
+			return col
+		}
+	}
+	return col
+}
+
+// firstWord returns the first word of a fence info string if it is a plausible language name
+func firstWord(info string) string {
+	fields := strings.Fields(info)
+	if len(fields) == 0 || !infoStringRe.MatchString(fields[0]) {
+		return ""
+	}
+	return fields[0]
+}
+
+// safeLine returns lines[i], or "" past the end
+func safeLine(lines []string, i int) string {
+	if i < len(lines) {
+		return lines[i]
+	}
+	return ""
+}
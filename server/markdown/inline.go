@@ -0,0 +1,608 @@
+package markdown
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxLinkParens is how deeply parentheses may nest in a link destination
+const maxLinkParens = 32
+
+var (
+	autolinkRe = regexp.MustCompile(`^<([A-Za-z][A-Za-z0-9+.-]{1,31}:[^\s<>]*)>`)
+	emailRe    = regexp.MustCompile(`^<([a-zA-Z0-9.!#$%&'*+/=?^_` + "`" + `{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*)>`)
+	entityRe   = regexp.MustCompile(`^&(?:#[0-9]{1,7}|#[xX][0-9a-fA-F]{1,6}|[A-Za-z][A-Za-z0-9]{1,31});`)
+)
+
+// nodeKind identifies an inline element
+type nodeKind int
+
+const (
+	nodeText nodeKind = iota
+	nodeCode
+	nodeEmphasis
+	nodeStrong
+	nodeLink
+	nodeImage
+	nodeHardBreak
+	nodeSoftBreak
+	nodeDelimiter // A run of * or _ that may still become emphasis
+)
+
+// inlineNode is one element of parsed inline content
+type inlineNode struct {
+	kind     nodeKind
+	text     string // Literal text of text and code nodes
+	url      string // Destination of links and images
+	children []*inlineNode
+
+	// Delimiter runs only
+	delim    byte
+	count    int // Delimiters not yet used for emphasis
+	length   int // Length of the run as written
+	canOpen  bool
+	canClose bool
+}
+
+// inline renders inline markdown text as HTML, or as plain text in plain mode
+func (r *renderer) inline(text string) string {
+	var b strings.Builder
+	r.writeNodes(&b, parseInline(text, false))
+	return b.String()
+}
+
+func (r *renderer) writeNodes(b *strings.Builder, nodes []*inlineNode) {
+	for _, n := range nodes {
+		r.writeNode(b, n)
+	}
+}
+
+func (r *renderer) writeNode(b *strings.Builder, n *inlineNode) {
+	switch n.kind {
+	case nodeText:
+		if r.plain {
+			b.WriteString(n.text)
+		} else {
+			b.WriteString(html.EscapeString(n.text))
+		}
+	case nodeCode:
+		if r.plain {
+			b.WriteString(n.text)
+		} else {
+			b.WriteString("<code>" + html.EscapeString(n.text) + "</code>")
+		}
+	case nodeEmphasis, nodeStrong:
+		tag := "em"
+		if n.kind == nodeStrong {
+			tag = "strong"
+		}
+		if !r.plain {
+			b.WriteString("<" + tag + ">")
+		}
+		r.writeNodes(b, n.children)
+		if !r.plain {
+			b.WriteString("</" + tag + ">")
+		}
+	case nodeLink, nodeImage:
+		// Images are shown as links so that displaying a message never fetches anything
+		if !safeURL(n.url) {
+			r.writeNodes(b, n.children)
+			return
+		}
+		if r.plain {
+			var label strings.Builder
+			r.writeNodes(&label, n.children)
+			b.WriteString(label.String())
+			if label.String() != n.url && "mailto:"+label.String() != n.url {
+				b.WriteString(" (" + n.url + ")")
+			}
+			return
+		}
+		b.WriteString(`<a href="` + html.EscapeString(n.url) + `" rel="nofollow noopener noreferrer" target="_blank">`)
+		r.writeNodes(b, n.children)
+		b.WriteString("</a>")
+	case nodeHardBreak:
+		if r.plain {
+			b.WriteString("\n")
+		} else {
+			b.WriteString("<br />\n")
+		}
+	case nodeSoftBreak:
+		b.WriteString("\n")
+	case nodeDelimiter:
+		text := strings.Repeat(string(n.delim), n.count)
+		if r.plain {
+			b.WriteString(text)
+		} else {
+			b.WriteString(html.EscapeString(text))
+		}
+	}
+}
+
+// safeURL reports whether a link destination may be rendered as a link
+func safeURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		return u.Host != ""
+	case "mailto":
+		return u.Opaque != ""
+	default:
+		return false
+	}
+}
+
+// parseInline parses inline content. Inside a link label, brackets do not start nested links.
+func parseInline(text string, inLink bool) []*inlineNode {
+	p := &inlineParser{text: text, inLink: inLink}
+	p.parse()
+	return resolveEmphasis(p.nodes)
+}
+
+type inlineParser struct {
+	text   string
+	inLink bool
+	nodes  []*inlineNode
+	buf    strings.Builder
+
+	// closers maps the index of each [ to its matching ], or -1. It is filled
+	// by the first link, so unmatched brackets are not scanned again and again.
+	closers map[int]int
+
+	// unclosed maps the closing character of a link destination in <> or of a
+	// title to the first index from which it was searched for in vain, so the
+	// search is not repeated for every later link
+	unclosed map[byte]int
+}
+
+// flush turns pending literal text into a text node
+func (p *inlineParser) flush() {
+	if p.buf.Len() == 0 {
+		return
+	}
+	p.nodes = append(p.nodes, &inlineNode{kind: nodeText, text: p.buf.String()})
+	p.buf.Reset()
+}
+
+func (p *inlineParser) add(n *inlineNode) {
+	p.flush()
+	p.nodes = append(p.nodes, n)
+}
+
+func (p *inlineParser) parse() {
+	text := p.text
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == '\\' && i+1 < len(text) && text[i+1] == '\n':
+			p.add(&inlineNode{kind: nodeHardBreak})
+			i += 2
+			i += len(text[i:]) - len(strings.TrimLeft(text[i:], " \t"))
+
+		case c == '\\' && i+1 < len(text) && isASCIIPunct(text[i+1]):
+			p.buf.WriteByte(text[i+1])
+			i += 2
+
+		case c == '`':
+			i = p.codeSpan(i)
+
+		case c == '*' || c == '_':
+			i = p.delimiterRun(i)
+
+		case c == '!' && i+1 < len(text) && text[i+1] == '[' && !p.inLink:
+			if next, ok := p.link(i+1, nodeImage); ok {
+				i = next
+			} else {
+				p.buf.WriteByte('!')
+				i++
+			}
+
+		case c == '[' && !p.inLink:
+			if next, ok := p.link(i, nodeLink); ok {
+				i = next
+			} else {
+				p.buf.WriteByte('[')
+				i++
+			}
+
+		case c == '<':
+			if m := autolinkRe.FindStringSubmatch(text[i:]); m != nil {
+				p.add(&inlineNode{kind: nodeLink, url: m[1], children: []*inlineNode{{kind: nodeText, text: m[1]}}})
+				i += len(m[0])
+			} else if m := emailRe.FindStringSubmatch(text[i:]); m != nil {
+				p.add(&inlineNode{kind: nodeLink, url: "mailto:" + m[1], children: []*inlineNode{{kind: nodeText, text: m[1]}}})
+				i += len(m[0])
+			} else {
+				// Raw HTML is not supported; it is shown as text
+				p.buf.WriteByte('<')
+				i++
+			}
+
+		case c == '&':
+			if m := entityRe.FindString(text[i:]); m != "" {
+				p.buf.WriteString(html.UnescapeString(m))
+				i += len(m)
+			} else {
+				p.buf.WriteByte('&')
+				i++
+			}
+
+		case c == '\n':
+			// Two or more trailing spaces make a hard break
+			pending := p.buf.String()
+			trimmed := strings.TrimRight(pending, " \t")
+			hard := len(pending)-len(trimmed) >= 2
+			p.buf.Reset()
+			p.buf.WriteString(trimmed)
+			if hard {
+				p.add(&inlineNode{kind: nodeHardBreak})
+			} else {
+				p.add(&inlineNode{kind: nodeSoftBreak})
+			}
+			i++
+			i += len(text[i:]) - len(strings.TrimLeft(text[i:], " \t"))
+
+		default:
+			p.buf.WriteByte(c)
+			i++
+		}
+	}
+	p.flush()
+}
+
+// codeSpan parses a code span starting at a backtick run and returns the index after it.
+// A run without a matching closing run is literal text.
+func (p *inlineParser) codeSpan(start int) int {
+	text := p.text
+	n := start
+	for n < len(text) && text[n] == '`' {
+		n++
+	}
+	run := n - start
+
+	for i := n; i < len(text); {
+		if text[i] != '`' {
+			i++
+			continue
+		}
+		j := i
+		for j < len(text) && text[j] == '`' {
+			j++
+		}
+		if j-i == run {
+			code := strings.ReplaceAll(text[n:i], "\n", " ")
+			if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.Trim(code, " ") != "" {
+				code = code[1 : len(code)-1]
+			}
+			p.add(&inlineNode{kind: nodeCode, text: code})
+			return j
+		}
+		i = j
+	}
+
+	p.buf.WriteString(text[start:n])
+	return n
+}
+
+// delimiterRun records a run of * or _ with the flanking rules that decide
+// whether it can open or close emphasis
+func (p *inlineParser) delimiterRun(start int) int {
+	text := p.text
+	c := text[start]
+	end := start
+	for end < len(text) && text[end] == c {
+		end++
+	}
+
+	before, after := ' ', ' '
+	if start > 0 {
+		before, _ = utf8.DecodeLastRuneInString(text[:start])
+	}
+	if end < len(text) {
+		after, _ = utf8.DecodeRuneInString(text[end:])
+	}
+
+	leftFlanking := !unicode.IsSpace(after) && (!isPunct(after) || unicode.IsSpace(before) || isPunct(before))
+	rightFlanking := !unicode.IsSpace(before) && (!isPunct(before) || unicode.IsSpace(after) || isPunct(after))
+
+	n := &inlineNode{kind: nodeDelimiter, delim: c, count: end - start, length: end - start}
+	if c == '*' {
+		n.canOpen = leftFlanking
+		n.canClose = rightFlanking
+	} else {
+		n.canOpen = leftFlanking && (!rightFlanking || isPunct(before))
+		n.canClose = rightFlanking && (!leftFlanking || isPunct(after))
+	}
+	p.add(n)
+	return end
+}
+
+// link parses [label](destination "title") starting at the opening bracket and
+// returns the index after it. The title is accepted but not rendered.
+func (p *inlineParser) link(start int, kind nodeKind) (int, bool) {
+	text := p.text
+
+	closeAt := p.closingBracket(start)
+	if closeAt < 0 || closeAt+1 >= len(text) || text[closeAt+1] != '(' {
+		return 0, false
+	}
+
+	i := skipSpace(text, closeAt+2)
+	var dest string
+	if i < len(text) && text[i] == '<' {
+		if p.searchedInVain('>', i+1) {
+			return 0, false
+		}
+		end := strings.IndexAny(text[i+1:], ">\n")
+		if end < 0 {
+			p.unclosed['>'] = i + 1
+		}
+		if end < 0 || text[i+1+end] != '>' {
+			return 0, false
+		}
+		dest = text[i+1 : i+1+end]
+		i += end + 2
+	} else {
+		j, parens := i, 0
+		for ; j < len(text); j++ {
+			ch := text[j]
+			if ch == '\\' && j+1 < len(text) && isASCIIPunct(text[j+1]) {
+				j++
+				continue
+			}
+			if ch <= ' ' {
+				break
+			}
+			if ch == '(' {
+				// Nesting is limited, as CommonMark allows, so that a run of
+				// unclosed links does not make every one scan to the end
+				if parens++; parens > maxLinkParens {
+					return 0, false
+				}
+			} else if ch == ')' {
+				if parens == 0 {
+					break
+				}
+				parens--
+			}
+		}
+		dest = text[i:j]
+		i = j
+	}
+
+	// Optional title in quotes or parentheses, which must be separated by whitespace
+	j := skipSpace(text, i)
+	if j > i && j < len(text) && (text[j] == '"' || text[j] == '\'' || text[j] == '(') {
+		closer := text[j]
+		if closer == '(' {
+			closer = ')'
+		}
+		if p.searchedInVain(closer, j+1) {
+			return 0, false
+		}
+		k := j + 1
+		for k < len(text) && text[k] != closer {
+			if text[k] == '\\' {
+				k++
+			}
+			k++
+		}
+		if k >= len(text) {
+			p.unclosed[closer] = j + 1
+			return 0, false
+		}
+		j = skipSpace(text, k+1)
+	}
+	if j >= len(text) || text[j] != ')' {
+		return 0, false
+	}
+
+	p.add(&inlineNode{
+		kind:     kind,
+		url:      unescapeDestination(dest),
+		children: parseInline(text[start+1:closeAt], true),
+	})
+	return j + 1, true
+}
+
+// searchedInVain reports whether c was already searched for from an index at
+// or before from without being found
+func (p *inlineParser) searchedInVain(c byte, from int) bool {
+	if p.unclosed == nil {
+		p.unclosed = make(map[byte]int)
+	}
+	at, ok := p.unclosed[c]
+	return ok && at <= from
+}
+
+// closingBracket returns the index of the ] that matches the [ at start, or
+// -1 if there is none. Escaped brackets are skipped.
+func (p *inlineParser) closingBracket(start int) int {
+	if p.closers == nil {
+		p.closers = make(map[int]int)
+		var open []int
+		for i := 0; i < len(p.text); i++ {
+			switch p.text[i] {
+			case '\\':
+				i++
+			case '[':
+				open = append(open, i)
+				p.closers[i] = -1
+			case ']':
+				if len(open) > 0 {
+					p.closers[open[len(open)-1]] = i
+					open = open[:len(open)-1]
+				}
+			}
+		}
+	}
+	if closeAt, ok := p.closers[start]; ok {
+		return closeAt
+	}
+	return -1
+}
+
+// unescapeDestination resolves backslash escapes and entities in a link destination
+func unescapeDestination(dest string) string {
+	var b strings.Builder
+	for i := 0; i < len(dest); i++ {
+		if dest[i] == '\\' && i+1 < len(dest) && isASCIIPunct(dest[i+1]) {
+			i++
+		}
+		b.WriteByte(dest[i])
+	}
+	return html.UnescapeString(b.String())
+}
+
+// emphasisItem is an inline node in the doubly linked lists resolveEmphasis
+// works on: all nodes in order, and the delimiter runs among them
+type emphasisItem struct {
+	node                 *inlineNode
+	prev, next           *emphasisItem
+	prevDelim, nextDelim *emphasisItem
+}
+
+// resolveEmphasis pairs delimiter runs into emphasis and strong emphasis
+// following the CommonMark delimiter rules. Unpaired runs stay literal text.
+// As in the CommonMark reference algorithm, it remembers for each kind of
+// closer how far back an opener search has already failed, so no search
+// covers the same delimiters twice and the time taken grows linearly.
+func resolveEmphasis(nodes []*inlineNode) []*inlineNode {
+	head := &emphasisItem{} // Sentinel before the first node
+	tail, lastDelim := head, (*emphasisItem)(nil)
+	var firstDelim *emphasisItem
+	for _, n := range nodes {
+		item := &emphasisItem{node: n, prev: tail}
+		tail.next = item
+		tail = item
+		if n.kind == nodeDelimiter {
+			item.prevDelim = lastDelim
+			if lastDelim != nil {
+				lastDelim.nextDelim = item
+			} else {
+				firstDelim = item
+			}
+			lastDelim = item
+		}
+	}
+
+	// The delimiter below which no opener for a kind of closer can be found,
+	// by delimiter, whether the closer can also open, and its length mod 3
+	bottom := make(map[[3]int]*emphasisItem)
+
+	removeDelim := func(d *emphasisItem) {
+		if d.prevDelim != nil {
+			d.prevDelim.nextDelim = d.nextDelim
+		}
+		if d.nextDelim != nil {
+			d.nextDelim.prevDelim = d.prevDelim
+		}
+	}
+	removeNode := func(item *emphasisItem) {
+		item.prev.next = item.next
+		if item.next != nil {
+			item.next.prev = item.prev
+		}
+	}
+
+	for closer := firstDelim; closer != nil; {
+		c := closer.node
+		if !c.canClose {
+			closer = closer.nextDelim
+			continue
+		}
+
+		key := [3]int{int(c.delim), 0, c.length % 3}
+		if c.canOpen {
+			key[1] = 1
+		}
+		bottomItem, searched := bottom[key]
+
+		var opener *emphasisItem
+		for k := closer.prevDelim; k != nil && !(searched && k == bottomItem); k = k.prevDelim {
+			o := k.node
+			if o.delim != c.delim || !o.canOpen {
+				continue
+			}
+			// The rule of three: a run that can both open and close only pairs when
+			// the lengths do not sum to a multiple of three, unless both are
+			if (o.canClose || c.canOpen) && (o.length+c.length)%3 == 0 &&
+				!(o.length%3 == 0 && c.length%3 == 0) {
+				continue
+			}
+			opener = k
+			break
+		}
+
+		if opener == nil {
+			bottom[key] = closer.prevDelim
+			next := closer.nextDelim
+			// A closer that cannot open is of no further use
+			if !c.canOpen {
+				removeDelim(closer)
+			}
+			closer = next
+			continue
+		}
+
+		o := opener.node
+		use, kind := 1, nodeEmphasis
+		if o.count >= 2 && c.count >= 2 {
+			use, kind = 2, nodeStrong
+		}
+		o.count -= use
+		c.count -= use
+
+		// Everything between the pair moves into the new node, and the
+		// delimiters among it can no longer pair with anything outside
+		wrapped := &inlineNode{kind: kind}
+		for item := opener.next; item != closer; item = item.next {
+			wrapped.children = append(wrapped.children, item.node)
+		}
+		item := &emphasisItem{node: wrapped, prev: opener, next: closer}
+		opener.next = item
+		closer.prev = item
+		opener.nextDelim = closer
+		closer.prevDelim = opener
+
+		if o.count == 0 {
+			removeDelim(opener)
+			removeNode(opener)
+		}
+		// Look at the same closer again if some of it is left over
+		if c.count == 0 {
+			next := closer.nextDelim
+			removeDelim(closer)
+			removeNode(closer)
+			closer = next
+		}
+	}
+
+	result := make([]*inlineNode, 0, len(nodes))
+	for item := head.next; item != nil; item = item.next {
+		result = append(result, item.node)
+	}
+	return result
+}
+
+func skipSpace(text string, i int) int {
+	for i < len(text) && (text[i] == ' ' || text[i] == '\t' || text[i] == '\n') {
+		i++
+	}
+	return i
+}
+
+func isASCIIPunct(c byte) bool {
+	return strings.IndexByte("!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~", c) >= 0
+}
+
+func isPunct(r rune) bool {
+	return unicode.IsPunct(r) || unicode.IsSymbol(r)
+}
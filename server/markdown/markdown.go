@@ -0,0 +1,141 @@
+// Package markdown renders a CommonMark subset to HTML that is safe to insert
+// into a page as-is, and to plain text for nodes that only show text.
+//
+// Safety comes from construction, not from filtering: every character of the
+// source is escaped, raw HTML in the source is shown as text, and the output
+// contains only the tags p, h1-h6, em, strong, code, pre, blockquote, ul, ol,
+// li, a, br and hr. Links are kept only for http, https and mailto URLs, and
+// images are rendered as links so viewing a message never loads anything.
+package markdown
+
+import (
+	"html"
+	"strconv"
+	"strings"
+)
+
+// ToHTML renders markdown source to sanitized HTML
+func ToHTML(src string) string {
+	r := &renderer{}
+	r.renderBlocks(splitLines(src), false, 0)
+	return r.out.String()
+}
+
+// ToText renders markdown source to plain text with the markup removed.
+// Link targets are kept in parentheses after the link text.
+func ToText(src string) string {
+	r := &renderer{plain: true}
+	r.renderBlocks(splitLines(src), false, 0)
+	return strings.TrimRight(r.out.String(), "\n")
+}
+
+// splitLines normalizes line endings and splits src into lines
+func splitLines(src string) []string {
+	src = strings.ReplaceAll(src, "\r\n", "\n")
+	src = strings.ReplaceAll(src, "\r", "\n")
+	src = strings.ReplaceAll(src, "\x00", "�")
+	return strings.Split(src, "\n")
+}
+
+// renderer writes blocks as HTML, or as plain text when plain is set
+type renderer struct {
+	out   strings.Builder
+	plain bool
+}
+
+// open writes an opening tag followed by after. tag may carry attributes,
+// which must already be escaped.
+func (r *renderer) open(tag, after string) {
+	if r.plain {
+		return
+	}
+	r.newline()
+	r.out.WriteString("<" + tag + ">" + after)
+}
+
+// close writes a closing tag followed by after
+func (r *renderer) close(tag, after string) {
+	if r.plain {
+		r.newline()
+		return
+	}
+	r.out.WriteString("</" + tag + ">" + after)
+}
+
+// newline ends the current output line unless it is already ended. Block
+// elements start on a new line, also after the unwrapped text of a tight list item.
+func (r *renderer) newline() {
+	s := r.out.String()
+	if len(s) > 0 && !strings.HasSuffix(s, "\n") {
+		r.out.WriteString("\n")
+	}
+}
+
+func (r *renderer) paragraph(text string, tight bool) {
+	if r.plain {
+		r.out.WriteString(r.inline(text))
+		r.out.WriteString("\n")
+		return
+	}
+	if tight {
+		r.out.WriteString(r.inline(text))
+		return
+	}
+	r.newline()
+	r.out.WriteString("<p>" + r.inline(text) + "</p>\n")
+}
+
+func (r *renderer) heading(level int, text string) {
+	if r.plain {
+		r.out.WriteString(r.inline(text) + "\n")
+		return
+	}
+	tag := "h" + strconv.Itoa(level)
+	r.newline()
+	r.out.WriteString("<" + tag + ">" + r.inline(text) + "</" + tag + ">\n")
+}
+
+func (r *renderer) thematicBreak() {
+	if r.plain {
+		r.out.WriteString("---\n")
+		return
+	}
+	r.newline()
+	r.out.WriteString("<hr />\n")
+}
+
+func (r *renderer) codeBlock(lines []string, lang string) {
+	code := strings.Join(lines, "\n")
+	if len(lines) > 0 {
+		code += "\n"
+	}
+
+	if r.plain {
+		r.out.WriteString(code)
+		return
+	}
+
+	r.newline()
+	if lang != "" {
+		r.out.WriteString(`<pre><code class="language-` + html.EscapeString(lang) + `">`)
+	} else {
+		r.out.WriteString("<pre><code>")
+	}
+	r.out.WriteString(html.EscapeString(code))
+	r.out.WriteString("</code></pre>\n")
+}
+
+// listItem starts the n-th item of a list
+func (r *renderer) listItem(ordered bool, start string, n int) {
+	if !r.plain {
+		r.out.WriteString("<li>")
+		return
+	}
+
+	if ordered {
+		first, _ := strconv.Atoi(start)
+		r.out.WriteString(strconv.Itoa(first+n) + ". ")
+	} else {
+		r.out.WriteString("- ")
+	}
+}
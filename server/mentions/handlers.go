@@ -0,0 +1,87 @@
+package mentions
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"cyberchat/server/clientapi"
+	"cyberchat/server/db"
+)
+
+// Handlers contains HTTP handlers for mention operations
+type Handlers struct {
+	db     *db.DB
+	guid   string
+	apiKey string
+}
+
+// NewHandlers creates a new Handlers instance
+func NewHandlers(database *db.DB, guid string, apiKey string) *Handlers {
+	return &Handlers{
+		db:     database,
+		guid:   guid,
+		apiKey: apiKey,
+	}
+}
+
+// HandleList returns mentions of this node, unread only unless ?all=true
+func (h *Handlers) HandleList(w http.ResponseWriter, r *http.Request) {
+	if !clientapi.VerifyClient(r, h.apiKey) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	limit := 100
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > 1000 {
+			http.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	unreadOnly := r.URL.Query().Get("all") != "true"
+
+	mentions, err := h.db.GetMentions(h.guid, unreadOnly, limit)
+	if err != nil {
+		http.Error(w, "Failed to get mentions", http.StatusInternalServerError)
+		return
+	}
+	if mentions == nil {
+		mentions = []*db.Mention{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(mentions)
+}
+
+// HandleMarkRead marks mentions as read. An empty message_ids list marks all of them.
+func (h *Handlers) HandleMarkRead(w http.ResponseWriter, r *http.Request) {
+	if !clientapi.VerifyClient(r, h.apiKey) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		MessageIDs []string `json:"message_ids"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Failed to parse request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	updated, err := h.db.MarkMentionsRead(h.guid, req.MessageIDs)
+	if err != nil {
+		http.Error(w, "Failed to mark mentions read", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "success",
+		"updated": updated,
+	})
+}
@@ -0,0 +1,136 @@
+package mentions
+
+import (
+	"strings"
+
+	"cyberchat/server/db"
+	"cyberchat/server/logging"
+	"cyberchat/server/messages"
+)
+
+// WebSocketManager interface for notifying local clients about mentions
+type WebSocketManager interface {
+	Broadcast(message interface{})
+}
+
+// Tracker finds @mentions in stored messages and notifies web clients when we are named
+type Tracker struct {
+	db        *db.DB
+	guid      string
+	wsManager WebSocketManager
+}
+
+// New creates a new mention tracker
+func New(database *db.DB, guid string, wsManager WebSocketManager) *Tracker {
+	return &Tracker{
+		db:        database,
+		guid:      guid,
+		wsManager: wsManager,
+	}
+}
+
+// HandleMessage records the mentions in a newly stored message.
+// Registered as a message handler listener.
+func (t *Tracker) HandleMessage(msg *messages.Message) {
+	if msg.Type != messages.TypeText && msg.Type != messages.TypeRichText {
+		return
+	}
+
+	tokens := messages.ParseMentions(string(msg.Content))
+	if len(tokens) == 0 {
+		return
+	}
+
+	guids, err := t.resolve(tokens)
+	if err != nil {
+		logging.Error("Mentions", "Failed to resolve mentions in %s: %v", msg.ID, err)
+		return
+	}
+	if len(guids) == 0 {
+		return
+	}
+
+	if err := t.db.SaveMentions(msg, guids); err != nil {
+		logging.Error("Mentions", "Failed to save mentions for %s: %v", msg.ID, err)
+		return
+	}
+
+	// Only someone else naming us is worth a notification
+	if msg.SenderGUID == t.guid {
+		return
+	}
+	for _, guid := range guids {
+		if guid == t.guid {
+			logging.Info("Mentions", "Mentioned by %s in %s message %s", msg.SenderGUID, msg.Scope, msg.ID)
+			t.notify(msg)
+			break
+		}
+	}
+}
+
+// resolve maps mention tokens to node GUIDs. A token matches a known GUID
+// exactly or a node name case-insensitively; tokens that match nothing are dropped.
+func (t *Tracker) resolve(tokens []string) ([]string, error) {
+	ownName, err := t.db.GetName()
+	if err != nil {
+		return nil, err
+	}
+	knownPeers, err := t.db.GetAllPeers()
+	if err != nil {
+		return nil, err
+	}
+
+	byGUID := map[string]bool{t.guid: true}
+	byName := map[string][]string{strings.ToLower(ownName): {t.guid}}
+	for _, peer := range knownPeers {
+		byGUID[peer.GUID] = true
+		if peer.Username != "" {
+			name := strings.ToLower(peer.Username)
+			byName[name] = append(byName[name], peer.GUID)
+		}
+	}
+
+	var guids []string
+	seen := make(map[string]bool)
+	add := func(guid string) {
+		if !seen[guid] {
+			seen[guid] = true
+			guids = append(guids, guid)
+		}
+	}
+
+	for _, token := range tokens {
+		if byGUID[strings.ToLower(token)] {
+			add(strings.ToLower(token))
+			continue
+		}
+		// Names shared by several nodes mention all of them
+		for _, guid := range byName[strings.ToLower(token)] {
+			add(guid)
+		}
+	}
+
+	return guids, nil
+}
+
+// notify sends a mention event to local web clients
+func (t *Tracker) notify(msg *messages.Message) {
+	if t.wsManager == nil {
+		return
+	}
+
+	t.wsManager.Broadcast(struct {
+		Type    string     `json:"type"`
+		Content db.Mention `json:"content"`
+	}{
+		Type: "mention",
+		Content: db.Mention{
+			MessageID:     msg.ID,
+			MentionedGUID: t.guid,
+			SenderGUID:    msg.SenderGUID,
+			Scope:         msg.Scope,
+			Content:       string(msg.Content),
+			CreatedAt:     msg.Timestamp,
+		},
+	})
+}
@@ -0,0 +1,73 @@
+package messagehandler
+
+import (
+	"sync"
+
+	"cyberchat/server/messages"
+)
+
+// maxConcurrentDeliveries bounds how many normal and low priority deliveries run at once
+const maxConcurrentDeliveries = 4
+
+// deliveryLanes schedules outbound deliveries by priority. Urgent deliveries
+// never wait; normal deliveries wait for a free slot; low priority deliveries
+// only get a slot when no normal delivery is waiting for one.
+type deliveryLanes struct {
+	mu     sync.Mutex
+	active int
+	normal []chan struct{} // Waiting normal deliveries, oldest first
+	low    []chan struct{} // Waiting low priority deliveries, oldest first
+}
+
+// acquire blocks until a delivery of the given priority may start and returns
+// the function that must be called once it is done
+func (l *deliveryLanes) acquire(priority messages.Priority) func() {
+	if priority == messages.PriorityUrgent {
+		return func() {}
+	}
+
+	l.mu.Lock()
+	free := l.active < maxConcurrentDeliveries
+	if priority == messages.PriorityLow {
+		free = free && len(l.normal) == 0 && len(l.low) == 0
+	} else {
+		free = free && len(l.normal) == 0
+	}
+	if free {
+		l.active++
+		l.mu.Unlock()
+		return l.release
+	}
+
+	ready := make(chan struct{})
+	if priority == messages.PriorityLow {
+		l.low = append(l.low, ready)
+	} else {
+		l.normal = append(l.normal, ready)
+	}
+	l.mu.Unlock()
+
+	// release hands its slot over, so active already counts us
+	<-ready
+	return l.release
+}
+
+// release frees a slot, handing it to the oldest waiting normal delivery,
+// or to the oldest low priority one if no normal delivery is waiting
+func (l *deliveryLanes) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	switch {
+	case len(l.normal) > 0:
+		next := l.normal[0]
+		l.normal = l.normal[1:]
+		close(next)
+	case len(l.low) > 0:
+		next := l.low[0]
+		l.low = l.low[1:]
+		close(next)
+	default:
+		l.active--
+	}
+}
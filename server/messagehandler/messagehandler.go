@@ -7,24 +7,40 @@ import (
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"mime"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"cyberchat/server/db"
 	"cyberchat/server/discovery"
+	"cyberchat/server/files"
+	"cyberchat/server/imageproc"
+	"cyberchat/server/markdown"
 	"cyberchat/server/messages"
 	"cyberchat/server/peers"
+	"cyberchat/server/ratelimit"
 	"cyberchat/server/websocket"
 
 	"github.com/google/uuid"
 )
 
+const (
+	deliveryTimeout       = 500 * time.Millisecond // Per attempt for low and normal priority
+	urgentDeliveryTimeout = 2 * time.Second        // Per attempt for urgent messages
+	urgentAttempts        = 3                      // Delivery attempts for urgent messages
+	urgentRetryDelay      = 250 * time.Millisecond // Multiplied by the attempt number
+	urgentAlertWindow     = 10 * time.Minute       // Older urgent messages are not announced as alerts
+)
+
 // Handler handles all message-related operations
 type Handler struct {
 	db          *db.DB
@@ -35,10 +51,30 @@ type Handler struct {
 	peerMgr     *peers.Manager
 	OnMessage   func(*messages.Message)
 	failedPeers sync.Map // Tracks recently failed peers with their failure time
+	clock       *messages.LamportClock
+	lanes       deliveryLanes            // Orders outbound deliveries by priority
+	limits      *ratelimit.MessageLimits // Limits on inbound peer messages; nil means unlimited
+
+	// controlHandlers receive inbound control messages instead of ProcessMessage.
+	// Handlers must be registered before the server starts accepting requests.
+	controlHandlers map[messages.MessageType]func(*messages.Message, string)
+
+	// listeners are called with every new message once it is stored
+	listeners []func(*messages.Message)
 }
 
 // New creates a new message handler
 func New(db *db.DB, guid string, privateKey *rsa.PrivateKey, discovery *discovery.Service, wsManager *websocket.Manager, peerMgr *peers.Manager) *Handler {
+	// Continue the logical clock from the newest stored message
+	var start uint64
+	if db != nil {
+		if latest, err := db.GetMaxLamportClock(); err != nil {
+			log.Printf("[Message] Failed to load Lamport clock, starting from 0: %v", err)
+		} else {
+			start = latest
+		}
+	}
+
 	return &Handler{
 		db:         db,
 		guid:       guid,
@@ -46,11 +82,91 @@ func New(db *db.DB, guid string, privateKey *rsa.PrivateKey, discovery *discover
 		discovery:  discovery,
 		wsManager:  wsManager,
 		peerMgr:    peerMgr,
+		clock:      messages.NewLamportClock(start),
+
+		controlHandlers: make(map[messages.MessageType]func(*messages.Message, string)),
+	}
+}
+
+// RegisterControl routes inbound messages of the given type to fn instead of
+// storing them. Used for ephemeral signals that must not reach the messages table.
+func (h *Handler) RegisterControl(msgType messages.MessageType, fn func(*messages.Message, string)) {
+	h.controlHandlers[msgType] = fn
+}
+
+// SetRateLimits applies limits to messages received on the core message endpoint.
+// Must be called before the server starts.
+func (h *Handler) SetRateLimits(limits *ratelimit.MessageLimits) {
+	h.limits = limits
+}
+
+// AddListener registers fn to be called with every new message, local or
+// received, once it has been stored. Must be called before the server starts.
+func (h *Handler) AddListener(fn func(*messages.Message)) {
+	h.listeners = append(h.listeners, fn)
+}
+
+// SendControl forwards a control message to its audience in the background.
+// Unlike ProcessMessage it neither stores the message nor reports delivery to web clients.
+// Control traffic is low priority unless the caller says otherwise.
+func (h *Handler) SendControl(msg *messages.Message) {
+	if msg.Priority == "" {
+		msg.Priority = messages.PriorityLow
+	}
+
+	var targets []discovery.Peer
+	if msg.Scope == messages.ScopeBroadcast {
+		for _, mgrPeer := range h.peerMgr.GetPeers() {
+			if mgrPeer.GUID == h.guid {
+				continue
+			}
+			targets = append(targets, discovery.Peer{
+				GUID: mgrPeer.GUID,
+				Name: mgrPeer.Name,
+				IP:   net.ParseIP(mgrPeer.IPAddress),
+				Port: mgrPeer.Port,
+			})
+		}
+	} else if mgrPeer, exists := h.peerMgr.GetPeer(msg.ReceiverGUID); exists {
+		targets = append(targets, discovery.Peer{
+			GUID: mgrPeer.GUID,
+			Name: mgrPeer.Name,
+			IP:   net.ParseIP(mgrPeer.IPAddress),
+			Port: mgrPeer.Port,
+		})
 	}
+
+	go func() {
+		for _, peer := range targets {
+			peerMsg := *msg
+			peerMsg.ReceiverGUID = peer.GUID
+			if status := h.ForwardMessageToPeer(&peerMsg, &peer); !status.Success {
+				log.Printf("[Message] Failed to send %s control message to %s: %s", msg.Type, peer.GUID, status.Error)
+			}
+		}
+	}()
+}
+
+// AcquireLane blocks until network work of the given priority may start and
+// returns the function that releases its lane. Background traffic that does not
+// go through ForwardMessageToPeer uses it to yield to chat deliveries.
+func (h *Handler) AcquireLane(priority messages.Priority) func() {
+	return h.lanes.acquire(priority)
 }
 
 // ProcessMessage handles an incoming message internally and returns a delivery report
 func (h *Handler) ProcessMessage(msg *messages.Message, sourceIP string) *messages.MessageDeliveryReport {
+	return h.processMessage(msg, sourceIP, false)
+}
+
+// ProcessSyncedMessage handles a broadcast pulled by history sync. It arrives
+// long after it was sent, so its timestamp says nothing about the sender's
+// clock and it is not checked for clock skew.
+func (h *Handler) ProcessSyncedMessage(msg *messages.Message, sourceIP string) *messages.MessageDeliveryReport {
+	return h.processMessage(msg, sourceIP, true)
+}
+
+func (h *Handler) processMessage(msg *messages.Message, sourceIP string, synced bool) *messages.MessageDeliveryReport {
 	// Create delivery report
 	report := &messages.MessageDeliveryReport{
 		MessageID:    msg.ID,
@@ -67,9 +183,61 @@ func (h *Handler) ProcessMessage(msg *messages.Message, sourceIP string) *messag
 		}
 	}
 
+	// Messages from blocked peers can still arrive through history sync
+	if msg.SenderGUID != h.guid && h.isBlocked(msg.SenderGUID) {
+		log.Printf("[Message] Skipping message %s from blocked peer %s", msg.ID, msg.SenderGUID)
+		return report
+	}
+
+	// Stamp our own messages; merge the sender's clock into ours for everything else.
+	// Messages from nodes without a clock, or with one too far ahead of ours,
+	// are ordered by when we received them.
+	if msg.SenderGUID == h.guid {
+		msg.Clock = h.clock.Tick()
+	} else {
+		observed := h.clock.Observe(msg.Clock)
+		if msg.Clock == 0 || msg.Clock > observed {
+			msg.Clock = observed
+		}
+		if msg.ClockSkew = !synced && msg.HasClockSkew(time.Now()); msg.ClockSkew {
+			log.Printf("[Message] Clock skew on message %s from %s: sent at %s",
+				msg.ID, msg.SenderGUID, msg.Timestamp.Format(time.RFC3339))
+		}
+	}
+
+	// Strip EXIF and other metadata from our own images before they are stored
+	// or sent; an image it cannot be removed from is not sent at all
+	if msg.SenderGUID == h.guid && msg.Type == messages.TypeImage {
+		stripped, err := imageproc.StripMetadata(msg.Content)
+		if err != nil {
+			log.Printf("[Message] Rejecting image %s: failed to strip metadata: %v", msg.ID, err)
+			report.Rejected = &messages.ValidationError{Code: messages.CodeInvalidImage, Message: "image metadata could not be removed"}
+			report.Summary = report.Rejected.Message
+			return report
+		}
+		msg.Content = stripped
+	}
+
+	// Our own file offers carry a download token for our own web clients; each
+	// peer's copy gets a token of its own when it is forwarded
+	if msg.SenderGUID == h.guid {
+		h.AddDownloadToken(msg, h.guid)
+	}
+
+	// Rich text is rendered here rather than by clients so every client shows the
+	// same sanitized HTML. Other types never carry HTML, whatever the sender set.
+	msg.HTML = ""
+	if msg.Type == messages.TypeRichText {
+		msg.HTML = markdown.ToHTML(string(msg.Content))
+	}
+
 	// Store message with source IP before any processing
 	if err := h.db.SaveMessage(msg, sourceIP); err != nil {
 		log.Printf("Failed to store message: %v", err)
+	} else {
+		for _, listener := range h.listeners {
+			listener(msg)
+		}
 	}
 
 	// Only attempt peer discovery and broadcast for messages we originate
@@ -80,15 +248,7 @@ func (h *Handler) ProcessMessage(msg *messages.Message, sourceIP string) *messag
 		}
 
 		// Convert to web message format with string content
-		webMsg := &messages.WebMessage{
-			ID:           msg.ID,
-			SenderGUID:   msg.SenderGUID,
-			ReceiverGUID: msg.ReceiverGUID,
-			Type:         msg.Type,
-			Scope:        msg.Scope,
-			Content:      string(msg.Content),
-			Timestamp:    msg.Timestamp,
-		}
+		webMsg := msg.ToWebMessage()
 
 		// Broadcast to web clients
 		h.wsManager.Broadcast(struct {
@@ -193,12 +353,23 @@ func (h *Handler) ProcessMessage(msg *messages.Message, sourceIP string) *messag
 					},
 				})
 
+				// Urgent broadcasts go out to all peers at once instead of one after another
+				var urgentStatuses []messages.MessageDeliveryStatus
+				if msg.EffectivePriority() == messages.PriorityUrgent {
+					urgentStatuses = h.forwardToAll(msg, broadcastPeers)
+				}
+
 				// Forward to all peers
-				for _, peer := range broadcastPeers {
-					// Create a copy of the message with this peer as receiver
-					peerMsg := *msg
-					peerMsg.ReceiverGUID = peer.GUID
-					status := h.ForwardMessageToPeer(&peerMsg, &peer)
+				for i, peer := range broadcastPeers {
+					var status messages.MessageDeliveryStatus
+					if urgentStatuses != nil {
+						status = urgentStatuses[i]
+					} else {
+						// Create a copy of the message with this peer as receiver
+						peerMsg := *msg
+						peerMsg.ReceiverGUID = peer.GUID
+						status = h.ForwardMessageToPeer(&peerMsg, &peer)
+					}
 					report.PeerStatuses = append(report.PeerStatuses, status)
 
 					if status.Success {
@@ -207,7 +378,6 @@ func (h *Handler) ProcessMessage(msg *messages.Message, sourceIP string) *messag
 					} else {
 						report.Failed++
 						log.Printf("[Message] ✗ Failed to deliver to %s (%s): %s", peer.Name, peer.GUID, status.Error)
-						h.handleDeliveryFailure(&peer, &status)
 					}
 
 					// Send per-peer delivery status
@@ -350,7 +520,6 @@ func (h *Handler) ProcessMessage(msg *messages.Message, sourceIP string) *messag
 				} else {
 					report.Failed++
 					log.Printf("[Message] ✗ Failed to deliver private message to %s (%s): %s", peer.Name, peer.GUID, status.Error)
-					h.handleDeliveryFailure(peer, &status)
 				}
 
 				// Send final private message status
@@ -424,15 +593,7 @@ func (h *Handler) ProcessMessage(msg *messages.Message, sourceIP string) *messag
 		}
 	} else {
 		// For messages from other peers, just notify web clients
-		webMsg := &messages.WebMessage{
-			ID:           msg.ID,
-			SenderGUID:   msg.SenderGUID,
-			ReceiverGUID: msg.ReceiverGUID,
-			Type:         msg.Type,
-			Scope:        msg.Scope,
-			Content:      string(msg.Content),
-			Timestamp:    msg.Timestamp,
-		}
+		webMsg := msg.ToWebMessage()
 
 		h.wsManager.Broadcast(struct {
 			Type    string               `json:"type"`
@@ -443,6 +604,18 @@ func (h *Handler) ProcessMessage(msg *messages.Message, sourceIP string) *messag
 		})
 
 		log.Printf("[Message] Received %s message (ID: %s) from %s", msg.Scope, msg.ID, msg.SenderGUID)
+
+		// Alert web clients to urgent messages, unless they are old news merged by history sync
+		if msg.EffectivePriority() == messages.PriorityUrgent && time.Since(msg.Timestamp) < urgentAlertWindow {
+			log.Printf("[Message] Urgent message %s from %s", msg.ID, msg.SenderGUID)
+			h.wsManager.Broadcast(struct {
+				Type    string               `json:"type"`
+				Content *messages.WebMessage `json:"content"`
+			}{
+				Type:    "urgent",
+				Content: webMsg,
+			})
+		}
 	}
 
 	// Log overall delivery status with more detail
@@ -473,9 +646,168 @@ func (h *Handler) ProcessMessage(msg *messages.Message, sourceIP string) *messag
 	return report
 }
 
-// ForwardMessageToPeer forwards a message to a specific peer and returns the delivery status
+// ForwardMessageToPeer forwards a message to a specific peer and returns the delivery status.
+// The delivery waits for a lane according to the message priority. Urgent messages
+// are retried with a longer timeout before the peer is treated as unreachable.
+// A peer that rate limits us is not treated as unreachable. Rich text that a
+// peer rejects as an unknown type is sent again as its plain text rendering.
 func (h *Handler) ForwardMessageToPeer(msg *messages.Message, peer *discovery.Peer) messages.MessageDeliveryStatus {
-	status := messages.MessageDeliveryStatus{
+	release := h.lanes.acquire(msg.EffectivePriority())
+	defer release()
+
+	if msg.IsFileOffer() {
+		peerMsg := *msg
+		h.AddDownloadToken(&peerMsg, peer.GUID)
+		msg = &peerMsg
+	}
+
+	attempts, timeout := 1, deliveryTimeout
+	if msg.EffectivePriority() == messages.PriorityUrgent {
+		attempts, timeout = urgentAttempts, urgentDeliveryTimeout
+	}
+
+	var status messages.MessageDeliveryStatus
+	var reachable bool
+	var code string
+	for attempt := 1; ; attempt++ {
+		status, reachable, code = h.sendToPeer(msg, peer, timeout)
+		if !status.Success && code == messages.CodeInvalidType && msg.Type == messages.TypeRichText {
+			// Older nodes only understand text; the copy keeps the ID so it is the same message
+			log.Printf("[Message] Peer %s does not support rich text, sending %s as text", peer.GUID, msg.ID)
+			fallback := *msg
+			fallback.Type = messages.TypeText
+			fallback.Content = []byte(markdown.ToText(string(msg.Content)))
+			fallback.HTML = ""
+			msg = &fallback
+			status, reachable, code = h.sendToPeer(msg, peer, timeout)
+		}
+		if status.Success || attempt >= attempts {
+			break
+		}
+		log.Printf("[Message] Retrying urgent message %s to %s (attempt %d/%d): %s",
+			msg.ID, peer.GUID, attempt+1, attempts, status.Error)
+		time.Sleep(time.Duration(attempt) * urgentRetryDelay)
+	}
+
+	if !status.Success && !reachable {
+		h.handleDeliveryFailure(peer, &status)
+	}
+	return status
+}
+
+// AddDownloadToken puts a download token for audience into the file offer in
+// msg, replacing any token it had, along with the file's content hash, the
+// key its body is encrypted with, its chunk manifest and a seed token for the
+// nodes serving copies if it is swarmed and, for directories, its kind. Other
+// fields of the offer are kept as sent.
+func (h *Handler) AddDownloadToken(msg *messages.Message, audience string) {
+	if !msg.IsFileOffer() {
+		return
+	}
+
+	var offer map[string]json.RawMessage
+	if err := json.Unmarshal(msg.Content, &offer); err != nil {
+		log.Printf("[Message] Failed to parse file offer in %s: %v", msg.ID, err)
+		return
+	}
+	var fileID string
+	if err := json.Unmarshal(offer["file_id"], &fileID); err != nil {
+		log.Printf("[Message] File offer in %s has no file_id", msg.ID)
+		return
+	}
+
+	// The registered hash is signed into the token and shown in the offer, and
+	// the file key goes along for the receiver to decrypt the body with
+	var hash string
+	var swarmed bool
+	ttl := files.DownloadTokenTTL
+	delete(offer, "seed_token")
+	if record, err := h.db.GetFile(fileID); err != nil {
+		log.Printf("[Message] Failed to look up file %s: %v", fileID, err)
+	} else if record != nil {
+		hash = record.SHA256
+		if hash != "" {
+			offer["sha256"], _ = json.Marshal(hash)
+		}
+		if record.EncKey != "" {
+			offer["encryption"], _ = json.Marshal(messages.FileEncryptionScheme)
+			offer["key"], _ = json.Marshal(record.EncKey)
+		}
+		// A shared directory is listed when the offer is sent, so its kind and
+		// total size come from the record
+		if record.Kind == messages.FileKindDirectory {
+			offer["kind"], _ = json.Marshal(record.Kind)
+			offer["size"], _ = json.Marshal(record.Size)
+		}
+		// Limits are shown to the receiver, and a token outlives no share
+		if record.ExpiresAt != nil {
+			offer["expires_at"], _ = json.Marshal(record.ExpiresAt)
+			if remaining := time.Until(*record.ExpiresAt); remaining > 0 && remaining < ttl {
+				ttl = remaining
+			}
+		}
+		if record.MaxDownloads > 0 {
+			offer["max_downloads"], _ = json.Marshal(record.MaxDownloads)
+		}
+		// Receivers that verified a copy serve its chunks to the others
+		if record.Chunks != "" && record.EncKey != "" {
+			offer["chunks"] = json.RawMessage(record.Chunks)
+			swarmed = true
+		}
+	}
+
+	token, err := files.IssueToken(h.privateKey, fileID, audience, hash, ttl)
+	if err != nil {
+		log.Printf("[Message] Failed to issue download token for %s: %v", fileID, err)
+		return
+	}
+	offer["token"], _ = json.Marshal(token)
+
+	// Nodes serving copies get a token of their own, which this node refuses,
+	// so they cannot download from it as the receiver. Our own clients fetch
+	// from us alone.
+	if swarmed && audience != h.guid {
+		seedToken, err := files.IssueSeedToken(h.privateKey, fileID, audience, ttl)
+		if err != nil {
+			log.Printf("[Message] Failed to issue seed token for %s: %v", fileID, err)
+		} else {
+			offer["seed_token"], _ = json.Marshal(seedToken)
+		}
+	}
+
+	content, err := json.Marshal(offer)
+	if err != nil {
+		log.Printf("[Message] Failed to marshal file offer in %s: %v", msg.ID, err)
+		return
+	}
+	msg.Content = content
+}
+
+// forwardToAll forwards a copy of msg to every peer concurrently. Statuses are
+// returned in the order of peers.
+func (h *Handler) forwardToAll(msg *messages.Message, peers []discovery.Peer) []messages.MessageDeliveryStatus {
+	statuses := make([]messages.MessageDeliveryStatus, len(peers))
+
+	var wg sync.WaitGroup
+	for i := range peers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			peerMsg := *msg
+			peerMsg.ReceiverGUID = peers[i].GUID
+			statuses[i] = h.ForwardMessageToPeer(&peerMsg, &peers[i])
+		}(i)
+	}
+	wg.Wait()
+
+	return statuses
+}
+
+// sendToPeer makes a single delivery attempt of msg to peer. reachable is false
+// when the failure means the peer is gone rather than that it refused the message.
+// code is the validation error code of a rejected message, if the peer sent one.
+func (h *Handler) sendToPeer(msg *messages.Message, peer *discovery.Peer, timeout time.Duration) (status messages.MessageDeliveryStatus, reachable bool, code string) {
+	status = messages.MessageDeliveryStatus{
 		PeerGUID: peer.GUID,
 		PeerName: peer.Name,
 		Time:     time.Now(),
@@ -486,8 +818,7 @@ func (h *Handler) ForwardMessageToPeer(msg *messages.Message, peer *discovery.Pe
 	if err != nil {
 		status.Success = false
 		status.Error = fmt.Sprintf("Failed to get public key: %v", err)
-		h.handleDeliveryFailure(peer, &status)
-		return status
+		return status, false, ""
 	}
 
 	// Parse public key
@@ -495,16 +826,14 @@ func (h *Handler) ForwardMessageToPeer(msg *messages.Message, peer *discovery.Pe
 	if block == nil {
 		status.Success = false
 		status.Error = "Failed to decode public key"
-		h.handleDeliveryFailure(peer, &status)
-		return status
+		return status, false, ""
 	}
 
 	receiverPubKey, err := x509.ParsePKCS1PublicKey(block.Bytes)
 	if err != nil {
 		status.Success = false
 		status.Error = fmt.Sprintf("Failed to parse public key: %v", err)
-		h.handleDeliveryFailure(peer, &status)
-		return status
+		return status, false, ""
 	}
 
 	// Encrypt message for peer
@@ -512,8 +841,7 @@ func (h *Handler) ForwardMessageToPeer(msg *messages.Message, peer *discovery.Pe
 	if err != nil {
 		status.Success = false
 		status.Error = fmt.Sprintf("Failed to encrypt message: %v", err)
-		h.handleDeliveryFailure(peer, &status)
-		return status
+		return status, false, ""
 	}
 
 	// Create HTTP client with short timeout
@@ -523,11 +851,11 @@ func (h *Handler) ForwardMessageToPeer(msg *messages.Message, peer *discovery.Pe
 				InsecureSkipVerify: true,
 			},
 			DialContext: (&net.Dialer{
-				Timeout: 500 * time.Millisecond,
+				Timeout: timeout,
 			}).DialContext,
-			TLSHandshakeTimeout: 500 * time.Millisecond,
+			TLSHandshakeTimeout: timeout,
 		},
-		Timeout: 500 * time.Millisecond,
+		Timeout: timeout,
 	}
 
 	// Marshal encrypted message
@@ -535,8 +863,7 @@ func (h *Handler) ForwardMessageToPeer(msg *messages.Message, peer *discovery.Pe
 	if err != nil {
 		status.Success = false
 		status.Error = fmt.Sprintf("Failed to marshal message: %v", err)
-		h.handleDeliveryFailure(peer, &status)
-		return status
+		return status, false, ""
 	}
 
 	// Forward to peer's server
@@ -545,8 +872,7 @@ func (h *Handler) ForwardMessageToPeer(msg *messages.Message, peer *discovery.Pe
 	if err != nil {
 		status.Success = false
 		status.Error = fmt.Sprintf("Failed to send message: %v", err)
-		h.handleDeliveryFailure(peer, &status)
-		return status
+		return status, false, ""
 	}
 	defer resp.Body.Close()
 
@@ -554,12 +880,18 @@ func (h *Handler) ForwardMessageToPeer(msg *messages.Message, peer *discovery.Pe
 		body, _ := io.ReadAll(resp.Body)
 		status.Success = false
 		status.Error = fmt.Sprintf("Peer returned error (HTTP %d): %s", resp.StatusCode, string(body))
-		h.handleDeliveryFailure(peer, &status)
-		return status
+		if resp.StatusCode == http.StatusBadRequest {
+			var rejection messages.ValidationError
+			if json.Unmarshal(body, &rejection) == nil {
+				code = rejection.Code
+			}
+		}
+		// A rate limited peer is alive; it just wants us to slow down
+		return status, resp.StatusCode == http.StatusTooManyRequests || code != "", code
 	}
 
 	status.Success = true
-	return status
+	return status, true, ""
 }
 
 // handleDeliveryFailure handles a failed message delivery by removing the peer from memory
@@ -791,79 +1123,151 @@ func (h *Handler) discoverPeerFromMessage(msg *messages.Message, sourceIP string
 	})
 }
 
-// HandleMessage processes an HTTP message request
+// HandleMessage receives an encrypted message from a peer. Only encrypted
+// envelopes are accepted here; web clients send through the client API, so a
+// malformed peer payload can never be taken for a locally originated message.
 func (h *Handler) HandleMessage(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Read request body
-	body, err := io.ReadAll(r.Body)
+	// Only the connection's address identifies the source; X-Forwarded-For is
+	// chosen by the sender, and control handlers authenticate peers by this address
+	sourceIP, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		http.Error(w, "Failed to read request body", http.StatusBadRequest)
-		return
+		sourceIP = r.RemoteAddr
 	}
 
-	// Get source IP
-	sourceIP := r.RemoteAddr
-	if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
-		sourceIP = forwardedFor
+	if h.limits != nil {
+		if ok, wait := h.limits.AllowSource(sourceIP); !ok {
+			log.Printf("[Message] Rate limited message from %s", sourceIP)
+			writeRateLimited(w, wait)
+			return
+		}
 	}
 
-	var report *messages.MessageDeliveryReport
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	if r.ContentLength > messages.MaxEnvelopeSize {
+		messages.WriteValidationError(w, &messages.ValidationError{Code: messages.CodeContentTooLarge, Message: "message envelope too large"})
+		return
+	}
 
-	// Try to parse as an encrypted message first
+	// Decode the envelope straight from the capped body; exactly one JSON object is allowed
 	var encMsg messages.EncryptedMessage
-	if err := json.Unmarshal(body, &encMsg); err == nil {
-		// Validate this message is for us
-		if encMsg.ReceiverGUID != h.guid {
-			log.Printf("Message not intended for this server (got %s, expected %s)", encMsg.ReceiverGUID, h.guid)
-			http.Error(w, "Message not intended for this server", http.StatusBadRequest)
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, messages.MaxEnvelopeSize))
+	if err := decoder.Decode(&encMsg); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			messages.WriteValidationError(w, &messages.ValidationError{Code: messages.CodeContentTooLarge, Message: "message envelope too large"})
 			return
 		}
+		messages.WriteValidationError(w, &messages.ValidationError{Code: messages.CodeInvalidEnvelope, Message: "failed to parse message envelope"})
+		return
+	}
+	if err := decoder.Decode(&struct{}{}); err != io.EOF {
+		messages.WriteValidationError(w, &messages.ValidationError{Code: messages.CodeInvalidEnvelope, Message: "unexpected data after message envelope"})
+		return
+	}
 
-		// Decrypt the message
-		message, err := encMsg.Decrypt(h.privateKey)
-		if err != nil {
-			log.Printf("Failed to decrypt message: %v", err)
-			http.Error(w, "Failed to decrypt message", http.StatusInternalServerError)
-			return
-		}
+	if err := encMsg.Validate(); err != nil {
+		log.Printf("[Message] Rejecting envelope %s from %s: %v", encMsg.ID, sourceIP, err)
+		messages.WriteValidationError(w, err)
+		return
+	}
 
-		log.Printf("Successfully decrypted message from %s", message.SenderGUID)
+	// Validate this message is for us
+	if encMsg.ReceiverGUID != h.guid {
+		log.Printf("Message not intended for this server (got %s, expected %s)", encMsg.ReceiverGUID, h.guid)
+		http.Error(w, "Message not intended for this server", http.StatusBadRequest)
+		return
+	}
 
-		// Only try to discover peer if message is not from us
-		if message.SenderGUID != h.guid {
-			// Try to discover peer from message
-			h.discoverPeerFromMessage(message, sourceIP)
-		}
+	// Our own GUID on an inbound envelope is never genuine
+	if encMsg.SenderGUID == h.guid {
+		log.Printf("[Message] Rejecting message %s from %s claiming to be from us", encMsg.ID, sourceIP)
+		http.Error(w, "Invalid sender", http.StatusBadRequest)
+		return
+	}
 
-		// Process the decrypted message
-		report = h.ProcessMessage(message, sourceIP)
-	} else {
-		// If not encrypted, try to parse as a web client message
-		var msg struct {
-			Type         string `json:"type"`
-			Content      string `json:"content"`
-			ReceiverGUID string `json:"receiver_guid"`
-			Scope        string `json:"scope"`
-		}
-		if err := json.Unmarshal(body, &msg); err != nil {
-			http.Error(w, "Failed to parse message", http.StatusBadRequest)
+	// Decrypt the message
+	message, err := encMsg.Decrypt(h.privateKey)
+	if err != nil {
+		log.Printf("Failed to decrypt message: %v", err)
+		http.Error(w, "Failed to decrypt message", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Successfully decrypted message from %s", message.SenderGUID)
+
+	if h.limits != nil {
+		if ok, wait := h.limits.AllowSender(message.SenderGUID); !ok {
+			log.Printf("[Message] Rate limited message %s from %s", message.ID, message.SenderGUID)
+			writeRateLimited(w, wait)
 			return
 		}
+	}
+
+	// Malformed content is rejected before it reaches any subsystem or the database
+	if err := message.ValidateContent(); err != nil {
+		log.Printf("[Message] Rejecting %s message %s from %s: %v", message.Type, message.ID, message.SenderGUID, err)
+		messages.WriteValidationError(w, err)
+		return
+	}
 
-		// Create a new message from the web client data
-		message := messages.NewWebMessage(h.guid, msg.ReceiverGUID, messages.MessageType(msg.Type), msg.Content)
-		message.Scope = messages.MessageScope(msg.Scope)
+	// Blocked peers get the usual answer so they cannot tell they are blocked
+	if h.isBlocked(message.SenderGUID) {
+		log.Printf("[Message] Dropping %s message %s from blocked peer %s", message.Type, message.ID, message.SenderGUID)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	// Try to discover peer from message
+	h.discoverPeerFromMessage(message, sourceIP)
 
-		// Process the message
-		report = h.ProcessMessage(message, sourceIP)
+	// Control messages go to their subsystem and are never stored
+	if handler, ok := h.controlHandlers[message.Type]; ok {
+		handler(message, sourceIP)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	if err := message.ValidateChat(); err != nil {
+		log.Printf("[Message] Rejecting %s message %s from %s: %v", message.Type, message.ID, message.SenderGUID, err)
+		messages.WriteValidationError(w, err)
+		return
 	}
 
+	// Process the decrypted message
+	report := h.ProcessMessage(message, sourceIP)
+
 	// Return delivery report
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusAccepted)
 	json.NewEncoder(w).Encode(report)
 }
+
+// isBlocked reports whether messages from guid are refused
+func (h *Handler) isBlocked(guid string) bool {
+	if h.db == nil {
+		return false
+	}
+	blocked, err := h.db.IsPeerBlocked(guid)
+	if err != nil {
+		log.Printf("[Message] Failed to check whether %s is blocked: %v", guid, err)
+		return false
+	}
+	return blocked
+}
+
+// writeRateLimited rejects a request with 429 and tells the sender when to retry
+func writeRateLimited(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, "Too many messages", http.StatusTooManyRequests)
+}
@@ -0,0 +1,66 @@
+package messages
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// MaxClockSkew is how far a sender's wall clock may differ from ours before
+	// the message is flagged. Ordering never depends on wall clocks alone.
+	MaxClockSkew = 5 * time.Minute
+
+	// MaxClock is the largest Lamport stamp accepted from a peer. Stamps are
+	// stored as SQLite integers, which are signed.
+	MaxClock = math.MaxInt64
+
+	// MaxClockJump bounds how far one received stamp moves our clock forward,
+	// so a peer cannot push it to the end of its range
+	MaxClockJump = 1 << 32
+)
+
+// LamportClock is a logical clock that gives messages a causal order across
+// nodes regardless of how far their wall clocks have drifted apart
+type LamportClock struct {
+	mu   sync.Mutex
+	time uint64
+}
+
+// NewLamportClock creates a clock that continues from start
+func NewLamportClock(start uint64) *LamportClock {
+	return &LamportClock{time: start}
+}
+
+// Tick advances the clock for a locally originated message and returns its stamp
+func (c *LamportClock) Tick() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.time++
+	return c.time
+}
+
+// Observe merges a stamp received from another node and returns the local
+// time of the receive event. A stamp more than MaxClockJump ahead of ours
+// only moves the clock that far, and the receive time is then below it.
+func (c *LamportClock) Observe(remote uint64) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if remote > c.time {
+		c.time += min(remote-c.time, MaxClockJump)
+	}
+	c.time++
+	return c.time
+}
+
+// HasClockSkew reports whether the message's wall clock timestamp differs
+// from now by more than MaxClockSkew
+func (m *Message) HasClockSkew(now time.Time) bool {
+	diff := now.Sub(m.Timestamp)
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff > MaxClockSkew
+}
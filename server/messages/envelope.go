@@ -0,0 +1,53 @@
+package messages
+
+import (
+	"encoding/base64"
+
+	"github.com/google/uuid"
+)
+
+// EnvelopeVersion is the version of the EncryptedMessage format sent by this node.
+// Envelopes without a version come from older nodes and are read as version 1.
+const EnvelopeVersion = 1
+
+// MaxEnvelopeSize bounds the encoded size of an EncryptedMessage: the largest
+// content after AES-GCM sealing and base64 encoding, plus room for the other fields
+const MaxEnvelopeSize = (MaxMessageSize+64)/3*4 + 4 + 64*1024
+
+// Validate checks the envelope's version and fields before any decryption is attempted.
+// Errors are *ValidationError.
+func (em *EncryptedMessage) Validate() error {
+	if em.Version < 0 || em.Version > EnvelopeVersion {
+		return newValidationError(CodeUnsupportedVersion, "unsupported envelope version %d", em.Version)
+	}
+
+	if _, err := uuid.Parse(em.ID); err != nil {
+		return newValidationError(CodeInvalidEnvelope, "envelope has invalid id")
+	}
+	if em.SenderGUID == "" || em.ReceiverGUID == "" {
+		return newValidationError(CodeInvalidEnvelope, "envelope requires sender_guid and receiver_guid")
+	}
+	if em.Type == "" {
+		return newValidationError(CodeInvalidEnvelope, "envelope requires type")
+	}
+	if em.Scope != ScopePrivate && em.Scope != ScopeBroadcast {
+		return newValidationError(CodeInvalidEnvelope, "envelope has invalid scope %q", em.Scope)
+	}
+	if em.Clock > MaxClock {
+		return newValidationError(CodeInvalidEnvelope, "envelope clock is out of range")
+	}
+	if !em.Priority.Valid() {
+		return newValidationError(CodeInvalidPriority, "invalid message priority: %s", em.Priority)
+	}
+
+	if em.Content == "" {
+		return newValidationError(CodeEmptyContent, "message content cannot be empty")
+	}
+	if em.EncryptedKey != "" {
+		if _, err := base64.StdEncoding.DecodeString(em.EncryptedKey); err != nil {
+			return newValidationError(CodeInvalidEnvelope, "envelope encrypted_key is not valid base64")
+		}
+	}
+
+	return nil
+}
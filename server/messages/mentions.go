@@ -0,0 +1,49 @@
+package messages
+
+import (
+	"strings"
+	"unicode"
+)
+
+// ParseMentions returns the distinct @mentions in text content without the
+// leading @, in order of appearance. A mention must start the text or follow
+// whitespace or punctuation, so e-mail addresses are not matched.
+func ParseMentions(content string) []string {
+	var mentions []string
+	seen := make(map[string]bool)
+
+	runes := []rune(content)
+	for i := 0; i < len(runes); i++ {
+		if runes[i] != '@' {
+			continue
+		}
+		if i > 0 && !unicode.IsSpace(runes[i-1]) && !unicode.IsPunct(runes[i-1]) {
+			continue
+		}
+
+		end := i + 1
+		for end < len(runes) && isMentionRune(runes[end]) {
+			end++
+		}
+
+		// Trailing dots and dashes are sentence punctuation, not part of the name
+		token := strings.TrimRight(string(runes[i+1:end]), ".-")
+		i = end - 1
+		if token == "" {
+			continue
+		}
+
+		key := strings.ToLower(token)
+		if !seen[key] {
+			seen[key] = true
+			mentions = append(mentions, token)
+		}
+	}
+
+	return mentions
+}
+
+// isMentionRune reports whether r can appear in a peer name or GUID mention
+func isMentionRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.'
+}
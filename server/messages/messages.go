@@ -1,6 +1,8 @@
 package messages
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
@@ -8,12 +10,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"time"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
 )
 
 const (
-	MaxMessageSize = 100 * 1024 * 1024 // 100MB
+	MaxMessageSize  = 100 * 1024 * 1024 // 100MB
+	MaxRichTextSize = 16 * 1024         // Markdown source of a rich text message
 )
 
 // MessageType represents the type of message content
@@ -26,6 +30,20 @@ const (
 	TypeText  MessageType = "text"
 	TypeImage MessageType = "image"
 	TypeFile  MessageType = "file"
+	TypePoll  MessageType = "poll"
+
+	// TypeRichText carries CommonMark. Nodes store it with HTML rendered by the
+	// markdown package; older nodes are sent a TypeText copy instead.
+	TypeRichText MessageType = "rich_text"
+
+	// Control message types are exchanged between nodes but never stored as chat messages
+	TypePresence   MessageType = "presence"
+	TypePollVote   MessageType = "poll_vote"
+	TypePollAction MessageType = "poll_action"
+	TypePin        MessageType = "pin"
+	TypeTopic      MessageType = "topic"
+	TypeFileRevoke MessageType = "file_revoke"
+	TypeFileSource MessageType = "file_source"
 
 	// Message scope constants
 	ScopePrivate   MessageScope = "private"   // Message sent to a single peer
@@ -41,6 +59,10 @@ type Message struct {
 	Scope        MessageScope `json:"scope"`
 	Content      []byte       `json:"content"`
 	Timestamp    time.Time    `json:"timestamp"`
+	Clock        uint64       `json:"clock,omitempty"`      // Lamport clock stamped by the sender
+	ClockSkew    bool         `json:"clock_skew,omitempty"` // Sender's wall clock differed greatly from ours
+	Priority     Priority     `json:"priority,omitempty"`   // Unset means normal
+	HTML         string       `json:"html,omitempty"`       // Sanitized rendering of rich text, made by the storing node
 }
 
 // WebMessage represents a message for web client communication
@@ -52,6 +74,10 @@ type WebMessage struct {
 	Scope        MessageScope `json:"scope"`
 	Content      string       `json:"content"` // String content for web clients
 	Timestamp    time.Time    `json:"timestamp"`
+	Clock        uint64       `json:"clock,omitempty"`
+	ClockSkew    bool         `json:"clock_skew,omitempty"`
+	Priority     Priority     `json:"priority,omitempty"`
+	HTML         string       `json:"html,omitempty"`
 }
 
 // MessageDeliveryStatus represents the delivery status for a single peer
@@ -72,6 +98,9 @@ type MessageDeliveryReport struct {
 	DeliveryTime time.Time               `json:"delivery_time"`
 	PeerStatuses []MessageDeliveryStatus `json:"peer_statuses"`
 	Summary      string                  `json:"summary"` // Human-readable delivery summary
+
+	// Rejected is set when the message was refused before it was stored or sent
+	Rejected *ValidationError `json:"rejected,omitempty"`
 }
 
 // NewMessage creates a new message
@@ -102,6 +131,7 @@ func NewWebMessage(senderGUID string, receiverGUID string, messageType MessageTy
 
 // EncryptedMessage represents an encrypted message ready for transmission
 type EncryptedMessage struct {
+	Version      int          `json:"version"` // Envelope format; see EnvelopeVersion
 	ID           string       `json:"id"`
 	SenderGUID   string       `json:"sender_guid"`
 	ReceiverGUID string       `json:"receiver_guid"`
@@ -109,27 +139,50 @@ type EncryptedMessage struct {
 	Scope        MessageScope `json:"scope"`
 	Content      string       `json:"content"` // Base64 encoded encrypted content
 	Timestamp    time.Time    `json:"timestamp"`
+	Clock        uint64       `json:"clock,omitempty"`         // Lamport clock, absent from older nodes
+	EncryptedKey string       `json:"encrypted_key,omitempty"` // Base64 RSA-wrapped AES key; set when content is AES-GCM encrypted
+	Priority     Priority     `json:"priority,omitempty"`      // Absent from older nodes, meaning normal
 }
 
-// Encrypt encrypts a message for the receiver using their public key
+// Encrypt encrypts a message for the receiver using their public key.
+// Content that fits in a single RSA-OAEP block is encrypted directly so older
+// nodes can still read it; larger content is sealed with a random AES-256-GCM
+// key that is itself RSA-encrypted.
 func (m *Message) Encrypt(receiverKey *rsa.PublicKey) (*EncryptedMessage, error) {
-	// Encrypt content
 	label := []byte(m.ID) // Use message ID as label for additional security
-	ciphertext, err := rsa.EncryptOAEP(
-		sha256.New(),
-		rand.Reader,
-		receiverKey,
-		m.Content,
-		label,
-	)
-	if err != nil {
-		return nil, fmt.Errorf("failed to encrypt message: %w", err)
+
+	var ciphertext []byte
+	var encryptedKey string
+	if len(m.Content) <= maxOAEPPlaintext(receiverKey) {
+		var err error
+		ciphertext, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, receiverKey, m.Content, label)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt message: %w", err)
+		}
+	} else {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("failed to generate content key: %w", err)
+		}
+
+		sealed, err := sealContent(key, m.Content, label)
+		if err != nil {
+			return nil, err
+		}
+		ciphertext = sealed
+
+		wrappedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, receiverKey, key, label)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt content key: %w", err)
+		}
+		encryptedKey = base64.StdEncoding.EncodeToString(wrappedKey)
 	}
 
 	// Encode encrypted content as base64
 	encoded := base64.StdEncoding.EncodeToString(ciphertext)
 
 	return &EncryptedMessage{
+		Version:      EnvelopeVersion,
 		ID:           m.ID,
 		SenderGUID:   m.SenderGUID,
 		ReceiverGUID: m.ReceiverGUID,
@@ -137,6 +190,9 @@ func (m *Message) Encrypt(receiverKey *rsa.PublicKey) (*EncryptedMessage, error)
 		Scope:        m.Scope,
 		Content:      encoded,
 		Timestamp:    m.Timestamp,
+		Clock:        m.Clock,
+		EncryptedKey: encryptedKey,
+		Priority:     m.Priority,
 	}, nil
 }
 
@@ -148,17 +204,29 @@ func (em *EncryptedMessage) Decrypt(privateKey *rsa.PrivateKey) (*Message, error
 		return nil, fmt.Errorf("failed to decode message content: %w", err)
 	}
 
-	// Decrypt content
 	label := []byte(em.ID) // Use message ID as label
-	plaintext, err := rsa.DecryptOAEP(
-		sha256.New(),
-		rand.Reader,
-		privateKey,
-		ciphertext,
-		label,
-	)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decrypt message: %w", err)
+
+	var plaintext []byte
+	if em.EncryptedKey == "" {
+		plaintext, err = rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, ciphertext, label)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt message: %w", err)
+		}
+	} else {
+		wrappedKey, err := base64.StdEncoding.DecodeString(em.EncryptedKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode content key: %w", err)
+		}
+
+		key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, wrappedKey, label)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt content key: %w", err)
+		}
+
+		plaintext, err = openContent(key, ciphertext, label)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return &Message{
@@ -169,32 +237,123 @@ func (em *EncryptedMessage) Decrypt(privateKey *rsa.PrivateKey) (*Message, error
 		Scope:        em.Scope,
 		Content:      plaintext,
 		Timestamp:    em.Timestamp,
+		Clock:        em.Clock,
+		Priority:     em.Priority,
 	}, nil
 }
 
-// ValidateContent checks if the message content is valid
+// maxOAEPPlaintext returns the largest plaintext RSA-OAEP with SHA-256 can encrypt under key
+func maxOAEPPlaintext(key *rsa.PublicKey) int {
+	return key.Size() - 2*sha256.Size - 2
+}
+
+// sealContent encrypts content with AES-GCM, binding it to label. The nonce is prepended.
+func sealContent(key, content, label []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return gcm.Seal(nonce, nonce, content, label), nil
+}
+
+// openContent reverses sealContent
+func openContent(key, sealed, label []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("encrypted content too short")
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], label)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt message: %w", err)
+	}
+	return plaintext, nil
+}
+
+// ValidateContent checks if the message content is valid.
+// Errors are *ValidationError so callers can report a stable code.
 func (m *Message) ValidateContent() error {
 	if len(m.Content) == 0 {
-		return fmt.Errorf("message content cannot be empty")
+		return newValidationError(CodeEmptyContent, "message content cannot be empty")
+	}
+
+	if !m.Priority.Valid() {
+		return newValidationError(CodeInvalidPriority, "invalid message priority: %s", m.Priority)
 	}
 
 	if len(m.Content) > MaxMessageSize {
-		return fmt.Errorf("message content exceeds maximum size of %d bytes", MaxMessageSize)
+		return newValidationError(CodeContentTooLarge, "message content exceeds maximum size of %d bytes", MaxMessageSize)
 	}
 
 	switch m.Type {
 	case TypeText:
-		// Text messages don't need additional validation
+		// The web client announces files as JSON text, so hold those to the file offer schema
+		if isFileOffer(m.Content) {
+			_, err := ParseFileOffer(m.Content)
+			return err
+		}
 		return nil
-	case TypeImage:
-		// TODO: Add image format validation
+	case TypeRichText:
+		if len(m.Content) > MaxRichTextSize {
+			return newValidationError(CodeContentTooLarge, "rich text exceeds maximum size of %d bytes", MaxRichTextSize)
+		}
+		if !utf8.Valid(m.Content) {
+			return newValidationError(CodeInvalidRichText, "rich text must be valid UTF-8")
+		}
 		return nil
+	case TypeImage:
+		_, _, _, err := ValidateImage(m.Content)
+		return err
 	case TypeFile:
-		// TODO: Add file type validation
+		_, err := ParseFileOffer(m.Content)
+		return err
+	case TypePoll:
+		if _, err := ParsePoll(m.Content); err != nil {
+			return newValidationError(CodeInvalidPoll, "%v", err)
+		}
 		return nil
 	default:
-		return fmt.Errorf("invalid message type: %s", m.Type)
+		if m.Type.IsControl() {
+			// Control payloads are validated by the subsystem that handles them
+			return nil
+		}
+		return newValidationError(CodeInvalidType, "invalid message type: %s", m.Type)
+	}
+}
+
+// ValidateChat checks a message that is to be stored and shown as chat: its
+// content as ValidateContent does, and that it is not a control message,
+// which only travels between the subsystems of nodes
+func (m *Message) ValidateChat() error {
+	if m.Type.IsControl() {
+		return newValidationError(CodeInvalidType, "%s is a control message type", m.Type)
+	}
+	return m.ValidateContent()
+}
+
+// IsControl reports whether t is a control message type
+func (t MessageType) IsControl() bool {
+	switch t {
+	case TypePresence, TypePollVote, TypePollAction, TypePin, TypeTopic, TypeFileRevoke, TypeFileSource:
+		return true
 	}
+	return false
 }
 
 // ToJSON converts a message to JSON
@@ -221,6 +380,10 @@ func (m *Message) ToWebMessage() *WebMessage {
 		Scope:        m.Scope,
 		Content:      string(m.Content),
 		Timestamp:    m.Timestamp,
+		Clock:        m.Clock,
+		ClockSkew:    m.ClockSkew,
+		Priority:     m.EffectivePriority(),
+		HTML:         m.HTML,
 	}
 }
 
@@ -0,0 +1,68 @@
+package messages
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	MinPollOptions   = 2
+	MaxPollOptions   = 20
+	MaxPollTextSize  = 500 // Maximum length of the question and of each option
+	PollActionClose  = "close"
+	PollActionReveal = "reveal"
+)
+
+// PollContent is the content of a poll message
+type PollContent struct {
+	Question    string    `json:"question"`
+	Options     []string  `json:"options"`
+	ClosesAt    time.Time `json:"closes_at,omitempty"`    // Zero means open until closed by the creator
+	HideResults bool      `json:"hide_results,omitempty"` // Tallies stay hidden until the poll is closed or revealed
+}
+
+// PollVote is the payload of a poll_vote control message
+type PollVote struct {
+	PollID string `json:"poll_id"`
+	Option int    `json:"option"` // Index into the poll's options
+}
+
+// PollAction is the payload of a poll_action control message, sent by the poll's creator
+type PollAction struct {
+	PollID string `json:"poll_id"`
+	Action string `json:"action"` // close or reveal
+}
+
+// ParsePoll decodes and validates poll message content
+func ParsePoll(content []byte) (*PollContent, error) {
+	var poll PollContent
+	if err := json.Unmarshal(content, &poll); err != nil {
+		return nil, fmt.Errorf("invalid poll content: %w", err)
+	}
+
+	poll.Question = strings.TrimSpace(poll.Question)
+	if poll.Question == "" {
+		return nil, fmt.Errorf("poll question cannot be empty")
+	}
+	if len(poll.Question) > MaxPollTextSize {
+		return nil, fmt.Errorf("poll question exceeds %d bytes", MaxPollTextSize)
+	}
+
+	if len(poll.Options) < MinPollOptions || len(poll.Options) > MaxPollOptions {
+		return nil, fmt.Errorf("poll must have between %d and %d options", MinPollOptions, MaxPollOptions)
+	}
+	for i, option := range poll.Options {
+		option = strings.TrimSpace(option)
+		if option == "" {
+			return nil, fmt.Errorf("poll option %d cannot be empty", i)
+		}
+		if len(option) > MaxPollTextSize {
+			return nil, fmt.Errorf("poll option %d exceeds %d bytes", i, MaxPollTextSize)
+		}
+		poll.Options[i] = option
+	}
+
+	return &poll, nil
+}
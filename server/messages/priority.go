@@ -0,0 +1,28 @@
+package messages
+
+// Priority controls how urgently a message is delivered
+type Priority string
+
+const (
+	PriorityLow    Priority = "low"    // Bulk traffic such as presence and sync; yields to chat
+	PriorityNormal Priority = "normal" // Regular chat traffic
+	PriorityUrgent Priority = "urgent" // Alerts; skip delivery queues and are retried harder
+)
+
+// Valid reports whether p is a known priority. The empty priority counts as normal.
+func (p Priority) Valid() bool {
+	switch p {
+	case "", PriorityLow, PriorityNormal, PriorityUrgent:
+		return true
+	default:
+		return false
+	}
+}
+
+// EffectivePriority returns the message's priority, treating an unset one as normal
+func (m *Message) EffectivePriority() Priority {
+	if m.Priority == "" {
+		return PriorityNormal
+	}
+	return m.Priority
+}
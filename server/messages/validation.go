@@ -0,0 +1,313 @@
+package messages
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"  // Register GIF for image.DecodeConfig
+	_ "image/jpeg" // Register JPEG for image.DecodeConfig
+	_ "image/png"  // Register PNG for image.DecodeConfig
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Validation error codes returned to peers and web clients
+const (
+	CodeEmptyContent       = "empty_content"
+	CodeContentTooLarge    = "content_too_large"
+	CodeInvalidType        = "invalid_type"
+	CodeUnsupportedImage   = "unsupported_image_format"
+	CodeInvalidImage       = "invalid_image"
+	CodeImageTooLarge      = "image_too_large"
+	CodeInvalidFileOffer   = "invalid_file_offer"
+	CodeInvalidPoll        = "invalid_poll"
+	CodeInvalidRichText    = "invalid_rich_text"
+	CodeInvalidPriority    = "invalid_priority"
+	CodeInvalidEnvelope    = "invalid_envelope"
+	CodeUnsupportedVersion = "unsupported_version"
+)
+
+const (
+	MaxImageDimension = 8192 // Maximum width or height of an image message in pixels
+	maxFileNameLength = 255
+)
+
+// Image formats accepted in image messages
+const (
+	ImageFormatPNG  = "png"
+	ImageFormatJPEG = "jpeg"
+	ImageFormatGIF  = "gif"
+	ImageFormatWebP = "webp"
+)
+
+// ValidationError describes why message content was rejected
+type ValidationError struct {
+	Code    string `json:"code"`
+	Message string `json:"error"`
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+// WriteValidationError reports rejected message content with its error code.
+// Errors other than *ValidationError are reported as invalid_type.
+func WriteValidationError(w http.ResponseWriter, err error) {
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		validationErr = &ValidationError{Code: CodeInvalidType, Message: err.Error()}
+	}
+
+	status := http.StatusBadRequest
+	if validationErr.Code == CodeContentTooLarge {
+		status = http.StatusRequestEntityTooLarge
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(validationErr)
+}
+
+// newValidationError creates a ValidationError with a formatted message
+func newValidationError(code, format string, args ...interface{}) *ValidationError {
+	return &ValidationError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// FileOffer is the content of a file message: a description of a file the
+// sender makes available for download from its node
+type FileOffer struct {
+	Type   string `json:"type"` // Always "file"
+	FileID string `json:"file_id"`
+	Name   string `json:"name"`
+	Mime   string `json:"mime"`
+	Size   int64  `json:"size"`
+	Token  string `json:"token,omitempty"`  // Download token issued by the sender's node to the receiving node
+	SHA256 string `json:"sha256,omitempty"` // Hex content hash, also signed into the token
+
+	// The sender's node serves the file encrypted in Encryption's format under Key, hex encoded
+	Encryption string `json:"encryption,omitempty"`
+	Key        string `json:"key,omitempty"`
+
+	// Kind is FileKindDirectory for a shared directory, whose size is the total
+	// of its files and whose hash is that of its manifest
+	Kind string `json:"kind,omitempty"`
+
+	// Limits the sender set on the share, for display; its node enforces them
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	MaxDownloads int        `json:"max_downloads,omitempty"`
+
+	// Chunks lists the hashes of the encrypted file's chunks, so it can be
+	// fetched from several nodes that have it and checked chunk by chunk
+	Chunks *ChunkManifest `json:"chunks,omitempty"`
+	// SeedToken is presented to those nodes instead of Token, which they could
+	// otherwise use at the sender's node as the receiver
+	SeedToken string `json:"seed_token,omitempty"`
+}
+
+// ChunkManifest describes an encrypted file body split into chunks of Size
+// bytes, the last of which may be shorter
+type ChunkManifest struct {
+	Size   int64    `json:"size"`
+	Length int64    `json:"length"` // Length of the encrypted body
+	SHA256 []string `json:"sha256"` // Hex hash of each chunk
+}
+
+// MaxChunks is the most chunks a chunk manifest may list
+const MaxChunks = 4096
+
+// validate checks that the manifest lists one valid hash per chunk
+func (c *ChunkManifest) validate() error {
+	if c.Size <= 0 || c.Length <= 0 {
+		return errors.New("chunk size and length must be positive")
+	}
+	count := (c.Length + c.Size - 1) / c.Size
+	if count > MaxChunks || int64(len(c.SHA256)) != count {
+		return fmt.Errorf("chunk manifest must list %d hashes, one per chunk, and at most %d", count, MaxChunks)
+	}
+	for _, hash := range c.SHA256 {
+		if sum, err := hex.DecodeString(hash); err != nil || len(sum) != 32 {
+			return errors.New("chunk manifest has an invalid hash")
+		}
+	}
+	return nil
+}
+
+// Kinds of file offers
+const (
+	FileKindFile      = "file"
+	FileKindDirectory = "directory"
+)
+
+// FileEncryptionScheme is the format file bodies are served in: chunked AES-256-GCM
+const FileEncryptionScheme = "aes-256-gcm-chunked"
+
+// ParseFileOffer decodes and validates file offer content
+func ParseFileOffer(content []byte) (*FileOffer, error) {
+	var offer FileOffer
+	if err := json.Unmarshal(content, &offer); err != nil {
+		return nil, newValidationError(CodeInvalidFileOffer, "invalid file offer: %v", err)
+	}
+
+	if offer.Type != "" && offer.Type != string(TypeFile) {
+		return nil, newValidationError(CodeInvalidFileOffer, "file offer has type %q", offer.Type)
+	}
+	if _, err := uuid.Parse(offer.FileID); err != nil {
+		return nil, newValidationError(CodeInvalidFileOffer, "file offer has invalid file_id")
+	}
+	if offer.Name == "" || len(offer.Name) > maxFileNameLength {
+		return nil, newValidationError(CodeInvalidFileOffer, "file name must be between 1 and %d bytes", maxFileNameLength)
+	}
+	if strings.ContainsAny(offer.Name, "/\\\x00") || offer.Name == "." || offer.Name == ".." {
+		return nil, newValidationError(CodeInvalidFileOffer, "file name must not contain a path")
+	}
+	if offer.Mime != "" {
+		if _, _, err := mime.ParseMediaType(offer.Mime); err != nil {
+			return nil, newValidationError(CodeInvalidFileOffer, "file offer has invalid mime type")
+		}
+	}
+	if offer.Size < 0 {
+		return nil, newValidationError(CodeInvalidFileOffer, "file size cannot be negative")
+	}
+	if offer.MaxDownloads < 0 {
+		return nil, newValidationError(CodeInvalidFileOffer, "max_downloads cannot be negative")
+	}
+	if offer.Kind != "" && offer.Kind != FileKindFile && offer.Kind != FileKindDirectory {
+		return nil, newValidationError(CodeInvalidFileOffer, "file offer has unknown kind %q", offer.Kind)
+	}
+	if offer.Key != "" || offer.Encryption != "" {
+		if offer.Encryption != FileEncryptionScheme {
+			return nil, newValidationError(CodeInvalidFileOffer, "file offer has unsupported encryption %q", offer.Encryption)
+		}
+		if key, err := hex.DecodeString(offer.Key); err != nil || len(key) != 32 {
+			return nil, newValidationError(CodeInvalidFileOffer, "file offer has invalid key")
+		}
+	}
+	if offer.Chunks != nil {
+		if offer.Key == "" || offer.Kind == FileKindDirectory {
+			return nil, newValidationError(CodeInvalidFileOffer, "only encrypted files can have a chunk manifest")
+		}
+		if err := offer.Chunks.validate(); err != nil {
+			return nil, newValidationError(CodeInvalidFileOffer, "%v", err)
+		}
+	}
+
+	return &offer, nil
+}
+
+// IsFileOffer reports whether the message announces a file, either as a file
+// message or as a JSON file offer in a text message
+func (m *Message) IsFileOffer() bool {
+	return m.Type == TypeFile || (m.Type == TypeText && isFileOffer(m.Content))
+}
+
+// isFileOffer reports whether text content is a JSON file offer, which is how
+// the web client announces files
+func isFileOffer(content []byte) bool {
+	trimmed := bytes.TrimSpace(content)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return false
+	}
+
+	var probe struct {
+		Type string `json:"type"`
+	}
+	return json.Unmarshal(trimmed, &probe) == nil && probe.Type == string(TypeFile)
+}
+
+// DetectImageFormat identifies an accepted image format by its magic bytes.
+// It returns an empty string for anything else.
+func DetectImageFormat(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return ImageFormatPNG
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8, 0xFF}):
+		return ImageFormatJPEG
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return ImageFormatGIF
+	case len(data) >= 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return ImageFormatWebP
+	default:
+		return ""
+	}
+}
+
+// ValidateImage checks that data is a PNG, JPEG, GIF or WebP image within
+// MaxImageDimension and returns its format and size
+func ValidateImage(data []byte) (format string, width, height int, err error) {
+	format = DetectImageFormat(data)
+	if format == "" {
+		return "", 0, 0, newValidationError(CodeUnsupportedImage, "image must be PNG, JPEG, GIF or WebP")
+	}
+
+	if format == ImageFormatWebP {
+		width, height, err = webPSize(data)
+		if err != nil {
+			return "", 0, 0, newValidationError(CodeInvalidImage, "invalid WebP image: %v", err)
+		}
+	} else {
+		config, decoded, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return "", 0, 0, newValidationError(CodeInvalidImage, "invalid %s image: %v", format, err)
+		}
+		// The magic bytes and the decoder must agree on the format
+		if decoded != format {
+			return "", 0, 0, newValidationError(CodeInvalidImage, "image claims %s but decodes as %s", format, decoded)
+		}
+		width, height = config.Width, config.Height
+	}
+
+	if width <= 0 || height <= 0 {
+		return "", 0, 0, newValidationError(CodeInvalidImage, "image has no pixels")
+	}
+	if width > MaxImageDimension || height > MaxImageDimension {
+		return "", 0, 0, newValidationError(CodeImageTooLarge, "image is %dx%d, maximum is %dx%d",
+			width, height, MaxImageDimension, MaxImageDimension)
+	}
+
+	return format, width, height, nil
+}
+
+// webPSize reads the canvas size from a WebP header. The standard library has
+// no WebP decoder, so the lossy, lossless and extended headers are parsed directly.
+func webPSize(data []byte) (int, int, error) {
+	if len(data) < 30 {
+		return 0, 0, errors.New("header too short")
+	}
+
+	chunk := string(data[12:16])
+	payload := data[20:]
+	switch chunk {
+	case "VP8 ":
+		// Frame tag (3 bytes), start code, then 14-bit width and height
+		if !bytes.Equal(payload[3:6], []byte{0x9D, 0x01, 0x2A}) {
+			return 0, 0, errors.New("missing VP8 start code")
+		}
+		width := int(binary.LittleEndian.Uint16(payload[6:8]) & 0x3FFF)
+		height := int(binary.LittleEndian.Uint16(payload[8:10]) & 0x3FFF)
+		return width, height, nil
+	case "VP8L":
+		// Signature byte, then width-1 and height-1 packed in 14 bits each
+		if payload[0] != 0x2F {
+			return 0, 0, errors.New("missing VP8L signature")
+		}
+		bits := binary.LittleEndian.Uint32(payload[1:5])
+		width := int(bits&0x3FFF) + 1
+		height := int((bits>>14)&0x3FFF) + 1
+		return width, height, nil
+	case "VP8X":
+		// Flags (4 bytes), then canvas width-1 and height-1 as 24-bit values
+		width := int(uint32(payload[4])|uint32(payload[5])<<8|uint32(payload[6])<<16) + 1
+		height := int(uint32(payload[7])|uint32(payload[8])<<8|uint32(payload[9])<<16) + 1
+		return width, height, nil
+	default:
+		return 0, 0, fmt.Errorf("unknown chunk %q", chunk)
+	}
+}
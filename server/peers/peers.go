@@ -158,6 +158,22 @@ func (m *Manager) GetPeer(guid string) (Peer, bool) {
 	return peer, exists
 }
 
+// VerifySource reports whether sourceIP (host or host:port) matches the address
+// we know for the active peer guid. Used to check the claimed sender of control messages.
+func (m *Manager) VerifySource(guid, sourceIP string) bool {
+	peer, exists := m.GetPeer(guid)
+	if !exists {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(sourceIP)
+	if err != nil {
+		host = sourceIP
+	}
+	source := net.ParseIP(host)
+	return source != nil && source.Equal(net.ParseIP(peer.IPAddress))
+}
+
 // GetHistoricalPeer returns a peer from the database, regardless of active status
 func (m *Manager) GetHistoricalPeer(guid string) (*Peer, error) {
 	if m.db == nil {
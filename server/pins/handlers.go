@@ -0,0 +1,109 @@
+package pins
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"cyberchat/server/clientapi"
+	"cyberchat/server/db"
+)
+
+// Handlers contains HTTP handlers for pin operations
+type Handlers struct {
+	manager *Manager
+	apiKey  string
+}
+
+// NewHandlers creates a new Handlers instance
+func NewHandlers(manager *Manager, apiKey string) *Handlers {
+	return &Handlers{
+		manager: manager,
+		apiKey:  apiKey,
+	}
+}
+
+// HandleList returns pins, optionally limited to ?conversation=
+func (h *Handlers) HandleList(w http.ResponseWriter, r *http.Request) {
+	if !clientapi.VerifyClient(r, h.apiKey) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	pins, err := h.manager.List(r.URL.Query().Get("conversation"))
+	if err != nil {
+		http.Error(w, "Failed to get pins", http.StatusInternalServerError)
+		return
+	}
+	if pins == nil {
+		pins = []*db.Pin{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pins)
+}
+
+// HandlePin pins a stored message in its conversation
+func (h *Handlers) HandlePin(w http.ResponseWriter, r *http.Request) {
+	if !clientapi.VerifyClient(r, h.apiKey) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		MessageID string `json:"message_id"`
+		Note      string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MessageID == "" {
+		http.Error(w, "message_id is required", http.StatusBadRequest)
+		return
+	}
+
+	pin, err := h.manager.Pin(req.MessageID, req.Note)
+	if errors.Is(err, ErrMessageNotFound) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrNoteTooLong) {
+		http.Error(w, "Note is too long", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to pin message", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(pin)
+}
+
+// HandleUnpin removes a pin. ?conversation= defaults to the broadcast channel.
+func (h *Handlers) HandleUnpin(w http.ResponseWriter, r *http.Request) {
+	if !clientapi.VerifyClient(r, h.apiKey) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	conversation := r.URL.Query().Get("conversation")
+	if conversation == "" {
+		conversation = db.ConversationBroadcast
+	}
+
+	messageID := r.PathValue("message_id")
+	err := h.manager.Unpin(conversation, messageID)
+	if errors.Is(err, ErrNotPinned) {
+		http.Error(w, "Message is not pinned", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to unpin message", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":     "success",
+		"message_id": messageID,
+	})
+}
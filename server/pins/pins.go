@@ -0,0 +1,247 @@
+package pins
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"cyberchat/server/db"
+	"cyberchat/server/logging"
+	"cyberchat/server/messages"
+	"cyberchat/server/peers"
+)
+
+const (
+	ActionPin   = "pin"
+	ActionUnpin = "unpin"
+
+	maxNoteSize = 500
+)
+
+var (
+	ErrMessageNotFound = errors.New("message not found")
+	ErrNotPinned       = errors.New("message is not pinned")
+	ErrNoteTooLong     = errors.New("note is too long")
+)
+
+// Signal is the payload carried by pin control messages. Participants pin
+// their own copy of the message, so a pin never carries its content.
+type Signal struct {
+	Action    string `json:"action"` // pin or unpin
+	MessageID string `json:"message_id"`
+	Note      string `json:"note,omitempty"`
+}
+
+// WebSocketManager interface for notifying local clients about pin changes
+type WebSocketManager interface {
+	Broadcast(message interface{})
+}
+
+// Manager stores pins locally and shares them with conversation participants
+type Manager struct {
+	db        *db.DB
+	guid      string
+	peerMgr   *peers.Manager
+	send      func(*messages.Message)
+	wsManager WebSocketManager
+}
+
+// New creates a new pin manager. send forwards control messages to peers.
+func New(database *db.DB, guid string, peerMgr *peers.Manager, send func(*messages.Message), wsManager WebSocketManager) *Manager {
+	return &Manager{
+		db:        database,
+		guid:      guid,
+		peerMgr:   peerMgr,
+		send:      send,
+		wsManager: wsManager,
+	}
+}
+
+// Pin pins a stored message in its conversation and tells the other participants
+func (m *Manager) Pin(messageID, note string) (*db.Pin, error) {
+	if len(note) > maxNoteSize {
+		return nil, ErrNoteTooLong
+	}
+
+	msg, err := m.db.GetMessage(messageID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	pin := &db.Pin{
+		Conversation:     m.conversationOf(msg),
+		MessageID:        msg.ID,
+		PinnedBy:         m.guid,
+		Note:             note,
+		SenderGUID:       msg.SenderGUID,
+		Type:             msg.Type,
+		Content:          string(msg.Content),
+		MessageTimestamp: msg.Timestamp,
+		PinnedAt:         time.Now(),
+	}
+	if err := m.db.SavePin(pin); err != nil {
+		return nil, err
+	}
+
+	m.share(pin.Conversation, Signal{Action: ActionPin, MessageID: pin.MessageID, Note: pin.Note})
+	m.broadcast(ActionPin, pin)
+	return pin, nil
+}
+
+// Unpin removes a pin from a conversation and tells the other participants
+func (m *Manager) Unpin(conversation, messageID string) error {
+	err := m.db.DeletePin(conversation, messageID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotPinned
+	}
+	if err != nil {
+		return err
+	}
+
+	m.share(conversation, Signal{Action: ActionUnpin, MessageID: messageID})
+	m.broadcast(ActionUnpin, &db.Pin{Conversation: conversation, MessageID: messageID, PinnedBy: m.guid})
+	return nil
+}
+
+// List returns pins, limited to one conversation unless conversation is empty
+func (m *Manager) List(conversation string) ([]*db.Pin, error) {
+	return m.db.GetPins(conversation)
+}
+
+// HandleSignal processes an inbound pin control message from a peer
+func (m *Manager) HandleSignal(msg *messages.Message, sourceIP string) {
+	if !m.peerMgr.VerifySource(msg.SenderGUID, sourceIP) {
+		logging.Error("Pins", "Rejecting pin signal claiming to be from %s sent from %s", msg.SenderGUID, sourceIP)
+		return
+	}
+
+	var signal Signal
+	if err := json.Unmarshal(msg.Content, &signal); err != nil {
+		logging.Error("Pins", "Invalid pin signal from %s: %v", msg.SenderGUID, err)
+		return
+	}
+	if signal.MessageID == "" {
+		logging.Error("Pins", "Pin signal from %s has no message_id", msg.SenderGUID)
+		return
+	}
+
+	// From our side, a private conversation is the one with the sender
+	conversation := db.ConversationBroadcast
+	if msg.Scope == messages.ScopePrivate {
+		conversation = msg.SenderGUID
+	}
+
+	switch signal.Action {
+	case ActionPin:
+		if len(signal.Note) > maxNoteSize {
+			logging.Error("Pins", "Ignoring pin from %s with oversized note", msg.SenderGUID)
+			return
+		}
+
+		// Only our own copy of the message says who wrote it and what it says
+		local, err := m.db.GetMessage(signal.MessageID)
+		if errors.Is(err, sql.ErrNoRows) {
+			logging.Info("Pins", "Ignoring pin from %s of message %s we do not have", msg.SenderGUID, signal.MessageID)
+			return
+		}
+		if err != nil {
+			logging.Error("Pins", "Failed to get message %s pinned by %s: %v", signal.MessageID, msg.SenderGUID, err)
+			return
+		}
+		if m.conversationOf(local) != conversation {
+			logging.Error("Pins", "Ignoring pin from %s of message %s from another conversation", msg.SenderGUID, signal.MessageID)
+			return
+		}
+
+		pin := &db.Pin{
+			Conversation:     conversation,
+			MessageID:        local.ID,
+			PinnedBy:         msg.SenderGUID,
+			Note:             signal.Note,
+			SenderGUID:       local.SenderGUID,
+			Type:             local.Type,
+			Content:          string(local.Content),
+			MessageTimestamp: local.Timestamp,
+			PinnedAt:         time.Now(),
+		}
+
+		if err := m.db.SavePin(pin); err != nil {
+			logging.Error("Pins", "Failed to save pin from %s: %v", msg.SenderGUID, err)
+			return
+		}
+		m.broadcast(ActionPin, pin)
+
+	case ActionUnpin:
+		if err := m.db.DeletePin(conversation, signal.MessageID); err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				logging.Error("Pins", "Failed to delete pin for %s: %v", signal.MessageID, err)
+			}
+			return
+		}
+		m.broadcast(ActionUnpin, &db.Pin{Conversation: conversation, MessageID: signal.MessageID, PinnedBy: msg.SenderGUID})
+
+	default:
+		logging.Error("Pins", "Unknown pin action %q from %s", signal.Action, msg.SenderGUID)
+	}
+}
+
+// conversationOf returns the conversation a message belongs to from our side
+func (m *Manager) conversationOf(msg *messages.Message) string {
+	if msg.Scope != messages.ScopePrivate {
+		return db.ConversationBroadcast
+	}
+	if msg.SenderGUID == m.guid {
+		return msg.ReceiverGUID
+	}
+	return msg.SenderGUID
+}
+
+// share sends a pin signal to the other participants of a conversation
+func (m *Manager) share(conversation string, signal Signal) {
+	if m.send == nil {
+		return
+	}
+
+	content, err := json.Marshal(signal)
+	if err != nil {
+		logging.Error("Pins", "Failed to marshal pin signal: %v", err)
+		return
+	}
+
+	var msg *messages.Message
+	if conversation == db.ConversationBroadcast {
+		msg = messages.NewMessage(m.guid, "", messages.TypePin, content)
+		msg.Scope = messages.ScopeBroadcast
+	} else {
+		msg = messages.NewMessage(m.guid, conversation, messages.TypePin, content)
+	}
+	m.send(msg)
+}
+
+// broadcast notifies local web clients about a pin change
+func (m *Manager) broadcast(action string, pin *db.Pin) {
+	if m.wsManager == nil {
+		return
+	}
+
+	m.wsManager.Broadcast(struct {
+		Type    string `json:"type"`
+		Content struct {
+			Action string  `json:"action"`
+			Pin    *db.Pin `json:"pin"`
+		} `json:"content"`
+	}{
+		Type: "pin",
+		Content: struct {
+			Action string  `json:"action"`
+			Pin    *db.Pin `json:"pin"`
+		}{
+			Action: action,
+			Pin:    pin,
+		},
+	})
+}
@@ -0,0 +1,189 @@
+package polls
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"cyberchat/server/clientapi"
+	"cyberchat/server/messages"
+)
+
+// Handlers contains HTTP handlers for poll operations
+type Handlers struct {
+	manager *Manager
+	guid    string
+	apiKey  string
+	process func(*messages.Message, string) *messages.MessageDeliveryReport
+}
+
+// NewHandlers creates a new Handlers instance. process is the message handler's ProcessMessage.
+func NewHandlers(manager *Manager, guid string, apiKey string, process func(*messages.Message, string) *messages.MessageDeliveryReport) *Handlers {
+	return &Handlers{
+		manager: manager,
+		guid:    guid,
+		apiKey:  apiKey,
+		process: process,
+	}
+}
+
+// HandleCreate sends a new poll through the normal message path
+func (h *Handlers) HandleCreate(w http.ResponseWriter, r *http.Request) {
+	if !clientapi.VerifyClient(r, h.apiKey) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		messages.PollContent
+		DurationSeconds int    `json:"duration_seconds"`
+		ReceiverGUID    string `json:"receiver_guid"`
+		Scope           string `json:"scope"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Failed to parse request", http.StatusBadRequest)
+		return
+	}
+
+	poll := req.PollContent
+	if poll.ClosesAt.IsZero() && req.DurationSeconds > 0 {
+		poll.ClosesAt = time.Now().Add(time.Duration(req.DurationSeconds) * time.Second)
+	}
+	if !poll.ClosesAt.IsZero() && poll.ClosesAt.Before(time.Now()) {
+		http.Error(w, "closes_at is in the past", http.StatusBadRequest)
+		return
+	}
+
+	content, err := json.Marshal(poll)
+	if err != nil {
+		http.Error(w, "Failed to encode poll", http.StatusInternalServerError)
+		return
+	}
+
+	msg := messages.NewWebMessage(h.guid, req.ReceiverGUID, messages.TypePoll, string(content))
+	if req.Scope != "" {
+		msg.Scope = messages.MessageScope(req.Scope)
+	} else if req.ReceiverGUID != "" {
+		msg.Scope = messages.ScopePrivate
+	}
+	if msg.Scope != messages.ScopeBroadcast && msg.Scope != messages.ScopePrivate {
+		http.Error(w, "Invalid scope", http.StatusBadRequest)
+		return
+	}
+	if msg.Scope == messages.ScopePrivate && req.ReceiverGUID == "" {
+		http.Error(w, "Private polls require receiver_guid", http.StatusBadRequest)
+		return
+	}
+	if err := msg.ValidateContent(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report := h.process(msg, r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(struct {
+		PollID string                          `json:"poll_id"`
+		Report *messages.MessageDeliveryReport `json:"report"`
+	}{
+		PollID: msg.ID,
+		Report: report,
+	})
+}
+
+// HandleGet returns a poll and its current results
+func (h *Handlers) HandleGet(w http.ResponseWriter, r *http.Request) {
+	if !clientapi.VerifyClient(r, h.apiKey) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	results, err := h.manager.Results(r.PathValue("poll_id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// HandleVote casts or changes our vote in a poll
+func (h *Handlers) HandleVote(w http.ResponseWriter, r *http.Request) {
+	if !clientapi.VerifyClient(r, h.apiKey) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Option *int `json:"option"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Option == nil {
+		http.Error(w, "option is required", http.StatusBadRequest)
+		return
+	}
+
+	pollID := r.PathValue("poll_id")
+	if err := h.manager.Vote(pollID, *req.Option); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	h.writeResults(w, pollID)
+}
+
+// HandleClose closes one of our polls
+func (h *Handlers) HandleClose(w http.ResponseWriter, r *http.Request) {
+	h.handleAction(w, r, messages.PollActionClose)
+}
+
+// HandleReveal reveals the results of one of our polls before it closes
+func (h *Handlers) HandleReveal(w http.ResponseWriter, r *http.Request) {
+	h.handleAction(w, r, messages.PollActionReveal)
+}
+
+// handleAction applies a creator action to a poll
+func (h *Handlers) handleAction(w http.ResponseWriter, r *http.Request, action string) {
+	if !clientapi.VerifyClient(r, h.apiKey) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	pollID := r.PathValue("poll_id")
+	if err := h.manager.Act(pollID, action); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	h.writeResults(w, pollID)
+}
+
+// writeResults responds with a poll's current results
+func (h *Handlers) writeResults(w http.ResponseWriter, pollID string) {
+	results, err := h.manager.Results(pollID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// writeError maps poll errors to HTTP status codes
+func writeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrPollNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrNotCreator), errors.Is(err, ErrNotInAudience):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, ErrPollClosed):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrInvalidOption), errors.Is(err, ErrInvalidAction):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, "Failed to update poll", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,312 @@
+package polls
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"cyberchat/server/db"
+	"cyberchat/server/logging"
+	"cyberchat/server/messages"
+	"cyberchat/server/peers"
+)
+
+var (
+	ErrPollNotFound  = errors.New("poll not found")
+	ErrPollClosed    = errors.New("poll is closed")
+	ErrNotCreator    = errors.New("only the poll's creator can do this")
+	ErrNotInAudience = errors.New("not a participant of this poll")
+	ErrInvalidOption = errors.New("invalid poll option")
+	ErrInvalidAction = errors.New("invalid poll action")
+)
+
+// Results is a poll with its tally as seen by this node
+type Results struct {
+	*db.Poll
+	Closed         bool  `json:"closed"`
+	ResultsVisible bool  `json:"results_visible"`
+	Counts         []int `json:"counts,omitempty"` // Votes per option; omitted while results are hidden
+	TotalVotes     int   `json:"total_votes"`
+	MyVote         *int  `json:"my_vote,omitempty"`
+}
+
+// WebSocketManager interface for sending live poll updates to local clients
+type WebSocketManager interface {
+	Broadcast(message interface{})
+}
+
+// Manager tallies polls locally from poll messages and vote control messages
+type Manager struct {
+	db        *db.DB
+	guid      string
+	peerMgr   *peers.Manager
+	send      func(*messages.Message)
+	wsManager WebSocketManager
+}
+
+// New creates a new poll manager. send forwards control messages to peers.
+func New(database *db.DB, guid string, peerMgr *peers.Manager, send func(*messages.Message), wsManager WebSocketManager) *Manager {
+	return &Manager{
+		db:        database,
+		guid:      guid,
+		peerMgr:   peerMgr,
+		send:      send,
+		wsManager: wsManager,
+	}
+}
+
+// HandleMessage stores newly stored poll messages as polls.
+// Registered as a message handler listener.
+func (m *Manager) HandleMessage(msg *messages.Message) {
+	if msg.Type != messages.TypePoll {
+		return
+	}
+
+	content, err := messages.ParsePoll(msg.Content)
+	if err != nil {
+		logging.Error("Polls", "Ignoring invalid poll %s from %s: %v", msg.ID, msg.SenderGUID, err)
+		return
+	}
+
+	poll := &db.Poll{
+		PollID:       msg.ID,
+		CreatorGUID:  msg.SenderGUID,
+		ReceiverGUID: msg.ReceiverGUID,
+		Scope:        msg.Scope,
+		Question:     content.Question,
+		Options:      content.Options,
+		ClosesAt:     content.ClosesAt,
+		HideResults:  content.HideResults,
+		CreatedAt:    msg.Timestamp,
+	}
+	if err := m.db.SavePoll(poll); err != nil {
+		logging.Error("Polls", "Failed to save poll %s: %v", msg.ID, err)
+		return
+	}
+
+	m.broadcast(msg.ID)
+}
+
+// HandleVote processes a poll_vote control message from a peer
+func (m *Manager) HandleVote(msg *messages.Message, sourceIP string) {
+	if !m.peerMgr.VerifySource(msg.SenderGUID, sourceIP) {
+		logging.Error("Polls", "Rejecting vote claiming to be from %s sent from %s", msg.SenderGUID, sourceIP)
+		return
+	}
+
+	var vote messages.PollVote
+	if err := json.Unmarshal(msg.Content, &vote); err != nil {
+		logging.Error("Polls", "Invalid vote from %s: %v", msg.SenderGUID, err)
+		return
+	}
+
+	if err := m.recordVote(vote.PollID, msg.SenderGUID, vote.Option); err != nil {
+		logging.Error("Polls", "Rejecting vote from %s in poll %s: %v", msg.SenderGUID, vote.PollID, err)
+		return
+	}
+
+	logging.Debug("Polls", "Recorded vote from %s in poll %s", msg.SenderGUID, vote.PollID)
+	m.broadcast(vote.PollID)
+}
+
+// HandleAction processes a poll_action control message from a poll's creator
+func (m *Manager) HandleAction(msg *messages.Message, sourceIP string) {
+	if !m.peerMgr.VerifySource(msg.SenderGUID, sourceIP) {
+		logging.Error("Polls", "Rejecting poll action claiming to be from %s sent from %s", msg.SenderGUID, sourceIP)
+		return
+	}
+
+	var action messages.PollAction
+	if err := json.Unmarshal(msg.Content, &action); err != nil {
+		logging.Error("Polls", "Invalid poll action from %s: %v", msg.SenderGUID, err)
+		return
+	}
+
+	if err := m.applyAction(action, msg.SenderGUID); err != nil {
+		logging.Error("Polls", "Rejecting %s of poll %s from %s: %v", action.Action, action.PollID, msg.SenderGUID, err)
+		return
+	}
+
+	m.broadcast(action.PollID)
+}
+
+// Vote records our vote and sends it to the poll's other participants
+func (m *Manager) Vote(pollID string, option int) error {
+	if err := m.recordVote(pollID, m.guid, option); err != nil {
+		return err
+	}
+
+	if err := m.sendToAudience(pollID, messages.TypePollVote, messages.PollVote{PollID: pollID, Option: option}); err != nil {
+		return err
+	}
+
+	m.broadcast(pollID)
+	return nil
+}
+
+// Act closes or reveals one of our polls and tells its participants
+func (m *Manager) Act(pollID, action string) error {
+	pollAction := messages.PollAction{PollID: pollID, Action: action}
+	if err := m.applyAction(pollAction, m.guid); err != nil {
+		return err
+	}
+
+	if err := m.sendToAudience(pollID, messages.TypePollAction, pollAction); err != nil {
+		return err
+	}
+
+	m.broadcast(pollID)
+	return nil
+}
+
+// Results returns a poll and its tally. Counts are withheld while the creator
+// keeps results hidden, until the poll is closed or revealed.
+func (m *Manager) Results(pollID string) (*Results, error) {
+	poll, err := m.getPoll(pollID)
+	if err != nil {
+		return nil, err
+	}
+
+	votes, err := m.db.GetPollVotes(pollID)
+	if err != nil {
+		return nil, err
+	}
+
+	results := &Results{
+		Poll:       poll,
+		Closed:     isClosed(poll),
+		TotalVotes: len(votes),
+	}
+	results.ResultsVisible = !poll.HideResults || poll.Revealed || results.Closed
+
+	counts := make([]int, len(poll.Options))
+	for _, vote := range votes {
+		if vote.Option >= 0 && vote.Option < len(counts) {
+			counts[vote.Option]++
+		}
+		if vote.VoterGUID == m.guid {
+			option := vote.Option
+			results.MyVote = &option
+		}
+	}
+	if results.ResultsVisible {
+		results.Counts = counts
+	}
+
+	return results, nil
+}
+
+// recordVote validates and stores a vote. A later vote replaces an earlier one from the same node.
+func (m *Manager) recordVote(pollID, voterGUID string, option int) error {
+	poll, err := m.getPoll(pollID)
+	if err != nil {
+		return err
+	}
+	if !inAudience(poll, voterGUID) {
+		return ErrNotInAudience
+	}
+	if isClosed(poll) {
+		return ErrPollClosed
+	}
+	if option < 0 || option >= len(poll.Options) {
+		return ErrInvalidOption
+	}
+
+	return m.db.SavePollVote(pollID, voterGUID, option)
+}
+
+// applyAction closes or reveals a poll on behalf of actorGUID, who must be its creator
+func (m *Manager) applyAction(action messages.PollAction, actorGUID string) error {
+	poll, err := m.getPoll(action.PollID)
+	if err != nil {
+		return err
+	}
+	if poll.CreatorGUID != actorGUID {
+		return ErrNotCreator
+	}
+
+	switch action.Action {
+	case messages.PollActionClose:
+		return m.db.ClosePoll(action.PollID, time.Now())
+	case messages.PollActionReveal:
+		return m.db.RevealPoll(action.PollID)
+	default:
+		return ErrInvalidAction
+	}
+}
+
+// getPoll loads a poll, mapping a missing row to ErrPollNotFound
+func (m *Manager) getPoll(pollID string) (*db.Poll, error) {
+	poll, err := m.db.GetPoll(pollID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrPollNotFound
+	}
+	return poll, err
+}
+
+// sendToAudience wraps payload in a control message to everyone else taking part in the poll
+func (m *Manager) sendToAudience(pollID string, msgType messages.MessageType, payload interface{}) error {
+	if m.send == nil {
+		return fmt.Errorf("no sender configured")
+	}
+
+	poll, err := m.getPoll(pollID)
+	if err != nil {
+		return err
+	}
+
+	content, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %w", msgType, err)
+	}
+
+	// A private poll has exactly one other participant
+	receiverGUID := ""
+	if poll.Scope == messages.ScopePrivate {
+		receiverGUID = poll.ReceiverGUID
+		if receiverGUID == m.guid {
+			receiverGUID = poll.CreatorGUID
+		}
+	}
+
+	msg := messages.NewMessage(m.guid, receiverGUID, msgType, content)
+	msg.Scope = poll.Scope
+	m.send(msg)
+	return nil
+}
+
+// broadcast sends the latest results of a poll to local web clients
+func (m *Manager) broadcast(pollID string) {
+	if m.wsManager == nil {
+		return
+	}
+
+	results, err := m.Results(pollID)
+	if err != nil {
+		logging.Error("Polls", "Failed to get results for poll %s: %v", pollID, err)
+		return
+	}
+
+	m.wsManager.Broadcast(struct {
+		Type    string   `json:"type"`
+		Content *Results `json:"content"`
+	}{
+		Type:    "poll_update",
+		Content: results,
+	})
+}
+
+// isClosed reports whether a poll was closed by its creator or reached its close time
+func isClosed(poll *db.Poll) bool {
+	return !poll.ClosedAt.IsZero() || (!poll.ClosesAt.IsZero() && time.Now().After(poll.ClosesAt))
+}
+
+// inAudience reports whether guid takes part in the poll
+func inAudience(poll *db.Poll, guid string) bool {
+	if poll.Scope != messages.ScopePrivate {
+		return true
+	}
+	return guid == poll.CreatorGUID || guid == poll.ReceiverGUID
+}
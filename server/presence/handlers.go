@@ -0,0 +1,78 @@
+package presence
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"cyberchat/server/clientapi"
+)
+
+// Handlers contains HTTP handlers for presence operations
+type Handlers struct {
+	manager *Manager
+	apiKey  string
+}
+
+// NewHandlers creates a new Handlers instance
+func NewHandlers(manager *Manager, apiKey string) *Handlers {
+	return &Handlers{
+		manager: manager,
+		apiKey:  apiKey,
+	}
+}
+
+// HandleGetPresence returns our own status and the presence of all peers
+func (h *Handlers) HandleGetPresence(w http.ResponseWriter, r *http.Request) {
+	if !clientapi.VerifyClient(r, h.apiKey) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Status string  `json:"status"`
+		Peers  []State `json:"peers"`
+	}{
+		Status: h.manager.Status(),
+		Peers:  h.manager.GetStates(),
+	})
+}
+
+// HandleSetPresence updates our status or signals that the user is typing
+func (h *Handlers) HandleSetPresence(w http.ResponseWriter, r *http.Request) {
+	if !clientapi.VerifyClient(r, h.apiKey) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Status       string `json:"status"`
+		Typing       bool   `json:"typing"`
+		Conversation string `json:"conversation"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Failed to parse request", http.StatusBadRequest)
+		return
+	}
+
+	if req.Status == "" && !req.Typing {
+		http.Error(w, "Either status or typing is required", http.StatusBadRequest)
+		return
+	}
+
+	if req.Status != "" {
+		if err := h.manager.SetStatus(req.Status); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.Typing {
+		if err := h.manager.SetTyping(req.Conversation); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,271 @@
+package presence
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"cyberchat/server/logging"
+	"cyberchat/server/messages"
+	"cyberchat/server/peers"
+)
+
+const (
+	StatusOnline  = "online"
+	StatusAway    = "away"
+	StatusBusy    = "busy"
+	StatusOffline = "offline" // Reported locally when a peer's status expires
+
+	statusTTL       = 5 * time.Minute  // How long a received status stays valid
+	heartbeatPeriod = 2 * time.Minute  // How often we re-announce our own status
+	typingTTL       = 8 * time.Second  // How long a typing signal stays valid
+	maxTTL          = 10 * time.Minute // Upper bound for TTLs requested by peers
+	sweepInterval   = time.Second      // How often expired signals are swept
+)
+
+// Signal is the payload carried by presence control messages
+type Signal struct {
+	Status string `json:"status,omitempty"` // online, away or busy
+	Typing bool   `json:"typing,omitempty"` // Sender is typing in the message's conversation
+	TTL    int    `json:"ttl"`              // Seconds until the signal expires
+}
+
+// State is the last known presence of a node
+type State struct {
+	GUID            string    `json:"guid"`
+	Status          string    `json:"status"`
+	StatusExpiresAt time.Time `json:"status_expires_at"`
+	Typing          string    `json:"typing,omitempty"` // Conversation being typed in
+	TypingExpiresAt time.Time `json:"typing_expires_at,omitempty"`
+}
+
+// WebSocketManager interface for broadcasting presence to local clients
+type WebSocketManager interface {
+	Broadcast(message interface{})
+}
+
+// Manager tracks ephemeral presence for this node and its peers
+type Manager struct {
+	guid      string
+	peerMgr   *peers.Manager
+	send      func(*messages.Message)
+	wsManager WebSocketManager
+	mu        sync.Mutex
+	status    string
+	peers     map[string]*State
+}
+
+// New creates a new presence manager. send forwards control messages to peers.
+func New(guid string, peerMgr *peers.Manager, send func(*messages.Message), wsManager WebSocketManager) *Manager {
+	return &Manager{
+		guid:      guid,
+		peerMgr:   peerMgr,
+		send:      send,
+		wsManager: wsManager,
+		status:    StatusOnline,
+		peers:     make(map[string]*State),
+	}
+}
+
+// ValidStatus reports whether status can be set by a user
+func ValidStatus(status string) bool {
+	return status == StatusOnline || status == StatusAway || status == StatusBusy
+}
+
+// Run announces our status periodically and expires stale peer signals until ctx is done
+func (m *Manager) Run(ctx context.Context) {
+	heartbeat := time.NewTicker(heartbeatPeriod)
+	defer heartbeat.Stop()
+	sweep := time.NewTicker(sweepInterval)
+	defer sweep.Stop()
+
+	m.announceStatus()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-heartbeat.C:
+			m.announceStatus()
+		case <-sweep.C:
+			m.expire()
+		}
+	}
+}
+
+// Status returns this node's current status
+func (m *Manager) Status() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status
+}
+
+// SetStatus changes this node's status and announces it to all peers
+func (m *Manager) SetStatus(status string) error {
+	if !ValidStatus(status) {
+		return fmt.Errorf("invalid status: %s", status)
+	}
+
+	m.mu.Lock()
+	m.status = status
+	m.mu.Unlock()
+
+	m.announceStatus()
+	return nil
+}
+
+// SetTyping tells the peers of a conversation that we are typing in it.
+// conversation is a peer GUID or "broadcast".
+func (m *Manager) SetTyping(conversation string) error {
+	if conversation == "" {
+		return fmt.Errorf("conversation is required")
+	}
+
+	signal := Signal{Typing: true, TTL: int(typingTTL.Seconds())}
+	if conversation == string(messages.ScopeBroadcast) {
+		return m.sendSignal("", messages.ScopeBroadcast, signal)
+	}
+	return m.sendSignal(conversation, messages.ScopePrivate, signal)
+}
+
+// GetStates returns the presence of all peers with unexpired signals
+func (m *Manager) GetStates() []State {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	states := make([]State, 0, len(m.peers))
+	for _, state := range m.peers {
+		states = append(states, *state)
+	}
+	return states
+}
+
+// HandleSignal processes an inbound presence control message from a peer
+func (m *Manager) HandleSignal(msg *messages.Message, sourceIP string) {
+	if !m.peerMgr.VerifySource(msg.SenderGUID, sourceIP) {
+		logging.Error("Presence", "Rejecting presence signal claiming to be from %s sent from %s", msg.SenderGUID, sourceIP)
+		return
+	}
+
+	var signal Signal
+	if err := json.Unmarshal(msg.Content, &signal); err != nil {
+		logging.Error("Presence", "Invalid presence signal from %s: %v", msg.SenderGUID, err)
+		return
+	}
+
+	ttl := time.Duration(signal.TTL) * time.Second
+	if ttl <= 0 || ttl > maxTTL {
+		ttl = statusTTL
+	}
+	now := time.Now()
+
+	m.mu.Lock()
+	state, exists := m.peers[msg.SenderGUID]
+	if !exists {
+		state = &State{GUID: msg.SenderGUID, Status: StatusOnline, StatusExpiresAt: now.Add(statusTTL)}
+		m.peers[msg.SenderGUID] = state
+	}
+
+	if signal.Typing {
+		// A private typing signal is about the conversation with the sender
+		state.Typing = string(messages.ScopeBroadcast)
+		if msg.Scope == messages.ScopePrivate {
+			state.Typing = msg.SenderGUID
+		}
+		state.TypingExpiresAt = now.Add(ttl)
+	}
+	if signal.Status != "" {
+		if !ValidStatus(signal.Status) {
+			m.mu.Unlock()
+			logging.Error("Presence", "Ignoring unknown status %q from %s", signal.Status, msg.SenderGUID)
+			return
+		}
+		state.Status = signal.Status
+		state.StatusExpiresAt = now.Add(ttl)
+	}
+	snapshot := *state
+	m.mu.Unlock()
+
+	logging.Debug("Presence", "Peer %s is %s (typing=%q)", snapshot.GUID, snapshot.Status, snapshot.Typing)
+	m.broadcast(snapshot, false)
+}
+
+// expire clears typing indicators and statuses whose TTL has passed
+func (m *Manager) expire() {
+	now := time.Now()
+	var changed []State
+
+	m.mu.Lock()
+	for guid, state := range m.peers {
+		dirty := false
+		if state.Typing != "" && now.After(state.TypingExpiresAt) {
+			state.Typing = ""
+			state.TypingExpiresAt = time.Time{}
+			dirty = true
+		}
+		if now.After(state.StatusExpiresAt) {
+			state.Status = StatusOffline
+			delete(m.peers, guid)
+			dirty = true
+		}
+		if dirty {
+			changed = append(changed, *state)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, state := range changed {
+		m.broadcast(state, true)
+	}
+}
+
+// announceStatus sends our current status to all peers
+func (m *Manager) announceStatus() {
+	signal := Signal{Status: m.Status(), TTL: int(statusTTL.Seconds())}
+	if err := m.sendSignal("", messages.ScopeBroadcast, signal); err != nil {
+		logging.Error("Presence", "Failed to announce status: %v", err)
+	}
+}
+
+// sendSignal wraps a signal in a control message and hands it to the sender
+func (m *Manager) sendSignal(receiverGUID string, scope messages.MessageScope, signal Signal) error {
+	if m.send == nil {
+		return fmt.Errorf("no sender configured")
+	}
+
+	content, err := json.Marshal(signal)
+	if err != nil {
+		return fmt.Errorf("failed to marshal presence signal: %w", err)
+	}
+
+	msg := messages.NewMessage(m.guid, receiverGUID, messages.TypePresence, content)
+	msg.Scope = scope
+	m.send(msg)
+	return nil
+}
+
+// broadcast notifies local web clients about a peer's presence
+func (m *Manager) broadcast(state State, expired bool) {
+	if m.wsManager == nil {
+		return
+	}
+
+	m.wsManager.Broadcast(struct {
+		Type    string `json:"type"`
+		Content struct {
+			State
+			Expired bool `json:"expired"`
+		} `json:"content"`
+	}{
+		Type: "presence",
+		Content: struct {
+			State
+			Expired bool `json:"expired"`
+		}{
+			State:   state,
+			Expired: expired,
+		},
+	})
+}
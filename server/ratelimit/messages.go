@@ -0,0 +1,100 @@
+package ratelimit
+
+import (
+	"sync/atomic"
+	"time"
+
+	"cyberchat/server/config"
+)
+
+// Defaults for the core message endpoint limits
+const (
+	DefaultRatePerIP      = 10.0
+	DefaultBurstPerIP     = 50
+	DefaultRatePerSender  = 10.0
+	DefaultBurstPerSender = 50
+	DefaultRateGlobal     = 100.0
+	DefaultBurstGlobal    = 500
+)
+
+// Stats counts the decisions of a MessageLimits
+type Stats struct {
+	Requests       uint64 `json:"requests"`        // Requests checked against the limits
+	LimitedIP      uint64 `json:"limited_ip"`      // Rejected by the per source IP limit
+	LimitedSender  uint64 `json:"limited_sender"`  // Rejected by the per sender GUID limit
+	LimitedGlobal  uint64 `json:"limited_global"`  // Rejected by the global limit
+	TrackedIPs     int    `json:"tracked_ips"`     // Source IPs with a partially used bucket
+	TrackedSenders int    `json:"tracked_senders"` // Sender GUIDs with a partially used bucket
+}
+
+// MessageLimits limits inbound peer messages by source IP, by sender GUID and overall
+type MessageLimits struct {
+	perIP     *Limiter
+	perSender *Limiter
+	global    *Limiter
+
+	requests      atomic.Uint64
+	limitedIP     atomic.Uint64
+	limitedSender atomic.Uint64
+	limitedGlobal atomic.Uint64
+}
+
+// NewMessageLimits creates the message limits configured in cfg
+func NewMessageLimits(cfg *config.Config) *MessageLimits {
+	return &MessageLimits{
+		perIP:     newConfiguredLimiter(cfg.MessageRatePerIP, cfg.MessageBurstPerIP, DefaultRatePerIP, DefaultBurstPerIP),
+		perSender: newConfiguredLimiter(cfg.MessageRatePerSender, cfg.MessageBurstPerSender, DefaultRatePerSender, DefaultBurstPerSender),
+		global:    newConfiguredLimiter(cfg.MessageRateGlobal, cfg.MessageBurstGlobal, DefaultRateGlobal, DefaultBurstGlobal),
+	}
+}
+
+// newConfiguredLimiter applies the zero-means-default and negative-means-off rules
+func newConfiguredLimiter(rate float64, burst int, defaultRate float64, defaultBurst int) *Limiter {
+	if rate < 0 {
+		return nil
+	}
+	if rate == 0 {
+		rate = defaultRate
+	}
+	if burst <= 0 {
+		burst = defaultBurst
+	}
+	return NewLimiter(rate, burst)
+}
+
+// AllowSource checks the per source IP and global limits. It is called before
+// the message is read, so floods are turned away before any decryption work.
+func (m *MessageLimits) AllowSource(ip string) (bool, time.Duration) {
+	m.requests.Add(1)
+
+	if ok, wait := m.perIP.Allow(ip); !ok {
+		m.limitedIP.Add(1)
+		return false, wait
+	}
+	if ok, wait := m.global.Allow(""); !ok {
+		m.limitedGlobal.Add(1)
+		return false, wait
+	}
+	return true, 0
+}
+
+// AllowSender checks the per sender limit once the message has been decrypted
+func (m *MessageLimits) AllowSender(guid string) (bool, time.Duration) {
+	if ok, wait := m.perSender.Allow(guid); !ok {
+		m.limitedSender.Add(1)
+		return false, wait
+	}
+	return true, 0
+}
+
+// Stats returns the current counters
+func (m *MessageLimits) Stats() Stats {
+	return Stats{
+		Requests:       m.requests.Load(),
+		LimitedIP:      m.limitedIP.Load(),
+		LimitedSender:  m.limitedSender.Load(),
+		LimitedGlobal:  m.limitedGlobal.Load(),
+		TrackedIPs:     m.perIP.Keys(),
+		TrackedSenders: m.perSender.Keys(),
+	}
+}
@@ -0,0 +1,94 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// pruneInterval is how often idle buckets are dropped from a Limiter
+const pruneInterval = time.Minute
+
+// bucket holds the tokens left for one key
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter applies a token bucket per key. A nil Limiter allows everything.
+type Limiter struct {
+	mu         sync.Mutex
+	rate       float64 // Tokens added per second
+	burst      float64 // Bucket capacity
+	buckets    map[string]*bucket
+	lastPruned time.Time
+}
+
+// NewLimiter creates a limiter that allows rate events per second per key with
+// bursts of up to burst events
+func NewLimiter(rate float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:       rate,
+		burst:      float64(burst),
+		buckets:    make(map[string]*bucket),
+		lastPruned: time.Now(),
+	}
+}
+
+// Allow takes a token from key's bucket. If the bucket is empty it returns
+// false and how long until the next token is available.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastPruned) >= pruneInterval {
+		l.prune(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	} else {
+		b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+		b.last = now
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// Keys returns the number of keys currently tracked
+func (l *Limiter) Keys() int {
+	if l == nil {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+// prune drops buckets that have refilled completely; they behave the same as new ones
+func (l *Limiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastPruned = now
+}
@@ -0,0 +1,187 @@
+package scheduler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"cyberchat/server/clientapi"
+	"cyberchat/server/db"
+	"cyberchat/server/messages"
+
+	"github.com/google/uuid"
+)
+
+// maxDelay is the longest delay_seconds accepted, well below the 292 years a
+// time.Duration can hold
+const maxDelay = 10 * 365 * 24 * time.Hour
+
+// Handlers contains HTTP handlers for scheduled message operations
+type Handlers struct {
+	scheduler *Scheduler
+	db        *db.DB
+	apiKey    string
+}
+
+// NewHandlers creates a new Handlers instance
+func NewHandlers(scheduler *Scheduler, database *db.DB, apiKey string) *Handlers {
+	return &Handlers{
+		scheduler: scheduler,
+		db:        database,
+		apiKey:    apiKey,
+	}
+}
+
+// HandleCreate schedules a message for later delivery
+func (h *Handlers) HandleCreate(w http.ResponseWriter, r *http.Request) {
+	if !clientapi.VerifyClient(r, h.apiKey) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Type         string    `json:"type"`
+		Content      string    `json:"content"`
+		ReceiverGUID string    `json:"receiver_guid"`
+		Scope        string    `json:"scope"`
+		SendAt       time.Time `json:"send_at"`
+		DelaySeconds int       `json:"delay_seconds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Failed to parse request", http.StatusBadRequest)
+		return
+	}
+
+	if req.Content == "" {
+		http.Error(w, "Content cannot be empty", http.StatusBadRequest)
+		return
+	}
+	if len(req.Content) > messages.MaxMessageSize {
+		http.Error(w, "Content too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// Either an absolute time or a delay from now
+	sendAt := req.SendAt
+	if sendAt.IsZero() {
+		if req.DelaySeconds <= 0 {
+			http.Error(w, "Either send_at or delay_seconds is required", http.StatusBadRequest)
+			return
+		}
+		if req.DelaySeconds > int(maxDelay/time.Second) {
+			http.Error(w, "delay_seconds is too large", http.StatusBadRequest)
+			return
+		}
+		sendAt = time.Now().Add(time.Duration(req.DelaySeconds) * time.Second)
+	}
+	if sendAt.Before(time.Now().Add(-time.Minute)) {
+		http.Error(w, "send_at is in the past", http.StatusBadRequest)
+		return
+	}
+
+	msgType := messages.MessageType(req.Type)
+	if msgType == "" {
+		msgType = messages.TypeText
+	}
+
+	// Reject content that would fail validation when the message is sent
+	probe := messages.Message{Type: msgType, Content: []byte(req.Content)}
+	if err := probe.ValidateChat(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Same scope rules as messages typed into the web client
+	scope := messages.MessageScope(req.Scope)
+	if scope == "" {
+		scope = messages.ScopePrivate
+		if req.ReceiverGUID == "" {
+			scope = messages.ScopeBroadcast
+		}
+	}
+	if scope != messages.ScopeBroadcast && scope != messages.ScopePrivate {
+		http.Error(w, "Invalid scope", http.StatusBadRequest)
+		return
+	}
+	if scope == messages.ScopePrivate && req.ReceiverGUID == "" {
+		http.Error(w, "Private messages require receiver_guid", http.StatusBadRequest)
+		return
+	}
+
+	sm := &db.ScheduledMessage{
+		ScheduleID:   uuid.New().String(),
+		ReceiverGUID: req.ReceiverGUID,
+		Type:         msgType,
+		Scope:        scope,
+		Content:      []byte(req.Content),
+		SendAt:       sendAt.UTC(),
+		Status:       db.ScheduleStatusPending,
+		CreatedAt:    time.Now().UTC(),
+	}
+	if err := h.scheduler.Schedule(sm); err != nil {
+		http.Error(w, "Failed to schedule message", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(sm)
+}
+
+// HandleList returns scheduled messages, optionally filtered by ?status=
+func (h *Handlers) HandleList(w http.ResponseWriter, r *http.Request) {
+	if !clientapi.VerifyClient(r, h.apiKey) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	scheduled, err := h.db.GetScheduledMessages(r.URL.Query().Get("status"))
+	if err != nil {
+		http.Error(w, "Failed to get scheduled messages", http.StatusInternalServerError)
+		return
+	}
+
+	// Include content as a string for the web client
+	type scheduledView struct {
+		*db.ScheduledMessage
+		Content string `json:"content"`
+	}
+	views := make([]scheduledView, len(scheduled))
+	for i, sm := range scheduled {
+		views[i] = scheduledView{ScheduledMessage: sm, Content: string(sm.Content)}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(views)
+}
+
+// HandleCancel cancels a pending scheduled message
+func (h *Handlers) HandleCancel(w http.ResponseWriter, r *http.Request) {
+	if !clientapi.VerifyClient(r, h.apiKey) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	scheduleID := r.PathValue("schedule_id")
+	err := h.scheduler.Cancel(scheduleID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Scheduled message not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, db.ErrScheduleNotPending) {
+		http.Error(w, "Scheduled message already sent or cancelled", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to cancel scheduled message", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":      "success",
+		"schedule_id": scheduleID,
+	})
+}
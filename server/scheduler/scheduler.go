@@ -0,0 +1,195 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cyberchat/server/db"
+	"cyberchat/server/logging"
+	"cyberchat/server/messages"
+)
+
+const (
+	idleCheckInterval = time.Minute // Re-check the table at least this often
+	scheduledSourceIP = "scheduler" // Source recorded for messages sent by the scheduler
+)
+
+// WebSocketManager interface for reporting results to local clients
+type WebSocketManager interface {
+	Broadcast(message interface{})
+}
+
+// Scheduler fires scheduled messages through the normal message path when they come due
+type Scheduler struct {
+	db        *db.DB
+	guid      string
+	process   func(*messages.Message, string) *messages.MessageDeliveryReport
+	wsManager WebSocketManager
+	wake      chan struct{}
+}
+
+// New creates a new scheduler. process is the message handler's ProcessMessage.
+func New(database *db.DB, guid string, process func(*messages.Message, string) *messages.MessageDeliveryReport, wsManager WebSocketManager) *Scheduler {
+	return &Scheduler{
+		db:        database,
+		guid:      guid,
+		process:   process,
+		wsManager: wsManager,
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// Schedule stores a new scheduled message and wakes the scheduler
+func (s *Scheduler) Schedule(sm *db.ScheduledMessage) error {
+	if err := s.db.SaveScheduledMessage(sm); err != nil {
+		return err
+	}
+	s.Wake()
+	return nil
+}
+
+// Cancel cancels a pending scheduled message
+func (s *Scheduler) Cancel(scheduleID string) error {
+	if err := s.db.CancelScheduledMessage(scheduleID); err != nil {
+		return err
+	}
+	s.Wake()
+	return nil
+}
+
+// Wake makes the scheduler re-read the next due time
+func (s *Scheduler) Wake() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run fires due messages until ctx is done. Messages that came due while the
+// node was offline are sent as soon as it starts.
+func (s *Scheduler) Run(ctx context.Context) {
+	logging.Info("Scheduler", "Starting message scheduler")
+	if n, err := s.db.FailInterruptedScheduledMessages(); err != nil {
+		logging.Error("Scheduler", "Failed to check interrupted messages: %v", err)
+	} else if n > 0 {
+		logging.Error("Scheduler", "%d scheduled messages were interrupted while sending and are marked failed", n)
+	}
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.wake:
+		case <-timer.C:
+			s.fireDue()
+		}
+
+		// Sleep until the next pending message, bounded so clock changes are picked up
+		wait := idleCheckInterval
+		next, ok, err := s.db.GetNextScheduledTime()
+		if err != nil {
+			logging.Error("Scheduler", "Failed to get next scheduled time: %v", err)
+		} else if ok {
+			if until := time.Until(next); until < wait {
+				wait = until
+			}
+		}
+		if wait < 0 {
+			wait = 0
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+	}
+}
+
+// fireDue sends every pending message whose time has come
+func (s *Scheduler) fireDue() {
+	due, err := s.db.GetDueScheduledMessages(time.Now())
+	if err != nil {
+		logging.Error("Scheduler", "Failed to get due messages: %v", err)
+		return
+	}
+
+	for _, sm := range due {
+		s.fire(sm)
+	}
+}
+
+// fire sends a single scheduled message and records the outcome. The message
+// is claimed first, so one cancelled since it was read is not sent.
+func (s *Scheduler) fire(sm *db.ScheduledMessage) {
+	claimed, err := s.db.ClaimScheduledMessage(sm.ScheduleID)
+	if err != nil {
+		logging.Error("Scheduler", "Failed to claim %s: %v", sm.ScheduleID, err)
+		return
+	}
+	if !claimed {
+		logging.Info("Scheduler", "Scheduled message %s is no longer pending", sm.ScheduleID)
+		return
+	}
+
+	msg := messages.NewWebMessage(s.guid, sm.ReceiverGUID, sm.Type, string(sm.Content))
+	msg.Scope = sm.Scope
+
+	logging.Info("Scheduler", "Sending scheduled message %s as %s (due %s)",
+		sm.ScheduleID, msg.ID, sm.SendAt.Format(time.RFC3339))
+
+	status := db.ScheduleStatusSent
+	var errText string
+	var report *messages.MessageDeliveryReport
+	if s.process == nil {
+		status = db.ScheduleStatusFailed
+		errText = "no message handler configured"
+	} else {
+		report = s.process(msg, scheduledSourceIP)
+		if report != nil && report.Rejected != nil {
+			status = db.ScheduleStatusFailed
+			errText = report.Rejected.Message
+		} else if report != nil && report.TotalPeers > 0 && report.Succeeded == 0 {
+			status = db.ScheduleStatusFailed
+			errText = fmt.Sprintf("delivery failed to all %d peers", report.TotalPeers)
+		}
+	}
+
+	if err := s.db.CompleteScheduledMessage(sm.ScheduleID, status, msg.ID, errText); err != nil {
+		logging.Error("Scheduler", "Failed to record result for %s: %v", sm.ScheduleID, err)
+	}
+
+	if s.wsManager != nil {
+		s.wsManager.Broadcast(struct {
+			Type    string `json:"type"`
+			Content struct {
+				ScheduleID string                          `json:"schedule_id"`
+				MessageID  string                          `json:"message_id"`
+				Status     string                          `json:"status"`
+				Error      string                          `json:"error,omitempty"`
+				Report     *messages.MessageDeliveryReport `json:"report,omitempty"`
+			} `json:"content"`
+		}{
+			Type: "scheduled_message",
+			Content: struct {
+				ScheduleID string                          `json:"schedule_id"`
+				MessageID  string                          `json:"message_id"`
+				Status     string                          `json:"status"`
+				Error      string                          `json:"error,omitempty"`
+				Report     *messages.MessageDeliveryReport `json:"report,omitempty"`
+			}{
+				ScheduleID: sm.ScheduleID,
+				MessageID:  msg.ID,
+				Status:     status,
+				Error:      errText,
+				Report:     report,
+			},
+		})
+	}
+}
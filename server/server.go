@@ -1,7 +1,6 @@
 package server
 
 import (
-	"bytes"
 	"context"
 	"crypto/rand"
 	"crypto/rsa"
@@ -12,7 +11,6 @@ import (
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
-	"io"
 	"log"
 	"math/big"
 	"net"
@@ -23,14 +21,23 @@ import (
 	"time"
 
 	"cyberchat/server/clientapi"
+	"cyberchat/server/commands"
 	"cyberchat/server/config"
 	"cyberchat/server/db"
 	"cyberchat/server/discovery"
 	"cyberchat/server/files"
+	"cyberchat/server/historysync"
+	"cyberchat/server/imageproc"
 	"cyberchat/server/logging"
+	"cyberchat/server/mentions"
 	"cyberchat/server/messagehandler"
 	"cyberchat/server/messages"
 	"cyberchat/server/peers"
+	"cyberchat/server/pins"
+	"cyberchat/server/polls"
+	"cyberchat/server/presence"
+	"cyberchat/server/ratelimit"
+	"cyberchat/server/scheduler"
 	"cyberchat/server/web"
 	"cyberchat/server/websocket"
 
@@ -54,23 +61,41 @@ type Peer struct {
 
 // Server represents the main server instance
 type Server struct {
-	cfg            *config.Config
-	db             *db.DB
-	server         *http.Server
-	discovery      *discovery.Service
-	peerMgr        *peers.Manager
-	messageQueue   chan *messages.Message
-	wsManager      *websocket.Manager
-	guid           string
-	publicKey      *rsa.PublicKey
-	privateKey     *rsa.PrivateKey
-	OnMessage      func(*messages.Message)
-	messageHandler *messagehandler.Handler
-	peerHandlers   *peers.Handlers
-	clientHandlers *clientapi.Handlers
-	fileHandlers   *files.Handlers
-	tlsConfig      *tls.Config
-	listener       net.Listener
+	cfg              *config.Config
+	db               *db.DB
+	server           *http.Server
+	discovery        *discovery.Service
+	peerMgr          *peers.Manager
+	messageQueue     chan *messages.Message
+	wsManager        *websocket.Manager
+	guid             string
+	publicKey        *rsa.PublicKey
+	privateKey       *rsa.PrivateKey
+	OnMessage        func(*messages.Message)
+	messageHandler   *messagehandler.Handler
+	messageLimits    *ratelimit.MessageLimits
+	peerHandlers     *peers.Handlers
+	clientHandlers   *clientapi.Handlers
+	commands         *commands.Dispatcher
+	fileHandlers     *files.Handlers
+	downloader       *files.Downloader
+	blobs            *files.BlobStore
+	presenceMgr      *presence.Manager
+	presenceHandlers *presence.Handlers
+	scheduler        *scheduler.Scheduler
+	scheduleHandlers *scheduler.Handlers
+	historySync      *historysync.Syncer
+	syncHandlers     *historysync.Handlers
+	mentionTracker   *mentions.Tracker
+	mentionHandlers  *mentions.Handlers
+	pollMgr          *polls.Manager
+	pollHandlers     *polls.Handlers
+	pinMgr           *pins.Manager
+	pinHandlers      *pins.Handlers
+	thumbnailer      *imageproc.Thumbnailer
+	imageHandlers    *imageproc.Handlers
+	tlsConfig        *tls.Config
+	listener         net.Listener
 }
 
 // WebMessage represents a message in the format expected by web clients
@@ -82,6 +107,10 @@ type WebMessage struct {
 	Scope        string    `json:"scope"`
 	Content      string    `json:"content"`
 	Timestamp    time.Time `json:"timestamp"`
+	Clock        uint64    `json:"clock,omitempty"`
+	ClockSkew    bool      `json:"clock_skew,omitempty"`
+	Priority     string    `json:"priority"`
+	HTML         string    `json:"html,omitempty"`
 	SenderIP     string    `json:"sender_ip"`
 	SenderPort   int       `json:"sender_port"`
 }
@@ -129,6 +158,8 @@ func New(cfg *config.Config, database *db.DB) (*Server, error) {
 
 	// Initialize message handler
 	s.messageHandler = messagehandler.New(s.db, s.guid, s.privateKey, s.discovery, s.wsManager, s.peerMgr)
+	s.messageLimits = ratelimit.NewMessageLimits(cfg)
+	s.messageHandler.SetRateLimits(s.messageLimits)
 
 	// Initialize peer handlers
 	s.peerHandlers = peers.NewHandlers(s.peerMgr, s.discovery)
@@ -145,6 +176,13 @@ func New(cfg *config.Config, database *db.DB) (*Server, error) {
 		}
 	}
 
+	// Initialize polls; votes and creator actions travel as control messages
+	s.pollMgr = polls.New(s.db, s.guid, s.peerMgr, s.messageHandler.SendControl, s.wsManager)
+	s.pollHandlers = polls.NewHandlers(s.pollMgr, s.guid, clientAPIKey, s.messageHandler.ProcessMessage)
+	s.messageHandler.AddListener(s.pollMgr.HandleMessage)
+	s.messageHandler.RegisterControl(messages.TypePollVote, s.pollMgr.HandleVote)
+	s.messageHandler.RegisterControl(messages.TypePollAction, s.pollMgr.HandleAction)
+
 	// Initialize client API handlers with message handler that returns delivery report
 	s.clientHandlers = clientapi.NewHandlers(
 		s.db,
@@ -152,11 +190,63 @@ func New(cfg *config.Config, database *db.DB) (*Server, error) {
 		clientAPIKey,
 		s.messageHandler.ProcessMessage,
 		s.discovery,
+		func(pollID string) (interface{}, error) { return s.pollMgr.Results(pollID) },
 	)
 
+	// Initialize slash commands typed into web clients
+	s.commands = commands.New(s.db, s.guid, s.peerMgr, s.messageHandler.ProcessMessage, s.messageHandler.SendControl, s.clientHandlers.SetName, s.wsManager)
+	s.clientHandlers.SetCommands(s.commands)
+	s.messageHandler.RegisterControl(messages.TypeTopic, s.commands.HandleTopic)
+
 	// Initialize file handlers with database adapter
 	dbAdapter := &fileDBAdapter{db: s.db}
-	s.fileHandlers = files.NewHandlers(dbAdapter, s.guid, clientAPIKey, s.wsManager)
+	s.fileHandlers = files.NewHandlers(dbAdapter, s.guid, clientAPIKey, &s.privateKey.PublicKey, s.wsManager)
+	shareRoots, err := files.NewShareRoots(s.cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up share roots: %w", err)
+	}
+	s.fileHandlers.SetShareRoots(shareRoots)
+	s.blobs, err = files.NewBlobStore(s.cfg, dbAdapter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up file store: %w", err)
+	}
+	s.fileHandlers.SetBlobStore(s.blobs)
+	s.downloader = files.NewDownloader(s.cfg, s.db, s.peerMgr, s.wsManager)
+	s.fileHandlers.SetDownloader(s.downloader)
+	s.fileHandlers.SetSender(s.messageHandler.SendControl)
+	s.downloader.SetSender(s.guid, s.messageHandler.SendControl)
+	s.messageHandler.AddListener(s.downloader.HandleMessage)
+	s.messageHandler.RegisterControl(messages.TypeFileRevoke, s.downloader.HandleRevocation)
+	s.messageHandler.RegisterControl(messages.TypeFileSource, s.downloader.HandleSource)
+
+	// Initialize presence tracking; presence signals travel as control messages
+	s.presenceMgr = presence.New(s.guid, s.peerMgr, s.messageHandler.SendControl, s.wsManager)
+	s.presenceHandlers = presence.NewHandlers(s.presenceMgr, clientAPIKey)
+	s.messageHandler.RegisterControl(messages.TypePresence, s.presenceMgr.HandleSignal)
+
+	// Initialize scheduled message delivery through the normal message path
+	s.scheduler = scheduler.New(s.db, s.guid, s.messageHandler.ProcessMessage, s.wsManager)
+	s.scheduleHandlers = scheduler.NewHandlers(s.scheduler, s.db, clientAPIKey)
+
+	// Initialize history sync
+	s.historySync = historysync.New(s.db, s.guid, s.privateKey, s.discovery, s.peerMgr, s.messageHandler.ProcessSyncedMessage, s.messageHandler.AcquireLane)
+	s.syncHandlers = historysync.NewHandlers(s.historySync, s.db, s.guid, s.messageHandler.AddDownloadToken)
+
+	// Initialize mention tracking for every stored message
+	s.mentionTracker = mentions.New(s.db, s.guid, s.wsManager)
+	s.mentionHandlers = mentions.NewHandlers(s.db, s.guid, clientAPIKey)
+	s.messageHandler.AddListener(s.mentionTracker.HandleMessage)
+
+	// Initialize pins; pin changes are shared with conversation participants as control messages
+	s.pinMgr = pins.New(s.db, s.guid, s.peerMgr, s.messageHandler.SendControl, s.wsManager)
+	s.pinHandlers = pins.NewHandlers(s.pinMgr, clientAPIKey)
+	s.messageHandler.RegisterControl(messages.TypePin, s.pinMgr.HandleSignal)
+
+	// Initialize thumbnail generation for stored image messages
+	s.thumbnailer = imageproc.New(s.db, s.wsManager)
+	s.imageHandlers = imageproc.NewHandlers(s.db, clientAPIKey)
+	s.messageHandler.AddListener(s.thumbnailer.HandleMessage)
+
 	return s, nil
 }
 
@@ -165,8 +255,8 @@ type fileDBAdapter struct {
 	db *db.DB
 }
 
-func (a *fileDBAdapter) SaveFile(fileID, senderGUID, receiverGUID, filename, filepath string, size int64, mimeType string) error {
-	return a.db.SaveFile(fileID, senderGUID, receiverGUID, filename, filepath, size, mimeType)
+func (a *fileDBAdapter) SaveFile(fileID, senderGUID, receiverGUID, filename, filepath string, size int64, mimeType, sha256, encKey, kind, blob string) error {
+	return a.db.SaveFile(fileID, senderGUID, receiverGUID, filename, filepath, size, mimeType, sha256, encKey, kind, blob)
 }
 
 func (a *fileDBAdapter) GetFile(fileID string) (*files.FileRecord, error) {
@@ -186,6 +276,15 @@ func (a *fileDBAdapter) GetFile(fileID string) (*files.FileRecord, error) {
 		Size:         record.Size,
 		MimeType:     record.MimeType,
 		CreatedAt:    record.CreatedAt.Format(time.RFC3339),
+		SHA256:       record.SHA256,
+		EncKey:       record.EncKey,
+		Kind:         record.Kind,
+		ExpiresAt:    record.ExpiresAt,
+		MaxDownloads: record.MaxDownloads,
+		Downloads:    record.Downloads,
+		RevokedAt:    record.RevokedAt,
+		Blob:         record.Blob,
+		Chunks:       record.Chunks,
 	}, nil
 }
 
@@ -206,6 +305,15 @@ func (a *fileDBAdapter) GetFiles() ([]files.FileRecord, error) {
 			Size:         record.Size,
 			MimeType:     record.MimeType,
 			CreatedAt:    record.CreatedAt.Format(time.RFC3339),
+			SHA256:       record.SHA256,
+			EncKey:       record.EncKey,
+			Kind:         record.Kind,
+			ExpiresAt:    record.ExpiresAt,
+			MaxDownloads: record.MaxDownloads,
+			Downloads:    record.Downloads,
+			RevokedAt:    record.RevokedAt,
+			Blob:         record.Blob,
+			Chunks:       record.Chunks,
 		}
 	}
 	return fileRecords, nil
@@ -215,6 +323,47 @@ func (a *fileDBAdapter) TruncateFiles() error {
 	return a.db.TruncateFiles()
 }
 
+func (a *fileDBAdapter) SetFileLimits(fileID string, expiresAt *time.Time, maxDownloads int) error {
+	return a.db.SetFileLimits(fileID, expiresAt, maxDownloads)
+}
+
+func (a *fileDBAdapter) SetFileChunks(fileID, chunks string) error {
+	return a.db.SetFileChunks(fileID, chunks)
+}
+
+func (a *fileDBAdapter) RevokeFile(fileID string) error {
+	return a.db.RevokeFile(fileID)
+}
+
+func (a *fileDBAdapter) ClaimFileDownload(fileID, audience string, maxDownloads int) (bool, error) {
+	return a.db.ClaimFileDownload(fileID, audience, maxDownloads)
+}
+
+func (a *fileDBAdapter) SaveBlob(hash string, size int64) error {
+	return a.db.SaveBlob(hash, size)
+}
+
+func (a *fileDBAdapter) GetBlobs() ([]files.BlobRecord, error) {
+	blobs, err := a.db.GetBlobs()
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]files.BlobRecord, len(blobs))
+	for i, blob := range blobs {
+		records[i] = files.BlobRecord{Hash: blob.Hash, Size: blob.Size, CreatedAt: blob.CreatedAt}
+	}
+	return records, nil
+}
+
+func (a *fileDBAdapter) DeleteBlob(hash string) error {
+	return a.db.DeleteBlob(hash)
+}
+
+func (a *fileDBAdapter) GetMessage(messageID string) (*messages.Message, error) {
+	return a.db.GetMessage(messageID)
+}
+
 // FirstTimeSetup performs initial server setup if needed
 func (s *Server) FirstTimeSetup() error {
 	// Check if first time setup is needed
@@ -396,6 +545,21 @@ func (s *Server) StartServer(ctx context.Context) error {
 	// Start peer update handler
 	go s.handlePeerUpdates(ctx)
 
+	// Start presence announcements and expiry
+	go s.presenceMgr.Run(ctx)
+
+	// Start firing scheduled messages, including any that came due while offline
+	go s.scheduler.Run(ctx)
+
+	// Catch up on broadcasts sent while we were offline
+	go s.historySync.Run(ctx)
+
+	// Continue downloads that were queued or running when we stopped
+	go s.downloader.Resume()
+
+	// Free stored uploads that deleted, revoked and expired shares leave behind
+	go s.blobs.Run(ctx)
+
 	// Create TLS config
 	cert, err := tls.LoadX509KeyPair(filepath.Join(s.cfg.DataDir, "cert.pem"), filepath.Join(s.cfg.DataDir, "key.pem"))
 	if err != nil {
@@ -470,18 +634,45 @@ func (s *Server) SetupRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("GET /api/v1/whoami", s.handleWhoami)
 	mux.HandleFunc("GET /api/v1/discovery", s.peerHandlers.HandleDiscovery)
 	mux.HandleFunc("GET /api/v1/file/{file_id}", s.fileHandlers.HandleDownload)
+	mux.HandleFunc("GET /api/v1/file/{file_id}/manifest", s.fileHandlers.HandleManifest)
+	mux.HandleFunc("GET /api/v1/file/{file_id}/archive", s.fileHandlers.HandleArchive)
+	mux.HandleFunc("GET /api/v1/seed/{file_id}", s.fileHandlers.HandleSeed)
+	mux.HandleFunc("GET /api/v1/sync/broadcasts", s.syncHandlers.HandleListBroadcasts)
+	mux.HandleFunc("POST /api/v1/sync/messages", s.syncHandlers.HandlePull)
 
 	// Client API routes (web client only)
 	mux.HandleFunc("GET /api/v1/client/auth", s.clientHandlers.HandleAuth)
 	mux.HandleFunc("GET /api/v1/client/message", s.clientHandlers.HandleGetMessages)
+	mux.HandleFunc("GET /api/v1/client/message/history", s.clientHandlers.HandleGetHistory)
 	mux.HandleFunc("POST /api/v1/client/message", s.clientHandlers.HandleMessage)
 	mux.HandleFunc("POST /api/v1/client/message/truncate", s.clientHandlers.HandleTruncateMessages)
 	mux.HandleFunc("POST /api/v1/client/name", s.clientHandlers.HandleName)
+	mux.HandleFunc("GET /api/v1/client/mentions", s.mentionHandlers.HandleList)
+	mux.HandleFunc("POST /api/v1/client/mentions/read", s.mentionHandlers.HandleMarkRead)
 	mux.HandleFunc("GET /api/v1/client/peers", s.peerHandlers.HandleGetPeers)
+	mux.HandleFunc("GET /api/v1/client/pins", s.pinHandlers.HandleList)
+	mux.HandleFunc("POST /api/v1/client/pins", s.pinHandlers.HandlePin)
+	mux.HandleFunc("DELETE /api/v1/client/pins/{message_id}", s.pinHandlers.HandleUnpin)
+	mux.HandleFunc("POST /api/v1/client/poll", s.pollHandlers.HandleCreate)
+	mux.HandleFunc("GET /api/v1/client/poll/{poll_id}", s.pollHandlers.HandleGet)
+	mux.HandleFunc("POST /api/v1/client/poll/{poll_id}/vote", s.pollHandlers.HandleVote)
+	mux.HandleFunc("POST /api/v1/client/poll/{poll_id}/close", s.pollHandlers.HandleClose)
+	mux.HandleFunc("POST /api/v1/client/poll/{poll_id}/reveal", s.pollHandlers.HandleReveal)
+	mux.HandleFunc("GET /api/v1/client/presence", s.presenceHandlers.HandleGetPresence)
+	mux.HandleFunc("POST /api/v1/client/presence", s.presenceHandlers.HandleSetPresence)
+	mux.HandleFunc("GET /api/v1/client/schedule", s.scheduleHandlers.HandleList)
+	mux.HandleFunc("POST /api/v1/client/schedule", s.scheduleHandlers.HandleCreate)
+	mux.HandleFunc("DELETE /api/v1/client/schedule/{schedule_id}", s.scheduleHandlers.HandleCancel)
+	mux.HandleFunc("GET /api/v1/client/thumbnail/{message_id}", s.imageHandlers.HandleThumbnail)
 	mux.HandleFunc("GET /api/v1/client/filesystem", s.fileHandlers.HandleFilesystem)
 	mux.HandleFunc("GET /api/v1/client/files", s.fileHandlers.HandleListFiles)
 	mux.HandleFunc("POST /api/v1/client/file", s.fileHandlers.HandleUpload)
 	mux.HandleFunc("POST /api/v1/client/file/truncate", s.fileHandlers.HandleTruncate)
+	mux.HandleFunc("GET /api/v1/client/storage", s.fileHandlers.HandleStorage)
+	mux.HandleFunc("POST /api/v1/client/file/{file_id}/revoke", s.fileHandlers.HandleRevoke)
+	mux.HandleFunc("POST /api/v1/client/download", s.fileHandlers.HandleFetch)
+	mux.HandleFunc("GET /api/v1/client/manifest/{message_id}", s.fileHandlers.HandleClientManifest)
+	mux.HandleFunc("GET /api/v1/client/transfers", s.fileHandlers.HandleTransfers)
 
 	// WebSocket endpoint
 	mux.HandleFunc("/ws", s.wsManager.HandleConnection)
@@ -520,8 +711,15 @@ func (s *Server) handlePeerUpdates(ctx context.Context) {
 	}
 }
 
-// processMessage handles an incoming message internally
+// processMessage handles a message typed into a web client over the WebSocket.
+// It takes the same path as the client API so messages are stamped, stored and
+// delivered consistently.
 func (s *Server) processMessage(msg *messages.Message, sourceIP string) {
+	// Slash commands run here and are never sent; the result goes out over the WebSocket
+	if _, handled := s.commands.Handle(msg, sourceIP); handled {
+		return
+	}
+
 	// Log message if handler is set
 	if s.OnMessage != nil {
 		s.OnMessage(msg)
@@ -530,119 +728,12 @@ func (s *Server) processMessage(msg *messages.Message, sourceIP string) {
 	logging.Info("Server", "Processing message from %s to %s (type: %s, scope: %s)",
 		msg.SenderGUID, msg.ReceiverGUID, msg.Type, msg.Scope)
 
-	// Store message with source IP
-	if err := s.db.SaveMessage(msg, sourceIP); err != nil {
-		logging.Error("Server", "Failed to store message: %v", err)
+	if err := msg.ValidateChat(); err != nil {
+		logging.Error("Server", "Rejecting message %s from web client: %v", msg.ID, err)
 		return
 	}
 
-	// Convert to web message format with string content
-	webMsg := &WebMessage{
-		ID:           msg.ID,
-		SenderGUID:   msg.SenderGUID,
-		ReceiverGUID: msg.ReceiverGUID,
-		Type:         string(msg.Type),
-		Scope:        string(msg.Scope),
-		Content:      string(msg.Content), // Convert bytes to string
-		Timestamp:    msg.Timestamp,
-		SenderIP:     sourceIP,
-		SenderPort:   s.cfg.Port, // Use actual server port
-	}
-
-	// Broadcast to web clients
-	s.wsManager.Broadcast(struct {
-		Type    string      `json:"type"`
-		Content *WebMessage `json:"content"`
-	}{
-		Type:    "message",
-		Content: webMsg,
-	})
-
-	// Handle message forwarding based on scope
-	if msg.Scope == messages.ScopeBroadcast {
-		logging.Info("Server", "Broadcasting message to all peers")
-		// Forward to all peers except sender
-		peers := s.discovery.GetPeers()
-		for _, peer := range peers {
-			if peer.GUID == msg.SenderGUID {
-				continue // Skip sender
-			}
-			logging.Info("Server", "Forwarding broadcast message to peer %s (%s)", peer.Name, peer.GUID)
-			// Create a copy of the message with this peer as receiver
-			peerMsg := *msg
-			peerMsg.ReceiverGUID = peer.GUID
-			s.forwardMessageToPeer(&peerMsg, &peer)
-		}
-	} else if msg.Scope == messages.ScopePrivate && msg.ReceiverGUID != "" {
-		logging.Info("Server", "Forwarding private message to peer %s", msg.ReceiverGUID)
-		// Forward to specific peer
-		if peer := s.discovery.GetPeer(msg.ReceiverGUID); peer != nil {
-			s.forwardMessageToPeer(msg, peer)
-		} else {
-			logging.Error("Server", "Receiver peer %s not found", msg.ReceiverGUID)
-		}
-	}
-}
-
-// forwardMessageToPeer forwards a message to a specific peer
-func (s *Server) forwardMessageToPeer(msg *messages.Message, peer *discovery.Peer) {
-	// Get peer's public key
-	pubKeyBytes, err := s.discovery.GetPeerPublicKey(*peer)
-	if err != nil {
-		logging.Error("Server", "Failed to get peer's public key: %v", err)
-		return
-	}
-
-	// Parse public key
-	block, _ := pem.Decode(pubKeyBytes)
-	if block == nil {
-		logging.Error("Server", "Failed to decode peer's public key")
-		return
-	}
-
-	receiverPubKey, err := x509.ParsePKCS1PublicKey(block.Bytes)
-	if err != nil {
-		logging.Error("Server", "Failed to parse peer's public key: %v", err)
-		return
-	}
-
-	// Encrypt message for peer
-	encryptedMsg, err := msg.Encrypt(receiverPubKey)
-	if err != nil {
-		logging.Error("Server", "Failed to encrypt message: %v", err)
-		return
-	}
-
-	// Create HTTP client that accepts self-signed certs
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
-		},
-	}
-
-	// Marshal encrypted message
-	msgData, err := json.Marshal(encryptedMsg)
-	if err != nil {
-		logging.Error("Server", "Failed to marshal message: %v", err)
-		return
-	}
-
-	// Forward to peer's server
-	url := fmt.Sprintf("https://%s:%d/api/v1/message", peer.IP, peer.Port)
-	logging.Info("Server", "Forwarding message to %s", url)
-	resp, err := client.Post(url, "application/json", bytes.NewBuffer(msgData))
-	if err != nil {
-		logging.Error("Server", "Failed to forward message: %v", err)
-		return
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusAccepted {
-		body, _ := io.ReadAll(resp.Body)
-		logging.Error("Server", "Peer returned error: %s", string(body))
-	}
+	s.messageHandler.ProcessMessage(msg, sourceIP)
 }
 
 // handleGetMessages handles message retrieval
@@ -707,6 +798,10 @@ func (s *Server) handleGetMessages(w http.ResponseWriter, r *http.Request) {
 			Scope:        string(msg.Scope),
 			Content:      string(msg.Content),
 			Timestamp:    msg.Timestamp,
+			Clock:        msg.Clock,
+			ClockSkew:    msg.ClockSkew,
+			Priority:     string(msg.EffectivePriority()),
+			HTML:         msg.HTML,
 		}
 	}
 
@@ -724,23 +819,6 @@ func isBase64(s string) bool {
 	return err == nil
 }
 
-// Update file download handler:
-func (s *Server) handleFileDownload(w http.ResponseWriter, r *http.Request) {
-	// Add CORS headers
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "*")
-
-	// Handle preflight requests
-	if r.Method == "OPTIONS" {
-		w.WriteHeader(http.StatusOK)
-		return
-	}
-
-	// Delegate to file handlers
-	s.fileHandlers.HandleDownload(w, r)
-}
-
 func (s *Server) handleWhoami(w http.ResponseWriter, r *http.Request) {
 	// Add CORS headers
 	w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -894,6 +972,11 @@ func (s *Server) handlePeerUpdate(peer peers.Peer) {
 	})
 
 	log.Printf("[Server] Broadcasted peer update to web clients")
+
+	// Pull any broadcasts we missed while this peer was out of reach
+	if s.historySync != nil {
+		s.historySync.PeerSeen(peer.GUID)
+	}
 }
 
 // PeerStatus represents a peer's status for the API
@@ -927,17 +1010,19 @@ func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
 	}
 
 	status := struct {
-		GUID      string       `json:"guid"`
-		Name      string       `json:"name"`
-		Port      int          `json:"port"`
-		IPAddress string       `json:"ip_address"`
-		Peers     []PeerStatus `json:"peers"`
+		GUID      string          `json:"guid"`
+		Name      string          `json:"name"`
+		Port      int             `json:"port"`
+		IPAddress string          `json:"ip_address"`
+		Peers     []PeerStatus    `json:"peers"`
+		RateLimit ratelimit.Stats `json:"rate_limit"`
 	}{
 		GUID:      s.guid,
 		Name:      s.cfg.Name,
 		Port:      s.cfg.Port,
 		IPAddress: localIP,
 		Peers:     make([]PeerStatus, 0),
+		RateLimit: s.messageLimits.Stats(),
 	}
 
 	for _, peer := range peers {
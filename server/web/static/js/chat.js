@@ -133,6 +133,11 @@ class BasicChat {
             this.fileBrowser.show();
         };
 
+        // Upload button picks a file to copy to the node
+        document.getElementById('upload-button').onclick = () => {
+            this.fileInput.click();
+        };
+
         // Scope filter toggle
         this.scopeFilter.onclick = () => {
             this.scopeFilterActive = !this.scopeFilterActive;
@@ -368,6 +373,14 @@ class BasicChat {
                 } else {
                     console.error('FileTransferManager not initialized!');
                 }
+                if (data.content.direction === 'download') {
+                    this.showDownloadStatus(data.content);
+                }
+                return;
+            }
+
+            if (data.type === 'file_revoked') {
+                this.showRevoked(data.content);
                 return;
             }
 
@@ -592,9 +605,14 @@ class BasicChat {
         const fileID = uuid.v4();
 
         try {
-            // Send the file path instead of uploading the file
+            // Files picked on this device are uploaded and stored by the node;
+            // files from the file browser are shared from their path
             const formData = new FormData();
-            formData.append('filepath', file.path);
+            if (file instanceof File) {
+                formData.append('file', file);
+            } else {
+                formData.append('filepath', file.path);
+            }
             formData.append('file_id', fileID);
             formData.append('receiver_guid', this.peerList.value || ''); // Make receiver optional
 
@@ -607,8 +625,9 @@ class BasicChat {
             });
 
             if (!uploadResponse.ok) {
-                throw new Error('File registration failed');
+                throw new Error(await uploadResponse.text() || 'File registration failed');
             }
+            const registered = await uploadResponse.json();
 
             // Then send the file message
             const message = {
@@ -616,9 +635,10 @@ class BasicChat {
                 content: JSON.stringify({
                     type: 'file',
                     file_id: fileID,
-                    name: file.name,
-                    mime: file.type,
-                    size: file.size
+                    name: registered.name || file.name,
+                    mime: registered.mime || file.type,
+                    size: registered.size,
+                    kind: registered.kind
                 }),
                 receiver_guid: this.peerList.value || '',
                 scope: this.peerList.value ? 'private' : 'broadcast'
@@ -710,7 +730,26 @@ class BasicChat {
         if (msg.type === 'text') {
             let content = msg.content;
             if (typeof content === 'object') {
-                if (content.type === 'file') {
+                if (content.type === 'file' && content.kind === 'directory') {
+                    contentHtml = this.renderDirectoryOffer(msg, content);
+                    messageDiv.innerHTML = `
+                        <span class="timestamp">[${timestamp}]</span>
+                        <span class="sender" title="GUID: ${msg.sender_guid}">${escapeHtml(senderName.toString())}${scopeIndicator}:</span>
+                        ${contentHtml}
+                    `;
+                    messageList.appendChild(messageDiv);
+                    messageList.scrollTop = messageList.scrollHeight;
+                    return;
+                } else if (content.type === 'file' && content.key && msg.sender_guid !== this.myGuid) {
+                    // Encrypted files can only be decrypted by this node, so it downloads them
+                    const fileName = escapeHtml(String(content.name));
+                    contentHtml = `
+                        <div class="file-container">
+                            <span class="file-download">${this.getFileEmoji(String(content.mime || ''))} ${fileName} (${this.formatFileSize(content.size)})</span>
+                            <button onclick='window.chat.saveToNode(this, "${escapeHtml(msg.id)}")' class="cert-button" title="Download, decrypt and verify the file on this node">Save</button>
+                            <span class="file-status" data-download-file="${escapeHtml(String(content.file_id))}"></span>
+                        </div>`;
+                } else if (content.type === 'file') {
                     // Determine the correct URL base
                     let urlBase;
                     if (msg.sender_guid === this.myGuid) {
@@ -740,6 +779,9 @@ class BasicChat {
                 }
             }
             contentHtml = `<span class="content">${escapeHtml(content.toString())}</span>`;
+        } else if (msg.type === 'rich_text' && msg.html) {
+            // Rendered and sanitized by the node, so it is the same on every client
+            contentHtml = `<div class="content rich-text">${msg.html}</div>`;
         } else {
             contentHtml = `<span class="content">${escapeHtml(msg.content.toString())}</span>`;
         }
@@ -755,12 +797,28 @@ class BasicChat {
     }
 
     async tryLoadContent(messageDiv, urlBase, parsedContent) {
+        // The sender's node only serves the file with the token from the offer
+        const token = parsedContent.token ? `?token=${encodeURIComponent(parsedContent.token)}` : '';
+        const fileUrl = `https://${urlBase}/api/v1/file/${parsedContent.file_id}${token}`;
+
         try {
             // First check if the file exists by making a HEAD request
-            const fileResponse = await fetch(`https://${urlBase}/api/v1/file/${parsedContent.file_id}`, {
+            const fileResponse = await fetch(fileUrl, {
                 method: 'HEAD'
             });
 
+            if (fileResponse.status === 401 || fileResponse.status === 403) {
+                messageDiv.querySelector('.content-area').innerHTML = `
+                    <div class="file-container">
+                        <div class="file-error">
+                            <span class="file-icon">🔒</span>
+                            <span>Not authorized to download "${escapeHtml(parsedContent.name)}" (the link may have expired)</span>
+                        </div>
+                    </div>`;
+                this.messages.scrollTop = this.messages.scrollHeight;
+                return;
+            }
+
             if (fileResponse.status === 404) {
                 messageDiv.querySelector('.content-area').innerHTML = `
                     <div class="file-container">
@@ -793,11 +851,11 @@ class BasicChat {
             if (parsedContent.mime.startsWith('image/')) {
                 messageDiv.querySelector('.content-area').innerHTML = `
                     <div class="media-container">
-                        <img src="https://${urlBase}/api/v1/file/${parsedContent.file_id}"
+                        <img src="${fileUrl}"
                              alt="${parsedContent.name}"
                              style="max-width: 512px; max-height: 256px; object-fit: contain;"
                              onload="this.closest('#messages').scrollTop = this.closest('#messages').scrollHeight" />
-                        <a href="https://${urlBase}/api/v1/file/${parsedContent.file_id}"
+                        <a href="${fileUrl}"
                            download="${parsedContent.name}"
                            class="file-download">
                             🖼️ ${parsedContent.name} (${this.formatFileSize(parsedContent.size)})
@@ -808,11 +866,11 @@ class BasicChat {
                     <div class="media-container">
                         <video controls style="max-width: 512px; max-height: 512px;"
                                onloadedmetadata="this.closest('#messages').scrollTop = this.closest('#messages').scrollHeight">
-                            <source src="https://${urlBase}/api/v1/file/${parsedContent.file_id}"
+                            <source src="${fileUrl}"
                                     type="${parsedContent.mime}">
                             Your browser does not support video playback.
                         </video>
-                        <a href="https://${urlBase}/api/v1/file/${parsedContent.file_id}"
+                        <a href="${fileUrl}"
                            download="${parsedContent.name}"
                            class="file-download">
                             🎬 ${parsedContent.name} (${this.formatFileSize(parsedContent.size)})
@@ -821,7 +879,7 @@ class BasicChat {
             } else {
                 messageDiv.querySelector('.content-area').innerHTML = `
                     <div class="file-container">
-                        <a href="https://${urlBase}/api/v1/file/${parsedContent.file_id}"
+                        <a href="${fileUrl}"
                            download="${parsedContent.name}"
                            class="file-download">
                             ${this.getFileEmoji(parsedContent.mime)} ${parsedContent.name} (${this.formatFileSize(parsedContent.size)})
@@ -858,6 +916,132 @@ class BasicChat {
         }
     }
 
+    renderDirectoryOffer(msg, content) {
+        const name = escapeHtml(String(content.name));
+        const label = `📁 ${name} (${this.formatFileSize(content.size)})`;
+        if (msg.sender_guid === this.myGuid) {
+            // This node serves its own clients the plain archive
+            const token = encodeURIComponent(content.token || '');
+            const href = `/api/v1/file/${encodeURIComponent(content.file_id)}/archive?format=zip&token=${token}`;
+            return `
+                <div class="file-container">
+                    <a class="file-download" href="${href}" download="${name}.zip">${label}</a>
+                </div>`;
+        }
+        return `
+            <div class="file-container">
+                <span class="file-download">${label}</span>
+                <button onclick='window.chat.saveToNode(this, "${escapeHtml(msg.id)}")' class="cert-button" title="Download, decrypt and verify the directory on this node">Save all</button>
+                <button onclick='window.chat.chooseEntries(this, "${escapeHtml(msg.id)}")' class="cert-button" title="Pick files and folders to download">Choose…</button>
+                <span class="file-status" data-download-file="${escapeHtml(String(content.file_id))}"></span>
+                <div class="manifest-picker"></div>
+            </div>`;
+    }
+
+    async chooseEntries(button, messageId) {
+        const picker = button.parentElement.querySelector('.manifest-picker');
+        button.disabled = true;
+        try {
+            const response = await fetch(`/api/v1/client/manifest/${encodeURIComponent(messageId)}`, {
+                headers: { 'X-Client-API-Key': this.apiKey }
+            });
+            if (!response.ok) {
+                throw new Error(await response.text());
+            }
+            const manifest = await response.json();
+            const items = manifest.entries.map(entry => {
+                const depth = entry.path.split('/').length - 1;
+                const label = entry.type === 'dir'
+                    ? `📁 ${escapeHtml(entry.path)}/`
+                    : `${escapeHtml(entry.path)} (${this.formatFileSize(entry.size)})`;
+                return `
+                    <label style="display:block; margin-left:${depth}em">
+                        <input type="checkbox" value="${escapeHtml(entry.path)}"> ${label}
+                    </label>`;
+            }).join('');
+            const skipped = (manifest.skipped || []).length
+                ? `<div class="file-status">${manifest.skipped.length} entries not shared (links or special files)</div>`
+                : '';
+            picker.innerHTML = `
+                ${items}
+                ${skipped}
+                <button onclick='window.chat.saveSelected(this, "${escapeHtml(messageId)}")' class="cert-button">Save selected</button>`;
+        } catch (error) {
+            button.disabled = false;
+            this.log('Failed to list directory: ' + error.message);
+        }
+    }
+
+    async saveSelected(button, messageId) {
+        const picker = button.closest('.manifest-picker');
+        const paths = [...picker.querySelectorAll('input[type=checkbox]:checked')].map(box => box.value);
+        if (paths.length === 0) {
+            this.log('Select at least one entry to save');
+            return;
+        }
+        await this.saveToNode(button, messageId, paths);
+        if (button.disabled) {
+            picker.innerHTML = '';
+        }
+    }
+
+    async saveToNode(button, messageId, paths) {
+        button.disabled = true;
+        try {
+            const response = await fetch('/api/v1/client/download', {
+                method: 'POST',
+                headers: {
+                    'Content-Type': 'application/json',
+                    'X-Client-API-Key': this.apiKey
+                },
+                body: JSON.stringify({ message_id: messageId, paths })
+            });
+            if (!response.ok) {
+                throw new Error(await response.text());
+            }
+        } catch (error) {
+            button.disabled = false;
+            this.log('Failed to download file: ' + error.message);
+        }
+    }
+
+    showDownloadStatus(event) {
+        let text;
+        switch (event.status) {
+            case 'completed':
+                text = `Saved to ${event.path}`;
+                break;
+            case 'failed':
+                text = `Failed: ${event.error}`;
+                break;
+            case 'queued':
+                text = 'Queued';
+                break;
+            default:
+                text = event.size > 0 ? `${event.progress}%` : this.formatFileSize(event.bytes_read);
+        }
+        document.querySelectorAll(`[data-download-file="${CSS.escape(event.file_id)}"]`).forEach(el => {
+            el.textContent = text;
+            el.parentElement.querySelectorAll(':scope > button').forEach(button => {
+                button.disabled = event.status !== 'failed';
+            });
+        });
+    }
+
+    showRevoked(notice) {
+        if (notice.sender_guid === this.myGuid) {
+            return;
+        }
+        const sender = this.peerNames[notice.sender_guid] || notice.sender_guid;
+        this.log(`${sender} revoked a shared file`);
+        document.querySelectorAll(`[data-download-file="${CSS.escape(notice.file_id)}"]`).forEach(el => {
+            el.textContent = 'Revoked by sender';
+            el.parentElement.querySelectorAll('button').forEach(button => {
+                button.disabled = true;
+            });
+        });
+    }
+
     async retryContent(button, urlBase, parsedContent) {
         const messageDiv = button.closest('.message');
         await this.tryLoadContent(messageDiv, urlBase, parsedContent);
@@ -47,6 +47,8 @@
                 this.currentPath = this.container.querySelector('.current-path');
                 this.typeFilter = this.container.querySelector('.type-filter');
                 this.history = [];
+                this.roots = [];
+                this.parentPath = null;
 
                 // Bind event listeners
                 this.typeFilter.addEventListener('change', () => this.loadDirectory(this.currentPath.textContent));
@@ -93,13 +95,17 @@
                     });
 
                     if (!response.ok) {
-                        throw new Error(`HTTP error! status: ${response.status}`);
+                        // Paths outside the share roots are refused with a reason
+                        const failure = await response.json().catch(() => ({}));
+                        throw new Error(failure.error || `HTTP error! status: ${response.status}`);
                     }
 
                     const data = await response.json();
 
                     // Update current path display
                     this.currentPath.textContent = data.current_path;
+                    this.roots = data.roots || [];
+                    this.parentPath = data.is_root ? null : data.parent_path;
 
                     // Clear and populate file list
                     this.fileList.innerHTML = '';
@@ -132,7 +138,7 @@
 
                 const icon = entry.type === 'dir' ? '📁' : this.getFileIcon(entry.mime_type);
                 const size = entry.type === 'dir' ? '--' : this.formatSize(entry.size);
-                const date = new Date(entry.modified).toLocaleString();
+                const date = entry.modified ? new Date(entry.modified).toLocaleString() : '';
 
                 div.innerHTML = `
                     <div class="file-info">
@@ -179,6 +185,34 @@
                 this.hide();
             }
 
+            showRoots() {
+                this.currentPath.textContent = '';
+                this.parentPath = null;
+                this.fileList.innerHTML = '';
+                this.roots.forEach(root => this.addEntry({
+                    name: root,
+                    path: root,
+                    type: 'dir',
+                    size: 0,
+                    is_readable: true
+                }));
+            }
+
+            shareFolder() {
+                const path = this.currentPath.textContent;
+                if (!path) return;
+                const name = path.split('/').filter(Boolean).pop() || path;
+
+                // The node lists the folder and fills in its size
+                this.chat.handleFileUpload({
+                    name: name,
+                    path: path,
+                    type: 'inode/directory',
+                    size: 0
+                });
+                this.hide();
+            }
+
             goBack() {
                 if (this.history.length > 1) {
                     this.history.pop(); // Remove current
@@ -188,8 +222,14 @@
             }
 
             goUp() {
-                const parentPath = this.currentPath.textContent.split('/').slice(0, -1).join('/') || '/';
-                this.loadDirectory(parentPath);
+                // Browsing stops at the share roots; above them is the list of roots
+                if (this.parentPath === null) {
+                    if (this.roots.length > 1) {
+                        this.showRoots();
+                    }
+                    return;
+                }
+                this.loadDirectory(this.parentPath);
             }
 
             getFileIcon(mimeType) {
@@ -25,6 +25,10 @@ class FilesViewer {
         title.className = 'files-viewer-title';
         title.textContent = 'SHARED FILES';
 
+        this.usage = document.createElement('div');
+        this.usage.className = 'file-meta';
+        title.appendChild(this.usage);
+
         const controls = document.createElement('div');
         controls.className = 'files-viewer-controls';
 
@@ -98,6 +102,7 @@ class FilesViewer {
             try {
                 const files = JSON.parse(text);
                 this.updateFilesList(files);
+                this.loadUsage();
             } catch (parseError) {
                 console.error('JSON Parse Error:', parseError);
                 console.log('Response that failed to parse:', text);
@@ -109,6 +114,25 @@ class FilesViewer {
         }
     }
 
+    async loadUsage() {
+        try {
+            const response = await fetch('/api/v1/client/storage', {
+                headers: {
+                    'X-Client-API-Key': window.chat.apiKey
+                }
+            });
+            if (!response.ok) {
+                throw new Error(`HTTP error! status: ${response.status}`);
+            }
+            const usage = await response.json();
+            this.usage.textContent = `💾 ${this.formatFileSize(usage.stored_bytes)} stored, ` +
+                `${this.formatFileSize(usage.saved_bytes)} saved by deduplication`;
+        } catch (error) {
+            console.error('Failed to load storage usage:', error);
+            this.usage.textContent = '';
+        }
+    }
+
     formatFileSize(bytes) {
         if (bytes === 0) return '0 B';
         const k = 1024;
@@ -148,10 +172,11 @@ class FilesViewer {
             const fileElement = document.createElement('div');
             fileElement.className = 'file-item';
             fileElement.style.animationDelay = `${index * 0.1}s`;
-            fileElement.style.cursor = 'pointer';
+            const ended = file.RevokedAt || (file.ExpiresAt && new Date(file.ExpiresAt) <= new Date());
+            fileElement.style.cursor = ended ? 'default' : 'pointer';
 
             // Add click handler to re-share the file
-            fileElement.onclick = async () => {
+            fileElement.onclick = ended ? null : async () => {
                 try {
                     const response = await fetch('/api/v1/client/message', {
                         method: 'POST',
@@ -193,13 +218,61 @@ class FilesViewer {
                 <div class="file-stats">
                     <div class="file-size">📊 ${this.formatFileSize(file.Size)}</div>
                     <div class="file-date">🕒 ${this.formatDate(file.CreatedAt)}</div>
+                    <div class="file-limits">${this.formatLimits(file)}</div>
+                    ${file.Blob ? '<div class="file-stored">💾 Stored copy</div>' : ''}
                 </div>
             `;
 
+            if (!file.RevokedAt) {
+                const revokeBtn = document.createElement('button');
+                revokeBtn.className = 'files-purge-btn';
+                revokeBtn.textContent = 'REVOKE';
+                revokeBtn.onclick = (e) => {
+                    e.stopPropagation(); // Don't re-share the file
+                    this.revokeFile(file.FileID);
+                };
+                fileElement.querySelector('.file-stats').appendChild(revokeBtn);
+            }
+
             this.filesList.appendChild(fileElement);
         });
     }
 
+    formatLimits(file) {
+        if (file.RevokedAt) {
+            return `⛔ Revoked ${this.formatDate(file.RevokedAt)}`;
+        }
+        const limits = [];
+        if (file.ExpiresAt) {
+            const expired = new Date(file.ExpiresAt) <= new Date();
+            limits.push(`${expired ? 'Expired' : 'Expires'} ${this.formatDate(file.ExpiresAt)}`);
+        }
+        limits.push(file.MaxDownloads > 0
+            ? `${file.Downloads}/${file.MaxDownloads} downloads`
+            : `${file.Downloads} downloads`);
+        return `⏳ ${limits.join(', ')}`;
+    }
+
+    async revokeFile(fileId) {
+        if (!confirm('Revoke this share? Peers will no longer be able to download it.')) {
+            return;
+        }
+        try {
+            const response = await fetch(`/api/v1/client/file/${encodeURIComponent(fileId)}/revoke`, {
+                method: 'POST',
+                headers: {
+                    'X-Client-API-Key': window.chat.apiKey
+                }
+            });
+            if (!response.ok) {
+                throw new Error(await response.text());
+            }
+            this.loadFiles();
+        } catch (error) {
+            console.error('Failed to revoke file:', error);
+        }
+    }
+
     showEmptyState(message) {
         this.filesList.innerHTML = `
             <div class="files-empty-state">
@@ -237,6 +310,7 @@ class FilesViewer {
                 setTimeout(() => {
                     this.filesList.classList.remove('purging');
                     this.showEmptyState('All files have been purged');
+                    this.loadUsage();
                 }, items.length * 100 + 500);
             } else {
                 throw new Error('Failed to purge files');
@@ -65,7 +65,7 @@ class FileTransferManager {
 
     handleTransfer(data) {
         const { content } = data;
-        const { transferId } = content;
+        const { transfer_id: transferId } = content;
 
         // Remove idle state when there's activity
         this.setIdleState(false);
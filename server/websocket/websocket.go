@@ -3,12 +3,12 @@ package websocket
 import (
 	"encoding/json"
 	"log"
-	"net"
 	"net/http"
 	"strings"
 	"sync"
 	"time"
 
+	"cyberchat/server/clientapi"
 	"cyberchat/server/discovery"
 	"cyberchat/server/logging"
 	"cyberchat/server/messages"
@@ -36,31 +36,13 @@ type Connection struct {
 	id               string
 }
 
-// verifyLocalhost checks if the request is coming from localhost
-func verifyLocalhost(r *http.Request) bool {
-	// Get the real client IP, considering X-Forwarded-For
-	ip := r.RemoteAddr
-	if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
-		ip = forwardedFor
-	}
-
-	// Extract host from IP:port format
-	host, _, err := net.SplitHostPort(ip)
-	if err != nil {
-		host = ip // If no port, use the IP as is
-	}
-
-	// Check if it's a localhost address
-	return host == "127.0.0.1" || host == "::1" || host == "localhost"
-}
-
 // upgrader configures WebSocket connection parameters
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
 	CheckOrigin: func(r *http.Request) bool {
 		// Only allow connections from localhost
-		if !verifyLocalhost(r) {
+		if !clientapi.IsLocalRequest(r) {
 			return false
 		}
 
@@ -90,7 +72,7 @@ func NewManager(messageHandler func(*messages.Message, string), myGUID string) *
 // HandleConnection upgrades HTTP connection to WebSocket and manages it
 func (m *Manager) HandleConnection(w http.ResponseWriter, r *http.Request) {
 	// Additional security check for localhost
-	if !verifyLocalhost(r) {
+	if !clientapi.IsLocalRequest(r) {
 		http.Error(w, "WebSocket connections only allowed from localhost", http.StatusForbidden)
 		return
 	}
@@ -231,6 +213,7 @@ func (c *Connection) readPump(m *Manager) {
 				Content      string `json:"content"`
 				ReceiverGUID string `json:"receiver_guid"`
 				Scope        string `json:"scope"`
+				Priority     string `json:"priority"`
 			}
 			if err := json.Unmarshal(msg.Content, &content); err != nil {
 				logging.Error("WebSocket", "Failed to parse message content: %v", err)
@@ -247,6 +230,7 @@ func (c *Connection) readPump(m *Manager) {
 				messages.MessageType(content.Type),
 				[]byte(content.Content),
 			)
+			message.Priority = messages.Priority(content.Priority)
 
 			// Set scope based on explicit scope field or receiver
 			if content.Scope == string(messages.ScopeBroadcast) {